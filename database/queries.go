@@ -44,45 +44,194 @@ func (db *Handler) BeginEndEntityOperations() (*Transaction, error) {
 	return &Transaction{tx, id}, nil
 }
 
-// GetLabelOfLatestEE returns the label of the latest end-entity for the specified signer
+// BeginSignerEndEntityOperations behaves like BeginEndEntityOperations
+// but only locks the end-entities of a single signer, using a
+// transaction scoped advisory lock keyed on the signer id. Distinct
+// signers can generate keys in parallel while operations on the same
+// signer remain serialized, which cuts the cold-start time of services
+// that construct many signers.
+func (db *Handler) BeginSignerEndEntityOperations(signerID string) (*Transaction, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		err = errors.Wrap(err, "failed to create transaction")
+		return nil, err
+	}
+	// the advisory lock is held until the transaction commits or rolls
+	// back, and only conflicts with other holders of the same signer id
+	_, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('endentities'), hashtext($1))", signerID)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to lock end-entities of signer %q", signerID)
+		tx.Rollback()
+		return nil, err
+	}
+	var id uint64
+	err = tx.QueryRow(`INSERT INTO endentities_lock(is_locked)
+				VALUES ($1) RETURNING id`,
+		true).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "failed to lock endentities table")
+		return nil, err
+	}
+	return &Transaction{tx, id}, nil
+}
+
+// EndEntity is the database record of an end-entity key
+type EndEntity struct {
+	Label string
+	X5U   string
+	// Mode is the signing mode/algorithm the end-entity signs with,
+	// recorded at creation time so operators can query which
+	// algorithms are in active use without parsing certificates. It
+	// is empty on records created before the column existed.
+	Mode string
+}
+
+// GetLabelOfLatestEE returns the record of the latest end-entity for the specified signer
 // that is no older than a given duration
-func (tx *Transaction) GetLabelOfLatestEE(signerID string, youngerThan time.Duration) (label, x5u string, err error) {
-	var nullableX5U sql.NullString
+func (tx *Transaction) GetLabelOfLatestEE(signerID string, youngerThan time.Duration) (ee EndEntity, err error) {
+	var nullableX5U, nullableMode sql.NullString
 	maxAge := time.Now().Add(-youngerThan)
-	err = tx.QueryRow(`SELECT label, x5u FROM endentities
+	err = tx.QueryRow(`SELECT label, x5u, mode FROM endentities
 				WHERE is_current=TRUE AND signer_id=$1 AND created_at > $2
 				ORDER BY created_at DESC LIMIT 1`,
-		signerID, maxAge).Scan(&label, &nullableX5U)
+		signerID, maxAge).Scan(&ee.Label, &nullableX5U, &nullableMode)
 	if err == sql.ErrNoRows {
-		return "", "", ErrNoSuitableEEFound
+		return EndEntity{}, ErrNoSuitableEEFound
 	}
 	x5uValue, err := nullableX5U.Value()
 	if x5uValue != nil {
-		x5u = x5uValue.(string)
+		ee.X5U = x5uValue.(string)
+	}
+	modeValue, err := nullableMode.Value()
+	if modeValue != nil {
+		ee.Mode = modeValue.(string)
 	}
 	return
 }
 
-// InsertEE uses an existing transaction to insert an end-entity in database
-func (tx *Transaction) InsertEE(x5u, label, signerID string, hsmHandle uint) (err error) {
-	_, err = tx.Exec(`INSERT INTO endentities(x5u, label, signer_id, hsm_handle, is_current)
-				VALUES ($1, $2, $3, $4, $5)`, x5u, label, signerID, hsmHandle, true)
+// InsertEE uses an existing transaction to insert an end-entity in
+// database. The previously current key of the signer is demoted before
+// the new one is inserted, so the partial unique index on current
+// end-entities never sees two current rows for a signer. Writers of the
+// same signer are serialized by the per-signer advisory lock, so no
+// concurrent transaction can promote a key between the two statements
+func (tx *Transaction) InsertEE(x5u, label, signerID, mode string, hsmHandle uint) (err error) {
+	_, err = tx.Exec(`UPDATE endentities SET is_current=FALSE
+				WHERE signer_id=$1 AND is_current`, signerID)
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "failed to demote previous key in database")
+		return
+	}
+	_, err = tx.Exec(`INSERT INTO endentities(x5u, label, signer_id, mode, hsm_handle, is_current)
+				VALUES ($1, $2, $3, $4, $5, $6)`, x5u, label, signerID, mode, hsmHandle, true)
 	if err != nil {
 		tx.Rollback()
 		err = errors.Wrap(err, "failed to insert new key in database")
 		return
 	}
-	// mark all other keys for this signer as no longer current
-	_, err = tx.Exec("UPDATE endentities SET is_current=FALSE WHERE signer_id=$1 and label!=$2",
-		signerID, label)
+	return nil
+}
+
+// GetRecentX5UsForSigner returns the x5u locations of the end-entities
+// of a signer created within a given window, newest first, including
+// retired ones. Clients that pin end-entity keys use this to refresh
+// their pin set ahead of a rotation.
+func (db *Handler) GetRecentX5UsForSigner(signerID string, youngerThan time.Duration) ([]string, error) {
+	maxAge := time.Now().Add(-youngerThan)
+	rows, err := db.Query(`SELECT x5u FROM endentities
+				WHERE signer_id=$1 AND created_at > $2 AND x5u IS NOT NULL
+				ORDER BY created_at DESC`, signerID, maxAge)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query end-entities of signer from database")
+	}
+	defer rows.Close()
+	var x5us []string
+	for rows.Next() {
+		var x5u string
+		err = rows.Scan(&x5u)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan end-entity x5u from database")
+		}
+		x5us = append(x5us, x5u)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read end-entity x5us from database")
+	}
+	return x5us, nil
+}
+
+// UpdateX5U updates the x5u location of an end-entity, which is used
+// when chain hosting migrates to a new bucket or domain
+func (tx *Transaction) UpdateX5U(x5u, label, signerID string) (err error) {
+	_, err = tx.Exec("UPDATE endentities SET x5u=$1 WHERE label=$2 AND signer_id=$3",
+		x5u, label, signerID)
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "failed to update x5u of end-entity in database")
+		return
+	}
+	return nil
+}
+
+// SetEEIssuer records the id of the issuer key an end-entity was issued
+// under, which is used to track end-entities across issuer rotations
+func (tx *Transaction) SetEEIssuer(label, issuerKeyID string) (err error) {
+	_, err = tx.Exec("UPDATE endentities SET issuer_key_id=$1 WHERE label=$2",
+		issuerKeyID, label)
 	if err != nil {
-		err = errors.Wrap(err, "failed to update is_current status of keys in database")
 		tx.Rollback()
+		err = errors.Wrap(err, "failed to set issuer key id of end-entity in database")
 		return
 	}
 	return nil
 }
 
+// IncrSignatureCount records n signatures issued by a signer. Callers
+// are expected to batch their increments and call this with aggregated
+// counts, not once per signature, to keep the write load low
+func (db *Handler) IncrSignatureCount(signerID string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	_, err := db.Exec(`INSERT INTO signature_stats(signer_id, count)
+				VALUES ($1, $2)`, signerID, n)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert signature count in database")
+	}
+	return nil
+}
+
+// GetSignatureStats returns the number of signatures issued by each
+// signer since a given time, aggregated per signer
+func (db *Handler) GetSignatureStats(since time.Time) (map[string]int64, error) {
+	rows, err := db.Query(`SELECT signer_id, SUM(count) FROM signature_stats
+				WHERE created_at >= $1 GROUP BY signer_id`, since)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query signature stats from database")
+	}
+	defer rows.Close()
+	stats := make(map[string]int64)
+	for rows.Next() {
+		var (
+			signerID string
+			count    int64
+		)
+		err = rows.Scan(&signerID, &count)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan signature stats from database")
+		}
+		stats[signerID] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read signature stats from database")
+	}
+	return stats, nil
+}
+
 // End commits a transaction
 func (tx *Transaction) End() error {
 	_, err := tx.Exec("UPDATE endentities_lock SET is_locked=FALSE, freed_at=NOW() WHERE id=$1", tx.ID)
@@ -40,6 +40,63 @@ func TestConcurrentEndEntityOperations(t *testing.T) {
 		reflect.ValueOf(labels).MapKeys(), concurrency)
 }
 
+func TestPerSignerValidityEESelection(t *testing.T) {
+	db, err := Connect(Config{
+		Name:     "autograph",
+		User:     "myautographdbuser",
+		Password: "myautographdbpassword",
+		Host:     "127.0.0.1:5432",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	signerID := fmt.Sprintf("database_unit_testing_%d", time.Now().UnixNano())
+	tx, err := db.BeginEndEntityOperations()
+	if err != nil {
+		t.Fatalf("failed to begin end-entity db operations: %v", err)
+	}
+	label := fmt.Sprintf("%d", time.Now().UnixNano())
+	err = tx.InsertEE("http://example.com/TestPerSignerValidityEESelection",
+		label, signerID, "p384ecdsa", 0)
+	if err != nil {
+		t.Fatalf("failed to insert end-entity into db: %v", err)
+	}
+	err = tx.End()
+	if err != nil {
+		t.Fatalf("failed to end end-entity db operations: %v", err)
+	}
+
+	// age the end-entity past the validity of a short lived signer
+	time.Sleep(2 * time.Second)
+
+	// a signer with a short validity must not reuse the aged end-entity,
+	// forcing a rotation, while a signer with a long validity reuses it
+	tx, err = db.BeginEndEntityOperations()
+	if err != nil {
+		t.Fatalf("failed to begin end-entity db operations: %v", err)
+	}
+	_, err = tx.GetLabelOfLatestEE(signerID, 1*time.Second)
+	if err != ErrNoSuitableEEFound {
+		t.Fatalf("expected no suitable end-entity for short validity signer but got err=%v", err)
+	}
+	found, err := tx.GetLabelOfLatestEE(signerID, 1*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to find end-entity for long validity signer: %v", err)
+	}
+	if found.Label != label {
+		t.Fatalf("expected to find end-entity %q for long validity signer but got %q", label, found.Label)
+	}
+	if found.Mode != "p384ecdsa" {
+		t.Fatalf("expected mode \"p384ecdsa\" recorded on end-entity but got %q", found.Mode)
+	}
+	err = tx.End()
+	if err != nil {
+		t.Fatalf("failed to end end-entity db operations: %v", err)
+	}
+}
+
 func waitAndMakeEE(j int, db *Handler, wg *sync.WaitGroup, t *testing.T, signerID string) string {
 	defer wg.Done()
 	t.Logf("TestConcurrentEndEntityOperations: starting routine %d", j)
@@ -52,14 +109,15 @@ func waitAndMakeEE(j int, db *Handler, wg *sync.WaitGroup, t *testing.T, signerI
 	if err != nil {
 		t.Fatalf("failed to begin end-entity db operations: %v", err)
 	}
-	label, _, err := tx.GetLabelOfLatestEE(signerID, 15*time.Second)
+	ee, err := tx.GetLabelOfLatestEE(signerID, 15*time.Second)
+	label := ee.Label
 	switch err {
 	case ErrNoSuitableEEFound:
 		// make a new EE
 		label = fmt.Sprintf("%d", time.Now().UnixNano())
 		t.Logf("TestConcurrentEndEntityOperations: routine %d is making an end-entity", j)
 		err = tx.InsertEE("http://example.com/TestConcurrentEndEntityOperations",
-			label, signerID, uint(j))
+			label, signerID, "p256ecdsa", uint(j))
 		if err != nil {
 			t.Fatalf("failed to insert end-entity into db: %v", err)
 		}
@@ -74,3 +132,181 @@ func waitAndMakeEE(j int, db *Handler, wg *sync.WaitGroup, t *testing.T, signerI
 	}
 	return label
 }
+
+func TestSignatureStats(t *testing.T) {
+	db, err := Connect(Config{
+		Name:     "autograph",
+		User:     "myautographdbuser",
+		Password: "myautographdbpassword",
+		Host:     "127.0.0.1:5432",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	signerID := fmt.Sprintf("database_unit_testing_%d", time.Now().UnixNano())
+	otherSignerID := signerID + "_other"
+	since := time.Now().Add(-time.Minute)
+
+	// batched increments for the same signer must aggregate
+	err = db.IncrSignatureCount(signerID, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.IncrSignatureCount(signerID, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.IncrSignatureCount(otherSignerID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a zero increment is a no-op
+	err = db.IncrSignatureCount(signerID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := db.GetSignatureStats(since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats[signerID] != 7 {
+		t.Fatalf("expected 7 signatures for signer %q but got %d", signerID, stats[signerID])
+	}
+	if stats[otherSignerID] != 1 {
+		t.Fatalf("expected 1 signature for signer %q but got %d", otherSignerID, stats[otherSignerID])
+	}
+	// counts older than the since boundary are excluded
+	stats, err = db.GetSignatureStats(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stats[signerID]; ok {
+		t.Fatalf("expected no recent signatures for signer %q but got %d", signerID, stats[signerID])
+	}
+}
+
+func TestPerSignerLockParallelism(t *testing.T) {
+	db, err := Connect(Config{
+		Name:     "autograph",
+		User:     "myautographdbuser",
+		Password: "myautographdbpassword",
+		Host:     "127.0.0.1:5432",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	signerA := fmt.Sprintf("database_unit_testing_a_%d", time.Now().UnixNano())
+	signerB := fmt.Sprintf("database_unit_testing_b_%d", time.Now().UnixNano())
+
+	txA, err := db.BeginSignerEndEntityOperations(signerA)
+	if err != nil {
+		t.Fatalf("failed to begin end-entity db operations: %v", err)
+	}
+
+	// a distinct signer can operate while the first transaction is
+	// still open, so startup generation runs in parallel
+	otherSignerDone := make(chan struct{})
+	go func() {
+		txB, err := db.BeginSignerEndEntityOperations(signerB)
+		if err != nil {
+			t.Errorf("failed to begin end-entity db operations for distinct signer: %v", err)
+			return
+		}
+		err = txB.End()
+		if err != nil {
+			t.Errorf("failed to end end-entity db operations for distinct signer: %v", err)
+			return
+		}
+		close(otherSignerDone)
+	}()
+	select {
+	case <-otherSignerDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("a distinct signer blocked on the per-signer end-entities lock")
+	}
+
+	// the same signer remains serialized: a second transaction only
+	// acquires the lock once the first one ends
+	sameSignerAcquired := make(chan struct{})
+	go func() {
+		tx2, err := db.BeginSignerEndEntityOperations(signerA)
+		if err != nil {
+			t.Errorf("failed to begin end-entity db operations for same signer: %v", err)
+			return
+		}
+		close(sameSignerAcquired)
+		err = tx2.End()
+		if err != nil {
+			t.Errorf("failed to end end-entity db operations for same signer: %v", err)
+		}
+	}()
+	select {
+	case <-sameSignerAcquired:
+		t.Fatal("the same signer acquired the per-signer lock twice concurrently")
+	case <-time.After(2 * time.Second):
+	}
+	err = txA.End()
+	if err != nil {
+		t.Fatalf("failed to end end-entity db operations: %v", err)
+	}
+	select {
+	case <-sameSignerAcquired:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the same signer never acquired the lock after it was released")
+	}
+}
+
+func TestSingleCurrentEEPerSigner(t *testing.T) {
+	db, err := Connect(Config{
+		Name:     "autograph",
+		User:     "myautographdbuser",
+		Password: "myautographdbpassword",
+		Host:     "127.0.0.1:5432",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// insert two end-entities for the same signer concurrently, the
+	// partial unique index and the atomic insert guarantee exactly one
+	// of them ends up current
+	signerID := fmt.Sprintf("database_unit_testing_%d", time.Now().UnixNano())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		go func(j int) {
+			defer wg.Done()
+			tx, err := db.BeginEndEntityOperations()
+			if err != nil {
+				t.Errorf("failed to begin end-entity db operations: %v", err)
+				return
+			}
+			label := fmt.Sprintf("%s-%d", signerID, j)
+			err = tx.InsertEE("http://example.com/chain", label, signerID, "p384ecdsa", uint(j))
+			if err != nil {
+				t.Errorf("failed to insert end-entity: %v", err)
+				return
+			}
+			err = tx.End()
+			if err != nil {
+				t.Errorf("failed to commit end-entity operations: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var current int
+	err = db.QueryRow("SELECT COUNT(*) FROM endentities WHERE signer_id=$1 AND is_current=TRUE",
+		signerID).Scan(&current)
+	if err != nil {
+		t.Fatalf("failed to count current end-entities: %v", err)
+	}
+	if current != 1 {
+		t.Fatalf("expected exactly one current end-entity but found %d", current)
+	}
+}
@@ -8,12 +8,15 @@ CREATE TABLE endentities(
       signer_id   VARCHAR NOT NULL,
       is_current  BOOLEAN NOT NULL,
       x5u         VARCHAR NULL,
+      issuer_key_id VARCHAR NULL,
+      mode        VARCHAR NULL,
       created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 CREATE INDEX endentities_latest_idx ON endentities(label, signer_id, is_current);
+CREATE UNIQUE INDEX endentities_one_current_idx ON endentities(signer_id) WHERE is_current;
 ALTER TABLE endentities ADD CONSTRAINT endentities_unique_label UNIQUE (label);
 GRANT SELECT, INSERT ON endentities TO myautographdbuser;
-GRANT UPDATE (is_current) ON endentities TO myautographdbuser;
+GRANT UPDATE (is_current, issuer_key_id, x5u) ON endentities TO myautographdbuser;
 GRANT USAGE ON endentities_id_seq TO myautographdbuser;
 
 CREATE TABLE endentities_lock(
@@ -25,3 +28,13 @@ CREATE TABLE endentities_lock(
 );
 GRANT SELECT, INSERT, UPDATE ON endentities_lock TO myautographdbuser;
 GRANT USAGE ON endentities_lock_id_seq TO myautographdbuser;
+
+CREATE TABLE signature_stats(
+      id          SERIAL PRIMARY KEY,
+      signer_id   VARCHAR NOT NULL,
+      count       BIGINT NOT NULL,
+      created_at  TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+CREATE INDEX signature_stats_signer_idx ON signature_stats(signer_id, created_at);
+GRANT SELECT, INSERT ON signature_stats TO myautographdbuser;
+GRANT USAGE ON signature_stats_id_seq TO myautographdbuser;
@@ -0,0 +1,55 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// drainTimeout is the maximum duration the service waits for in-flight
+// signing operations to complete at shutdown
+const drainTimeout = 30 * time.Second
+
+// beginOperation registers an in-flight signing operation with the
+// autographer. It fails when the service is draining, so no new
+// operation starts during shutdown
+func (a *autographer) beginOperation() error {
+	a.drainLock.Lock()
+	defer a.drainLock.Unlock()
+	if a.draining {
+		return errors.New("service is shutting down, no new signing operation is accepted")
+	}
+	a.inflight.Add(1)
+	return nil
+}
+
+// endOperation marks an in-flight signing operation as completed
+func (a *autographer) endOperation() {
+	a.inflight.Done()
+}
+
+// Drain blocks new signing operations and waits for the active ones to
+// complete, so in-flight hsm transactions and end-entity generations
+// finish cleanly before exit. It returns when all operations have
+// completed, or with an error when the context expires first
+func (a *autographer) Drain(ctx context.Context) error {
+	a.drainLock.Lock()
+	a.draining = true
+	a.drainLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		a.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "drain deadline reached with signing operations still in flight")
+	}
+}
@@ -0,0 +1,64 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDrainWaitsForInflightOperations(t *testing.T) {
+	t.Parallel()
+	a := newAutographer(1)
+	// simulate an in-flight signing operation
+	err := a.beginOperation()
+	if err != nil {
+		t.Fatalf("failed to begin operation: %v", err)
+	}
+	drained := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		drained <- a.Drain(ctx)
+	}()
+	// drain must not return while the operation is in flight
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned %v before the in-flight operation completed", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// new operations must be rejected while draining
+	err = a.beginOperation()
+	if err == nil {
+		t.Fatal("expected to fail starting an operation while draining but succeeded")
+	}
+	// completing the operation must unblock the drain
+	a.endOperation()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatalf("drain failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("drain did not return after the in-flight operation completed")
+	}
+}
+
+func TestDrainDeadline(t *testing.T) {
+	t.Parallel()
+	a := newAutographer(1)
+	err := a.beginOperation()
+	if err != nil {
+		t.Fatalf("failed to begin operation: %v", err)
+	}
+	defer a.endOperation()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = a.Drain(ctx)
+	if err == nil {
+		t.Fatal("expected drain to fail on deadline with an operation still in flight but it succeeded")
+	}
+}
@@ -19,6 +19,7 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
 )
 
 // a signaturerequest is sent by an autograph client to request
@@ -27,6 +28,11 @@ type signaturerequest struct {
 	Input   string `json:"input"`
 	KeyID   string `json:"keyid,omitempty"`
 	Options interface{}
+
+	// WithContentDigest requests that the response carries the sha256 of
+	// the raw input, so clients can check the service signed exactly what
+	// they sent, independently of the signature itself
+	WithContentDigest bool `json:"with_content_digest,omitempty"`
 }
 
 // a signatureresponse is returned by autograph to a client with
@@ -40,6 +46,37 @@ type signatureresponse struct {
 	Signature  string `json:"signature,omitempty"`
 	SignedFile string `json:"signed_file,omitempty"`
 	X5U        string `json:"x5u,omitempty"`
+
+	// ContentDigest is the hex encoded sha256 of the raw input, only
+	// returned when the request asked for it. It is not templated, unlike
+	// the hash covered by the signature.
+	ContentDigest string `json:"content_digest,omitempty"`
+
+	// EELabel is the label of the end-entity key that issued the
+	// signature, only returned when the request asked for it via the
+	// include_ee_label option of pki signers.
+	EELabel string `json:"ee_label,omitempty"`
+
+	// RootHash is the hex encoded sha256 of the root certificate of
+	// the pki that issued the signature, only returned when the
+	// request asked for it via the include_root_hash option of pki
+	// signers, so clients can pin the expected root.
+	RootHash string `json:"root_hash,omitempty"`
+}
+
+// a dedupResult holds the output of a signing operation so identical
+// items later in the same batch can reuse it without signing again
+type dedupResult struct {
+	signature  string
+	signedFile string
+	eeLabel    string
+	rootHash   string
+}
+
+// a dedupCounter tracks the dedup outcome of one batch for one signer,
+// reported to the metrics backend once the batch completes
+type dedupCounter struct {
+	total, unique, hits int
 }
 
 // handleSignature endpoint accepts a list of signature requests in a HAWK authenticated POST request
@@ -47,6 +84,12 @@ type signatureresponse struct {
 func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 	rid := getRequestID(r)
 	starttime := getRequestStartTime(r)
+	err := a.beginOperation()
+	if err != nil {
+		httpError(w, r, http.StatusServiceUnavailable, "%v", err)
+		return
+	}
+	defer a.endOperation()
 	auth, userid, err := a.authorizeHeader(r)
 	if err != nil {
 		if a.stats != nil {
@@ -109,6 +152,11 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("signature request\n-----------------\n%s\n", body)
 	}
 	sigresps := make([]signatureresponse, len(sigreqs))
+	// identical items in a batch are signed once and served from the
+	// first result, with per-signer dedup counters reported to the
+	// metrics backend once the batch completes
+	dedupCache := make(map[string]dedupResult)
+	dedupStats := make(map[int]*dedupCounter)
 	// Each signature requested in the http request body is processed individually.
 	// For each, a signer is looked up, and used to compute a raw signature
 	// the signature is then encoded appropriately, and added to the response slice
@@ -144,6 +192,63 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			SignedFile: base64.StdEncoding.EncodeToString(signedfile),
 			X5U:        a.signers[signerID].Config().X5U,
 		}
+		// items are identical when they share a signer, an endpoint,
+		// options and input data
+		optjson, err := json.Marshal(sigreq.Options)
+		if err != nil {
+			httpError(w, r, http.StatusBadRequest, "%v", err)
+			return
+		}
+		dedupKey := fmt.Sprintf("%d/%s/%s/%x", signerID, r.URL.RequestURI(), optjson, sha256.Sum256(input))
+		counts, ok := dedupStats[signerID]
+		if !ok {
+			counts = new(dedupCounter)
+			dedupStats[signerID] = counts
+		}
+		counts.total++
+		if prev, dup := dedupCache[dedupKey]; dup {
+			// reuse the result of the identical item signed earlier in
+			// this batch instead of signing again
+			counts.hits++
+			sigresps[i].Signature = prev.signature
+			sigresps[i].SignedFile = prev.signedFile
+			sigresps[i].EELabel = prev.eeLabel
+			sigresps[i].RootHash = prev.rootHash
+			switch r.URL.RequestURI() {
+			case "/sign/hash":
+				hashlog = fmt.Sprintf("%X", input)
+			case "/sign/data":
+				md := sha256.New()
+				md.Write(input)
+				hashlog = fmt.Sprintf("%X", md.Sum(nil))
+				if sigreq.WithContentDigest {
+					sigresps[i].ContentDigest = fmt.Sprintf("%x", md.Sum(nil))
+				}
+			case "/sign/file":
+				md := sha256.New()
+				md.Write(input)
+				hashlog = fmt.Sprintf("%X", md.Sum(nil))
+			}
+			err := a.logSignature(sigresps[i], hashlog)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, "%v", err)
+				return
+			}
+			a.countSignature(sigresps[i].SignerID)
+			log.WithFields(log.Fields{
+				"rid":        rid,
+				"options":    sigreq.Options,
+				"mode":       sigresps[i].Mode,
+				"ref":        sigresps[i].Ref,
+				"type":       sigresps[i].Type,
+				"signer_id":  sigresps[i].SignerID,
+				"input_hash": hashlog,
+				"user_id":    userid,
+				"t":          int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
+			}).Info("signing operation succeeded")
+			continue
+		}
+		counts.unique++
 		// Make sure the signer implements the right interface, then sign the data
 		switch r.URL.RequestURI() {
 		case "/sign/hash":
@@ -185,6 +290,9 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			md := sha256.New()
 			md.Write(input)
 			hashlog = fmt.Sprintf("%X", md.Sum(nil))
+			if sigreq.WithContentDigest {
+				sigresps[i].ContentDigest = fmt.Sprintf("%x", md.Sum(nil))
+			}
 
 		case "/sign/file":
 			fileSigner, ok := a.signers[signerID].(signer.FileSigner)
@@ -203,6 +311,27 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			md.Write(input)
 			hashlog = fmt.Sprintf("%X", md.Sum(nil))
 		}
+		// pki signatures can opt into reporting the label of the
+		// end-entity key that issued them and the hash of the root of
+		// their chain
+		if csig, ok := sig.(*contentsignaturepki.ContentSignature); ok {
+			sigresps[i].EELabel = csig.EELabel
+			sigresps[i].RootHash = csig.RootHash
+		}
+		dedupCache[dedupKey] = dedupResult{
+			signature:  sigresps[i].Signature,
+			signedFile: sigresps[i].SignedFile,
+			eeLabel:    sigresps[i].EELabel,
+			rootHash:   sigresps[i].RootHash,
+		}
+		// the record of the signature must be durable before the
+		// signature is released to the client
+		err = a.logSignature(sigresps[i], hashlog)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		a.countSignature(sigresps[i].SignerID)
 		log.WithFields(log.Fields{
 			"rid":        rid,
 			"options":    sigreq.Options,
@@ -215,6 +344,11 @@ func (a *autographer) handleSignature(w http.ResponseWriter, r *http.Request) {
 			"t":          int32(time.Since(starttime) / time.Millisecond), //  request processing time in ms
 		}).Info("signing operation succeeded")
 	}
+	// report the dedup outcome of the batch for each signer it named
+	for signerID, counts := range dedupStats {
+		conf := a.signers[signerID].Config()
+		signer.Metrics().ObserveBatchDedup(conf.Type, conf.Mode, counts.total, counts.unique, counts.hits)
+	}
 	respdata, err := json.Marshal(sigresps)
 	if err != nil {
 		httpError(w, r, http.StatusInternalServerError, "signing failed with error: %v", err)
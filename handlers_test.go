@@ -23,7 +23,9 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"go.mozilla.org/autograph/signer"
 	"go.mozilla.org/autograph/signer/apk"
 	"go.mozilla.org/autograph/signer/contentsignature"
 	"go.mozilla.org/autograph/signer/mar"
@@ -227,6 +229,67 @@ func TestSignaturePass(t *testing.T) {
 	}
 }
 
+func TestContentDigest(t *testing.T) {
+	t.Parallel()
+
+	input := "PCFET0NUWVBFIEhUTUw+CjxodG1sPgo8IS0tIGh0dHBzOi8vYnVnemlsbGEubW96aWxsYS5vcmcvc2hvd19idWcuY2dpP2lkPTEyMjY5MjggLS0+CjxoZWFkPgogIDxtZXRhIGNoYXJzZXQ9InV0Zi04Ij4KICA8dGl0bGU+VGVzdHBhZ2UgZm9yIGJ1ZyAxMjI2OTI4PC90aXRsZT4KPC9oZWFkPgo8Ym9keT4KICBKdXN0IGEgZnVsbHkgZ29vZCB0ZXN0cGFnZSBmb3IgQnVnIDEyMjY5Mjg8YnIvPgo8L2JvZHk+CjwvaHRtbD4K"
+	requests := []signaturerequest{
+		// the first request asks for a content digest, the second doesn't
+		signaturerequest{
+			Input:             input,
+			KeyID:             "appkey2",
+			WithContentDigest: true,
+		},
+		signaturerequest{
+			Input: input,
+			KeyID: "appkey2",
+		},
+	}
+	userid := conf.Authorizations[0].ID
+	body, err := json.Marshal(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr := bytes.NewReader(body)
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authheader := getAuthHeader(req,
+		ag.auths[userid].ID,
+		ag.auths[userid].Key,
+		sha256.New,
+		id(),
+		"application/json",
+		body)
+	req.Header.Set("Authorization", authheader)
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusCreated || w.Body.String() == "" {
+		t.Fatalf("failed with %d: %s; request was: %+v", w.Code, w.Body.String(), req)
+	}
+	var responses []signatureresponse
+	err = json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 responses but got %d", len(responses))
+	}
+	rawInput, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDigest := fmt.Sprintf("%x", sha256.Sum256(rawInput))
+	if responses[0].ContentDigest != expectedDigest {
+		t.Fatalf("expected content digest %q but got %q", expectedDigest, responses[0].ContentDigest)
+	}
+	if responses[1].ContentDigest != "" {
+		t.Fatalf("expected no content digest without the opt-in but got %q", responses[1].ContentDigest)
+	}
+}
+
 func TestBadRequest(t *testing.T) {
 	t.Parallel()
 
@@ -753,3 +816,138 @@ func parsePublicKeyFromB64(b64PubKey string) (pubkey *ecdsa.PublicKey, err error
 	pubkey = keyInterface.(*ecdsa.PublicKey)
 	return pubkey, nil
 }
+
+// batchDedupRecorder captures dedup measurements emitted at the end of
+// a batch signing call
+type batchDedupRecorder struct {
+	calls []struct {
+		signerType, mode    string
+		total, unique, hits int
+	}
+}
+
+func (m *batchDedupRecorder) IncSignSuccess(signerType, mode string)                       {}
+func (m *batchDedupRecorder) IncSignError(signerType, mode, reason string)                 {}
+func (m *batchDedupRecorder) ObserveSignDuration(signerType, mode string, d time.Duration) {}
+func (m *batchDedupRecorder) ObserveBatchDedup(signerType, mode string, total, unique, hits int) {
+	m.calls = append(m.calls, struct {
+		signerType, mode    string
+		total, unique, hits int
+	}{signerType, mode, total, unique, hits})
+}
+
+func TestBatchDedupMetrics(t *testing.T) {
+	// not parallel, this test swaps the metrics backend
+	recorder := new(batchDedupRecorder)
+	prevMetrics := signer.Metrics()
+	signer.RegisterMetrics(recorder)
+	defer signer.RegisterMetrics(prevMetrics)
+
+	input := "PCFET0NUWVBFIEhUTUw+CjxodG1sPgo8IS0tIGh0dHBzOi8vYnVnemlsbGEubW96aWxsYS5vcmcvc2hvd19idWcuY2dpP2lkPTEyMjY5MjggLS0+CjxoZWFkPgogIDxtZXRhIGNoYXJzZXQ9InV0Zi04Ij4KICA8dGl0bGU+VGVzdHBhZ2UgZm9yIGJ1ZyAxMjI2OTI4PC90aXRsZT4KPC9oZWFkPgo8Ym9keT4KICBKdXN0IGEgZnVsbHkgZ29vZCB0ZXN0cGFnZSBmb3IgQnVnIDEyMjY5Mjg8YnIvPgo8L2JvZHk+CjwvaHRtbD4K"
+	otherInput := base64.StdEncoding.EncodeToString([]byte("some other input to sign"))
+	requests := []signaturerequest{
+		// the first and third items are identical, the second is not
+		signaturerequest{Input: input, KeyID: "appkey2"},
+		signaturerequest{Input: otherInput, KeyID: "appkey2"},
+		signaturerequest{Input: input, KeyID: "appkey2"},
+	}
+	userid := conf.Authorizations[0].ID
+	body, err := json.Marshal(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr := bytes.NewReader(body)
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authheader := getAuthHeader(req,
+		ag.auths[userid].ID,
+		ag.auths[userid].Key,
+		sha256.New,
+		id(),
+		"application/json",
+		body)
+	req.Header.Set("Authorization", authheader)
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusCreated || w.Body.String() == "" {
+		t.Fatalf("failed with %d: %s; request was: %+v", w.Code, w.Body.String(), req)
+	}
+	var responses []signatureresponse
+	err = json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("expected 3 responses but got %d", len(responses))
+	}
+	// duplicate items must carry the same signature
+	if responses[0].Signature != responses[2].Signature {
+		t.Fatal("expected identical items to share a signature")
+	}
+	if responses[0].Signature == responses[1].Signature {
+		t.Fatal("expected different items to have different signatures")
+	}
+	// a single dedup measurement covers the whole batch
+	if len(recorder.calls) != 1 {
+		t.Fatalf("expected 1 dedup measurement but got %d", len(recorder.calls))
+	}
+	call := recorder.calls[0]
+	if call.signerType != contentsignature.Type {
+		t.Fatalf("expected signer type %q in dedup measurement but got %q", contentsignature.Type, call.signerType)
+	}
+	if call.total != 3 || call.unique != 2 || call.hits != 1 {
+		t.Fatalf("expected dedup counts total=3 unique=2 hits=1 but got total=%d unique=%d hits=%d",
+			call.total, call.unique, call.hits)
+	}
+}
+
+func TestSignatureResponseEELabel(t *testing.T) {
+	t.Parallel()
+	input := base64.StdEncoding.EncodeToString([]byte("some input to sign with a pki signer"))
+	requests := []signaturerequest{
+		signaturerequest{Input: input, KeyID: "normandy"},
+		signaturerequest{Input: input, KeyID: "normandy",
+			Options: map[string]bool{"include_ee_label": true}},
+	}
+	userid := conf.Authorizations[0].ID
+	body, err := json.Marshal(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr := bytes.NewReader(body)
+	req, err := http.NewRequest("POST", "http://foo.bar/sign/data", rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authheader := getAuthHeader(req,
+		ag.auths[userid].ID,
+		ag.auths[userid].Key,
+		sha256.New,
+		id(),
+		"application/json",
+		body)
+	req.Header.Set("Authorization", authheader)
+	w := httptest.NewRecorder()
+	ag.handleSignature(w, req)
+	if w.Code != http.StatusCreated || w.Body.String() == "" {
+		t.Fatalf("failed with %d: %s; request was: %+v", w.Code, w.Body.String(), req)
+	}
+	var responses []signatureresponse
+	err = json.Unmarshal(w.Body.Bytes(), &responses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("expected 2 responses but got %d", len(responses))
+	}
+	if responses[0].EELabel != "" {
+		t.Fatalf("expected no ee label without the option, got %q", responses[0].EELabel)
+	}
+	if responses[1].EELabel == "" {
+		t.Fatal("expected a populated ee label with the include_ee_label option")
+	}
+}
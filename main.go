@@ -9,6 +9,7 @@ package main
 //go:generate ./version.sh
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -17,6 +18,7 @@ import (
 	"os/signal"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -37,7 +39,9 @@ import (
 	"go.mozilla.org/autograph/signer/gpg2"
 	"go.mozilla.org/autograph/signer/mar"
 	"go.mozilla.org/autograph/signer/pgp"
+	"go.mozilla.org/autograph/signer/quorum"
 	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/sshsig"
 	"go.mozilla.org/autograph/signer/xpi"
 
 	"go.mozilla.org/sops"
@@ -61,8 +65,12 @@ type configuration struct {
 		Namespace string
 		Buflen    int
 	}
-	HSM            crypto11.PKCS11Config
-	Database       database.Config
+	HSM          crypto11.PKCS11Config
+	Database     database.Config
+	SignatureLog struct {
+		Path       string
+		FailClosed bool
+	}
 	Signers        []signer.Configuration
 	Authorizations []authorization
 	Monitoring     authorization
@@ -78,6 +86,20 @@ type autographer struct {
 	signerIndex map[string]int
 	nonces      *lru.Cache
 	debug       bool
+
+	// in-flight signing operations are tracked so shutdown can
+	// drain them, see drain.go
+	inflight  sync.WaitGroup
+	drainLock sync.Mutex
+	draining  bool
+
+	// issued signatures are counted asynchronously for usage
+	// reporting, see sigstats.go
+	sigCounts chan string
+
+	// issued signatures are optionally recorded in a durable
+	// write-ahead log for disaster recovery, see siglog.go
+	sigLog *signatureLog
 }
 
 func main() {
@@ -166,6 +188,14 @@ func run(conf configuration, listen string, authPrint, debug bool) {
 		}
 	}
 
+	// open the signature write-ahead log if one is configured
+	if conf.SignatureLog.Path != "" {
+		ag.sigLog, err = newSignatureLog(conf.SignatureLog.Path, conf.SignatureLog.FailClosed)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	err = ag.addSigners(conf.Signers)
 	if err != nil {
 		log.Fatal(err)
@@ -189,6 +219,7 @@ func run(conf configuration, listen string, authPrint, debug bool) {
 	}
 
 	ag.startCleanupHandler()
+	ag.startSignatureCounter()
 
 	router := mux.NewRouter().StrictSlash(true)
 	router.HandleFunc("/__heartbeat__", handleHeartbeat).Methods("GET")
@@ -279,7 +310,14 @@ func (a *autographer) startCleanupHandler() {
 
 	go func() {
 		sig := <-c
-		log.Infof("main: received signal %s; cleaning up signers", sig)
+		log.Infof("main: received signal %s; draining in-flight signing operations", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		err := a.Drain(ctx)
+		cancel()
+		if err != nil {
+			log.Errorf("main: %s", err)
+		}
+		log.Infof("main: cleaning up signers")
 		for _, s := range a.signers {
 			statefulSigner, ok := s.(signer.StatefulSigner)
 			if !ok {
@@ -299,6 +337,7 @@ func (a *autographer) startCleanupHandler() {
 // autographer handler.
 func (a *autographer) addSigners(signerConfs []signer.Configuration) error {
 	sids := make(map[string]bool)
+	var quorumConfs []signer.Configuration
 	for _, signerConf := range signerConfs {
 		if !regexp.MustCompile(signer.IDFormat).MatchString(signerConf.ID) {
 			return fmt.Errorf("signer ID %q does not match the permitted format %q",
@@ -368,11 +407,28 @@ func (a *autographer) addSigners(signerConfs []signer.Configuration) error {
 			if err != nil {
 				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
 			}
+		case sshsig.Type:
+			s, err = sshsig.New(signerConf)
+			if err != nil {
+				return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
+			}
+		case quorum.Type:
+			// quorum signers are constructed in a second pass once all
+			// their backend signers exist
+			quorumConfs = append(quorumConfs, signerConf)
+			continue
 		default:
 			return fmt.Errorf("unknown signer type %q", signerConf.Type)
 		}
 		a.signers = append(a.signers, s)
 	}
+	for _, signerConf := range quorumConfs {
+		s, err := quorum.New(signerConf, a.signers)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add signer %q", signerConf.ID)
+		}
+		a.signers = append(a.signers, s)
+	}
 	return nil
 }
 
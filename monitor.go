@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,9 +15,38 @@ import (
 	"go.mozilla.org/autograph/signer"
 )
 
-// MonitoringInputData is the data signed by the monitoring handler
+// MonitoringInputData is the data signed by the monitoring handler. It
+// defaults to a fixed probe string unless overridden via environment,
+// see makeMonitoringInputData
 var MonitoringInputData = []byte(`AUTOGRAPH MONITORING`)
 
+// defaultMonitoringInputData is the historical fixed probe string
+const defaultMonitoringInputData = "AUTOGRAPH MONITORING"
+
+// makeMonitoringInputData assembles the monitoring probe payload from
+// the AUTOGRAPH_MONITORING_PAYLOAD and
+// AUTOGRAPH_MONITORING_PAYLOAD_SIZE environment variables: the content
+// string is repeated until it reaches the requested size, so monitors
+// can exercise signers with large multi-chunk inputs. Monitoring
+// clients must be configured with the same values to verify the
+// signatures this handler returns.
+func makeMonitoringInputData() ([]byte, error) {
+	content := os.Getenv("AUTOGRAPH_MONITORING_PAYLOAD")
+	if content == "" {
+		content = defaultMonitoringInputData
+	}
+	sizeStr := os.Getenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+	if sizeStr == "" {
+		return []byte(content), nil
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("invalid AUTOGRAPH_MONITORING_PAYLOAD_SIZE %q, expected a positive integer", sizeStr)
+	}
+	payload := bytes.Repeat([]byte(content), (size+len(content)-1)/len(content))
+	return payload[:size], nil
+}
+
 func (a *autographer) addMonitoring(monitoring authorization) error {
 	if monitoring.Key == "" {
 		return nil
@@ -22,6 +54,11 @@ func (a *autographer) addMonitoring(monitoring authorization) error {
 	if _, ok := a.auths["monitor"]; ok {
 		return fmt.Errorf("user 'monitor' is reserved for monitoring, duplication is not permitted")
 	}
+	payload, err := makeMonitoringInputData()
+	if err != nil {
+		return err
+	}
+	MonitoringInputData = payload
 	monitoring.hawkMaxTimestampSkew = time.Minute
 	a.auths["monitor"] = monitoring
 	return nil
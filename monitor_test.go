@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
 
@@ -207,3 +208,40 @@ func TestMonitorBadRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestMakeMonitoringInputData(t *testing.T) {
+	defer os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD")
+	defer os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+
+	// without configuration, the historical fixed probe string is used
+	os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD")
+	os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+	payload, err := makeMonitoringInputData()
+	if err != nil {
+		t.Fatalf("failed to make monitoring input data: %v", err)
+	}
+	if string(payload) != defaultMonitoringInputData {
+		t.Fatalf("expected the default probe string but got %q", payload)
+	}
+
+	// a configured size repeats the content until it is reached
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD", "chunked probe ")
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE", "1048576")
+	payload, err = makeMonitoringInputData()
+	if err != nil {
+		t.Fatalf("failed to make monitoring input data: %v", err)
+	}
+	if len(payload) != 1048576 {
+		t.Fatalf("expected a payload of 1048576 bytes but got %d", len(payload))
+	}
+	if !bytes.HasPrefix(payload, []byte("chunked probe chunked probe ")) {
+		t.Fatalf("expected the payload to repeat the configured content, got %q...", payload[:32])
+	}
+
+	// invalid sizes are rejected
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE", "many")
+	_, err = makeMonitoringInputData()
+	if err == nil {
+		t.Fatal("expected an error with an invalid payload size")
+	}
+}
@@ -0,0 +1,95 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// signatureLogEntry is one record of the signature write-ahead log,
+// holding enough metadata to reconstruct which signatures were issued
+// should the signing keys be lost in an incident
+type signatureLogEntry struct {
+	Timestamp        time.Time `json:"timestamp"`
+	Ref              string    `json:"ref"`
+	SignerID         string    `json:"signer_id"`
+	InputDigest      string    `json:"input_digest"`
+	Signature        string    `json:"signature,omitempty"`
+	SignedFileDigest string    `json:"signed_file_digest,omitempty"`
+}
+
+// signatureLog is an append-only log of issued signatures. Each entry
+// is synced to stable storage before the signature is returned to the
+// client, so the log always covers everything clients have seen
+type signatureLog struct {
+	sync.Mutex
+	fd         *os.File
+	failClosed bool
+}
+
+// newSignatureLog opens the write-ahead log at the given path, creating
+// it if needed and appending to it otherwise
+func newSignatureLog(path string, failClosed bool) (*signatureLog, error) {
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open signature write-ahead log")
+	}
+	return &signatureLog{fd: fd, failClosed: failClosed}, nil
+}
+
+// record appends an entry to the log and syncs it to stable storage. In
+// fail-closed mode a write error is returned so the caller withholds
+// the signature; in fail-open mode it is logged and signing proceeds
+func (sl *signatureLog) record(entry signatureLogEntry) error {
+	sl.Lock()
+	defer sl.Unlock()
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = fmt.Fprintf(sl.fd, "%s\n", data)
+	}
+	if err == nil {
+		err = sl.fd.Sync()
+	}
+	if err == nil {
+		return nil
+	}
+	if sl.failClosed {
+		return errors.Wrap(err, "failed to record signature in write-ahead log")
+	}
+	log.Errorf("main: failed to record signature %q in write-ahead log: %s", entry.Ref, err)
+	return nil
+}
+
+// logSignature records an issued signature in the write-ahead log when
+// one is configured. The returned error is only ever non-nil when the
+// log is configured to fail closed
+func (a *autographer) logSignature(resp signatureresponse, inputDigest string) error {
+	if a.sigLog == nil {
+		return nil
+	}
+	entry := signatureLogEntry{
+		Timestamp:   time.Now().UTC(),
+		Ref:         resp.Ref,
+		SignerID:    resp.SignerID,
+		InputDigest: inputDigest,
+		Signature:   resp.Signature,
+	}
+	if resp.SignedFile != "" {
+		// signed files can be large, so the log stores their digest
+		// rather than their content
+		signedFile, _ := base64.StdEncoding.DecodeString(resp.SignedFile)
+		entry.SignedFileDigest = fmt.Sprintf("%x", sha256.Sum256(signedFile))
+	}
+	return a.sigLog.record(entry)
+}
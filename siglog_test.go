@@ -0,0 +1,96 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSignatureLogRecordsIssuedSignatures(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "siglogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpag := newAutographer(1)
+	tmpag.sigLog, err = newSignatureLog(filepath.Join(dir, "signatures.log"), true)
+	if err != nil {
+		t.Fatalf("failed to open signature log: %v", err)
+	}
+	err = tmpag.logSignature(signatureresponse{
+		Ref:       "testref1",
+		SignerID:  "testsigner1",
+		Signature: "dGVzdHNpZ25hdHVyZQ",
+	}, "DEADBEEF")
+	if err != nil {
+		t.Fatalf("failed to record signature: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "signatures.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry signatureLogEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		t.Fatalf("failed to parse log entry: %v", err)
+	}
+	if entry.Ref != "testref1" || entry.SignerID != "testsigner1" ||
+		entry.InputDigest != "DEADBEEF" || entry.Signature != "dGVzdHNpZ25hdHVyZQ" {
+		t.Fatalf("log entry does not match issued signature: %+v", entry)
+	}
+	if entry.Timestamp.IsZero() {
+		t.Fatal("log entry carries no timestamp")
+	}
+}
+
+func TestSignatureLogFailClosed(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "siglogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sigLog, err := newSignatureLog(filepath.Join(dir, "signatures.log"), true)
+	if err != nil {
+		t.Fatalf("failed to open signature log: %v", err)
+	}
+	// close the underlying file to make the next write fail
+	sigLog.fd.Close()
+	err = sigLog.record(signatureLogEntry{Ref: "testref1"})
+	if err == nil {
+		t.Fatal("expected a fail-closed log to return a write error but got none")
+	}
+	if !strings.Contains(err.Error(), "write-ahead log") {
+		t.Fatalf("expected a write-ahead log error but got: %v", err)
+	}
+}
+
+func TestSignatureLogFailOpen(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "siglogtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sigLog, err := newSignatureLog(filepath.Join(dir, "signatures.log"), false)
+	if err != nil {
+		t.Fatalf("failed to open signature log: %v", err)
+	}
+	// close the underlying file to make the next write fail
+	sigLog.fd.Close()
+	err = sigLog.record(signatureLogEntry{Ref: "testref1"})
+	if err != nil {
+		t.Fatalf("expected a fail-open log to swallow write errors but got: %v", err)
+	}
+}
@@ -85,6 +85,7 @@ func New(conf signer.Configuration) (s *APKSigner, err error) {
 	}
 	// if specified, don't sign with attributes
 	s.noSignedAttr = conf.NoPKCS7SignedAttributes
+	s.AuditHook = conf.AuditHook
 	return
 }
 
@@ -106,7 +107,8 @@ func (s *APKSigner) Config() signer.Configuration {
 // data is the signed aligned APK.
 //
 // This implements apksigning v1, aka jarsigner. apksigning v2 is not supported.
-func (s *APKSigner) SignFile(input []byte, options interface{}) (signer.SignedFile, error) {
+func (s *APKSigner) SignFile(input []byte, options interface{}) (sf signer.SignedFile, err error) {
+	defer func() { s.Audit(signer.AuditOpSignFile, input, err) }()
 	opt, err := GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "apk: cannot get options")
@@ -146,7 +148,8 @@ func (s *APKSigner) SignFile(input []byte, options interface{}) (signer.SignedFi
 }
 
 // SignData takes a JAR signature file and returns a pkcs7 signature
-func (s *APKSigner) SignData(sigfile []byte, options interface{}) (signer.Signature, error) {
+func (s *APKSigner) SignData(sigfile []byte, options interface{}) (retsig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, sigfile, err) }()
 	p7sig, err := s.signData(sigfile, options)
 	if err != nil {
 		return nil, err
@@ -215,6 +218,19 @@ func (sig *Signature) Verify() error {
 	return sig.p7.Verify()
 }
 
+// SignerCert returns the certificate of the signer embedded in the PKCS7
+// signature
+func (sig *Signature) SignerCert() (*x509.Certificate, error) {
+	if !sig.Finished {
+		return nil, errors.New("apk: cannot get signer certificate of unfinished signature")
+	}
+	cert := sig.p7.GetOnlySigner()
+	if cert == nil {
+		return nil, errors.New("apk: no signer certificate found in signature")
+	}
+	return cert, nil
+}
+
 // Marshal returns the base64 representation of a PKCS7 detached signature
 func (sig *Signature) Marshal() (string, error) {
 	if !sig.Finished {
@@ -0,0 +1,85 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+const (
+	// AuditOpSignData identifies audit events emitted by SignData
+	AuditOpSignData = "sign_data"
+
+	// AuditOpSignFile identifies audit events emitted by SignFile
+	AuditOpSignFile = "sign_file"
+
+	// AuditResultSuccess marks audit events of signing operations that succeeded
+	AuditResultSuccess = "success"
+
+	// AuditResultError marks audit events of signing operations that failed
+	AuditResultError = "error"
+)
+
+// AuditEvent describes a single signing operation for the audit trail.
+// It carries the sha256 of the input rather than the input itself, so
+// events can be exported to an external stream without leaking the
+// signed material. The service request logs record which authenticated
+// user requested an operation and can be joined with the audit stream
+// by timestamp and signer id.
+type AuditEvent struct {
+	// Timestamp is the time the signing operation completed
+	Timestamp time.Time `json:"timestamp"`
+
+	// SignerID, SignerType and Mode identify the signer that performed
+	// the operation
+	SignerID   string `json:"signer_id"`
+	SignerType string `json:"signer_type"`
+	Mode       string `json:"mode,omitempty"`
+
+	// Operation is the signing entry point that was called, one of
+	// AuditOpSignData or AuditOpSignFile
+	Operation string `json:"operation"`
+
+	// InputDigest is the hex encoded sha256 of the input
+	InputDigest string `json:"input_digest"`
+
+	// Result is AuditResultSuccess or AuditResultError
+	Result string `json:"result"`
+
+	// Error carries the failure message when Result is AuditResultError
+	Error string `json:"error,omitempty"`
+}
+
+// Audit emits an audit event describing a signing operation to the
+// audit hook of the signer, if one is configured. The timestamp, the
+// identity of the signer and the input digest are filled automatically
+func (cfg *Configuration) Audit(operation string, input []byte, signErr error) {
+	if cfg.AuditHook == nil {
+		return
+	}
+	digest := sha256.Sum256(input)
+	cfg.AuditDigest(operation, digest[:], signErr)
+}
+
+// AuditDigest behaves like Audit for callers that hash their input
+// incrementally and only hold its sha256 digest by the time the
+// operation completes
+func (cfg *Configuration) AuditDigest(operation string, digest []byte, signErr error) {
+	if cfg.AuditHook == nil {
+		return
+	}
+	event := AuditEvent{
+		Timestamp:   time.Now().UTC(),
+		SignerID:    cfg.ID,
+		SignerType:  cfg.Type,
+		Mode:        cfg.Mode,
+		Operation:   operation,
+		InputDigest: fmt.Sprintf("%x", digest),
+		Result:      AuditResultSuccess,
+	}
+	if signErr != nil {
+		event.Result = AuditResultError
+		event.Error = signErr.Error()
+	}
+	cfg.AuditHook(event)
+}
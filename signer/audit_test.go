@@ -0,0 +1,64 @@
+package signer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestAudit(t *testing.T) {
+	t.Parallel()
+	input := []byte("some input that was signed")
+	var events []AuditEvent
+	cfg := Configuration{
+		ID:   "testaudit",
+		Type: "testtype",
+		Mode: "testmode",
+		AuditHook: func(event AuditEvent) {
+			events = append(events, event)
+		},
+	}
+
+	before := time.Now().UTC()
+	cfg.Audit(AuditOpSignData, input, nil)
+	cfg.Audit(AuditOpSignFile, input, errors.New("something went wrong"))
+	after := time.Now().UTC()
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 audit events but got %d", len(events))
+	}
+	success := events[0]
+	if success.SignerID != cfg.ID || success.SignerType != cfg.Type || success.Mode != cfg.Mode {
+		t.Fatalf("expected audit event to identify the signer but got %+v", success)
+	}
+	if success.Operation != AuditOpSignData {
+		t.Fatalf("expected operation %q but got %q", AuditOpSignData, success.Operation)
+	}
+	if success.InputDigest != fmt.Sprintf("%x", sha256.Sum256(input)) {
+		t.Fatalf("expected the sha256 of the input but got %q", success.InputDigest)
+	}
+	if success.Result != AuditResultSuccess || success.Error != "" {
+		t.Fatalf("expected a success result but got %+v", success)
+	}
+	if success.Timestamp.Before(before) || success.Timestamp.After(after) {
+		t.Fatalf("expected a timestamp between %s and %s but got %s", before, after, success.Timestamp)
+	}
+
+	failure := events[1]
+	if failure.Operation != AuditOpSignFile {
+		t.Fatalf("expected operation %q but got %q", AuditOpSignFile, failure.Operation)
+	}
+	if failure.Result != AuditResultError || failure.Error != "something went wrong" {
+		t.Fatalf("expected an error result but got %+v", failure)
+	}
+}
+
+func TestAuditWithoutHook(t *testing.T) {
+	t.Parallel()
+	// a configuration without a hook must not panic
+	cfg := Configuration{ID: "testaudit", Type: "testtype"}
+	cfg.Audit(AuditOpSignData, []byte("some input"), nil)
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/asn1"
+	"encoding/binary"
 	"hash"
 	"io"
 
@@ -37,8 +38,17 @@ const (
 	// P521ECDSABYTESIZE defines the bytes length of a P521ECDSA signature
 	P521ECDSABYTESIZE = 132
 
-	// SignaturePrefix is a string preprended to data prior to signing
+	// SignaturePrefix is a string preprended to data prior to signing,
+	// composed of SignaturePrefixLabel and DefaultPrefixSeparator
 	SignaturePrefix = "Content-Signature:\x00"
+
+	// SignaturePrefixLabel is the label part of the signature prefix,
+	// before the separator
+	SignaturePrefixLabel = "Content-Signature:"
+
+	// DefaultPrefixSeparator is the separator placed between the prefix
+	// label and the input data when the configuration doesn't specify one
+	DefaultPrefixSeparator = "\x00"
 )
 
 // ContentSigner implements an issuer of content signatures
@@ -47,6 +57,38 @@ type ContentSigner struct {
 	priv crypto.PrivateKey
 	pub  crypto.PublicKey
 	rand io.Reader
+
+	// prefixSeparator is placed between the prefix label and the input
+	// data when templating, and defaults to DefaultPrefixSeparator
+	prefixSeparator string
+
+	// lengthBound encodes the length of the input data into the hashed
+	// preimage when templating, and defaults to off
+	lengthBound bool
+}
+
+// Options accepts per-call signing parameters. It is not exposed over
+// the HTTP API: a custom randomness source can only be provided by
+// in-process callers, typically for known-answer tests
+type Options struct {
+	// Rand overrides the randomness source of the signer for a single
+	// call. When nil, the signer uses its configured source
+	Rand io.Reader `json:"-"`
+}
+
+// GetOptions returns the options of a signing call. Anything that isn't
+// an Options value, including the nil options of regular API calls,
+// maps to the default options
+func GetOptions(input interface{}) (options Options) {
+	switch opt := input.(type) {
+	case Options:
+		return opt
+	case *Options:
+		if opt != nil {
+			return *opt
+		}
+	}
+	return
 }
 
 // New initializes a ContentSigner using a signer configuration
@@ -56,6 +98,7 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	s.Type = conf.Type
 	s.PrivateKey = conf.PrivateKey
 	s.X5U = conf.X5U
+	s.AuditHook = conf.AuditHook
 	if conf.Type != Type {
 		return nil, errors.Errorf("contentsignature: invalid type %q, must be %q", conf.Type, Type)
 	}
@@ -65,6 +108,13 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	if conf.PrivateKey == "" {
 		return nil, errors.New("contentsignature: missing private key in signer configuration")
 	}
+	s.prefixSeparator = conf.PrefixSeparator
+	if s.prefixSeparator == "" {
+		s.prefixSeparator = DefaultPrefixSeparator
+	}
+	s.PrefixSeparator = s.prefixSeparator
+	s.lengthBound = conf.LengthBoundHashing
+	s.LengthBoundHashing = s.lengthBound
 	s.priv, s.pub, s.rand, s.PublicKey, err = conf.GetKeysAndRand()
 	if err != nil {
 		return nil, errors.Wrap(err, "contentsignature: failed to retrieve signer")
@@ -81,50 +131,150 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 // Config returns the configuration of the current signer
 func (s *ContentSigner) Config() signer.Configuration {
 	return signer.Configuration{
-		ID:         s.ID,
-		Type:       s.Type,
-		Mode:       s.Mode,
-		PrivateKey: s.PrivateKey,
-		PublicKey:  s.PublicKey,
-		X5U:        s.X5U,
+		ID:                 s.ID,
+		Type:               s.Type,
+		Mode:               s.Mode,
+		PrivateKey:         s.PrivateKey,
+		PublicKey:          s.PublicKey,
+		X5U:                s.X5U,
+		PrefixSeparator:    s.prefixSeparator,
+		LengthBoundHashing: s.lengthBound,
 	}
 }
 
 // SignData takes input data, templates it, hashes it and signs it.
 // The returned signature is of type ContentSignature and ready to be Marshalled.
-func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Signature, error) {
+func (s *ContentSigner) SignData(input []byte, options interface{}) (sig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, input, err) }()
 	if len(input) < 10 {
 		return nil, errors.Errorf("contentsignature: refusing to sign input data shorter than 10 bytes")
 	}
-	alg, hash := makeTemplatedHash(input, s.Mode)
-	sig, err := s.SignHash(hash, options)
+	alg, hash := makeTemplatedHashWithSeparator(input, s.Mode, s.prefixSeparator, s.lengthBound)
+	sig, err = s.SignHash(hash, options)
 	sig.(*ContentSignature).storeHashName(alg)
+	sig.(*ContentSignature).LengthBound = s.lengthBound
 	return sig, err
 }
 
+// SignStream behaves like SignData but reads the input from a reader
+// and hashes it incrementally, so large files can be signed without
+// being held in memory. Length bound hashing includes the input length
+// in the preimage before the data itself, which a single pass over a
+// stream cannot provide, so signers configured with it refuse to sign
+// streams.
+func (s *ContentSigner) SignStream(input io.Reader, options interface{}) (sig signer.Signature, err error) {
+	auditMd := sha256.New()
+	defer func() { s.AuditDigest(signer.AuditOpSignData, auditMd.Sum(nil), err) }()
+	if s.lengthBound {
+		return nil, errors.Errorf("contentsignature: signer %q hashes the input length before the data and cannot sign a stream", s.ID)
+	}
+	var alg string
+	switch s.Mode {
+	case P384ECDSA:
+		alg = "sha384"
+	case P521ECDSA:
+		alg = "sha512"
+	default:
+		alg = "sha256"
+	}
+	md, err := newTemplatedHash(alg, s.prefixSeparator)
+	if err != nil {
+		return nil, err
+	}
+	n, err := io.Copy(io.MultiWriter(md, auditMd), input)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignature: failed to read input stream")
+	}
+	if n < 10 {
+		return nil, errors.Errorf("contentsignature: refusing to sign input data shorter than 10 bytes")
+	}
+	sig, err = s.SignHash(md.Sum(nil), options)
+	if err != nil {
+		return nil, err
+	}
+	sig.(*ContentSignature).storeHashName(alg)
+	return sig, nil
+}
+
 // hash returns the templated sha384 of the input data. The template adds
 // the string "Content-Signature:\x00" before the input data prior to
 // calculating the sha384.
 //
 // The name of the hash function is returned, followed by the hash bytes
 func makeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
-	templated := make([]byte, len(SignaturePrefix)+len(data))
-	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
-	copy(templated[len(SignaturePrefix):], data)
-	var md hash.Hash
+	return makeTemplatedHashWithSeparator(data, curvename, DefaultPrefixSeparator, false)
+}
+
+// makeTemplatedHashWithSeparator behaves like makeTemplatedHash with a
+// custom separator between the prefix label and the input data, and an
+// optional length bound on the hashed preimage
+func makeTemplatedHashWithSeparator(data []byte, curvename, sep string, lengthBound bool) (alg string, out []byte) {
 	switch curvename {
 	case P384ECDSA:
-		md = sha512.New384()
 		alg = "sha384"
 	case P521ECDSA:
-		md = sha512.New()
 		alg = "sha512"
 	default:
-		md = sha256.New()
 		alg = "sha256"
 	}
-	md.Write(templated)
-	return alg, md.Sum(nil)
+	out, _ = makeTemplatedDigest(data, alg, sep, lengthBound)
+	return
+}
+
+// makeTemplatedDigest returns the templated digest of the input data
+// for a given hash algorithm name and prefix separator. When
+// lengthBound is set, the 64 bit big endian length of the input data is
+// hashed between the prefix and the data, so the preimage encodes where
+// the data starts and how long it is, as a domain separation hardening
+// against inputs crafted to shift the logical message boundary
+func makeTemplatedDigest(data []byte, alg, sep string, lengthBound bool) ([]byte, error) {
+	md, err := newTemplatedHash(alg, sep)
+	if err != nil {
+		return nil, err
+	}
+	if lengthBound {
+		var dataLen [8]byte
+		binary.BigEndian.PutUint64(dataLen[:], uint64(len(data)))
+		md.Write(dataLen[:])
+	}
+	md.Write(data)
+	return md.Sum(nil), nil
+}
+
+// newTemplatedHash returns a hash of the requested algorithm already
+// filled with the signature prefix label and separator, ready to
+// receive the input data
+func newTemplatedHash(alg, sep string) (hash.Hash, error) {
+	var md hash.Hash
+	switch alg {
+	case "sha256":
+		md = sha256.New()
+	case "sha384":
+		md = sha512.New384()
+	case "sha512":
+		md = sha512.New()
+	default:
+		return nil, errors.Errorf("contentsignature: unsupported digest algorithm %q", alg)
+	}
+	md.Write([]byte(SignaturePrefixLabel))
+	md.Write([]byte(sep))
+	return md, nil
+}
+
+// MakeTemplatedDigests returns the templated digest of the input data
+// for every requested hash algorithm, so clients can precompute
+// digests for verifiers with different capabilities in a single pass.
+// It does not sign anything
+func MakeTemplatedDigests(input []byte, algs []string) (map[string][]byte, error) {
+	digests := make(map[string][]byte, len(algs))
+	for _, alg := range algs {
+		digest, err := makeTemplatedDigest(input, alg, DefaultPrefixSeparator, false)
+		if err != nil {
+			return nil, err
+		}
+		digests[alg] = digest
+	}
+	return digests, nil
 }
 
 // SignHash takes an input hash and returns a signature. It assumes the input data
@@ -142,7 +292,14 @@ func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Sign
 		ID:   s.ID,
 	}
 
-	asn1Sig, err := s.priv.(crypto.Signer).Sign(rand.Reader, input, nil)
+	rng := s.rand
+	if rng == nil {
+		rng = rand.Reader
+	}
+	if opt := GetOptions(options); opt.Rand != nil {
+		rng = opt.Rand
+	}
+	asn1Sig, err := s.priv.(crypto.Signer).Sign(rng, input, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "contentsignature: failed to sign hash")
 	}
@@ -204,6 +361,7 @@ func (s *ContentSigner) getModeFromCurve() string {
 }
 
 // GetDefaultOptions returns nil because this signer has no option
+// exposed over the HTTP API
 func (s *ContentSigner) GetDefaultOptions() interface{} {
 	return nil
 }
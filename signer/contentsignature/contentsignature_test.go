@@ -7,10 +7,14 @@
 package contentsignature
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -235,3 +239,471 @@ func TestNoShortData(t *testing.T) {
 		t.Fatalf("expected to fail with input data too short but failed with: %v", err)
 	}
 }
+
+// patternReader is a deterministic randomness source that
+// endlessly repeats a single byte
+type patternReader struct {
+	pattern byte
+}
+
+func (r patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.pattern
+	}
+	return len(p), nil
+}
+
+func TestSignWithCustomRand(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// signing the same input twice with the same deterministic
+	// randomness source must produce the same signature
+	sig1, err := s.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sig2, err := s.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr1, err := sig1.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	sigstr2, err := sig2.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	if sigstr1 != sigstr2 {
+		t.Fatalf("expected identical signatures from a deterministic randomness source, got %q and %q",
+			sigstr1, sigstr2)
+	}
+
+	// a different randomness source must produce a different signature
+	sig3, err := s.SignData(input, Options{Rand: patternReader{pattern: 0x43}})
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr3, err := sig3.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	if sigstr1 == sigstr3 {
+		t.Fatal("expected different signatures from different randomness sources")
+	}
+
+	// the signature must still verify
+	keyBytes, err := base64.StdEncoding.DecodeString(s.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+	keyInterface, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		t.Fatalf("failed to parse public key DER: %v", err)
+	}
+	if !sig1.(*ContentSignature).VerifyData(input, keyInterface.(*ecdsa.PublicKey)) {
+		t.Fatal("failed to verify content signature made with a custom randomness source")
+	}
+
+	// nil options keep the default source
+	sig4, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if !sig4.(*ContentSignature).VerifyData(input, keyInterface.(*ecdsa.PublicKey)) {
+		t.Fatal("failed to verify content signature made with the default randomness source")
+	}
+}
+
+func TestMakeTemplatedDigests(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	digests, err := MakeTemplatedDigests(input, []string{"sha256", "sha384", "sha512"})
+	if err != nil {
+		t.Fatalf("failed to make templated digests: %v", err)
+	}
+	if len(digests) != 3 {
+		t.Fatalf("expected 3 digests, got %d", len(digests))
+	}
+	for alg, expectedLen := range map[string]int{
+		"sha256": 32,
+		"sha384": 48,
+		"sha512": 64,
+	} {
+		if len(digests[alg]) != expectedLen {
+			t.Fatalf("expected %s digest of %d bytes, got %d", alg, expectedLen, len(digests[alg]))
+		}
+	}
+	// each digest must match the one used when signing with the
+	// corresponding curve
+	for mode, alg := range map[string]string{
+		P256ECDSA: "sha256",
+		P384ECDSA: "sha384",
+		P521ECDSA: "sha512",
+	} {
+		hashAlg, hashed := makeTemplatedHash(input, mode)
+		if hashAlg != alg {
+			t.Fatalf("expected mode %q to hash with %q, got %q", mode, alg, hashAlg)
+		}
+		if !bytes.Equal(digests[alg], hashed) {
+			t.Fatalf("%s digest does not match the templated hash of mode %q", alg, mode)
+		}
+	}
+	_, err = MakeTemplatedDigests(input, []string{"sha256", "md5"})
+	if err == nil {
+		t.Fatal("expected to fail with an unsupported digest algorithm but succeeded")
+	}
+	if !strings.Contains(err.Error(), `unsupported digest algorithm "md5"`) {
+		t.Fatalf("expected unsupported algorithm error, got: %v", err)
+	}
+}
+
+func TestCustomPrefixSeparator(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+
+	// initialize a signer with the default separator and one with a
+	// custom separator, sharing the same key
+	defaultSigner, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	customCfg := PASSINGTESTCASES[0].cfg
+	customCfg.PrefixSeparator = "\x1f"
+	customSigner, err := New(customCfg)
+	if err != nil {
+		t.Fatalf("custom separator signer initialization failed with: %v", err)
+	}
+	if customSigner.Config().PrefixSeparator != "\x1f" {
+		t.Fatalf("signer separator %q does not match configuration %q", customSigner.Config().PrefixSeparator, "\x1f")
+	}
+	if defaultSigner.Config().PrefixSeparator != DefaultPrefixSeparator {
+		t.Fatalf("signer separator %q does not match the default separator %q", defaultSigner.Config().PrefixSeparator, DefaultPrefixSeparator)
+	}
+
+	// with a deterministic randomness source, the separator is the only
+	// difference between the two signatures
+	defaultSig, err := defaultSigner.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	customSig, err := customSigner.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+	if err != nil {
+		t.Fatalf("failed to sign data with custom separator: %v", err)
+	}
+	defaultSigStr, err := defaultSig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	customSigStr, err := customSig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal custom separator signature: %v", err)
+	}
+	if defaultSigStr == customSigStr {
+		t.Fatal("expected different signatures for different separators but they are identical")
+	}
+
+	// each signature must verify with its own separator and not the other
+	pubKey := defaultSigner.pub.(*ecdsa.PublicKey)
+	if !defaultSig.(*ContentSignature).VerifyData(input, pubKey) {
+		t.Fatal("failed to verify signature with default separator")
+	}
+	if !customSig.(*ContentSignature).VerifyDataWithSeparator(input, pubKey, "\x1f") {
+		t.Fatal("failed to verify signature with custom separator")
+	}
+	if customSig.(*ContentSignature).VerifyData(input, pubKey) {
+		t.Fatal("signature with custom separator verified with the default separator")
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	var events []signer.AuditEvent
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.AuditHook = func(event signer.AuditEvent) {
+		events = append(events, event)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// a successful signature emits a success event
+	_, err = s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	// an input too short to sign emits an error event
+	_, err = s.SignData([]byte("short"), nil)
+	if err == nil {
+		t.Fatal("expected to fail signing a short input but succeeded")
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("expected 2 audit events but got %d", len(events))
+	}
+	success := events[0]
+	if success.SignerID != cfg.ID || success.SignerType != Type || success.Mode != s.Mode {
+		t.Fatalf("expected audit event to identify the signer but got %+v", success)
+	}
+	if success.Operation != signer.AuditOpSignData {
+		t.Fatalf("expected operation %q but got %q", signer.AuditOpSignData, success.Operation)
+	}
+	if success.InputDigest != fmt.Sprintf("%x", sha256.Sum256(input)) {
+		t.Fatalf("expected the sha256 of the input but got %q", success.InputDigest)
+	}
+	if success.Result != signer.AuditResultSuccess {
+		t.Fatalf("expected a success result but got %+v", success)
+	}
+	failure := events[1]
+	if failure.Result != signer.AuditResultError {
+		t.Fatalf("expected an error result but got %+v", failure)
+	}
+	if !strings.Contains(failure.Error, "refusing to sign input data shorter than 10 bytes") {
+		t.Fatalf("expected the signing error in the audit event but got %q", failure.Error)
+	}
+}
+
+func TestLengthBoundHashing(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+
+	// initialize a signer with default templating and one with length
+	// bound hashing, sharing the same key
+	defaultSigner, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	boundCfg := PASSINGTESTCASES[0].cfg
+	boundCfg.LengthBoundHashing = true
+	boundSigner, err := New(boundCfg)
+	if err != nil {
+		t.Fatalf("length bound signer initialization failed with: %v", err)
+	}
+	if !boundSigner.Config().LengthBoundHashing {
+		t.Fatal("expected the signer configuration to record length bound hashing")
+	}
+	if defaultSigner.Config().LengthBoundHashing {
+		t.Fatal("expected length bound hashing to default to off")
+	}
+
+	// with a deterministic randomness source, the length encoding is
+	// the only difference between the two signatures
+	defaultSig, err := defaultSigner.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	boundSig, err := boundSigner.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+	if err != nil {
+		t.Fatalf("failed to sign data with length bound hashing: %v", err)
+	}
+	defaultSigStr, err := defaultSig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	boundSigStr, err := boundSig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal length bound signature: %v", err)
+	}
+	if defaultSigStr == boundSigStr {
+		t.Fatal("expected a length bound signature to differ from a default one but they are identical")
+	}
+
+	// each signature verifies with its own templating and not the other
+	pubKey := defaultSigner.pub.(*ecdsa.PublicKey)
+	if !boundSig.(*ContentSignature).LengthBound {
+		t.Fatal("expected the signature to record length bound hashing")
+	}
+	if !boundSig.(*ContentSignature).VerifyData(input, pubKey) {
+		t.Fatal("failed to verify length bound signature")
+	}
+	if !defaultSig.(*ContentSignature).VerifyData(input, pubKey) {
+		t.Fatal("failed to verify default signature")
+	}
+	boundSig.(*ContentSignature).LengthBound = false
+	if boundSig.(*ContentSignature).VerifyData(input, pubKey) {
+		t.Fatal("length bound signature verified against an unbound preimage")
+	}
+}
+
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+		sig, err := s.SignData(input, nil)
+		if err != nil {
+			t.Fatalf("testcase %d failed to sign data: %v", i, err)
+		}
+		csig := sig.(*ContentSignature)
+
+		// the binary form is the raw r||s bytes the string form encodes
+		raw, err := csig.MarshalBinary()
+		if err != nil {
+			t.Fatalf("testcase %d failed to marshal signature to binary: %v", i, err)
+		}
+		if len(raw) != csig.Len {
+			t.Fatalf("testcase %d binary signature is %d bytes, expected %d", i, len(raw), csig.Len)
+		}
+		str, err := csig.Marshal()
+		if err != nil {
+			t.Fatalf("testcase %d failed to marshal signature to string: %v", i, err)
+		}
+		if base64.RawURLEncoding.EncodeToString(raw) != str {
+			t.Fatalf("testcase %d binary and string forms of the signature don't match", i)
+		}
+
+		// the binary form round trips into a verifiable signature
+		parsed := new(ContentSignature)
+		err = parsed.UnmarshalBinary(raw)
+		if err != nil {
+			t.Fatalf("testcase %d failed to unmarshal binary signature: %v", i, err)
+		}
+		if parsed.Mode != csig.Mode || parsed.HashName != csig.HashName || parsed.Len != csig.Len {
+			t.Fatalf("testcase %d unmarshalled signature metadata %q/%q/%d does not match original %q/%q/%d",
+				i, parsed.Mode, parsed.HashName, parsed.Len, csig.Mode, csig.HashName, csig.Len)
+		}
+		if parsed.R.Cmp(csig.R) != 0 || parsed.S.Cmp(csig.S) != 0 {
+			t.Fatalf("testcase %d unmarshalled R and S values don't match the original signature", i)
+		}
+		key := s.pub.(*ecdsa.PublicKey)
+		if !parsed.VerifyData(input, key) {
+			t.Fatalf("testcase %d failed to verify unmarshalled binary signature", i)
+		}
+	}
+
+	// an unfinished signature cannot be encoded
+	_, err := new(ContentSignature).MarshalBinary()
+	if err == nil {
+		t.Fatal("expected to fail marshalling an unfinished signature to binary but succeeded")
+	}
+
+	// bytes of an unknown length are rejected
+	err = new(ContentSignature).UnmarshalBinary(make([]byte, 42))
+	if err == nil {
+		t.Fatal("expected to fail unmarshalling a 42 bytes signature but succeeded")
+	}
+}
+
+func TestSignStream(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	for i, testcase := range PASSINGTESTCASES {
+		s, err := New(testcase.cfg)
+		if err != nil {
+			t.Fatalf("testcase %d signer initialization failed with: %v", i, err)
+		}
+
+		// with a deterministic randomness source, the streaming path
+		// must produce the exact signature the buffered path produces
+		bufSig, err := s.SignData(input, Options{Rand: patternReader{pattern: 0x42}})
+		if err != nil {
+			t.Fatalf("testcase %d failed to sign data: %v", i, err)
+		}
+		streamSig, err := s.SignStream(bytes.NewReader(input), Options{Rand: patternReader{pattern: 0x42}})
+		if err != nil {
+			t.Fatalf("testcase %d failed to sign stream: %v", i, err)
+		}
+		bufStr, err := bufSig.Marshal()
+		if err != nil {
+			t.Fatalf("testcase %d failed to marshal buffered signature: %v", i, err)
+		}
+		streamStr, err := streamSig.Marshal()
+		if err != nil {
+			t.Fatalf("testcase %d failed to marshal streamed signature: %v", i, err)
+		}
+		if bufStr != streamStr {
+			t.Fatalf("testcase %d buffered and streamed signatures don't match:\nbuffered=%s\nstreamed=%s", i, bufStr, streamStr)
+		}
+		if !streamSig.(*ContentSignature).VerifyData(input, s.pub.(*ecdsa.PublicKey)) {
+			t.Fatalf("testcase %d failed to verify streamed signature", i)
+		}
+	}
+
+	// a stream shorter than the 10 bytes minimum is refused
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s.SignStream(bytes.NewReader([]byte("short")), nil)
+	if err == nil {
+		t.Fatal("expected to fail signing a short stream but succeeded")
+	}
+	if !strings.Contains(err.Error(), "refusing to sign input data shorter than 10 bytes") {
+		t.Fatalf("expected a short input error but got: %v", err)
+	}
+
+	// length bound hashing needs the input length before the data and
+	// cannot be applied to a stream
+	boundCfg := PASSINGTESTCASES[0].cfg
+	boundCfg.LengthBoundHashing = true
+	boundSigner, err := New(boundCfg)
+	if err != nil {
+		t.Fatalf("length bound signer initialization failed with: %v", err)
+	}
+	_, err = boundSigner.SignStream(bytes.NewReader(input), nil)
+	if err == nil {
+		t.Fatal("expected to fail signing a stream with a length bound signer but succeeded")
+	}
+	if !strings.Contains(err.Error(), "cannot sign a stream") {
+		t.Fatalf("expected a length bound error but got: %v", err)
+	}
+
+	// the audit event carries the sha256 of the streamed input
+	var events []signer.AuditEvent
+	auditCfg := PASSINGTESTCASES[0].cfg
+	auditCfg.AuditHook = func(event signer.AuditEvent) {
+		events = append(events, event)
+	}
+	auditSigner, err := New(auditCfg)
+	if err != nil {
+		t.Fatalf("audited signer initialization failed with: %v", err)
+	}
+	_, err = auditSigner.SignStream(bytes.NewReader(input), nil)
+	if err != nil {
+		t.Fatalf("failed to sign stream: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("expected 1 audit event but got %d", len(events))
+	}
+	if events[0].InputDigest != fmt.Sprintf("%x", sha256.Sum256(input)) {
+		t.Fatalf("expected the sha256 of the streamed input but got %q", events[0].InputDigest)
+	}
+}
+
+// benchmarkStreamSize is the input size the signing benchmarks hash.
+// The buffered path loads the input on every iteration, as a caller
+// signing a file would, so running with -benchmem shows the allocation
+// difference with the streaming path
+const benchmarkStreamSize = 32 << 20
+
+func BenchmarkSignData(b *testing.B) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		b.Fatalf("signer initialization failed with: %v", err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		input := make([]byte, benchmarkStreamSize)
+		_, err := s.SignData(input, nil)
+		if err != nil {
+			b.Fatalf("failed to sign data: %v", err)
+		}
+	}
+}
+
+func BenchmarkSignStream(b *testing.B) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		b.Fatalf("signer initialization failed with: %v", err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := s.SignStream(io.LimitReader(patternReader{}, benchmarkStreamSize), nil)
+		if err != nil {
+			b.Fatalf("failed to sign stream: %v", err)
+		}
+	}
+}
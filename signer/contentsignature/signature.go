@@ -17,6 +17,13 @@ type ContentSignature struct {
 	ID       string
 	Len      int
 	Finished bool
+
+	// LengthBound records that the hashed preimage of the signature
+	// encodes the length of the input data, issued by a signer with
+	// length bound hashing enabled. It is not part of the compact
+	// marshalled signature, so verifiers of marshalled signatures must
+	// know the setting of the issuing signer out of band.
+	LengthBound bool
 }
 
 // a private struct to unmarshal asn1 signatures produced by crypto.Signer
@@ -30,7 +37,13 @@ func (sig *ContentSignature) storeHashName(alg string) {
 
 // VerifyData verifies a signatures on its raw, untemplated, input using a public key
 func (sig *ContentSignature) VerifyData(input []byte, pubKey *ecdsa.PublicKey) bool {
-	_, hash := makeTemplatedHash(input, sig.Mode)
+	return sig.VerifyDataWithSeparator(input, pubKey, DefaultPrefixSeparator)
+}
+
+// VerifyDataWithSeparator behaves like VerifyData against a signature
+// issued by a signer configured with a custom prefix separator
+func (sig *ContentSignature) VerifyDataWithSeparator(input []byte, pubKey *ecdsa.PublicKey, sep string) bool {
+	_, hash := makeTemplatedHashWithSeparator(input, sig.Mode, sep, sig.LengthBound)
 	return sig.VerifyHash(hash, pubKey)
 }
 
@@ -42,11 +55,24 @@ func (sig *ContentSignature) VerifyHash(hash []byte, pubKey *ecdsa.PublicKey) bo
 // Marshal returns the R||S signature is encoded in base64 URL safe,
 // following DL/ECSSA format spec from IEEE Std 1363-2000.
 func (sig *ContentSignature) Marshal() (str string, err error) {
+	rs, err := sig.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	encodedsig := base64.RawURLEncoding.EncodeToString(rs)
+	return fmt.Sprintf("%s", encodedsig), nil
+}
+
+// MarshalBinary returns the canonical R||S bytes of the signature
+// without any base64 encoding, for clients writing to binary
+// transports. It implements encoding.BinaryMarshaler and carries the
+// same content as Marshal.
+func (sig *ContentSignature) MarshalBinary() ([]byte, error) {
 	if !sig.Finished {
-		return "", fmt.Errorf("contentsignature.Marshal: unfinished cannot be encoded")
+		return nil, fmt.Errorf("contentsignature.Marshal: unfinished cannot be encoded")
 	}
 	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE && sig.Len != P521ECDSABYTESIZE {
-		return "", fmt.Errorf("contentsignature.Marshal: invalid signature length %d", sig.Len)
+		return nil, fmt.Errorf("contentsignature.Marshal: invalid signature length %d", sig.Len)
 	}
 	// write R and S into a slice of len
 	// both R and S are zero-padded to the left to be exactly
@@ -58,25 +84,16 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 	rs := make([]byte, sig.Len)
 	copy(rs[Rstart:Rend], sig.R.Bytes())
 	copy(rs[Sstart:Send], sig.S.Bytes())
-	encodedsig := base64.RawURLEncoding.EncodeToString(rs)
-	return fmt.Sprintf("%s", encodedsig), nil
+	return rs, nil
 }
 
-// Unmarshal parses a base64 url encoded content signature
-// and returns it into a ContentSignature structure that can be verified.
+// UnmarshalBinary parses the canonical R||S bytes of a content
+// signature into the receiver, determining the mode from the length the
+// same way Unmarshal does. It implements encoding.BinaryUnmarshaler.
 //
 // Note this function does not set the X5U value of a signature.
-func Unmarshal(signature string) (sig *ContentSignature, err error) {
-	if len(signature) < 30 {
-		return nil, errors.Errorf("contentsignature: signature cannot be shorter than 30 characters, got %d", len(signature))
-	}
-	// decode the actual signature into its R and S values
-	data, err := base64.RawURLEncoding.DecodeString(signature)
-	if err != nil {
-		return nil, errors.Wrap(err, "contentsignature")
-	}
+func (sig *ContentSignature) UnmarshalBinary(data []byte) error {
 	// Use the length to determine the mode
-	sig = new(ContentSignature)
 	sig.Len = len(data)
 	switch sig.Len {
 	case P256ECDSABYTESIZE:
@@ -86,7 +103,7 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 	case P521ECDSABYTESIZE:
 		sig.Mode = P521ECDSA
 	default:
-		return nil, errors.Errorf("contentsignature: unknown signature length %d", len(data))
+		return errors.Errorf("contentsignature: unknown signature length %d", len(data))
 	}
 	sig.HashName = getSignatureHash(sig.Mode)
 	// parse the signature into R and S value by splitting it in the middle
@@ -94,6 +111,27 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 	sig.R.SetBytes(data[:len(data)/2])
 	sig.S.SetBytes(data[len(data)/2:])
 	sig.Finished = true
+	return nil
+}
+
+// Unmarshal parses a base64 url encoded content signature
+// and returns it into a ContentSignature structure that can be verified.
+//
+// Note this function does not set the X5U value of a signature.
+func Unmarshal(signature string) (sig *ContentSignature, err error) {
+	if len(signature) < 30 {
+		return nil, errors.Errorf("contentsignature: signature cannot be shorter than 30 characters, got %d", len(signature))
+	}
+	// decode the actual signature into its R and S values
+	data, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignature")
+	}
+	sig = new(ContentSignature)
+	err = sig.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
 	return sig, nil
 }
 
@@ -1,15 +1,27 @@
 package contentsignaturepki // import "go.mozilla.org/autograph/signer/contentsignaturepki"
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
 	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"hash"
 	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"go.mozilla.org/autograph/database"
@@ -18,6 +30,7 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/mozlogrus"
+	"go.mozilla.org/pkcs7"
 )
 
 func init() {
@@ -41,27 +54,85 @@ const (
 	// P384ECDSABYTESIZE defines the bytes length of a P384ECDSA signature
 	P384ECDSABYTESIZE = 96
 
+	// P521ECDSA defines an ecdsa content signature on the P-521 curve
+	P521ECDSA = "p521ecdsa"
+
+	// P521ECDSABYTESIZE defines the bytes length of a P521ECDSA signature
+	P521ECDSABYTESIZE = 132
+
 	// SignaturePrefix is a string preprended to data prior to signing
 	SignaturePrefix = "Content-Signature:\x00"
 
 	// CSNameSpace is a string that contains the namespace on which
 	// content signature certificates are issued
 	CSNameSpace = ".content-signature.mozilla.org"
+
+	// DefaultValidity is the lifetime applied to end-entity certificates
+	// when no validity is configured on the signer
+	DefaultValidity = 720 * time.Hour
+
+	// NoExpiry is a sentinel validity that disables the default and
+	// issues end-entity certificates that do not expire, using the
+	// RFC 5280 no well-defined expiration date 99991231235959Z
+	NoExpiry = time.Duration(-1)
 )
 
+// dnsNameFormat matches dns names made of alphanumeric labels separated
+// by dots, with hyphens permitted inside labels
+var dnsNameFormat = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// timeNow returns the current time. It is a variable so tests can move
+// the clock near rotation boundaries
+var timeNow = time.Now
+
+// selfVerifyHash checks a freshly issued signature against the public
+// key of the end-entity that produced it, see the SelfVerify option. It
+// is a variable so tests can simulate a corrupted signer.
+var selfVerifyHash = func(sig *ContentSignature, hash []byte, pub *ecdsa.PublicKey) bool {
+	return sig.VerifyHash(hash, pub)
+}
+
+// makeEELabel derives the label of a new end-entity from the signer ID
+// and the time of generation, following the format
+// `<signer id>-<generation time as UTC yyyymmddhhmmss>`, so operators
+// can map a label found in the hsm or database back to its signer and
+// generation date. It is a variable so tests can install a
+// deterministic generator and assert exact labels.
+var makeEELabel = func(signerID string, now time.Time) string {
+	return fmt.Sprintf("%s-%s", signerID, now.UTC().Format("20060102150405"))
+}
+
 // ContentSigner implements an issuer of content signatures
 type ContentSigner struct {
 	signer.Configuration
 	issuerPriv, eePriv  crypto.PrivateKey
 	issuerPub, eePub    crypto.PublicKey
 	eeLabel             string
+	eeExpiry            time.Time
+	eeNamespace         string
+	eeCurveEncoding     string
 	rand                io.Reader
 	validity            time.Duration
+	rotationThreshold   time.Duration
 	clockSkewTolerance  time.Duration
 	chainUploadLocation string
+	chainCacheFile      string
 	chain               string
 	caCert              string
 	db                  *database.Handler
+	httpClient          *http.Client
+
+	// eeMu guards the end-entity state of the signer: eeLabel, eePriv,
+	// eePub, eeExpiry, X5U and chain. Handler goroutines share one
+	// signer, so the signing paths hold it for reading and rotations
+	// hold it for writing, ensuring a signature is never issued under a
+	// half-swapped key/chain pair. The pg advisory lock only serializes
+	// rotations across processes, not within one
+	eeMu sync.RWMutex
+
+	// conf is a copy of the configuration the signer was initialized
+	// with, kept around for lifecycle operations like issuer rotation
+	conf signer.Configuration
 }
 
 // New initializes a ContentSigner using a signer configuration
@@ -73,10 +144,34 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	s.PublicKey = conf.PublicKey
 	s.X5U = conf.X5U
 	s.validity = conf.Validity
+	s.rotationThreshold = conf.RotationThreshold
 	s.clockSkewTolerance = conf.ClockSkewTolerance
 	s.chainUploadLocation = conf.ChainUploadLocation
+	s.chainCacheFile = conf.ChainCacheFile
 	s.caCert = conf.CaCert
 	s.db = conf.DB
+	s.httpClient = conf.HTTPClient
+	s.conf = conf
+	s.AuditHook = conf.AuditHook
+
+	// private deployments can issue end-entities under their own
+	// namespace, the default is the mozilla content signature one
+	s.eeNamespace = conf.EENamespace
+	if s.eeNamespace == "" {
+		s.eeNamespace = CSNameSpace
+	}
+
+	// picky verifiers can request explicit curve parameters in
+	// end-entity certificates, the default is a named curve OID
+	s.eeCurveEncoding = conf.EECurveEncoding
+	switch s.eeCurveEncoding {
+	case "":
+		s.eeCurveEncoding = CurveEncodingNamed
+	case CurveEncodingNamed, CurveEncodingExplicit:
+	default:
+		return nil, errors.Errorf("contentsignaturepki: invalid ee curve encoding %q, must be %q or %q",
+			s.eeCurveEncoding, CurveEncodingNamed, CurveEncodingExplicit)
+	}
 
 	if conf.Type != Type {
 		return nil, errors.Errorf("contentsignaturepki: invalid type %q, must be %q", conf.Type, Type)
@@ -91,10 +186,14 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "contentsignaturepki: failed to get keys and rand for signer %q", conf.ID)
 	}
-	// if validity is undef, default to 30 days
-	if s.validity == 0 {
+	// if validity is undef, default to 30 days. a negative validity is
+	// a sentinel that disables expiry of end-entity certificates
+	switch {
+	case s.validity == 0:
 		log.Printf("contentsignaturepki: no validity configured for signer %s, defaulting to 30 days", s.ID)
-		s.validity = 720 * time.Hour
+		s.validity = DefaultValidity
+	case s.validity < 0:
+		log.Printf("contentsignaturepki: expiry disabled for signer %s, end-entity certs will not expire", s.ID)
 	}
 
 	switch s.issuerPub.(type) {
@@ -103,12 +202,25 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 		return nil, errors.New("contentsignaturepki: invalid public key type for issuer, must be ecdsa")
 	}
 	s.Mode = s.getModeFromCurve()
+	s.AllowedSigAlgs = conf.AllowedSigAlgs
+	if !conf.IsAllowedSigAlg(s.Mode) {
+		return nil, errors.Errorf("contentsignaturepki: signature mode %q is not allowed by the configuration of signer %q", s.Mode, s.ID)
+	}
+
+	// the common name of issued end-entities must look like a legal
+	// dns name, or clients will refuse the certificates
+	cn := s.ID + s.eeNamespace
+	if len(cn) > 253 || !dnsNameFormat.MatchString(cn) {
+		return nil, errors.Errorf("contentsignaturepki: common name %q for signer %q is not a valid dns name", cn, s.ID)
+	}
 
 	// the end-entity key is not stored in configuration but may already
 	// exist in an hsm, if present. Try to retrieve it, or make a new one.
+	// the lock is per-signer so distinct signers can generate their
+	// end-entities in parallel at startup
 	var tx *database.Transaction
 	if s.db != nil {
-		tx, err = s.db.BeginEndEntityOperations()
+		tx, err = s.db.BeginSignerEndEntityOperations(s.ID)
 		if err != nil {
 			return nil, errors.Wrap(err, "contentsignaturepki: failed to begin end-entity db operations")
 		}
@@ -116,23 +228,24 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 	err = s.findAndSetEE(conf, tx)
 	if err != nil {
 		if err == database.ErrNoSuitableEEFound {
-			log.Printf("contentsignaturepki: making new end-entity for signer %q", s.ID)
+			corrID := signer.MakeCorrelationID()
+			log.Printf("contentsignaturepki: making new end-entity for signer %q (correlation id %s)", s.ID, corrID)
 			// create a label and generate the key
-			s.eeLabel = fmt.Sprintf("%s-%s", s.ID, time.Now().UTC().Format("20060102150405"))
+			s.eeLabel = makeEELabel(s.ID, time.Now())
 			s.eePriv, s.eePub, err = conf.MakeKey(s.issuerPub, s.eeLabel)
 			if err != nil {
-				err = errors.Wrap(err, "failed to generate key for end entity")
+				err = errors.Wrapf(err, "failed to generate key for end entity (correlation id %s)", corrID)
 				return
 			}
 			// make the certificate and upload the chain
-			err = s.makeAndUploadChain()
+			err = s.makeAndUploadChain(eeValidity{})
 			if err != nil {
-				return nil, errors.Wrap(err, "contentsignaturepki: failed to make chain and x5u for end-entity")
+				return nil, errors.Wrapf(err, "contentsignaturepki: failed to make chain and x5u for end-entity (correlation id %s)", corrID)
 			}
 			if tx != nil {
 				// insert it in database
 				hsmHandle := signer.GetPrivKeyHandle(s.eePriv)
-				err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, hsmHandle)
+				err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, s.Mode, hsmHandle)
 				if err != nil {
 					return nil, errors.Wrap(err, "contentsignaturepki: failed to insert new EE into database")
 				}
@@ -144,10 +257,13 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 
 	// check if we already have a valid x5u, and if not make a new chain,
 	// upload it and re-verify
-	_, err = GetX5U(s.X5U)
+	certs, err := s.getX5U(s.X5U)
 	if err != nil {
 		return nil, errors.Wrap(err, "contentsignaturepki: failed to verify x5u")
 	}
+	// keep the expiry of the active end-entity around so the signing
+	// path can refuse to issue signatures about to go stale
+	s.eeExpiry = certs[0].NotAfter
 	if tx != nil {
 		err = tx.End()
 		if err != nil {
@@ -159,6 +275,8 @@ func New(conf signer.Configuration) (s *ContentSigner, err error) {
 
 // Config returns the configuration of the current signer
 func (s *ContentSigner) Config() signer.Configuration {
+	s.eeMu.RLock()
+	defer s.eeMu.RUnlock()
 	return signer.Configuration{
 		ID:                  s.ID,
 		Type:                s.Type,
@@ -167,22 +285,339 @@ func (s *ContentSigner) Config() signer.Configuration {
 		PublicKey:           s.PublicKey,
 		X5U:                 s.X5U,
 		Validity:            s.validity,
+		RotationThreshold:   s.rotationThreshold,
 		ClockSkewTolerance:  s.clockSkewTolerance,
 		ChainUploadLocation: s.chainUploadLocation,
+		ChainCacheFile:      s.chainCacheFile,
 		CaCert:              s.caCert,
+		EENamespace:         s.eeNamespace,
+		EECurveEncoding:     s.eeCurveEncoding,
+	}
+}
+
+// ChainInfo describes the certificate chain of the active end-entity
+// of a signer, so operators can introspect the minted certificates
+// without fetching the x5u location
+type ChainInfo struct {
+	// Chain is the full PEM chain: end-entity, intermediate and root
+	Chain string `json:"chain"`
+
+	// CaCert is the PEM certificate of the root of the pki
+	CaCert string `json:"cacert"`
+
+	// EELabel is the label of the active end-entity key
+	EELabel string `json:"ee_label"`
+
+	// EEExpiry is the expiry of the active end-entity certificate,
+	// which monitoring can use to warn ahead of a rotation
+	EEExpiry time.Time `json:"ee_expiry"`
+}
+
+// ChainInfo returns the certificate chain of the active end-entity of
+// the signer. A chain minted by this process is returned directly, a
+// chain reused from a previous run is fetched from the x5u location
+// once and kept around.
+func (s *ContentSigner) ChainInfo() (ChainInfo, error) {
+	// the chain is fetched lazily, so the lock is taken for writing
+	s.eeMu.Lock()
+	defer s.eeMu.Unlock()
+	if s.chain == "" {
+		body, err := fetchX5U(s.X5U)
+		if err != nil {
+			return ChainInfo{}, errors.Wrapf(err, "contentsignaturepki: failed to fetch chain of signer %q", s.ID)
+		}
+		s.chain = string(body)
+	}
+	return ChainInfo{
+		Chain:    s.chain,
+		CaCert:   s.caCert,
+		EELabel:  s.eeLabel,
+		EEExpiry: s.eeExpiry,
+	}, nil
+}
+
+// CheckHealth verifies the end-entity key of the signer is loaded, its
+// x5u is retrievable and the end-entity certificate is not close to
+// expiry
+func (s *ContentSigner) CheckHealth() error {
+	s.eeMu.RLock()
+	eePriv, x5u := s.eePriv, s.X5U
+	s.eeMu.RUnlock()
+	if eePriv == nil {
+		return errors.New("contentsignaturepki: end-entity key is not loaded")
 	}
+	certs, err := s.getX5U(x5u)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to retrieve x5u")
+	}
+	if time.Now().Add(15 * 24 * time.Hour).After(certs[0].NotAfter) {
+		return errors.Errorf("contentsignaturepki: end-entity certificate expires in less than 15 days: notAfter=%s",
+			certs[0].NotAfter)
+	}
+	return nil
 }
 
 // SignData takes input data, templates it, hashes it and signs it.
 // The returned signature is of type ContentSignature and ready to be Marshalled.
-func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Signature, error) {
+func (s *ContentSigner) SignData(input []byte, options interface{}) (sig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, input, err) }()
 	if len(input) < 10 {
+		signer.Metrics().IncSignError(Type, s.Mode, "input")
 		return nil, errors.Errorf("contentsignaturepki: refusing to sign input data shorter than 10 bytes")
 	}
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to get options")
+	}
+	if opt.CorrelationID == "" {
+		opt.CorrelationID = signer.MakeCorrelationID()
+	}
+	switch opt.InputEncoding {
+	case "":
+		// the default input encoding is raw bytes
+	case InputEncodingBase64:
+		decoded, decErr := base64.StdEncoding.DecodeString(string(input))
+		if decErr != nil {
+			signer.Metrics().IncSignError(Type, s.Mode, "input_encoding")
+			return nil, errors.Wrapf(decErr, "contentsignaturepki: failed to decode base64 input (correlation id %s)", opt.CorrelationID)
+		}
+		input = decoded
+	default:
+		return nil, errors.Errorf("contentsignaturepki: invalid input encoding %q, must be %q (correlation id %s)",
+			opt.InputEncoding, InputEncodingBase64, opt.CorrelationID)
+	}
+	// a signature issued by an end-entity within clock skew tolerance
+	// of expiry would be dead on arrival by the time clients use it
+	s.eeMu.RLock()
+	eeExpiry := s.eeExpiry
+	s.eeMu.RUnlock()
+	if !eeExpiry.IsZero() && timeNow().Add(s.clockSkewTolerance).After(eeExpiry) {
+		signer.Metrics().IncSignError(Type, s.Mode, "ee_expiry")
+		return nil, errors.Errorf("contentsignaturepki: end-entity of signer %q expires %s, refusing to issue a dead-on-arrival signature (correlation id %s)",
+			s.ID, eeExpiry.UTC().Format(time.RFC3339), opt.CorrelationID)
+	}
+	if bytes.HasPrefix(input, []byte(SignaturePrefix)) {
+		switch opt.PrefixHandling {
+		case PrefixHandlingStrict:
+			signer.Metrics().IncSignError(Type, s.Mode, "templated_input")
+			return nil, errors.Errorf("contentsignaturepki: input data already starts with the signature prefix (correlation id %s)", opt.CorrelationID)
+		case PrefixHandlingSkip:
+			input = input[len(SignaturePrefix):]
+		default:
+			log.Warnf("contentsignaturepki: input data of signer %q already starts with the signature prefix, templating it again (correlation id %s)", s.ID, opt.CorrelationID)
+		}
+	}
+	log.Infof("contentsignaturepki: signing data with signer %q (correlation id %s)", s.ID, opt.CorrelationID)
 	alg, hash := MakeTemplatedHash(input, s.Mode)
-	sig, err := s.SignHash(hash, options)
+	// sign and self-verify under the read side of the end-entity lock,
+	// so a rotation in another goroutine cannot swap the key between
+	// the two. The lock cannot be held across RotateEE, which takes the
+	// write side
+	s.eeMu.RLock()
+	sig, err = s.signHash(hash, opt)
+	if err != nil {
+		s.eeMu.RUnlock()
+		return nil, err
+	}
 	sig.(*ContentSignature).storeHashName(alg)
-	return sig, err
+	selfVerified := !opt.SelfVerify || selfVerifyHash(sig.(*ContentSignature), hash, s.eePub.(*ecdsa.PublicKey))
+	eeLabel := s.eeLabel
+	s.eeMu.RUnlock()
+	if !selfVerified {
+		// a signature that fails against its own key indicates hsm or
+		// key corruption: rotate the suspect end-entity and retry once
+		// rather than continuing to emit bad signatures
+		signer.Metrics().IncSignError(Type, s.Mode, "self_verify")
+		log.Errorf("contentsignaturepki: signature from signer %q failed self-verification, rotating suspect end-entity %q (correlation id %s)",
+			s.ID, eeLabel, opt.CorrelationID)
+		err = s.RotateEE(s.rotationBounds(opt))
+		if err != nil {
+			return nil, errors.Wrapf(err, "contentsignaturepki: failed to rotate suspect end-entity (correlation id %s)", opt.CorrelationID)
+		}
+		s.eeMu.RLock()
+		sig, err = s.signHash(hash, opt)
+		if err != nil {
+			s.eeMu.RUnlock()
+			return nil, err
+		}
+		sig.(*ContentSignature).storeHashName(alg)
+		selfVerified = selfVerifyHash(sig.(*ContentSignature), hash, s.eePub.(*ecdsa.PublicKey))
+		s.eeMu.RUnlock()
+		if !selfVerified {
+			signer.Metrics().IncSignError(Type, s.Mode, "self_verify")
+			return nil, errors.Errorf("contentsignaturepki: signature still fails self-verification after rotating the end-entity of signer %q (correlation id %s)",
+				s.ID, opt.CorrelationID)
+		}
+	}
+	if opt.DetachedCMS {
+		s.eeMu.RLock()
+		cms, err := s.makeDetachedCMS(input, opt)
+		s.eeMu.RUnlock()
+		if err != nil {
+			signer.Metrics().IncSignError(Type, s.Mode, "cms")
+			return nil, err
+		}
+		sig.(*ContentSignature).CMS = cms
+	}
+	return sig, nil
+}
+
+// rotationBounds converts the EENotBefore signing option into explicit
+// validity bounds for an end-entity rotation, deriving the expiry from
+// the signer validity the same way New does. A zero EENotBefore returns
+// empty bounds, which rotate with the default skew-backdated window.
+func (s *ContentSigner) rotationBounds(opt Options) RotateEEOptions {
+	if opt.EENotBefore.IsZero() {
+		return RotateEEOptions{}
+	}
+	return RotateEEOptions{
+		NotBefore: opt.EENotBefore,
+		NotAfter:  opt.EENotBefore.Add(s.validity + s.clockSkewTolerance),
+	}
+}
+
+// SignDataWithManifest behaves like SignData and additionally returns
+// a manifest entry of the form
+//
+//	<filename> <hash algorithm> <hex templated hash> <marshalled signature>
+//
+// ready to append to a signatures file, so clients packaging signed
+// content do not reassemble the entry themselves. The hash of the entry
+// is verified against the signature before returning, guaranteeing the
+// manifest never drifts from what was actually signed.
+func (s *ContentSigner) SignDataWithManifest(input []byte, filename string, options interface{}) (signer.Signature, string, error) {
+	if filename == "" || strings.ContainsAny(filename, " \t\r\n") {
+		return nil, "", errors.Errorf("contentsignaturepki: invalid manifest filename %q, must be non-empty without whitespace", filename)
+	}
+	sig, err := s.SignData(input, options)
+	if err != nil {
+		return nil, "", err
+	}
+	csig := sig.(*ContentSignature)
+	sigstr, err := csig.Marshal()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "contentsignaturepki: failed to marshal signature for manifest")
+	}
+	alg, hash := MakeTemplatedHash(input, s.Mode)
+	s.eeMu.RLock()
+	eePub := s.eePub
+	s.eeMu.RUnlock()
+	if !csig.VerifyHash(hash, eePub.(*ecdsa.PublicKey)) {
+		// signing options that transform the input, like base64
+		// decoding, make the manifest hash unverifiable
+		return nil, "", errors.Errorf("contentsignaturepki: signature of %q does not cover the manifest hash, cannot build a manifest entry from transformed input", filename)
+	}
+	entry := fmt.Sprintf("%s %s %s %s", filename, alg, hex.EncodeToString(hash), sigstr)
+	return sig, entry, nil
+}
+
+// makeDetachedCMS signs the templated input a second time and wraps the
+// result in a detached PKCS#7/CMS SignedData structure embedding the
+// certificate chain of the signer, for verifiers that consume CMS
+// rather than the compact content signature format
+func (s *ContentSigner) makeDetachedCMS(input []byte, opt Options) ([]byte, error) {
+	templated := make([]byte, len(SignaturePrefix)+len(input))
+	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
+	copy(templated[len(SignaturePrefix):], input)
+
+	certs, err := s.getX5U(s.X5U)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to retrieve x5u to build cms")
+	}
+	toBeSigned, err := pkcs7.NewSignedData(templated)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki: failed to initialize cms signed data (correlation id %s)", opt.CorrelationID)
+	}
+	switch s.Mode {
+	case P384ECDSA:
+		toBeSigned.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA384)
+	default:
+		toBeSigned.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	}
+	// the end-entity signs, the issuer and root ride along in the
+	// certificates field so verifiers can rebuild the chain
+	err = toBeSigned.AddSignerChain(certs[0], s.eePriv, certs[1:], pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki: failed to sign cms (correlation id %s)", opt.CorrelationID)
+	}
+	toBeSigned.Detach()
+	cms, err := toBeSigned.Finish()
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki: failed to finalize cms (correlation id %s)", opt.CorrelationID)
+	}
+	return cms, nil
+}
+
+// SignatureBundle is a single distributable artifact combining a
+// detached content signature with the certificate chain that verifies
+// it. The chain is packaged as a PKCS#7 certs-only structure (p7b) so
+// standard tools can import it, and the signature keeps the compact
+// content signature encoding
+type SignatureBundle struct {
+	Mode      string `json:"mode"`
+	SignerID  string `json:"signer_id"`
+	Signature string `json:"signature"`
+	P7B       []byte `json:"p7b"`
+}
+
+// MakeSignatureBundle signs input data and packages the resulting
+// detached signature with the certificate chain of the signer into a
+// single json encoded SignatureBundle, so clients can verify with one
+// artifact instead of fetching the chain separately
+func (s *ContentSigner) MakeSignatureBundle(input []byte, options interface{}) ([]byte, error) {
+	sig, err := s.SignData(input, options)
+	if err != nil {
+		return nil, err
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to marshal signature for bundle")
+	}
+	s.eeMu.RLock()
+	x5u := s.X5U
+	s.eeMu.RUnlock()
+	certs, err := s.getX5U(x5u)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to retrieve x5u to build bundle")
+	}
+	var chainDER []byte
+	for _, cert := range certs {
+		chainDER = append(chainDER, cert.Raw...)
+	}
+	p7b, err := pkcs7.DegenerateCertificate(chainDER)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to build certs-only pkcs7 for bundle")
+	}
+	return json.Marshal(SignatureBundle{
+		Mode:      s.Mode,
+		SignerID:  s.ID,
+		Signature: sigstr,
+		P7B:       p7b,
+	})
+}
+
+// VerifyBundle unpacks a json encoded SignatureBundle, validates the
+// certificate chain embedded in its p7b and verifies the signature on
+// the input data using the end-entity of the chain
+func VerifyBundle(bundle, input []byte) error {
+	var b SignatureBundle
+	err := json.Unmarshal(bundle, &b)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse signature bundle")
+	}
+	p7, err := pkcs7.Parse(b.P7B)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse certs-only pkcs7 of signature bundle")
+	}
+	var chainPEM []byte
+	for _, cert := range p7.Certificates {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	certs, err := ParseChain(chainPEM)
+	if err != nil {
+		return err
+	}
+	return verifyWithCerts(certs, b.Signature, input, VerifyOptions{})
 }
 
 // MakeTemplatedHash returns the templated sha384 of the input data. The template adds
@@ -191,14 +626,24 @@ func (s *ContentSigner) SignData(input []byte, options interface{}) (signer.Sign
 //
 // The name of the hash function is returned, followed by the hash bytes
 func MakeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
-	templated := make([]byte, len(SignaturePrefix)+len(data))
-	copy(templated[:len(SignaturePrefix)], []byte(SignaturePrefix))
-	copy(templated[len(SignaturePrefix):], data)
+	return MakeTemplatedHashWithPrefix(data, SignaturePrefix, curvename)
+}
+
+// MakeTemplatedHashWithPrefix behaves like MakeTemplatedHash with a
+// custom prefix instead of the standard SignaturePrefix, for verifiers
+// migrating between prefixes
+func MakeTemplatedHashWithPrefix(data []byte, prefix, curvename string) (alg string, out []byte) {
+	templated := make([]byte, len(prefix)+len(data))
+	copy(templated[:len(prefix)], []byte(prefix))
+	copy(templated[len(prefix):], data)
 	var md hash.Hash
 	switch curvename {
 	case P384ECDSA:
 		md = sha512.New384()
 		alg = "sha384"
+	case P521ECDSA:
+		md = sha512.New()
+		alg = "sha512"
 	default:
 		md = sha256.New()
 		alg = "sha256"
@@ -210,10 +655,43 @@ func MakeTemplatedHash(data []byte, curvename string) (alg string, out []byte) {
 // SignHash takes an input hash and returns a signature. It assumes the input data
 // has already been hashed with something like sha384
 func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Signature, error) {
+	s.eeMu.RLock()
+	defer s.eeMu.RUnlock()
+	return s.signHash(input, options)
+}
+
+// signHash implements SignHash and expects the caller to hold the
+// end-entity lock for reading
+func (s *ContentSigner) signHash(input []byte, options interface{}) (signer.Signature, error) {
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to get options")
+	}
+	// an oversized digest, e.g. a sha512 for a p-256 key, is truncated
+	// to the field size of the curve by keeping its leftmost bytes, per
+	// FIPS 186-4 section 6.4. ECDSA verifiers apply the same truncation
+	// internally, so the resulting signature verifies against the full
+	// digest as well as the truncated one
+	if opt.TruncateHash && len(input) > getSignatureLen(s.Mode)/2 {
+		input = input[:getSignatureLen(s.Mode)/2]
+	}
 	if len(input) != 32 && len(input) != 48 && len(input) != 64 {
 		return nil, errors.Errorf("contentsignaturepki: refusing to sign input hash. length %d, expected 32, 48 or 64", len(input))
 	}
-	var err error
+	if opt.CorrelationID == "" {
+		opt.CorrelationID = signer.MakeCorrelationID()
+	}
+	if opt.ExpectedKeyFingerprint != "" {
+		fingerprint, err := s.keyFingerprint()
+		if err != nil {
+			return nil, err
+		}
+		if !constantTimeEqualFold(opt.ExpectedKeyFingerprint, fingerprint) {
+			signer.Metrics().IncSignError(Type, s.Mode, "key_fingerprint_mismatch")
+			return nil, errors.Errorf("contentsignaturepki: active key fingerprint %q does not match expected fingerprint %q (correlation id %s)",
+				fingerprint, opt.ExpectedKeyFingerprint, opt.CorrelationID)
+		}
+	}
 	csig := new(ContentSignature)
 	csig = &ContentSignature{
 		Len:  getSignatureLen(s.Mode),
@@ -221,22 +699,162 @@ func (s *ContentSigner) SignHash(input []byte, options interface{}) (signer.Sign
 		X5U:  s.X5U,
 		ID:   s.ID,
 	}
+	if opt.IncludeEELabel {
+		csig.EELabel = s.eeLabel
+	}
+	if opt.IncludeRootHash {
+		rootHash, err := s.rootHash()
+		if err != nil {
+			return nil, err
+		}
+		csig.RootHash = rootHash
+	}
+	if opt.SignatureValidity > 0 {
+		csig.ExpiresAt = timeNow().Add(opt.SignatureValidity).UTC()
+	}
 
-	asn1Sig, err := s.eePriv.(crypto.Signer).Sign(rand.Reader, input, nil)
+	start := time.Now()
+	sigBytes, err := s.eePriv.(crypto.Signer).Sign(rand.Reader, input, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "contentsignaturepki: failed to sign hash")
+		signer.Metrics().IncSignError(Type, s.Mode, "sign")
+		return nil, errors.Wrapf(err, "contentsignaturepki: failed to sign hash (correlation id %s)", opt.CorrelationID)
 	}
-	var ecdsaSig ecdsaAsn1Signature
-	_, err = asn1.Unmarshal(asn1Sig, &ecdsaSig)
+	csig.R, csig.S, err = parseSignatureOutput(sigBytes, csig.Len)
 	if err != nil {
+		signer.Metrics().IncSignError(Type, s.Mode, "parse_signature")
 		return nil, errors.Wrap(err, "contentsignaturepki: failed to parse signature")
 	}
-	csig.R = ecdsaSig.R
-	csig.S = ecdsaSig.S
 	csig.Finished = true
+	signer.Metrics().IncSignSuccess(Type, s.Mode)
+	signer.Metrics().ObserveSignDuration(Type, s.Mode, time.Since(start))
 	return csig, nil
 }
 
+// rootHash returns the hex encoded sha256 of the der form of the root
+// certificate of the signer pki, in the format monitoring clients use
+// to pin the expected root
+func (s *ContentSigner) rootHash() (string, error) {
+	block, _ := pem.Decode([]byte(s.caCert))
+	if block == nil {
+		return "", errors.Errorf("contentsignaturepki: failed to parse root certificate of signer %q", s.ID)
+	}
+	h := sha256.Sum256(block.Bytes)
+	return fmt.Sprintf("%X", h[:]), nil
+}
+
+// parseSignatureOutput normalizes the output of the underlying
+// crypto.Signer into R and S values. Most signers return an ASN.1 DER
+// sequence, but some HSMs return the raw concatenation of r and s,
+// which is detected by its length of exactly sigLen bytes
+func parseSignatureOutput(output []byte, sigLen int) (r, s *big.Int, err error) {
+	var ecdsaSig ecdsaAsn1Signature
+	_, asn1Err := asn1.Unmarshal(output, &ecdsaSig)
+	if asn1Err == nil {
+		return ecdsaSig.R, ecdsaSig.S, nil
+	}
+	if len(output) == sigLen {
+		r = new(big.Int).SetBytes(output[:sigLen/2])
+		s = new(big.Int).SetBytes(output[sigLen/2:])
+		return r, s, nil
+	}
+	return nil, nil, errors.Wrap(asn1Err, "signature output is neither valid der nor raw r||s")
+}
+
+// KeyFingerprint returns the hex encoded sha256 of the pkix der form of
+// the active end-entity public key of the signer, suitable for clients
+// that pin the exact key expected to sign their requests
+func (s *ContentSigner) KeyFingerprint() (string, error) {
+	s.eeMu.RLock()
+	defer s.eeMu.RUnlock()
+	return s.keyFingerprint()
+}
+
+// keyFingerprint implements KeyFingerprint and expects the caller to
+// hold the end-entity lock for reading
+func (s *ContentSigner) keyFingerprint() (string, error) {
+	pubBytes, err := x509.MarshalPKIXPublicKey(s.eePub)
+	if err != nil {
+		return "", errors.Wrap(err, "contentsignaturepki: failed to marshal end-entity public key")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(pubBytes)), nil
+}
+
+// TrustedFingerprints returns the hex encoded sha256 fingerprints of
+// the end-entity public keys a client of this signer may encounter: the
+// active one, plus the keys of end-entities recently retired but still
+// within their validity. Pinning clients poll this to refresh their pin
+// set ahead of a rotation. Without a database, only the active
+// end-entity is known.
+func (s *ContentSigner) TrustedFingerprints() ([]string, error) {
+	active, err := s.KeyFingerprint()
+	if err != nil {
+		return nil, err
+	}
+	fingerprints := []string{active}
+	if s.db == nil {
+		return fingerprints, nil
+	}
+	x5us, err := s.db.GetRecentX5UsForSigner(s.ID, s.validity)
+	if err != nil {
+		return nil, errors.Wrapf(err, "contentsignaturepki: failed to list recent end-entities of signer %q", s.ID)
+	}
+	retired, err := fingerprintX5Us(x5us)
+	if err != nil {
+		return nil, err
+	}
+	for _, fp := range retired {
+		if !constantTimeEqual(fp, active) {
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	return fingerprints, nil
+}
+
+// fingerprintX5Us fetches each chain and returns the hex encoded
+// sha256 fingerprints of their end-entity public keys, deduplicated
+// and in order
+func fingerprintX5Us(x5us []string) (fingerprints []string, err error) {
+	seen := make(map[string]bool)
+	for _, x5u := range x5us {
+		certs, err := GetX5U(x5u)
+		if err != nil {
+			return nil, errors.Wrapf(err, "contentsignaturepki: failed to fetch chain of end-entity at %q", x5u)
+		}
+		pubBytes, err := x509.MarshalPKIXPublicKey(certs[0].PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "contentsignaturepki: failed to marshal end-entity public key")
+		}
+		fp := fmt.Sprintf("%x", sha256.Sum256(pubBytes))
+		if seen[fp] {
+			continue
+		}
+		seen[fp] = true
+		fingerprints = append(fingerprints, fp)
+	}
+	return fingerprints, nil
+}
+
+// SignHexHash takes a hex encoded hash, decodes it and validates its
+// length, then delegates signing to SignHash. It exists for HTTP clients
+// that prefer sending hex encoded digests over raw bytes.
+func (s *ContentSigner) SignHexHash(hexDigest string, options interface{}) (signer.Signature, error) {
+	input, err := hex.DecodeString(hexDigest)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to decode hex digest")
+	}
+	opt, err := GetOptions(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "contentsignaturepki: failed to get options")
+	}
+	// oversized digests are handled by SignHash when truncation is
+	// requested, otherwise the length is validated here to reject bad
+	// digests before signing
+	if !opt.TruncateHash && len(input) != 32 && len(input) != 48 && len(input) != 64 {
+		return nil, errors.Errorf("contentsignaturepki: refusing to sign input hash. length %d, expected 32, 48 or 64", len(input))
+	}
+	return s.SignHash(input, options)
+}
+
 // getSignatureLen returns the size of an ECDSA signature issued by the signer,
 // or -1 if the mode is unknown
 //
@@ -249,6 +867,8 @@ func getSignatureLen(mode string) int {
 		return P256ECDSABYTESIZE
 	case P384ECDSA:
 		return P384ECDSABYTESIZE
+	case P521ECDSA:
+		return P521ECDSABYTESIZE
 	}
 	return -1
 }
@@ -261,6 +881,8 @@ func getSignatureHash(mode string) string {
 		return "sha256"
 	case P384ECDSA:
 		return "sha384"
+	case P521ECDSA:
+		return "sha512"
 	}
 	return ""
 }
@@ -272,36 +894,703 @@ func (s *ContentSigner) getModeFromCurve() string {
 		return P256ECDSA
 	case "P-384":
 		return P384ECDSA
+	case "P-521":
+		return P521ECDSA
 	default:
 		return ""
 	}
 }
 
-// GetDefaultOptions returns nil because this signer has no option
+// Options accepts a correlation id used to tie together the log lines of
+// a single signing request across the service, HSM and database logs
+type Options struct {
+	// CorrelationID is an identifier included in log lines and error
+	// messages to correlate a signing request across systems. If empty,
+	// the signer generates one.
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// ExpectedKeyFingerprint is the hex encoded sha256 of the pkix der
+	// form of the end-entity public key the client expects to sign its
+	// request. When set, the signer refuses to sign if its active key
+	// differs, protecting pinned clients against a silent rotation.
+	ExpectedKeyFingerprint string `json:"expected_key_fingerprint,omitempty"`
+
+	// PrefixHandling controls what happens when the input data already
+	// starts with the signature prefix, which usually means the client
+	// templated it by accident. The default is PrefixHandlingWarn.
+	PrefixHandling string `json:"prefix_handling,omitempty"`
+
+	// IncludeEELabel requests the label of the end-entity key that
+	// issued the signature in the response, so support cases can be
+	// triaged against the endentities table
+	IncludeEELabel bool `json:"include_ee_label,omitempty"`
+
+	// IncludeRootHash requests the hex encoded sha256 of the root
+	// certificate of the signer pki in the response, so clients can
+	// verify the chain terminates in the root they pin without
+	// fetching it separately
+	IncludeRootHash bool `json:"include_root_hash,omitempty"`
+
+	// DetachedCMS requests an additional detached PKCS#7/CMS SignedData
+	// structure over the templated input, embedding the certificate
+	// chain of the signer, for verifiers that consume CMS rather than
+	// the compact content signature format. The structure is stored in
+	// the CMS field of the returned signature.
+	DetachedCMS bool `json:"detached_cms,omitempty"`
+
+	// TruncateHash accepts an input hash larger than the field size of
+	// the signer curve and truncates it to the leftmost field size
+	// bytes before signing, per FIPS 186-4 section 6.4. The default is
+	// to reject input hashes whose length doesn't match a supported
+	// digest algorithm.
+	TruncateHash bool `json:"truncate_hash,omitempty"`
+
+	// InputEncoding declares how the input data is encoded. The default
+	// is raw bytes, InputEncodingBase64 makes the signer decode the
+	// input before templating it, for clients that carry their payloads
+	// base64 encoded and would otherwise decode them first.
+	InputEncoding string `json:"input_encoding,omitempty"`
+
+	// SignatureValidity declares how long the signature is intended to
+	// be honored, independent of the validity of the certificate chain.
+	// When positive, the deadline is stored in the ExpiresAt field of
+	// the returned signature as metadata for verifiers that enforce
+	// application-level freshness. The default is no deadline.
+	SignatureValidity time.Duration `json:"signature_validity,omitempty"`
+
+	// SelfVerify requests verification of the produced signature
+	// against the active end-entity key before it is returned. A
+	// signature that fails its own verification indicates hsm or key
+	// corruption: the end-entity is marked suspect, rotated, and the
+	// signing retried once.
+	SelfVerify bool `json:"self_verify,omitempty"`
+
+	// EENotBefore pins the notBefore time of an end-entity minted
+	// while processing the signing request, such as the rotation
+	// triggered by a failed self-verify, so re-issued chains can
+	// reproduce the validity window of an existing one. The expiry
+	// derives from the signer validity like it does at startup. When
+	// unset, the end-entity is backdated by the clock skew tolerance
+	// of the signer, preserving the default behavior.
+	EENotBefore time.Time `json:"ee_not_before,omitempty"`
+}
+
+// InputEncodingBase64 declares input data encoded with standard base64,
+// see the InputEncoding option
+const InputEncodingBase64 = "base64"
+
+const (
+	// PrefixHandlingWarn logs a warning when the input already starts
+	// with the signature prefix and signs it as-is, templating it again
+	PrefixHandlingWarn = "warn"
+
+	// PrefixHandlingStrict rejects input that already starts with the
+	// signature prefix
+	PrefixHandlingStrict = "strict"
+
+	// PrefixHandlingSkip signs input that already starts with the
+	// signature prefix without adding another prefix
+	PrefixHandlingSkip = "skip"
+)
+
+// GetDefaultOptions returns default options of the signer
 func (s *ContentSigner) GetDefaultOptions() interface{} {
-	return nil
+	return Options{}
+}
+
+// GetOptions takes a input interface and reflects it into a struct of options
+func GetOptions(input interface{}) (options Options, err error) {
+	buf, err := json.Marshal(input)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(buf, &options)
+	return
+}
+
+// Sentinel errors identifying the step at which a verification
+// failed, carried by VerificationError. Callers that need to tell a
+// transient network failure apart from a cryptographic one branch on
+// the Step of the returned error.
+var (
+	// ErrX5URetrieval marks a failure to retrieve the chain from its
+	// x5u location, typically a transient network or hosting problem
+	ErrX5URetrieval = errors.New("failed to retrieve the chain from its x5u location")
+	// ErrChainValidation marks a chain that was retrieved but failed
+	// to decode or validate, including expired certificates and
+	// broken issuer signatures
+	ErrChainValidation = errors.New("failed to validate the certificate chain")
+	// ErrSignatureVerification marks a signature that does not verify
+	// against the end-entity of an otherwise valid chain
+	ErrSignatureVerification = errors.New("the signature does not verify against the chain")
+)
+
+// VerificationError wraps a failure of the verify path with the step
+// that failed, one of the Err sentinels of this package
+type VerificationError struct {
+	Step error
+	Err  error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Step, e.Err)
+}
+
+// Cause returns the underlying failure, following the convention of
+// github.com/pkg/errors
+func (e *VerificationError) Cause() error {
+	return e.Err
 }
 
 // Verify takes the location of a cert chain (x5u), a signature in its
 // raw base64_url format and input data. It then performs a verification
 // of the signature on the input data using the end-entity certificate
 // of the chain, and returns an error if it fails, or nil on success.
+// Failures are returned as a *VerificationError carrying the step that
+// failed.
 func Verify(x5u, signature string, input []byte) error {
-	certs, err := GetX5U(x5u)
+	return VerifyWithOptions(x5u, signature, input, VerifyOptions{})
+}
+
+// VerifyOptions controls optional behaviors of the verify path
+type VerifyOptions struct {
+	// LegacyCompat relaxes the decoding of the signature to accept
+	// the padded and standard base64 variants produced by older
+	// versions of this package. Signature verification itself
+	// remains strict
+	LegacyCompat bool
+
+	// ExpectedSignerID, when set, requires the signature to have been
+	// issued by the named signer. The check relies on the common name
+	// of the end-entity certificate, which embeds the signer ID as its
+	// first dns label, and catches misrouted or swapped responses.
+	ExpectedSignerID string
+
+	// ExpiresAt is the application-level freshness deadline conveyed
+	// alongside the signature, see the SignatureValidity signing
+	// option. When set, verification fails once the deadline has
+	// passed, regardless of the validity of the certificate chain.
+	ExpiresAt time.Time
+
+	// ExpectedRootHash, when set, requires the chain to terminate in
+	// the root certificate with the given hex encoded sha256 of its
+	// der form. Colon separated fingerprints, as monitoring
+	// configurations spell them, are accepted. The comparison ignores
+	// case
+	ExpectedRootHash string
+
+	// RequiredEKU, when set, requires the end-entity certificate to
+	// carry the given extended key usage OID, so a certificate issued
+	// for another purpose is not accepted even if it holds the right
+	// key. End-entities issued by this package carry OIDCodeSigningEKU
+	RequiredEKU asn1.ObjectIdentifier
+
+	// CandidatePrefixes, when set, replaces the standard signature
+	// prefix with a list of candidates tried in order, accepting the
+	// signature if any of them verifies it. During a prefix migration
+	// this lets a verifier accept signatures issued under both the
+	// old and the new prefix. The default is the single standard
+	// SignaturePrefix.
+	CandidatePrefixes []string
+
+	// MatchedPrefix, when non-nil, receives the candidate prefix that
+	// verified the signature, so callers can track migration progress
+	MatchedPrefix *string
+}
+
+// OIDCodeSigningEKU is the id-kp-codeSigning extended key usage carried
+// by end-entity certificates issued by this package
+var OIDCodeSigningEKU = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}
+
+// ekuOIDs maps the extended key usages the go x509 parser knows about
+// to their OIDs, for usages that could plausibly appear on a signing
+// certificate. Usages outside this map are matched via the unknown
+// usages of the certificate
+var ekuOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:             {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageCodeSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageTimeStamping:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+// hasEKU returns whether a certificate carries the given extended key
+// usage OID, whether the go x509 parser knows the usage or not
+func hasEKU(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if known, ok := ekuOIDs[eku]; ok && known.Equal(oid) {
+			return true
+		}
+	}
+	for _, unknown := range cert.UnknownExtKeyUsage {
+		if unknown.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyWithOptions behaves like Verify with additional options, for
+// consumers that need to validate archived signatures created before
+// format changes
+func VerifyWithOptions(x5u, signature string, input []byte, options VerifyOptions) error {
+	certs, err := getX5UForVerify(x5u)
+	if err != nil {
+		return err
+	}
+	err = verifyWithCerts(certs, signature, input, options)
+	if err != nil {
+		return &VerificationError{Step: ErrSignatureVerification, Err: err}
+	}
+	return nil
+}
+
+// VerifyAsOf behaves like Verify but validates the certificate chain as
+// of a given time instead of now, so archived signatures whose chain
+// has since expired can still be checked against the validity window
+// they were issued under. The signature verification itself is
+// unchanged, only the chain validity checks use the provided time.
+func VerifyAsOf(x5u, signature string, input []byte, at time.Time) error {
+	body, err := fetchX5U(x5u)
+	if err != nil {
+		return err
+	}
+	certs, err := parseChainAsOf(body, DefaultMaxChainLen, at)
+	if err != nil {
+		return err
+	}
+	return verifyWithCerts(certs, signature, input, VerifyOptions{})
+}
+
+// VerifyWithChain takes a PEM encoded certificate chain, a signature in
+// its raw base64_url format and input data. It behaves like Verify but
+// validates against the provided chain instead of fetching it from an
+// x5u location, for consumers that already hold the chain or operate
+// without network access.
+func VerifyWithChain(chainPEM []byte, signature string, input []byte) error {
+	certs, err := ParseChain(chainPEM)
+	if err != nil {
+		return err
+	}
+	return verifyWithCerts(certs, signature, input, VerifyOptions{})
+}
+
+// A Verifier validates content signatures against a fixed set of
+// trusted roots, entirely offline. It is the building block for sealed
+// verifier binaries that embed their trust anchors and cannot make
+// outbound calls: chains are provided inline instead of being fetched
+// from an x5u location, and must terminate on one of the trusted roots.
+type Verifier struct {
+	roots []*x509.Certificate
+}
+
+// NewVerifier constructs a Verifier from a concatenation of PEM encoded
+// root certificates, typically embedded in the verifier binary
+func NewVerifier(rootsPEM []byte) (*Verifier, error) {
+	v := new(Verifier)
+	rest := rootsPEM
+	for len(rest) > 0 {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		root, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse root certificate")
+		}
+		v.roots = append(v.roots, root)
+	}
+	if len(v.roots) == 0 {
+		return nil, fmt.Errorf("no root certificate found in pem input")
+	}
+	return v, nil
+}
+
+// completeChain appends the trusted root that issued the intermediate
+// of a root-less chain, so the regular chain validation can run on the
+// completed chain
+func (v *Verifier) completeChain(chainPEM []byte) ([]byte, error) {
+	block, rest := pem.Decode(chainPEM)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode ee certificate from chain")
+	}
+	block, _ = pem.Decode(rest)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode intermediate issuer certificate from chain")
+	}
+	inter, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse intermediate issuer certificate from chain")
+	}
+	for _, root := range v.roots {
+		if inter.CheckSignatureFrom(root) == nil {
+			completed := make([]byte, 0, len(chainPEM)+len(root.Raw)*2)
+			completed = append(completed, chainPEM...)
+			if len(completed) > 0 && completed[len(completed)-1] != '\n' {
+				completed = append(completed, '\n')
+			}
+			completed = append(completed, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})...)
+			return completed, nil
+		}
+	}
+	return nil, fmt.Errorf("no trusted root issued the intermediate %q of the chain", inter.Subject.CommonName)
+}
+
+// Verify takes a PEM encoded certificate chain, a signature in its raw
+// base64_url format and input data. It validates the chain, requires
+// its root to be one of the trusted roots of the verifier, then
+// verifies the signature on the input data using the end-entity
+// certificate. No network access is performed.
+//
+// Chains that omit their root, as served by x5u locations that expect
+// verifiers to supply it from their own truststore, are completed with
+// the trusted root that issued their intermediate before validation.
+func (v *Verifier) Verify(chainPEM []byte, signature string, input []byte) error {
+	if bytes.Count(chainPEM, []byte("-----BEGIN CERTIFICATE-----")) == 2 {
+		completed, err := v.completeChain(chainPEM)
+		if err != nil {
+			return err
+		}
+		chainPEM = completed
+	}
+	certs, err := ParseChain(chainPEM)
 	if err != nil {
 		return err
 	}
-	// Get the public key from the end-entity
+	root := certs[len(certs)-1]
+	trusted := false
+	for _, trustedRoot := range v.roots {
+		if bytes.Equal(trustedRoot.Raw, root.Raw) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("chain root %q is not in the trusted set", root.Subject.CommonName)
+	}
+	return verifyWithCerts(certs, signature, input, VerifyOptions{})
+}
+
+// VerifyX5U behaves like Verify but fetches the chain from an x5u
+// location first, for consumers that pin their roots but still
+// retrieve chains over the network. The x5u may omit the root
+func (v *Verifier) VerifyX5U(x5u, signature string, input []byte) error {
+	body, err := fetchX5U(x5u)
+	if err != nil {
+		return err
+	}
+	return v.Verify(body, signature, input)
+}
+
+// BatchVerifyItem is one signature of a batch verification, carrying
+// the location of its own certificate chain
+type BatchVerifyItem struct {
+	X5U       string
+	Signature string
+	Input     []byte
+	Options   VerifyOptions
+}
+
+// cachedChain holds the outcome of fetching one chain, fetched at most
+// once regardless of how many items of a batch reference it
+type cachedChain struct {
+	once  sync.Once
+	certs []*x509.Certificate
+	err   error
+}
+
+// chainCache memoizes fetched certificate chains by x5u location so a
+// batch that references the same chain many times only fetches it
+// once. It is safe for concurrent use
+type chainCache struct {
+	sync.Mutex
+	chains map[string]*cachedChain
+}
+
+func newChainCache() *chainCache {
+	return &chainCache{chains: make(map[string]*cachedChain)}
+}
+
+// get returns the parsed and validated chain at an x5u location,
+// fetching it on the first call and serving it from memory afterwards
+func (c *chainCache) get(x5u string) ([]*x509.Certificate, error) {
+	c.Lock()
+	entry, ok := c.chains[x5u]
+	if !ok {
+		entry = new(cachedChain)
+		c.chains[x5u] = entry
+	}
+	c.Unlock()
+	entry.once.Do(func() {
+		entry.certs, entry.err = GetX5U(x5u)
+	})
+	return entry.certs, entry.err
+}
+
+// VerifyBatchConcurrent verifies a batch of signatures in parallel with
+// at most maxConcurrency outstanding verifications, and therefore at
+// most that many outstanding chain fetches. Chains are fetched once per
+// distinct x5u and shared across items. The returned slice holds the
+// verification result of each item at the same index as its input
+func VerifyBatchConcurrent(items []BatchVerifyItem, maxConcurrency int) []error {
+	results := make([]error, len(items))
+	if len(items) == 0 {
+		return results
+	}
+	if maxConcurrency < 1 {
+		maxConcurrency = 1
+	}
+	if maxConcurrency > len(items) {
+		maxConcurrency = len(items)
+	}
+	cache := newChainCache()
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < maxConcurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				certs, err := cache.get(items[i].X5U)
+				if err != nil {
+					results[i] = err
+					continue
+				}
+				results[i] = verifyWithCerts(certs, items[i].Signature, items[i].Input, items[i].Options)
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+const (
+	// DefaultPositiveCacheTTL is how long a VerificationCache serves a
+	// successful verification from memory before verifying again
+	DefaultPositiveCacheTTL = 5 * time.Minute
+
+	// DefaultNegativeCacheTTL is how long a VerificationCache serves a
+	// failed verification from memory. It is much shorter than the
+	// positive TTL so a chain fixed during an outage is picked up
+	// promptly
+	DefaultNegativeCacheTTL = 10 * time.Second
+)
+
+// cachedVerification holds the outcome of one verification
+type cachedVerification struct {
+	x5u       string
+	err       error
+	expiresAt time.Time
+}
+
+// VerificationCache memoizes verification results for a short time, so
+// a verifier under load does not fetch a known chain, good or bad, for
+// every signature it checks. Results are keyed by x5u location,
+// signature and input digest. Failures are cached for a shorter time
+// than successes, and all results computed against a chain are dropped
+// as soon as a fetch observes that the chain changed. It is safe for
+// concurrent use
+type VerificationCache struct {
+	sync.Mutex
+	positiveTTL  time.Duration
+	negativeTTL  time.Duration
+	results      map[string]*cachedVerification
+	chainDigests map[string][sha256.Size]byte
+}
+
+// NewVerificationCache initializes a VerificationCache with the given
+// TTLs for successful and failed verifications. TTLs that aren't
+// positive fall back to the package defaults
+func NewVerificationCache(positiveTTL, negativeTTL time.Duration) *VerificationCache {
+	if positiveTTL <= 0 {
+		positiveTTL = DefaultPositiveCacheTTL
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = DefaultNegativeCacheTTL
+	}
+	return &VerificationCache{
+		positiveTTL:  positiveTTL,
+		negativeTTL:  negativeTTL,
+		results:      make(map[string]*cachedVerification),
+		chainDigests: make(map[string][sha256.Size]byte),
+	}
+}
+
+// Verify behaves like VerifyWithOptions but serves repeated
+// verifications of the same signature from memory while the cached
+// result is fresh
+func (c *VerificationCache) Verify(x5u, signature string, input []byte, options VerifyOptions) error {
+	key := fmt.Sprintf("%s\x00%s\x00%x", x5u, signature, sha256.Sum256(input))
+	c.Lock()
+	entry, ok := c.results[key]
+	if ok && timeNow().Before(entry.expiresAt) {
+		err := entry.err
+		c.Unlock()
+		return err
+	}
+	c.Unlock()
+
+	body, err := fetchX5U(x5u)
+	if err != nil {
+		verr := &VerificationError{Step: ErrX5URetrieval, Err: err}
+		c.store(key, x5u, verr)
+		return verr
+	}
+	c.noteChain(x5u, sha256.Sum256(body))
+	var verr error
+	certs, err := ParseChain(body)
+	if err != nil {
+		verr = &VerificationError{Step: ErrChainValidation, Err: err}
+	} else if err := verifyWithCerts(certs, signature, input, options); err != nil {
+		verr = &VerificationError{Step: ErrSignatureVerification, Err: err}
+	}
+	c.store(key, x5u, verr)
+	return verr
+}
+
+// noteChain records the digest of the chain fetched from an x5u
+// location and drops all results computed against a previous version
+// of it, so a rotated or repaired chain takes effect on the next
+// verification rather than after the TTL
+func (c *VerificationCache) noteChain(x5u string, digest [sha256.Size]byte) {
+	c.Lock()
+	defer c.Unlock()
+	prev, ok := c.chainDigests[x5u]
+	if ok && prev != digest {
+		for key, entry := range c.results {
+			if entry.x5u == x5u {
+				delete(c.results, key)
+			}
+		}
+	}
+	c.chainDigests[x5u] = digest
+}
+
+// store caches a verification result with the TTL matching its
+// outcome, and prunes expired entries so the cache doesn't grow beyond
+// what the TTLs keep useful
+func (c *VerificationCache) store(key, x5u string, verr error) {
+	now := timeNow()
+	ttl := c.positiveTTL
+	if verr != nil {
+		ttl = c.negativeTTL
+	}
+	c.Lock()
+	defer c.Unlock()
+	for k, entry := range c.results {
+		if !now.Before(entry.expiresAt) {
+			delete(c.results, k)
+		}
+	}
+	c.results[key] = &cachedVerification{
+		x5u:       x5u,
+		err:       verr,
+		expiresAt: now.Add(ttl),
+	}
+}
+
+// constantTimeEqual compares two strings in constant time, so metadata
+// checks in the verify path cannot leak how much of a value matched
+// through response timing. The length of the values is not hidden.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// constantTimeEqualFold compares two hex encoded strings in constant
+// time, ignoring case
+func constantTimeEqualFold(a, b string) bool {
+	return constantTimeEqual(strings.ToLower(a), strings.ToLower(b))
+}
+
+// verifyWithCerts performs a verification of a signature on input data
+// using the end-entity certificate of an already verified chain
+func verifyWithCerts(certs []*x509.Certificate, signature string, input []byte, options VerifyOptions) error {
+	// Get the public key from the end-entity. Chain validation does not
+	// restrict the type of the leaf key, and caller-supplied chains can
+	// carry a validly issued non-ecdsa end-entity, which cannot have
+	// produced a content signature
 	if len(certs) < 1 {
 		return fmt.Errorf("no certificate found in x5u")
 	}
-	key := certs[0].PublicKey.(*ecdsa.PublicKey)
+	key, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("end-entity public key is %T, not ecdsa", certs[0].PublicKey)
+	}
+	if !options.ExpiresAt.IsZero() && timeNow().After(options.ExpiresAt) {
+		return fmt.Errorf("signature expired on %s and is no longer honored",
+			options.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	// when the end-entity declares key usages, they must permit
+	// digital signatures
+	if certs[0].KeyUsage != 0 && certs[0].KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return fmt.Errorf("end-entity certificate key usage does not permit digital signatures")
+	}
+	if len(options.RequiredEKU) > 0 && !hasEKU(certs[0], options.RequiredEKU) {
+		return fmt.Errorf("end-entity certificate does not carry the required extended key usage %s",
+			options.RequiredEKU)
+	}
+	if options.ExpectedSignerID != "" {
+		// signer IDs cannot contain dots, so the first label of the
+		// end-entity common name is the ID of the issuing signer
+		signerID := strings.SplitN(certs[0].Subject.CommonName, ".", 2)[0]
+		if !constantTimeEqual(signerID, options.ExpectedSignerID) {
+			return fmt.Errorf("signature was issued by signer %q, expected %q",
+				signerID, options.ExpectedSignerID)
+		}
+	}
+	if options.ExpectedRootHash != "" {
+		// the last certificate of a validated chain is its root
+		h := sha256.Sum256(certs[len(certs)-1].Raw)
+		expected := strings.Replace(options.ExpectedRootHash, ":", "", -1)
+		if !constantTimeEqualFold(expected, fmt.Sprintf("%X", h[:])) {
+			return fmt.Errorf("chain does not terminate in the expected root: expected root hash %s, got %X",
+				expected, h[:])
+		}
+	}
 	// parse the json signature
-	sig, err := Unmarshal(signature)
+	sig, err := UnmarshalWithCompat(signature, options.LegacyCompat)
+	if err != nil {
+		return err
+	}
+	// a signature whose mode doesn't match the curve of the leaf key
+	// cannot have been produced by it. Surface the incompatibility
+	// distinctly from a plain invalid signature, as it points at a
+	// rotation or chain mismatch rather than tampered input
+	var leafMode string
+	switch key.Curve.Params().Name {
+	case "P-256":
+		leafMode = P256ECDSA
+	case "P-384":
+		leafMode = P384ECDSA
+	case "P-521":
+		leafMode = P521ECDSA
+	}
+	if sig.Mode != leafMode {
+		return fmt.Errorf("%s signature is incompatible with the %s leaf key of the chain, the x5u does not match the signature",
+			sig.Mode, key.Curve.Params().Name)
+	}
+	// reject out of range signature values before verifying
+	err = sig.CheckScalarRange(key)
 	if err != nil {
 		return err
 	}
 	// make a templated hash
+	if len(options.CandidatePrefixes) > 0 {
+		for _, prefix := range options.CandidatePrefixes {
+			if sig.VerifyDataWithPrefix(input, key, prefix) {
+				if options.MatchedPrefix != nil {
+					*options.MatchedPrefix = prefix
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("ecdsa signature verification failed against all %d candidate prefixes", len(options.CandidatePrefixes))
+	}
 	if !sig.VerifyData(input, key) {
 		return fmt.Errorf("ecdsa signature verification failed")
 	}
@@ -7,11 +7,35 @@
 package contentsignaturepki
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/pkcs7"
 )
 
 func TestSign(t *testing.T) {
@@ -244,6 +268,462 @@ func TestUnmarshalBadBase64(t *testing.T) {
 	}
 }
 
+func TestDefaultValidity(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.Validity = 0
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.validity == 0 {
+		t.Fatal("expected zero configured validity to be defaulted but signer validity is still zero")
+	}
+	if s.validity != DefaultValidity {
+		t.Fatalf("expected default validity of %s, got %s", DefaultValidity, s.validity)
+	}
+}
+
+func TestZeroValidityEEWindow(t *testing.T) {
+	cfg := PASSINGTESTCASES[1].cfg
+	cfg.Validity = 0
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.X5U, err)
+	}
+	// the cert window is the default validity plus twice the clock skew
+	// tolerance, which is zero in this configuration. notBefore and
+	// notAfter are calculated from separate clock reads truncated to the
+	// second, so allow a couple seconds of drift.
+	window := certs[0].NotAfter.Sub(certs[0].NotBefore)
+	if window < DefaultValidity-2*time.Second || window > DefaultValidity+2*time.Second {
+		t.Fatalf("expected end-entity cert window of %s, got %s", DefaultValidity, window)
+	}
+}
+
+func TestNoExpiryValidity(t *testing.T) {
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.Validity = NoExpiry
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.X5U, err)
+	}
+	if certs[0].NotAfter.Year() != 9999 {
+		t.Fatalf("expected end-entity cert to use the no well-defined expiration date, got notAfter=%s", certs[0].NotAfter)
+	}
+}
+
+// fakeMetrics records measurements for inspection in tests
+type fakeMetrics struct {
+	success   int
+	errors    map[string]int
+	durations int
+}
+
+func (m *fakeMetrics) IncSignSuccess(signerType, mode string) {
+	m.success++
+}
+
+func (m *fakeMetrics) IncSignError(signerType, mode, reason string) {
+	if m.errors == nil {
+		m.errors = make(map[string]int)
+	}
+	m.errors[reason]++
+}
+
+func (m *fakeMetrics) ObserveSignDuration(signerType, mode string, value time.Duration) {
+	m.durations++
+}
+
+func (m *fakeMetrics) ObserveBatchDedup(signerType, mode string, total, unique, hits int) {
+}
+
+func TestSignerMetrics(t *testing.T) {
+	metrics := new(fakeMetrics)
+	prevMetrics := signer.Metrics()
+	signer.RegisterMetrics(metrics)
+	defer signer.RegisterMetrics(prevMetrics)
+
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s.SignData([]byte("foobarbaz1234abcd"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if metrics.success != 1 {
+		t.Fatalf("expected 1 success measurement, got %d", metrics.success)
+	}
+	if metrics.durations != 1 {
+		t.Fatalf("expected 1 duration measurement, got %d", metrics.durations)
+	}
+	_, err = s.SignData([]byte("a"), nil)
+	if err == nil {
+		t.Fatal("expected to fail signing short input but succeeded")
+	}
+	if metrics.errors["input"] != 1 {
+		t.Fatalf("expected 1 input error measurement, got %d", metrics.errors["input"])
+	}
+}
+
+func TestSignHexHash(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	// a valid hex encoded templated hash signs and verifies
+	alg, hash := MakeTemplatedHash([]byte("foobarbaz1234abcd"), s.Mode)
+	if alg != "sha384" {
+		t.Fatalf("expected templated hash alg sha384, got %q", alg)
+	}
+	sig, err := s.SignHexHash(hex.EncodeToString(hash), nil)
+	if err != nil {
+		t.Fatalf("failed to sign hex hash: %v", err)
+	}
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.X5U, err)
+	}
+	key := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !sig.(*ContentSignature).VerifyHash(hash, key) {
+		t.Fatal("failed to verify signature on hex hash")
+	}
+
+	// a digest of the wrong length is rejected
+	_, err = s.SignHexHash("aabbccdd", nil)
+	if err == nil {
+		t.Fatal("expected to fail signing a short hex digest but succeeded")
+	}
+	if err.Error() != "contentsignaturepki: refusing to sign input hash. length 4, expected 32, 48 or 64" {
+		t.Fatalf("expected to fail with wrong length but failed with: %v", err)
+	}
+
+	// malformed hex is rejected
+	_, err = s.SignHexHash("not hex at all", nil)
+	if err == nil {
+		t.Fatal("expected to fail signing malformed hex but succeeded")
+	}
+	if !strings.Contains(err.Error(), "failed to decode hex digest") {
+		t.Fatalf("expected to fail with hex decode error but failed with: %v", err)
+	}
+}
+
+func TestRotateIssuer(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	oldEELabel := s.eeLabel
+	// rotating to a key that doesn't match the issuer certificate must
+	// be refused
+	err = s.RotateIssuer(PASSINGTESTCASES[1].cfg.PrivateKey)
+	if err == nil {
+		t.Fatal("expected rotation to a mismatched key to fail but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "does not match the issuer certificate") {
+		t.Fatalf("expected to fail with mismatched issuer key but failed with: %v", err)
+	}
+	// rotating to a key matching the installed issuer certificate
+	// re-issues the end-entity and rebuilds the chain. end-entity labels
+	// have second resolution, so wait for the label to change
+	time.Sleep(time.Second)
+	err = s.RotateIssuer(PASSINGTESTCASES[0].cfg.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to rotate issuer: %v", err)
+	}
+	if s.eeLabel == oldEELabel {
+		t.Fatal("expected a fresh end-entity after rotation but label is unchanged")
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data after rotation: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature after rotation: %v", err)
+	}
+}
+
+// makeRSALeafChain issues an end-entity certificate holding an RSA
+// public key under the issuer of the signer and returns the full PEM
+// chain. The chain is validly signed and passes parsing, but its leaf
+// cannot have produced a content signature
+func makeRSALeafChain(t *testing.T, s *ContentSigner) []byte {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	block, _ := pem.Decode([]byte(s.PublicKey))
+	if block == nil {
+		t.Fatal("no pem block found in signer public key configuration")
+	}
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse issuer certificate: %v", err)
+	}
+	cn := s.ID + s.eeNamespace
+	crtTpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, crtTpl, issuer, &rsaKey.PublicKey, s.issuerPriv)
+	if err != nil {
+		t.Fatalf("failed to issue rsa end-entity cert: %v", err)
+	}
+	eePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	return append(append(eePEM, []byte(s.PublicKey)...), []byte(s.caCert)...)
+}
+
+func TestVerifyWithChain(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	// verification from the inline chain must match verification
+	// through the x5u location
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature from x5u: %v", err)
+	}
+	chainPEM, err := ioutil.ReadFile(strings.TrimPrefix(s.X5U, "file://"))
+	if err != nil {
+		t.Fatalf("failed to read chain file: %v", err)
+	}
+	err = VerifyWithChain(chainPEM, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature from inline chain: %v", err)
+	}
+	// a chain missing its root must not verify
+	err = VerifyWithChain(chainPEM[:len(chainPEM)/2], sigstr, input)
+	if err == nil {
+		t.Fatal("expected verification of a truncated chain to fail but it succeeded")
+	}
+	// a validly issued chain whose leaf key is not ecdsa must fail with
+	// an error, not a panic
+	err = VerifyWithChain(makeRSALeafChain(t, s), sigstr, input)
+	if err == nil {
+		t.Fatal("expected verification with an rsa leaf chain to fail but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "not ecdsa") {
+		t.Fatalf("expected a leaf key type error but got: %v", err)
+	}
+}
+
+func TestScalarRangeChecks(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	rawsig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sig := rawsig.(*ContentSignature)
+	pub := s.eePub.(*ecdsa.PublicKey)
+	if sig.CheckScalarRange(pub) != nil {
+		t.Fatalf("expected a valid signature to pass the range check but got: %v",
+			sig.CheckScalarRange(pub))
+	}
+	var testcases = []struct {
+		name string
+		r, s *big.Int
+	}{
+		{"r=0", big.NewInt(0), sig.S},
+		{"s=0", sig.R, big.NewInt(0)},
+		{"s=n", sig.R, pub.Curve.Params().N},
+	}
+	for _, testcase := range testcases {
+		badsig := *sig
+		badsig.R = testcase.r
+		badsig.S = testcase.s
+		if badsig.CheckScalarRange(pub) == nil {
+			t.Fatalf("expected the range check to reject %s but it passed", testcase.name)
+		}
+		if badsig.VerifyData(input, pub) {
+			t.Fatalf("expected verification to reject %s but it passed", testcase.name)
+		}
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	err = s.CheckHealth()
+	if err != nil {
+		t.Fatalf("expected health check of a fresh signer to pass but got: %v", err)
+	}
+	// a signer whose x5u is gone must report unhealthy
+	s.X5U = "file:///tmp/autograph_unit_tests/chains/doesnotexist.chain"
+	err = s.CheckHealth()
+	if err == nil {
+		t.Fatal("expected health check to fail with a missing x5u but it succeeded")
+	}
+}
+
+func TestCustomEENamespace(t *testing.T) {
+	// the namespace must stay within the name constraints of the test
+	// pki, but is otherwise freely configurable
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.EENamespace = ".private-deployment.content-signature.mozilla.org"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get x5u: %v", err)
+	}
+	expectedCN := cfg.ID + cfg.EENamespace
+	if certs[0].Subject.CommonName != expectedCN {
+		t.Fatalf("expected end-entity common name %q but got %q",
+			expectedCN, certs[0].Subject.CommonName)
+	}
+	// a namespace that doesn't produce a legal dns name is rejected
+	cfg = PASSINGTESTCASES[0].cfg
+	cfg.EENamespace = ".invalid namespace!"
+	_, err = New(cfg)
+	if err == nil {
+		t.Fatal("expected signer initialization to fail with an invalid namespace but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "not a valid dns name") {
+		t.Fatalf("expected a dns name error but got: %v", err)
+	}
+}
+
+func TestMaxChainLen(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	chainPEM, err := ioutil.ReadFile(strings.TrimPrefix(s.X5U, "file://"))
+	if err != nil {
+		t.Fatalf("failed to read chain file: %v", err)
+	}
+	// an over-long chain must be rejected before parsing
+	longChain := append(chainPEM, chainPEM...)
+	_, err = ParseChain(longChain)
+	if err == nil {
+		t.Fatal("expected parsing of an over-long chain to fail but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "exceeding the maximum") {
+		t.Fatalf("expected a chain length error but got: %v", err)
+	}
+	// a custom cap permits longer chains up to the parser requirements
+	_, err = ParseChainWithMaxLen(chainPEM, 2)
+	if err == nil {
+		t.Fatal("expected parsing with a cap of 2 to fail but it succeeded")
+	}
+	_, err = ParseChainWithMaxLen(chainPEM, 3)
+	if err != nil {
+		t.Fatalf("failed to parse a valid chain with a cap of 3: %v", err)
+	}
+}
+
+func TestChainCacheFile(t *testing.T) {
+	// with a chain cache file configured, the signer must work without
+	// any upload location, serving and verifying the chain from disk
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.ChainUploadLocation = ""
+	cfg.X5U = ""
+	cfg.ChainCacheFile = "/tmp/autograph_unit_tests/chaincache_" + cfg.ID + ".chain"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.X5U != "file://"+cfg.ChainCacheFile {
+		t.Fatalf("expected X5U to point at the chain cache file, got %q", s.X5U)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature from file-backed chain: %v", err)
+	}
+}
+
+func TestAllowedSigAlgs(t *testing.T) {
+	// the first test case uses a P-384 issuer, so p384ecdsa is allowed
+	// and p256ecdsa is not
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.AllowedSigAlgs = []string{P384ECDSA}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s.SignData([]byte("foobarbaz1234abcd"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign data with allowed mode: %v", err)
+	}
+
+	cfg = PASSINGTESTCASES[0].cfg
+	cfg.AllowedSigAlgs = []string{P256ECDSA}
+	_, err = New(cfg)
+	if err == nil {
+		t.Fatal("expected signer initialization to fail with disallowed mode but succeeded")
+	}
+	if !strings.Contains(err.Error(), "is not allowed by the configuration") {
+		t.Fatalf("expected to fail with disallowed mode but failed with: %v", err)
+	}
+}
+
+func TestSignWithCorrelationID(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, Options{CorrelationID: "unittestcorrid"})
+	if err != nil {
+		t.Fatalf("failed to sign data with correlation id: %v", err)
+	}
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.X5U, err)
+	}
+	key := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !sig.(*ContentSignature).VerifyData(input, key) {
+		t.Fatal("failed to verify signature produced with correlation id")
+	}
+}
+
 func TestNoShortData(t *testing.T) {
 	s, err := New(PASSINGTESTCASES[0].cfg)
 	if err != nil {
@@ -257,3 +737,2279 @@ func TestNoShortData(t *testing.T) {
 		t.Fatalf("expected to fail with input data too short but failed with: %v", err)
 	}
 }
+
+func TestChainUploadHeaders(t *testing.T) {
+	headers := makeChainUploadHeaders(time.Now().Add(30 * 24 * time.Hour))
+	if headers.contentType != "application/x-pem-file" {
+		t.Fatalf("expected pem content-type, got %q", headers.contentType)
+	}
+	if !strings.HasPrefix(headers.cacheControl, "public, max-age=") {
+		t.Fatalf("expected public cache-control with a max-age, got %q", headers.cacheControl)
+	}
+	var maxAge int64
+	_, err := fmt.Sscanf(headers.cacheControl, "public, max-age=%d", &maxAge)
+	if err != nil {
+		t.Fatalf("failed to parse max-age from cache-control %q: %v", headers.cacheControl, err)
+	}
+	// the ttl must reflect the remaining validity of the end-entity
+	if maxAge <= 29*24*3600 || maxAge > 30*24*3600 {
+		t.Fatalf("expected a max-age just under 30 days, got %d", maxAge)
+	}
+	// an expired end-entity must not be cached at all
+	headers = makeChainUploadHeaders(time.Now().Add(-time.Hour))
+	if headers.cacheControl != "public, max-age=0" {
+		t.Fatalf("expected a zero max-age for an expired end-entity, got %q", headers.cacheControl)
+	}
+}
+
+func TestVerifyLegacyCompat(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	rs, err := base64.RawURLEncoding.DecodeString(sigstr)
+	if err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+	// re-encode the signature the way older versions of this package
+	// did, with the standard alphabet and padding
+	for _, legacySig := range []string{
+		base64.StdEncoding.EncodeToString(rs),
+		base64.URLEncoding.EncodeToString(rs),
+	} {
+		// legacy encodings that happen to match the strict one, eg. a
+		// signature without any byte mapping to the characters that
+		// differ between alphabets, verify in both modes
+		if legacySig != sigstr {
+			err = Verify(s.X5U, legacySig, input)
+			if err == nil {
+				t.Fatalf("expected strict verification of legacy signature %q to fail but it succeeded", legacySig)
+			}
+		}
+		err = VerifyWithOptions(s.X5U, legacySig, input, VerifyOptions{LegacyCompat: true})
+		if err != nil {
+			t.Fatalf("failed to verify legacy signature %q in compat mode: %v", legacySig, err)
+		}
+	}
+	// compat mode must still accept the current strict encoding
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{LegacyCompat: true})
+	if err != nil {
+		t.Fatalf("failed to verify current signature in compat mode: %v", err)
+	}
+	// garbage doesn't verify in either mode
+	err = VerifyWithOptions(s.X5U, strings.Repeat("!", 96), input, VerifyOptions{LegacyCompat: true})
+	if err == nil {
+		t.Fatal("expected verification of a garbage signature to fail but it succeeded")
+	}
+}
+
+func TestExpectedKeyFingerprint(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	fingerprint, err := s.KeyFingerprint()
+	if err != nil {
+		t.Fatalf("failed to get key fingerprint: %v", err)
+	}
+	// signing with the fingerprint of the active key must succeed
+	_, err = s.SignData(input, Options{ExpectedKeyFingerprint: fingerprint})
+	if err != nil {
+		t.Fatalf("failed to sign data with matching fingerprint: %v", err)
+	}
+	// case differences in the hex encoding are tolerated
+	_, err = s.SignData(input, Options{ExpectedKeyFingerprint: strings.ToUpper(fingerprint)})
+	if err != nil {
+		t.Fatalf("failed to sign data with matching uppercase fingerprint: %v", err)
+	}
+	// a mismatched fingerprint must refuse to sign
+	_, err = s.SignData(input, Options{ExpectedKeyFingerprint: strings.Repeat("00", 32)})
+	if err == nil {
+		t.Fatal("expected signing with a mismatched fingerprint to fail but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "does not match expected fingerprint") {
+		t.Fatalf("expected a fingerprint mismatch error, got: %v", err)
+	}
+}
+
+// mockHSMSigner wraps an ecdsa key and returns signatures either as der
+// or as the raw r||s concatenation some hsms produce
+type mockHSMSigner struct {
+	priv   *ecdsa.PrivateKey
+	rawRS  bool
+	sigLen int
+}
+
+func (m *mockHSMSigner) Public() crypto.PublicKey {
+	return m.priv.Public()
+}
+
+func (m *mockHSMSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand, m.priv, digest)
+	if err != nil {
+		return nil, err
+	}
+	if !m.rawRS {
+		return asn1.Marshal(ecdsaAsn1Signature{R: r, S: s})
+	}
+	rs := make([]byte, m.sigLen)
+	copy(rs[(m.sigLen/2)-len(r.Bytes()):m.sigLen/2], r.Bytes())
+	copy(rs[m.sigLen-len(s.Bytes()):], s.Bytes())
+	return rs, nil
+}
+
+func TestSignHashNormalizesHSMOutput(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	eeKey, ok := s.eePriv.(*ecdsa.PrivateKey)
+	if !ok {
+		t.Fatalf("expected an ecdsa end-entity key, got %T", s.eePriv)
+	}
+	input := []byte("foobarbaz1234abcd")
+	for _, rawRS := range []bool{false, true} {
+		s.eePriv = &mockHSMSigner{
+			priv:   eeKey,
+			rawRS:  rawRS,
+			sigLen: getSignatureLen(s.Mode),
+		}
+		sig, err := s.SignData(input, nil)
+		if err != nil {
+			t.Fatalf("failed to sign data with rawRS=%t: %v", rawRS, err)
+		}
+		if !sig.(*ContentSignature).VerifyData(input, eeKey.Public().(*ecdsa.PublicKey)) {
+			t.Fatalf("failed to verify signature with rawRS=%t", rawRS)
+		}
+	}
+	// output that is neither der nor the right length for raw r||s fails
+	_, _, err = parseSignatureOutput([]byte("garbage"), getSignatureLen(s.Mode))
+	if err == nil {
+		t.Fatal("expected parsing garbage signature output to fail but it succeeded")
+	}
+}
+
+func TestPrefixHandling(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	payload := []byte("foobarbaz1234abcd")
+	templated := append([]byte(SignaturePrefix), payload...)
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U: %v", err)
+	}
+	key := certs[0].PublicKey.(*ecdsa.PublicKey)
+
+	// the default warns and templates the input again
+	sig, err := s.SignData(templated, nil)
+	if err != nil {
+		t.Fatalf("failed to sign templated data in default mode: %v", err)
+	}
+	if !sig.(*ContentSignature).VerifyData(templated, key) {
+		t.Fatal("failed to verify double-templated signature against the full input")
+	}
+
+	// strict mode rejects the input
+	_, err = s.SignData(templated, Options{PrefixHandling: PrefixHandlingStrict})
+	if err == nil {
+		t.Fatal("expected strict mode to reject already-templated input but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "already starts with the signature prefix") {
+		t.Fatalf("expected a prefix error, got: %v", err)
+	}
+
+	// skip mode signs the payload without adding another prefix
+	sig, err = s.SignData(templated, Options{PrefixHandling: PrefixHandlingSkip})
+	if err != nil {
+		t.Fatalf("failed to sign templated data in skip mode: %v", err)
+	}
+	if !sig.(*ContentSignature).VerifyData(payload, key) {
+		t.Fatal("failed to verify skip-mode signature against the untemplated payload")
+	}
+
+	// input without the prefix is unaffected by the option
+	sig, err = s.SignData(payload, Options{PrefixHandling: PrefixHandlingStrict})
+	if err != nil {
+		t.Fatalf("failed to sign untemplated data in strict mode: %v", err)
+	}
+	if !sig.(*ContentSignature).VerifyData(payload, key) {
+		t.Fatal("failed to verify signature of untemplated input")
+	}
+}
+
+// makeExpiredChain generates a root, intermediate and end-entity whose
+// validity window ended a day ago, writes the chain to the local upload
+// dir and returns its x5u location along with the ee private key
+func makeExpiredChain(t *testing.T) (x5u string, eeKey *ecdsa.PrivateKey) {
+	notBefore := time.Now().Add(-48 * time.Hour)
+	notAfter := time.Now().Add(-24 * time.Hour)
+
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate root key: %v", err)
+	}
+	rootTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "expired unit test root"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTpl, rootTpl, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatalf("failed to create root certificate: %v", err)
+	}
+	rootCert, _ := x509.ParseCertificate(rootDER)
+
+	interKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate intermediate key: %v", err)
+	}
+	interTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "expired unit test intermediate"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	interDER, err := x509.CreateCertificate(rand.Reader, interTpl, rootCert, interKey.Public(), rootKey)
+	if err != nil {
+		t.Fatalf("failed to create intermediate certificate: %v", err)
+	}
+	interCert, _ := x509.ParseCertificate(interDER)
+
+	eeKey, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ee key: %v", err)
+	}
+	eeTpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "expired.unit.test.ee"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	eeDER, err := x509.CreateCertificate(rand.Reader, eeTpl, interCert, eeKey.Public(), interKey)
+	if err != nil {
+		t.Fatalf("failed to create ee certificate: %v", err)
+	}
+
+	var chain bytes.Buffer
+	for _, der := range [][]byte{eeDER, interDER, rootDER} {
+		pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	err = os.MkdirAll("/tmp/autograph_unit_tests/chains/", 0755)
+	if err != nil {
+		t.Fatalf("failed to make chains directory: %v", err)
+	}
+	chainPath := "/tmp/autograph_unit_tests/chains/expiredchain.pem"
+	err = ioutil.WriteFile(chainPath, chain.Bytes(), 0755)
+	if err != nil {
+		t.Fatalf("failed to write chain file: %v", err)
+	}
+	return "file://" + chainPath, eeKey
+}
+
+func TestVerifyAsOf(t *testing.T) {
+	x5u, eeKey := makeExpiredChain(t)
+
+	// sign input with the ee key, as the signer would have done while
+	// the chain was still valid
+	input := []byte("foobarbaz1234abcd")
+	_, hash := MakeTemplatedHash(input, P384ECDSA)
+	r, s, err := ecdsa.Sign(rand.Reader, eeKey, hash)
+	if err != nil {
+		t.Fatalf("failed to sign input: %v", err)
+	}
+	csig := &ContentSignature{R: r, S: s, Mode: P384ECDSA, Len: P384ECDSABYTESIZE, Finished: true}
+	sigstr, err := csig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// the chain is expired, so verification as of now must fail
+	err = Verify(x5u, sigstr, input)
+	if err == nil {
+		t.Fatal("expected verification of an expired chain to fail but it succeeded")
+	}
+	err = VerifyAsOf(x5u, sigstr, input, time.Now())
+	if err == nil {
+		t.Fatal("expected verification as of now to fail but it succeeded")
+	}
+
+	// verification as of the middle of the validity window must pass
+	err = VerifyAsOf(x5u, sigstr, input, time.Now().Add(-36*time.Hour))
+	if err != nil {
+		t.Fatalf("failed to verify signature as of the chain validity window: %v", err)
+	}
+
+	// a bad signature must not verify even within the validity window
+	err = VerifyAsOf(x5u, strings.Repeat("A", 128), input, time.Now().Add(-36*time.Hour))
+	if err == nil {
+		t.Fatal("expected verification of a garbage signature to fail but it succeeded")
+	}
+}
+
+func TestRotateEEWithExplicitValidity(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// incoherent bounds must be refused before anything is issued
+	for _, testcase := range []struct {
+		opts RotateEEOptions
+		err  string
+	}{
+		{RotateEEOptions{NotBefore: time.Now()}, "must be provided together"},
+		{RotateEEOptions{NotAfter: time.Now()}, "must be provided together"},
+		{RotateEEOptions{NotBefore: time.Now(), NotAfter: time.Now().Add(-time.Hour)}, "notAfter must be after notBefore"},
+		{RotateEEOptions{NotBefore: time.Now().Add(-48 * time.Hour), NotAfter: time.Now().Add(-24 * time.Hour)}, "already in the past"},
+	} {
+		err = s.RotateEE(testcase.opts)
+		if err == nil {
+			t.Fatalf("expected rotation with options %+v to fail but it succeeded", testcase.opts)
+		}
+		if !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("expected to fail with %q but failed with: %v", testcase.err, err)
+		}
+	}
+
+	// pre-stage a rotation: the new end-entity only becomes valid in a day
+	notBefore := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	notAfter := notBefore.Add(48 * time.Hour)
+	err = s.RotateEE(RotateEEOptions{NotBefore: notBefore, NotAfter: notAfter})
+	if err != nil {
+		t.Fatalf("failed to rotate end-entity: %v", err)
+	}
+
+	// the chain must reflect the requested bounds, and only verify
+	// within them
+	body, err := fetchX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch x5u: %v", err)
+	}
+	certs, err := parseChainAsOf(body, DefaultMaxChainLen, notBefore.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to parse chain as of the activation time: %v", err)
+	}
+	if !certs[0].NotBefore.Equal(notBefore) {
+		t.Fatalf("expected end-entity notBefore %s but got %s", notBefore, certs[0].NotBefore)
+	}
+	if !certs[0].NotAfter.Equal(notAfter) {
+		t.Fatalf("expected end-entity notAfter %s but got %s", notAfter, certs[0].NotAfter)
+	}
+	_, err = ParseChain(body)
+	if err == nil {
+		t.Fatal("expected a pre-staged chain to fail verification as of now but it succeeded")
+	}
+}
+
+func TestDetachedCMS(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// the default format does not carry a cms structure
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if sig.(*ContentSignature).CMS != nil {
+		t.Fatal("expected no cms structure without the detached cms option")
+	}
+
+	sig, err = s.SignData(input, Options{DetachedCMS: true})
+	if err != nil {
+		t.Fatalf("failed to sign data with detached cms: %v", err)
+	}
+	csig := sig.(*ContentSignature)
+	if len(csig.CMS) == 0 {
+		t.Fatal("expected a cms structure with the detached cms option")
+	}
+	// the compact signature must still verify on its own
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to get X5U %q: %v", s.X5U, err)
+	}
+	if !csig.VerifyData(input, certs[0].PublicKey.(*ecdsa.PublicKey)) {
+		t.Fatal("failed to verify compact signature")
+	}
+
+	// verify the cms structure the way openssl smime -verify would:
+	// parse it, attach the detached content, check the message digest
+	// and signature, and validate the embedded chain up to the root
+	p7, err := pkcs7.Parse(csig.CMS)
+	if err != nil {
+		t.Fatalf("failed to parse cms structure: %v", err)
+	}
+	if len(p7.Content) != 0 {
+		t.Fatalf("expected detached cms with no embedded content, found %d bytes", len(p7.Content))
+	}
+	if len(p7.Certificates) != 3 {
+		t.Fatalf("expected 3 certificates embedded in cms, found %d", len(p7.Certificates))
+	}
+	p7.Content = append([]byte(SignaturePrefix), input...)
+	roots := x509.NewCertPool()
+	roots.AddCert(certs[2])
+	err = p7.VerifyWithChain(roots)
+	if err != nil {
+		t.Fatalf("failed to verify cms structure: %v", err)
+	}
+
+	// tampered content must not verify
+	p7.Content = append([]byte(SignaturePrefix), []byte("tampered content")...)
+	err = p7.VerifyWithChain(roots)
+	if err == nil {
+		t.Fatal("cms structure verified tampered content")
+	}
+}
+
+func TestEECurveEncoding(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+
+	// the default encodes the curve as a named curve OID that the
+	// stdlib parser accepts
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Config().EECurveEncoding != CurveEncodingNamed {
+		t.Fatalf("expected default curve encoding %q but got %q", CurveEncodingNamed, s.Config().EECurveEncoding)
+	}
+	body, err := fetchX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch X5U %q: %v", s.X5U, err)
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		t.Fatal("failed to decode ee certificate from chain")
+	}
+	_, err = x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("stdlib parser rejected a named curve certificate: %v", err)
+	}
+	_, err = parseExplicitCurveCert(block.Bytes)
+	if err == nil {
+		t.Fatal("expected the explicit curve parser to reject a named curve certificate")
+	}
+
+	// the explicit encoding replaces the named curve OID with domain
+	// parameters, which the stdlib parser rejects
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.EECurveEncoding = CurveEncodingExplicit
+	s, err = New(cfg)
+	if err != nil {
+		t.Fatalf("explicit curve signer initialization failed with: %v", err)
+	}
+	body, err = fetchX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch X5U %q: %v", s.X5U, err)
+	}
+	block, _ = pem.Decode(body)
+	if block == nil {
+		t.Fatal("failed to decode ee certificate from chain")
+	}
+	_, err = x509.ParseCertificate(block.Bytes)
+	if err == nil {
+		t.Fatal("expected the stdlib parser to reject explicit curve parameters")
+	}
+	explicit, err := parseExplicitCurveCert(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse explicit curve certificate: %v", err)
+	}
+	if explicit.pub.Curve != elliptic.P384() {
+		t.Fatalf("expected an ee on curve P-384 but got %q", explicit.pub.Curve.Params().Name)
+	}
+
+	// signatures over an explicit curve chain verify end to end
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature over explicit curve chain: %v", err)
+	}
+
+	// unknown encodings are rejected at initialization
+	cfg.EECurveEncoding = "compressed"
+	_, err = New(cfg)
+	if err == nil || !strings.Contains(err.Error(), "invalid ee curve encoding") {
+		t.Fatalf("expected an invalid curve encoding error but got: %v", err)
+	}
+}
+
+func TestIncludeEELabel(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// the label is not reported unless explicitly requested
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if sig.(*ContentSignature).EELabel != "" {
+		t.Fatalf("expected no ee label without the option, got %q", sig.(*ContentSignature).EELabel)
+	}
+
+	sig, err = s.SignData(input, Options{IncludeEELabel: true})
+	if err != nil {
+		t.Fatalf("failed to sign data with ee label: %v", err)
+	}
+	label := sig.(*ContentSignature).EELabel
+	if label == "" {
+		t.Fatal("expected a populated ee label with the include_ee_label option")
+	}
+	if label != s.eeLabel {
+		t.Fatalf("expected ee label %q in signature but got %q", s.eeLabel, label)
+	}
+}
+
+func TestIncludeRootHash(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// the root hash is not reported unless explicitly requested
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if sig.(*ContentSignature).RootHash != "" {
+		t.Fatalf("expected no root hash without the option, got %q", sig.(*ContentSignature).RootHash)
+	}
+
+	sig, err = s.SignData(input, Options{IncludeRootHash: true})
+	if err != nil {
+		t.Fatalf("failed to sign data with root hash: %v", err)
+	}
+	rootHash := sig.(*ContentSignature).RootHash
+	if rootHash == "" {
+		t.Fatal("expected a populated root hash with the include_root_hash option")
+	}
+
+	// the reported hash must match the sha256 of the configured root
+	block, _ := pem.Decode([]byte(PASSINGTESTCASES[0].cfg.CaCert))
+	if block == nil {
+		t.Fatal("failed to decode the configured root certificate")
+	}
+	h := sha256.Sum256(block.Bytes)
+	if rootHash != fmt.Sprintf("%X", h[:]) {
+		t.Fatalf("expected root hash %X in signature but got %q", h[:], rootHash)
+	}
+}
+
+func TestTruncateHash(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.Mode != P384ECDSA {
+		t.Fatalf("expected a %s signer but got %s", P384ECDSA, s.Mode)
+	}
+	digest := sha512.Sum512([]byte("some input hashed with a larger algorithm"))
+
+	// an unsupported digest length is rejected without the option
+	_, err = s.SignHash(digest[:50], nil)
+	if err == nil {
+		t.Fatal("expected to fail signing a 50 bytes hash without truncation but succeeded")
+	}
+	if !strings.Contains(err.Error(), "refusing to sign input hash") {
+		t.Fatalf("expected hash length error but got: %v", err)
+	}
+
+	// with truncation, the oversized digest is cut down to the field
+	// size of the curve, 48 bytes for p-384
+	sig, err := s.SignHash(digest[:], Options{TruncateHash: true})
+	if err != nil {
+		t.Fatalf("failed to sign oversized hash with truncation: %v", err)
+	}
+	csig := sig.(*ContentSignature)
+	pubKey := s.eePub.(*ecdsa.PublicKey)
+	if !csig.VerifyHash(digest[:48], pubKey) {
+		t.Fatal("signature failed to verify against the truncated digest")
+	}
+	// standard ECDSA verifiers apply the same leftmost bytes
+	// truncation internally, so the full digest verifies too
+	if !ecdsa.Verify(pubKey, digest[:], csig.R, csig.S) {
+		t.Fatal("signature failed to verify against the full digest")
+	}
+
+	// the hex variant accepts oversized digests as well
+	sig, err = s.SignHexHash(fmt.Sprintf("%x", digest), Options{TruncateHash: true})
+	if err != nil {
+		t.Fatalf("failed to sign oversized hex hash with truncation: %v", err)
+	}
+	if !sig.(*ContentSignature).VerifyHash(digest[:48], pubKey) {
+		t.Fatal("hex signature failed to verify against the truncated digest")
+	}
+}
+
+func TestDefaultEELabelFormat(t *testing.T) {
+	// labels follow `<signer id>-<generation time as UTC yyyymmddhhmmss>`
+	// so operators can map them back to a signer and a generation date
+	generated := time.Date(2023, time.April, 5, 6, 7, 8, 0, time.UTC)
+	label := makeEELabel("testsigner0", generated)
+	if label != "testsigner0-20230405060708" {
+		t.Fatalf("expected label \"testsigner0-20230405060708\" but got %q", label)
+	}
+}
+
+func TestDeterministicEELabel(t *testing.T) {
+	// install a deterministic generator keyed on a sequence number
+	// instead of the wall clock, like reproducibility tests would
+	defer func(orig func(string, time.Time) string) { makeEELabel = orig }(makeEELabel)
+	sequence := 0
+	makeEELabel = func(signerID string, _ time.Time) string {
+		sequence++
+		return fmt.Sprintf("%s-seq%d", signerID, sequence)
+	}
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s.eeLabel != "testsigner0-seq1" {
+		t.Fatalf("expected deterministic label \"testsigner0-seq1\" but got %q", s.eeLabel)
+	}
+	// rotating the end-entity uses the same generator
+	err = s.RotateEE(RotateEEOptions{})
+	if err != nil {
+		t.Fatalf("failed to rotate end-entity: %v", err)
+	}
+	if s.eeLabel != "testsigner0-seq2" {
+		t.Fatalf("expected deterministic label \"testsigner0-seq2\" but got %q", s.eeLabel)
+	}
+}
+
+func TestOfflineVerifier(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	chainPEM, err := fetchX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch x5u: %v", err)
+	}
+	certs, err := ParseChain(chainPEM)
+	if err != nil {
+		t.Fatalf("failed to parse chain: %v", err)
+	}
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[2].Raw})
+
+	// a verifier embedding the root of the chain verifies the inline
+	// chain and signature without network access
+	v, err := NewVerifier(rootPEM)
+	if err != nil {
+		t.Fatalf("failed to initialize verifier: %v", err)
+	}
+	err = v.Verify(chainPEM, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature offline: %v", err)
+	}
+
+	// tampered input must not verify
+	err = v.Verify(chainPEM, sigstr, []byte("tampered content"))
+	if err == nil {
+		t.Fatal("verifier accepted a signature over tampered input")
+	}
+
+	// a non-ecdsa leaf validly issued under the trusted root must fail
+	// with an error, not a panic
+	err = v.Verify(makeRSALeafChain(t, s), sigstr, input)
+	if err == nil {
+		t.Fatal("verifier accepted a chain with an rsa leaf")
+	}
+	if !strings.Contains(err.Error(), "not ecdsa") {
+		t.Fatalf("expected a leaf key type error but got: %v", err)
+	}
+
+	// a verifier trusting a different root must reject the chain even
+	// though the chain is internally consistent
+	other, err := New(PASSINGTESTCASES[1].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	otherChainPEM, err := fetchX5U(other.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch x5u: %v", err)
+	}
+	otherCerts, err := ParseChain(otherChainPEM)
+	if err != nil {
+		t.Fatalf("failed to parse chain: %v", err)
+	}
+	v, err = NewVerifier(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCerts[2].Raw}))
+	if err != nil {
+		t.Fatalf("failed to initialize verifier: %v", err)
+	}
+	err = v.Verify(chainPEM, sigstr, input)
+	if err == nil {
+		t.Fatal("verifier trusting a different root accepted the chain")
+	}
+	if !strings.Contains(err.Error(), "is not in the trusted set") {
+		t.Fatalf("expected an untrusted root error but got: %v", err)
+	}
+
+	// a verifier needs at least one root
+	_, err = NewVerifier([]byte("not pem at all"))
+	if err == nil || !strings.Contains(err.Error(), "no root certificate found") {
+		t.Fatalf("expected to fail on pem input without roots but got: %v", err)
+	}
+}
+
+func TestVerifyExpectedSignerID(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if sig.(*ContentSignature).ID != s.ID {
+		t.Fatalf("expected signature to carry signer id %q but got %q", s.ID, sig.(*ContentSignature).ID)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// verification pinned on the signer that issued the signature passes
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedSignerID: s.ID})
+	if err != nil {
+		t.Fatalf("failed to verify signature with expected signer id: %v", err)
+	}
+
+	// pinning a different signer id catches a misrouted response
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedSignerID: "testsigner1"})
+	if err == nil {
+		t.Fatal("expected verification with a mismatched signer id to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), `issued by signer "testsigner0", expected "testsigner1"`) {
+		t.Fatalf("expected a signer id mismatch error but got: %v", err)
+	}
+}
+
+func TestMigrateX5U(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	oldX5U := s.X5U
+	oldChain, err := fetchX5U(oldX5U)
+	if err != nil {
+		t.Fatalf("failed to fetch chain from old x5u: %v", err)
+	}
+
+	newLocation := "file:///tmp/autograph_unit_tests/migrated_chains/"
+	err = s.MigrateX5U(newLocation)
+	if err != nil {
+		t.Fatalf("failed to migrate x5u: %v", err)
+	}
+	if !strings.HasPrefix(s.X5U, newLocation) {
+		t.Fatalf("expected the x5u to move under %q but got %q", newLocation, s.X5U)
+	}
+
+	// the new location serves the exact same chain, the end-entity was
+	// not regenerated
+	newChain, err := fetchX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch chain from new x5u: %v", err)
+	}
+	if !bytes.Equal(oldChain, newChain) {
+		t.Fatal("expected the new x5u to serve the same chain as the old one")
+	}
+
+	// signatures verify against the new x5u
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature against migrated x5u: %v", err)
+	}
+}
+
+func TestVerifyRequiredEKU(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// end-entities issued by this package carry the code signing eku
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{RequiredEKU: OIDCodeSigningEKU})
+	if err != nil {
+		t.Fatalf("failed to verify signature with required code signing eku: %v", err)
+	}
+
+	// requiring an eku the end-entity doesn't carry, like email
+	// protection, is refused even though the key verifies the signature
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{
+		RequiredEKU: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4},
+	})
+	if err == nil {
+		t.Fatal("expected verification with a missing eku to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), "required extended key usage") {
+		t.Fatalf("expected a missing eku error but got: %v", err)
+	}
+}
+
+func TestVerifyBatchConcurrent(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// a batch mixing valid items, a tampered input and an unreachable
+	// chain keeps each result at the index of its item
+	items := []BatchVerifyItem{
+		{X5U: s.X5U, Signature: sigstr, Input: input},
+		{X5U: s.X5U, Signature: sigstr, Input: []byte("tampered input data")},
+		{X5U: "file:///nonexistent/chain.pem", Signature: sigstr, Input: input},
+		{X5U: s.X5U, Signature: sigstr, Input: input,
+			Options: VerifyOptions{ExpectedSignerID: "someothersigner"}},
+		{X5U: s.X5U, Signature: sigstr, Input: input},
+	}
+	results := VerifyBatchConcurrent(items, 3)
+	if len(results) != len(items) {
+		t.Fatalf("expected %d results, got %d", len(items), len(results))
+	}
+	if results[0] != nil {
+		t.Fatalf("failed to verify valid item 0: %v", results[0])
+	}
+	if results[4] != nil {
+		t.Fatalf("failed to verify valid item 4: %v", results[4])
+	}
+	if results[1] == nil || !strings.Contains(results[1].Error(), "ecdsa signature verification failed") {
+		t.Fatalf("expected item 1 to fail verification but got: %v", results[1])
+	}
+	if results[2] == nil {
+		t.Fatal("expected item 2 to fail fetching its chain but it passed")
+	}
+	if results[3] == nil || !strings.Contains(results[3].Error(), "someothersigner") {
+		t.Fatalf("expected item 3 to fail the signer id check but got: %v", results[3])
+	}
+
+	// degenerate concurrency values are clamped rather than refused
+	results = VerifyBatchConcurrent(items[:1], 0)
+	if results[0] != nil {
+		t.Fatalf("failed to verify valid item with clamped concurrency: %v", results[0])
+	}
+}
+
+func BenchmarkVerifyBatchConcurrent(b *testing.B) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		b.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		b.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		b.Fatalf("failed to marshal signature: %v", err)
+	}
+	items := make([]BatchVerifyItem, 64)
+	for i := range items {
+		items[i] = BatchVerifyItem{X5U: s.X5U, Signature: sigstr, Input: input}
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		results := VerifyBatchConcurrent(items, 8)
+		for i, res := range results {
+			if res != nil {
+				b.Fatalf("failed to verify item %d: %v", i, res)
+			}
+		}
+	}
+}
+
+func TestRefuseSigningNearEEExpiry(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.ClockSkewTolerance = time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// move the clock to half an hour before the end-entity expires,
+	// within the skew tolerance
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return s.eeExpiry.Add(-30 * time.Minute) }
+	_, err = s.SignData(input, nil)
+	if err == nil {
+		t.Fatal("expected to refuse signing near end-entity expiry but it signed")
+	}
+	if !strings.Contains(err.Error(), "dead-on-arrival") {
+		t.Fatalf("expected a dead-on-arrival error but got: %v", err)
+	}
+
+	// comfortably before the margin, signing proceeds
+	timeNow = func() time.Time { return s.eeExpiry.Add(-2 * time.Hour) }
+	_, err = s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data away from end-entity expiry: %v", err)
+	}
+}
+
+func TestVerifyRootlessChain(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	chainPEM, err := fetchX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch x5u: %v", err)
+	}
+	certs, err := ParseChain(chainPEM)
+	if err != nil {
+		t.Fatalf("failed to parse chain: %v", err)
+	}
+
+	// rebuild the chain without its root, the way some x5u locations
+	// serve it
+	rootlessPEM := append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[0].Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[1].Raw})...)
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[2].Raw})
+
+	// a verifier trusting the root of the chain completes and verifies
+	// the root-less chain
+	v, err := NewVerifier(rootPEM)
+	if err != nil {
+		t.Fatalf("failed to initialize verifier: %v", err)
+	}
+	err = v.Verify(rootlessPEM, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify root-less chain: %v", err)
+	}
+
+	// the same chain served from an x5u location verifies too
+	x5uDir, err := ioutil.TempDir("", "rootlesschain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(x5uDir)
+	err = ioutil.WriteFile(filepath.Join(x5uDir, "rootless.chain"), rootlessPEM, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = v.VerifyX5U("file://"+filepath.Join(x5uDir, "rootless.chain"), sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify root-less x5u: %v", err)
+	}
+
+	// a verifier trusting a different root cannot complete the chain
+	other, err := New(PASSINGTESTCASES[1].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	otherChainPEM, err := fetchX5U(other.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch x5u: %v", err)
+	}
+	otherCerts, err := ParseChain(otherChainPEM)
+	if err != nil {
+		t.Fatalf("failed to parse chain: %v", err)
+	}
+	v, err = NewVerifier(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherCerts[2].Raw}))
+	if err != nil {
+		t.Fatalf("failed to initialize verifier: %v", err)
+	}
+	err = v.Verify(rootlessPEM, sigstr, input)
+	if err == nil {
+		t.Fatal("expected the chain completion to fail with an unknown root but it passed")
+	}
+	if !strings.Contains(err.Error(), "no trusted root issued the intermediate") {
+		t.Fatalf("expected a chain completion error but got: %v", err)
+	}
+}
+
+func TestSignatureBundle(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	bundle, err := s.MakeSignatureBundle(input, nil)
+	if err != nil {
+		t.Fatalf("failed to make signature bundle: %v", err)
+	}
+
+	// the p7b of the bundle carries the full chain of the signer
+	var b SignatureBundle
+	err = json.Unmarshal(bundle, &b)
+	if err != nil {
+		t.Fatalf("failed to parse bundle: %v", err)
+	}
+	if b.SignerID != s.ID || b.Mode != s.Mode {
+		t.Fatalf("expected bundle from signer %q in mode %q but got %q in %q",
+			s.ID, s.Mode, b.SignerID, b.Mode)
+	}
+	p7, err := pkcs7.Parse(b.P7B)
+	if err != nil {
+		t.Fatalf("failed to parse certs-only pkcs7: %v", err)
+	}
+	chain, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch x5u: %v", err)
+	}
+	if len(p7.Certificates) != len(chain) {
+		t.Fatalf("expected %d certificates in bundle but got %d", len(chain), len(p7.Certificates))
+	}
+	for i := range chain {
+		if !bytes.Equal(p7.Certificates[i].Raw, chain[i].Raw) {
+			t.Fatalf("certificate %d of the bundle does not match the chain of the signer", i)
+		}
+	}
+
+	// the bundle verifies on its own and catches tampered input
+	err = VerifyBundle(bundle, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature bundle: %v", err)
+	}
+	err = VerifyBundle(bundle, []byte("tampered content"))
+	if err == nil {
+		t.Fatal("expected bundle verification over tampered input to fail but it passed")
+	}
+	err = VerifyBundle([]byte("not a bundle"), input)
+	if err == nil || !strings.Contains(err.Error(), "failed to parse signature bundle") {
+		t.Fatalf("expected a bundle parsing error but got: %v", err)
+	}
+
+	// a crafted bundle embedding a validly issued chain whose leaf key
+	// is not ecdsa must fail verification with an error, not a panic
+	rsaChain, err := ParseChain(makeRSALeafChain(t, s))
+	if err != nil {
+		t.Fatalf("failed to parse rsa leaf chain: %v", err)
+	}
+	var chainDER []byte
+	for _, cert := range rsaChain {
+		chainDER = append(chainDER, cert.Raw...)
+	}
+	p7b, err := pkcs7.DegenerateCertificate(chainDER)
+	if err != nil {
+		t.Fatalf("failed to build certs-only pkcs7: %v", err)
+	}
+	badBundle, err := json.Marshal(SignatureBundle{
+		Mode:      b.Mode,
+		SignerID:  b.SignerID,
+		Signature: b.Signature,
+		P7B:       p7b,
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal crafted bundle: %v", err)
+	}
+	err = VerifyBundle(badBundle, input)
+	if err == nil {
+		t.Fatal("expected verification of an rsa leaf bundle to fail but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "not ecdsa") {
+		t.Fatalf("expected a leaf key type error but got: %v", err)
+	}
+}
+
+func TestSignBase64EncodedInput(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// base64 encoded input is decoded before templating, so the
+	// signature verifies against the raw payload
+	encoded := []byte(base64.StdEncoding.EncodeToString(input))
+	sig, err := s.SignData(encoded, Options{InputEncoding: InputEncodingBase64})
+	if err != nil {
+		t.Fatalf("failed to sign base64 encoded input: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature over decoded input: %v", err)
+	}
+
+	// invalid base64 is refused
+	_, err = s.SignData([]byte("this is not base64!"), Options{InputEncoding: InputEncodingBase64})
+	if err == nil {
+		t.Fatal("expected to refuse invalid base64 input but it signed")
+	}
+	if !strings.Contains(err.Error(), "failed to decode base64 input") {
+		t.Fatalf("expected a base64 decoding error but got: %v", err)
+	}
+
+	// unknown encodings are refused
+	_, err = s.SignData(encoded, Options{InputEncoding: "base32"})
+	if err == nil || !strings.Contains(err.Error(), `invalid input encoding "base32"`) {
+		t.Fatalf("expected an invalid encoding error but got: %v", err)
+	}
+}
+
+func TestSignatureValidityMetadata(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// without the option, signatures carry no freshness deadline
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	if !sig.(*ContentSignature).ExpiresAt.IsZero() {
+		t.Fatal("expected no freshness deadline by default")
+	}
+
+	// with the option, the deadline is recorded on the signature
+	sig, err = s.SignData(input, Options{SignatureValidity: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	expiresAt := sig.(*ContentSignature).ExpiresAt
+	if expiresAt.IsZero() || time.Until(expiresAt) > time.Hour {
+		t.Fatalf("expected a deadline about an hour away but got %s", expiresAt)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// a verifier enforcing the deadline passes before it and fails
+	// after it
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatalf("failed to verify fresh signature: %v", err)
+	}
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return expiresAt.Add(time.Minute) }
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpiresAt: expiresAt})
+	if err == nil {
+		t.Fatal("expected verification of an expired signature to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), "no longer honored") {
+		t.Fatalf("expected a signature expiry error but got: %v", err)
+	}
+
+	// without the verify option, the expired deadline is not enforced
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("failed to verify signature without expiry enforcement: %v", err)
+	}
+}
+
+func TestFetchX5URedirectRestrictions(t *testing.T) {
+	// a target host serving a dummy chain body, and an origin host
+	// redirecting to it
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("dummy chain body"))
+	}))
+	defer target.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+"/chain.pem", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	// cross-host redirects are followed by default
+	body, err := fetchX5U(origin.URL + "/chain.pem")
+	if err != nil {
+		t.Fatalf("failed to fetch x5u through redirect: %v", err)
+	}
+	if string(body) != "dummy chain body" {
+		t.Fatalf("unexpected body fetched through redirect: %q", body)
+	}
+
+	// but rejected when the same host restriction is enabled
+	defer func() { X5URedirectSameHost = false }()
+	X5URedirectSameHost = true
+	_, err = fetchX5U(origin.URL + "/chain.pem")
+	if err == nil {
+		t.Fatal("expected a cross-host redirect to be rejected but it was followed")
+	}
+	if !strings.Contains(err.Error(), "different host") {
+		t.Fatalf("expected a cross-host redirect error but got: %v", err)
+	}
+
+	// a redirect loop is aborted after a few hops
+	X5URedirectSameHost = false
+	var loop *httptest.Server
+	loop = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, loop.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer loop.Close()
+	_, err = fetchX5U(loop.URL + "/chain.pem")
+	if err == nil || !strings.Contains(err.Error(), "stopped after 3 redirects") {
+		t.Fatalf("expected the redirect loop to be aborted but got: %v", err)
+	}
+}
+
+func TestSelfVerifyRotatesSuspectEE(t *testing.T) {
+	defer func() {
+		selfVerifyHash = func(sig *ContentSignature, hash []byte, pub *ecdsa.PublicKey) bool {
+			return sig.VerifyHash(hash, pub)
+		}
+	}()
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	origPub := s.eePub.(*ecdsa.PublicKey)
+
+	// a single self-verify failure rotates the end-entity and the
+	// retried signature is returned
+	failures := 1
+	selfVerifyHash = func(sig *ContentSignature, hash []byte, pub *ecdsa.PublicKey) bool {
+		if failures > 0 {
+			failures--
+			return false
+		}
+		return sig.VerifyHash(hash, pub)
+	}
+	sig, err := s.SignData(input, Options{SelfVerify: true})
+	if err != nil {
+		t.Fatalf("failed to sign with self-verify enabled: %v", err)
+	}
+	if s.eePub.(*ecdsa.PublicKey).Equal(origPub) {
+		t.Fatal("expected the suspect end-entity to be rotated but the key is unchanged")
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature issued after rotation: %v", err)
+	}
+
+	// a failure that persists through the rotation is returned as an
+	// error instead of emitting a bad signature
+	selfVerifyHash = func(sig *ContentSignature, hash []byte, pub *ecdsa.PublicKey) bool {
+		return false
+	}
+	_, err = s.SignData(input, Options{SelfVerify: true})
+	if err == nil {
+		t.Fatal("expected signing to fail after a persistent self-verify failure but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "still fails self-verification") {
+		t.Fatalf("expected a self-verification error but got: %v", err)
+	}
+}
+
+func TestVerifyLeafKeyIncompatibleWithSignature(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	p384Signer, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("p384 signer initialization failed with: %v", err)
+	}
+	p256Signer, err := New(PASSINGTESTCASES[1].cfg)
+	if err != nil {
+		t.Fatalf("p256 signer initialization failed with: %v", err)
+	}
+	sig, err := p256Signer.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// a p256 signature presented with a p384 chain is flagged as a
+	// chain mismatch, distinct from a plain invalid signature
+	err = Verify(p384Signer.X5U, sigstr, input)
+	if err == nil {
+		t.Fatal("expected verification with a mismatched chain to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), "incompatible with the P-384 leaf key") {
+		t.Fatalf("expected a leaf key incompatibility error but got: %v", err)
+	}
+
+	// the same signature against the right chain verifies
+	err = Verify(p256Signer.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature against its own chain: %v", err)
+	}
+
+	// a tampered signature on the right curve still reports a plain
+	// verification failure
+	err = Verify(p256Signer.X5U, sigstr, []byte("tampered input data"))
+	if err == nil || !strings.Contains(err.Error(), "ecdsa signature verification failed") {
+		t.Fatalf("expected a plain verification failure but got: %v", err)
+	}
+}
+
+// makeP521IssuerConfig generates a P-521 root and intermediate at
+// runtime and returns a signer configuration issuing under them
+func makeP521IssuerConfig(t *testing.T) signer.Configuration {
+	subject := pkix.Name{
+		Organization:       []string{"Mozilla Corporation"},
+		OrganizationalUnit: []string{"Cloud Services"},
+		Country:            []string{"US"},
+		Province:           []string{"California"},
+		Locality:           []string{"Mountain View"},
+	}
+	rootKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate p521 root key: %v", err)
+	}
+	rootSubject := subject
+	rootSubject.CommonName = "csroot-p521-test"
+	rootTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               rootSubject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(87600 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTpl, rootTpl, rootKey.Public(), rootKey)
+	if err != nil {
+		t.Fatalf("failed to issue p521 root cert: %v", err)
+	}
+	interKey, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate p521 intermediate key: %v", err)
+	}
+	interSubject := subject
+	interSubject.CommonName = "csinter-p521-test"
+	interTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               interSubject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(87600 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	rootCert, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		t.Fatalf("failed to parse p521 root cert: %v", err)
+	}
+	interDER, err := x509.CreateCertificate(rand.Reader, interTpl, rootCert, interKey.Public(), rootKey)
+	if err != nil {
+		t.Fatalf("failed to issue p521 intermediate cert: %v", err)
+	}
+	interKeyDER, err := x509.MarshalECPrivateKey(interKey)
+	if err != nil {
+		t.Fatalf("failed to marshal p521 intermediate key: %v", err)
+	}
+	return signer.Configuration{
+		Type:                Type,
+		ID:                  "p521tester",
+		X5U:                 "file:///tmp/autograph_unit_tests/chains/",
+		ChainUploadLocation: "file:///tmp/autograph_unit_tests/chains/",
+		PrivateKey:          string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: interKeyDER})),
+		PublicKey:           string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: interDER})),
+		CaCert:              string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER})),
+	}
+}
+
+func TestSignAndVerifyP521(t *testing.T) {
+	input := []byte("AUTOGRAPH MONITORING")
+	s, err := New(makeP521IssuerConfig(t))
+	if err != nil {
+		t.Fatalf("p521 signer initialization failed with: %v", err)
+	}
+	if s.Mode != P521ECDSA {
+		t.Fatalf("expected mode %q but got %q", P521ECDSA, s.Mode)
+	}
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	csig := sig.(*ContentSignature)
+	if csig.Len != P521ECDSABYTESIZE {
+		t.Fatalf("expected a signature of %d bytes but got %d", P521ECDSABYTESIZE, csig.Len)
+	}
+	if csig.HashName != "sha512" {
+		t.Fatalf("expected a sha512 templated hash but got %q", csig.HashName)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(sigstr)
+	if err != nil {
+		t.Fatalf("failed to decode marshalled signature: %v", err)
+	}
+	if len(raw) != P521ECDSABYTESIZE {
+		t.Fatalf("marshalled signature is %d bytes, expected %d", len(raw), P521ECDSABYTESIZE)
+	}
+	// the marshalled form round-trips with the right mode
+	parsed, err := Unmarshal(sigstr)
+	if err != nil {
+		t.Fatalf("failed to unmarshal signature: %v", err)
+	}
+	if parsed.Mode != P521ECDSA {
+		t.Fatalf("expected unmarshalled mode %q but got %q", P521ECDSA, parsed.Mode)
+	}
+	// and verifies against the generated chain
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify p521 signature against the chain: %v", err)
+	}
+	// tampering is still detected
+	err = Verify(s.X5U, sigstr, []byte("tampered input data"))
+	if err == nil {
+		t.Fatal("expected verification of tampered input to fail but it passed")
+	}
+}
+
+func TestEENotBeforePinsRotationWindow(t *testing.T) {
+	defer func() {
+		selfVerifyHash = func(sig *ContentSignature, hash []byte, pub *ecdsa.PublicKey) bool {
+			return sig.VerifyHash(hash, pub)
+		}
+	}()
+	input := []byte("foobarbaz1234abcd")
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.Validity = 30 * 24 * time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// fail the first self-verify so signing mints a new end-entity,
+	// with its notBefore pinned by the signing option
+	failures := 1
+	selfVerifyHash = func(sig *ContentSignature, hash []byte, pub *ecdsa.PublicKey) bool {
+		if failures > 0 {
+			failures--
+			return false
+		}
+		return sig.VerifyHash(hash, pub)
+	}
+	pinned := time.Now().Add(-42 * time.Minute).UTC().Truncate(time.Second)
+	sig, err := s.SignData(input, Options{SelfVerify: true, EENotBefore: pinned})
+	if err != nil {
+		t.Fatalf("failed to sign with a pinned rotation window: %v", err)
+	}
+	certs, err := GetX5U(s.X5U)
+	if err != nil {
+		t.Fatalf("failed to fetch chain of rotated end-entity: %v", err)
+	}
+	if !certs[0].NotBefore.Equal(pinned) {
+		t.Fatalf("expected rotated end-entity notBefore %s but got %s", pinned, certs[0].NotBefore)
+	}
+	if !certs[0].NotAfter.Equal(pinned.Add(cfg.Validity)) {
+		t.Fatalf("expected rotated end-entity notAfter %s but got %s", pinned.Add(cfg.Validity), certs[0].NotAfter)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature issued under the pinned window: %v", err)
+	}
+
+	// without the option, the rotated end-entity is backdated by the
+	// clock skew tolerance like at startup
+	bounds := s.rotationBounds(Options{})
+	if !bounds.NotBefore.IsZero() || !bounds.NotAfter.IsZero() {
+		t.Fatalf("expected empty rotation bounds without the option but got %+v", bounds)
+	}
+}
+
+func TestConstantTimeMetadataChecks(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	fingerprint, err := s.KeyFingerprint()
+	if err != nil {
+		t.Fatalf("failed to get key fingerprint: %v", err)
+	}
+
+	// fingerprint pinning still matches case-insensitively
+	_, err = s.SignData(input, Options{ExpectedKeyFingerprint: strings.ToUpper(fingerprint)})
+	if err != nil {
+		t.Fatalf("failed to sign with an upper case pinned fingerprint: %v", err)
+	}
+	// and still rejects a mismatch
+	wrong := strings.Repeat("0", len(fingerprint))
+	_, err = s.SignData(input, Options{ExpectedKeyFingerprint: wrong})
+	if err == nil || !strings.Contains(err.Error(), "does not match expected fingerprint") {
+		t.Fatalf("expected a fingerprint mismatch error but got: %v", err)
+	}
+
+	// expected signer id checks are unchanged
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedSignerID: s.ID})
+	if err != nil {
+		t.Fatalf("failed to verify with the expected signer id: %v", err)
+	}
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedSignerID: "someothersigner"})
+	if err == nil || !strings.Contains(err.Error(), "was issued by signer") {
+		t.Fatalf("expected a signer id mismatch error but got: %v", err)
+	}
+
+	// the comparison helpers behave like regular equality
+	if !constantTimeEqual("abc", "abc") || constantTimeEqual("abc", "abd") || constantTimeEqual("abc", "ab") {
+		t.Fatal("constantTimeEqual does not behave like equality")
+	}
+	if !constantTimeEqualFold("ABC123", "abc123") || constantTimeEqualFold("abc123", "abc124") {
+		t.Fatal("constantTimeEqualFold does not behave like case-insensitive equality")
+	}
+}
+
+func TestChainInfo(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	info, err := s.ChainInfo()
+	if err != nil {
+		t.Fatalf("failed to get chain info: %v", err)
+	}
+	if info.EELabel != s.eeLabel {
+		t.Fatalf("expected ee label %q but got %q", s.eeLabel, info.EELabel)
+	}
+	if !info.EEExpiry.Equal(s.eeExpiry) || info.EEExpiry.IsZero() {
+		t.Fatalf("expected ee expiry %s but got %s", s.eeExpiry, info.EEExpiry)
+	}
+	if info.CaCert != PASSINGTESTCASES[0].cfg.CaCert {
+		t.Fatal("returned root certificate does not match the configuration")
+	}
+
+	// the returned chain holds the end-entity, intermediate and root
+	var der []byte
+	rest := []byte(info.Chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		der = append(der, block.Bytes...)
+	}
+	certs, err := x509.ParseCertificates(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificates from chain info: %v", err)
+	}
+	if len(certs) != 3 {
+		t.Fatalf("expected 3 certificates in chain info but got %d", len(certs))
+	}
+	if !time.Time(certs[0].NotAfter).Equal(info.EEExpiry) {
+		t.Fatalf("chain end-entity expires %s but info reports %s", certs[0].NotAfter, info.EEExpiry)
+	}
+}
+
+func TestRotationThreshold(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.Validity = 30 * 24 * time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+
+	// without a threshold, a valid end-entity is never rotated
+	if s.eeNeedsRotation(s.X5U) {
+		t.Fatal("expected no rotation without a threshold but one was requested")
+	}
+
+	// an end-entity expiring tomorrow is within a 2 day threshold
+	s.rotationThreshold = 48 * time.Hour
+	timeNow = func() time.Time { return s.eeExpiry.Add(-24 * time.Hour) }
+	if !s.eeNeedsRotation(s.X5U) {
+		t.Fatal("expected an end-entity expiring tomorrow to need rotation but it was kept")
+	}
+
+	// and outside a 1 hour threshold
+	s.rotationThreshold = time.Hour
+	if s.eeNeedsRotation(s.X5U) {
+		t.Fatal("expected an end-entity expiring tomorrow to be kept but it was rotated")
+	}
+
+	// an unfetchable chain cannot be reused
+	if !s.eeNeedsRotation("file:///nonexistent/chain.pem") {
+		t.Fatal("expected an unfetchable chain to need rotation but it was kept")
+	}
+
+	// the threshold round-trips through the configuration
+	cfg.RotationThreshold = 48 * time.Hour
+	s2, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if s2.Config().RotationThreshold != 48*time.Hour {
+		t.Fatalf("expected a rotation threshold of 48h in the configuration but got %s",
+			s2.Config().RotationThreshold)
+	}
+}
+
+func TestFetchX5UMaxSize(t *testing.T) {
+	defer func() { MaxX5USize = DefaultMaxX5USize }()
+	MaxX5USize = 1024
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("A"), 2048))
+	}))
+	defer srv.Close()
+
+	// an oversized body is rejected instead of being read into memory
+	_, err := fetchX5U(srv.URL + "/chain.pem")
+	if err == nil {
+		t.Fatal("expected an oversized x5u body to be rejected but it was read")
+	}
+	if !strings.Contains(err.Error(), "exceeds the maximum size of 1024 bytes") {
+		t.Fatalf("expected a maximum size error but got: %v", err)
+	}
+
+	// a body within the limit is read in full
+	small := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("B"), 1024))
+	}))
+	defer small.Close()
+	body, err := fetchX5U(small.URL + "/chain.pem")
+	if err != nil {
+		t.Fatalf("failed to fetch x5u within the size limit: %v", err)
+	}
+	if len(body) != 1024 {
+		t.Fatalf("expected a 1024 bytes body but got %d", len(body))
+	}
+}
+
+func TestTrustedFingerprints(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	active, err := s.KeyFingerprint()
+	if err != nil {
+		t.Fatalf("failed to get active key fingerprint: %v", err)
+	}
+
+	// without a database, only the active end-entity is trusted
+	fps, err := s.TrustedFingerprints()
+	if err != nil {
+		t.Fatalf("failed to get trusted fingerprints: %v", err)
+	}
+	if len(fps) != 1 || fps[0] != active {
+		t.Fatalf("expected only the active fingerprint %q but got %q", active, fps)
+	}
+
+	// a retired end-entity within the window contributes its own
+	// fingerprint: simulate the database records with the x5u of the
+	// chain the signer had before a rotation
+	retiredX5U := s.X5U
+	// rotate with a distinct validity window, so the new chain gets its
+	// own name and the retired one remains fetchable
+	nb := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = s.RotateEE(RotateEEOptions{NotBefore: nb, NotAfter: nb.Add(100 * 24 * time.Hour)})
+	if err != nil {
+		t.Fatalf("failed to rotate end-entity: %v", err)
+	}
+	retired, err := fingerprintX5Us([]string{s.X5U, retiredX5U, retiredX5U})
+	if err != nil {
+		t.Fatalf("failed to fingerprint end-entity chains: %v", err)
+	}
+	if len(retired) != 2 {
+		t.Fatalf("expected 2 deduplicated fingerprints but got %d", len(retired))
+	}
+	rotatedActive, err := s.KeyFingerprint()
+	if err != nil {
+		t.Fatalf("failed to get rotated key fingerprint: %v", err)
+	}
+	if retired[0] != rotatedActive {
+		t.Fatal("expected the first fingerprint to be the active end-entity")
+	}
+	if retired[1] == rotatedActive {
+		t.Fatal("expected the retired end-entity to have a distinct fingerprint")
+	}
+}
+
+func TestVerificationErrorSteps(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	// an unreachable x5u location fails at the retrieval step
+	err = Verify("file:///nonexistent/autograph_unit_tests/chain.pem", sigstr, input)
+	verr, ok := err.(*VerificationError)
+	if !ok {
+		t.Fatalf("expected a *VerificationError but got %T: %v", err, err)
+	}
+	if verr.Step != ErrX5URetrieval {
+		t.Fatalf("expected step %v but got %v", ErrX5URetrieval, verr.Step)
+	}
+	if verr.Cause() == nil {
+		t.Fatal("expected the verification error to carry its cause")
+	}
+	// a chain that does not decode fails at the validation step
+	garbage, err := ioutil.TempFile("", "autograph_test_garbage_chain")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(garbage.Name())
+	if _, err = garbage.WriteString("this is not a certificate chain"); err != nil {
+		t.Fatalf("failed to write temp file: %v", err)
+	}
+	garbage.Close()
+	err = Verify("file://"+garbage.Name(), sigstr, input)
+	verr, ok = err.(*VerificationError)
+	if !ok {
+		t.Fatalf("expected a *VerificationError but got %T: %v", err, err)
+	}
+	if verr.Step != ErrChainValidation {
+		t.Fatalf("expected step %v but got %v", ErrChainValidation, verr.Step)
+	}
+	// a tampered input fails at the signature verification step
+	err = Verify(s.X5U, sigstr, []byte("tampered input data"))
+	verr, ok = err.(*VerificationError)
+	if !ok {
+		t.Fatalf("expected a *VerificationError but got %T: %v", err, err)
+	}
+	if verr.Step != ErrSignatureVerification {
+		t.Fatalf("expected step %v but got %v", ErrSignatureVerification, verr.Step)
+	}
+	// the message carries both the step and the underlying cause
+	if !strings.Contains(err.Error(), "does not verify against the chain") ||
+		!strings.Contains(err.Error(), "ecdsa signature verification failed") {
+		t.Fatalf("expected the error message to carry step and cause, got: %v", err)
+	}
+	// a valid verification still returns nil, not a typed error
+	err = Verify(s.X5U, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify valid signature: %v", err)
+	}
+}
+
+func TestSignDataWithManifest(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, entry, err := s.SignDataWithManifest(input, "blocklist.json", nil)
+	if err != nil {
+		t.Fatalf("failed to sign data with manifest: %v", err)
+	}
+	fields := strings.Fields(entry)
+	if len(fields) != 4 {
+		t.Fatalf("expected 4 fields in manifest entry but got %d: %q", len(fields), entry)
+	}
+	if fields[0] != "blocklist.json" {
+		t.Fatalf("expected filename %q in manifest entry but got %q", "blocklist.json", fields[0])
+	}
+	alg, hash := MakeTemplatedHash(input, s.Mode)
+	if fields[1] != alg {
+		t.Fatalf("expected hash algorithm %q in manifest entry but got %q", alg, fields[1])
+	}
+	if fields[2] != hex.EncodeToString(hash) {
+		t.Fatalf("manifest hash %q does not match the templated hash %q", fields[2], hex.EncodeToString(hash))
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	if fields[3] != sigstr {
+		t.Fatalf("manifest signature %q does not match the marshalled signature %q", fields[3], sigstr)
+	}
+	// the signature of the entry verifies against the chain
+	err = Verify(s.X5U, fields[3], input)
+	if err != nil {
+		t.Fatalf("failed to verify manifest signature: %v", err)
+	}
+	// filenames that would break the manifest format are refused
+	_, _, err = s.SignDataWithManifest(input, "bad name.json", nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid manifest filename") {
+		t.Fatalf("expected an invalid filename error but got: %v", err)
+	}
+	// options that transform the input cannot produce a manifest entry
+	b64input := []byte(base64.StdEncoding.EncodeToString(input))
+	_, _, err = s.SignDataWithManifest(b64input, "blocklist.json", Options{InputEncoding: InputEncodingBase64})
+	if err == nil || !strings.Contains(err.Error(), "cannot build a manifest entry") {
+		t.Fatalf("expected a transformed input error but got: %v", err)
+	}
+}
+
+func TestVerifyWithCandidatePrefixes(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	oldPrefix := SignaturePrefix
+	newPrefix := "Content-Signature-v2:\x00"
+
+	// one signature under the standard prefix, one under the
+	// migration prefix
+	oldSig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	oldSigStr, err := oldSig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	_, newHash := MakeTemplatedHashWithPrefix(input, newPrefix, s.Mode)
+	newSig, err := s.SignHash(newHash, nil)
+	if err != nil {
+		t.Fatalf("failed to sign hash: %v", err)
+	}
+	newSigStr, err := newSig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+
+	// both verify against the candidate list, and the matched prefix
+	// is reported
+	candidates := []string{oldPrefix, newPrefix}
+	var matched string
+	err = VerifyWithOptions(s.X5U, oldSigStr, input, VerifyOptions{CandidatePrefixes: candidates, MatchedPrefix: &matched})
+	if err != nil {
+		t.Fatalf("failed to verify old-prefix signature: %v", err)
+	}
+	if matched != oldPrefix {
+		t.Fatalf("expected the old prefix to match but got %q", matched)
+	}
+	err = VerifyWithOptions(s.X5U, newSigStr, input, VerifyOptions{CandidatePrefixes: candidates, MatchedPrefix: &matched})
+	if err != nil {
+		t.Fatalf("failed to verify new-prefix signature: %v", err)
+	}
+	if matched != newPrefix {
+		t.Fatalf("expected the new prefix to match but got %q", matched)
+	}
+
+	// without candidates, only the standard prefix verifies
+	err = Verify(s.X5U, oldSigStr, input)
+	if err != nil {
+		t.Fatalf("failed to verify old-prefix signature with the default prefix: %v", err)
+	}
+	err = Verify(s.X5U, newSigStr, input)
+	if err == nil {
+		t.Fatal("expected default verification of the new-prefix signature to fail but it passed")
+	}
+
+	// a list without the right prefix fails
+	err = VerifyWithOptions(s.X5U, newSigStr, input, VerifyOptions{CandidatePrefixes: []string{oldPrefix}})
+	if err == nil || !strings.Contains(err.Error(), "against all 1 candidate prefixes") {
+		t.Fatalf("expected verification against the wrong candidates to fail but got: %v", err)
+	}
+}
+
+func TestVerificationCache(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	// read the chain the signer uploaded so a counting server can
+	// serve it and the test can observe how often it is fetched
+	chain, err := ioutil.ReadFile(strings.TrimPrefix(s.X5U, "file://"))
+	if err != nil {
+		t.Fatalf("failed to read the chain uploaded by the signer: %v", err)
+	}
+	var fetches int
+	served := chain
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(served)
+	}))
+	defer srv.Close()
+
+	defer func() { timeNow = time.Now }()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	cache := NewVerificationCache(5*time.Minute, 10*time.Second)
+
+	// a successful verification is served from the cache without
+	// fetching the chain again
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("failed to verify cached signature: %v", err)
+	}
+	if fetches != 1 {
+		t.Fatalf("expected 1 chain fetch for 2 verifications but got %d", fetches)
+	}
+
+	// until the positive ttl expires
+	now = now.Add(5*time.Minute + time.Second)
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("failed to verify signature after cache expiry: %v", err)
+	}
+	if fetches != 2 {
+		t.Fatalf("expected an expired entry to fetch the chain again, got %d fetches", fetches)
+	}
+
+	// a failed verification is cached too, for a shorter time
+	served = []byte("this is not a certificate chain")
+	now = now.Add(6 * time.Minute)
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	verr, ok := err.(*VerificationError)
+	if !ok || verr.Step != ErrChainValidation {
+		t.Fatalf("expected a chain validation error but got %T: %v", err, err)
+	}
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	if verr, ok = err.(*VerificationError); !ok || verr.Step != ErrChainValidation {
+		t.Fatalf("expected the cached chain validation error but got %T: %v", err, err)
+	}
+	if fetches != 3 {
+		t.Fatalf("expected 1 chain fetch for 2 failed verifications but got %d", fetches)
+	}
+	now = now.Add(11 * time.Second)
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	if err == nil {
+		t.Fatal("expected verification against a garbage chain to fail but it succeeded")
+	}
+	if fetches != 4 {
+		t.Fatalf("expected an expired failure to fetch the chain again, got %d fetches", fetches)
+	}
+
+	// when a fetch observes that the chain changed, cached results
+	// computed against the previous chain are dropped immediately,
+	// without waiting for their ttl
+	served = chain
+	input2 := []byte("a second input to force a fetch")
+	sig2, err := s.SignData(input2, nil)
+	if err != nil {
+		t.Fatalf("failed to sign second input: %v", err)
+	}
+	sig2str, err := sig2.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal second signature: %v", err)
+	}
+	err = cache.Verify(srv.URL, sig2str, input2, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("failed to verify second signature against the repaired chain: %v", err)
+	}
+	err = cache.Verify(srv.URL, sigstr, input, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("expected the cached failure to be invalidated by the repaired chain but got: %v", err)
+	}
+	if fetches != 6 {
+		t.Fatalf("expected the repaired chain to be fetched for both signatures, got %d fetches", fetches)
+	}
+}
+
+// x5uTransportFunc adapts a function to the http.RoundTripper
+// interface, so tests can inject canned x5u responses
+type x5uTransportFunc func(*http.Request) (*http.Response, error)
+
+func (f x5uTransportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestX5UChainCache(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	chain, err := ioutil.ReadFile(strings.TrimPrefix(s.X5U, "file://"))
+	if err != nil {
+		t.Fatalf("failed to read the chain uploaded by the signer: %v", err)
+	}
+	var requests int
+	cacheControl := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Write(chain)
+	}))
+	defer srv.Close()
+
+	defer func() {
+		X5UCacheTTL = 0
+		timeNow = time.Now
+	}()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	X5UCacheTTL = 5 * time.Minute
+
+	// a second verification against the same x5u is served from the
+	// cache without a second request
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature with a cached chain: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected 1 request for 2 verifications but got %d", requests)
+	}
+
+	// until the ttl expires
+	now = now.Add(X5UCacheTTL + time.Second)
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature after cache expiry: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("expected an expired entry to fetch the chain again, got %d requests", requests)
+	}
+
+	// a max-age below the ttl shortens the lifetime of the entry
+	cacheControl = "public, max-age=30"
+	now = now.Add(X5UCacheTTL + time.Second)
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected a fresh fetch but got %d requests", requests)
+	}
+	now = now.Add(31 * time.Second)
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature after max-age expiry: %v", err)
+	}
+	if requests != 4 {
+		t.Fatalf("expected the max-age to expire the entry before the ttl, got %d requests", requests)
+	}
+
+	// no-store disables caching entirely
+	cacheControl = "no-store"
+	now = now.Add(31 * time.Second)
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	err = Verify(srv.URL, sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+	if requests != 6 {
+		t.Fatalf("expected no-store responses to never be cached, got %d requests", requests)
+	}
+
+	// an injected client replaces the default transport
+	X5UCacheTTL = 0
+	var injected int
+	X5UClient = &http.Client{Transport: x5uTransportFunc(func(req *http.Request) (*http.Response, error) {
+		injected++
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewReader(chain)),
+		}, nil
+	})}
+	defer func() { X5UClient = nil }()
+	err = Verify("http://chains.invalid/chain.pem", sigstr, input)
+	if err != nil {
+		t.Fatalf("failed to verify signature with an injected client: %v", err)
+	}
+	if injected != 1 {
+		t.Fatalf("expected the injected client to serve the chain, got %d requests", injected)
+	}
+}
+
+func TestConfiguredHTTPClient(t *testing.T) {
+	// initialize a first signer only to obtain a valid chain to serve
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	chain, err := ioutil.ReadFile(strings.TrimPrefix(s.X5U, "file://"))
+	if err != nil {
+		t.Fatalf("failed to read the chain uploaded by the signer: %v", err)
+	}
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(chain)
+	}))
+	defer srv.Close()
+
+	// a signer configured with a custom http client uses it for its
+	// own chain operations
+	var viaClient int
+	cfg := PASSINGTESTCASES[0].cfg
+	cfg.HTTPClient = &http.Client{Transport: x5uTransportFunc(func(req *http.Request) (*http.Response, error) {
+		viaClient++
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	s2, err := New(cfg)
+	if err != nil {
+		t.Fatalf("signer initialization with a custom http client failed with: %v", err)
+	}
+	s2.X5U = srv.URL
+	err = s2.CheckHealth()
+	if err != nil {
+		t.Fatalf("health check failed with: %v", err)
+	}
+	if viaClient != 1 || requests != 1 {
+		t.Fatalf("expected 1 chain fetch through the injected client but got %d via client and %d requests", viaClient, requests)
+	}
+
+	// a signer without a custom client is unaffected
+	if s.httpClient != nil {
+		t.Fatal("expected no http client on a signer configured without one")
+	}
+}
+
+func TestVerifyExpectedRootHash(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	input := []byte("foobarbaz1234abcd")
+	sig, err := s.SignData(input, nil)
+	if err != nil {
+		t.Fatalf("failed to sign data: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	block, _ := pem.Decode([]byte(PASSINGTESTCASES[0].cfg.CaCert))
+	if block == nil {
+		t.Fatal("failed to decode the configured root certificate")
+	}
+	h := sha256.Sum256(block.Bytes)
+	rootHash := fmt.Sprintf("%X", h[:])
+
+	// a chain terminating in the pinned root verifies
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedRootHash: rootHash})
+	if err != nil {
+		t.Fatalf("failed to verify signature with a matching root hash: %v", err)
+	}
+
+	// the colon separated lowercase spelling of monitoring
+	// configurations is accepted too
+	var pretty []string
+	for _, b := range h {
+		pretty = append(pretty, fmt.Sprintf("%02x", b))
+	}
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedRootHash: strings.Join(pretty, ":")})
+	if err != nil {
+		t.Fatalf("failed to verify signature with a colon separated root hash: %v", err)
+	}
+
+	// a chain terminating in any other root is rejected
+	err = VerifyWithOptions(s.X5U, sigstr, input, VerifyOptions{ExpectedRootHash: strings.Repeat("00", 32)})
+	if err == nil {
+		t.Fatal("expected verification with a mismatching root hash to fail but it succeeded")
+	}
+	if !strings.Contains(err.Error(), "expected root hash") {
+		t.Fatalf("expected a root hash mismatch error but got: %v", err)
+	}
+}
@@ -0,0 +1,385 @@
+package contentsignaturepki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CurveEncodingNamed encodes the curve of end-entity public keys
+	// as a named curve OID, the common case and the default
+	CurveEncodingNamed = "named_curve"
+
+	// CurveEncodingExplicit encodes the curve of end-entity public
+	// keys as explicit domain parameters, for verifiers that do not
+	// accept named curves
+	CurveEncodingExplicit = "explicit"
+)
+
+var (
+	// id-ecPublicKey, the algorithm identifier of ecdsa public keys
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+	// prime-field, the field type of the nist prime curves
+	oidPrimeField = asn1.ObjectIdentifier{1, 2, 840, 10045, 1, 1}
+
+	// ecdsa-with-SHA256 and ecdsa-with-SHA384 signature algorithms
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+)
+
+// certificateASN mirrors the outer layer of an x509 certificate just
+// closely enough to swap out its tbs certificate and signature without
+// interpreting the rest
+type certificateASN struct {
+	TBSCertificate     asn1.RawValue
+	SignatureAlgorithm asn1.RawValue
+	SignatureValue     asn1.BitString
+}
+
+// publicKeyInfoASN mirrors the subject public key info sequence of an
+// x509 certificate
+type publicKeyInfoASN struct {
+	Algorithm algorithmIdentifierASN
+	PublicKey asn1.BitString
+}
+
+// algorithmIdentifierASN carries an algorithm OID and its raw
+// parameters, which for ec keys hold either a named curve OID or
+// explicit domain parameters
+type algorithmIdentifierASN struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+// ecExplicitParams are the explicit ec domain parameters of rfc 3279
+// section 2.3.5, the form picky verifiers require instead of a named
+// curve OID
+type ecExplicitParams struct {
+	Version  int
+	FieldID  ecFieldID
+	Curve    ecCurveCoefficients
+	Base     []byte
+	Order    *big.Int
+	Cofactor int `asn1:"optional"`
+}
+
+// ecFieldID identifies the prime field a curve is defined over
+type ecFieldID struct {
+	FieldType asn1.ObjectIdentifier
+	Prime     *big.Int
+}
+
+// ecCurveCoefficients are the a and b coefficients of the curve
+// equation, encoded as field elements
+type ecCurveCoefficients struct {
+	A []byte
+	B []byte
+}
+
+// makeExplicitParams builds the explicit domain parameters of a nist
+// prime curve, whose a coefficient is always p minus 3
+func makeExplicitParams(curve elliptic.Curve) ecExplicitParams {
+	p := curve.Params()
+	byteLen := (p.BitSize + 7) / 8
+	a := new(big.Int).Sub(p.P, big.NewInt(3))
+	return ecExplicitParams{
+		Version: 1,
+		FieldID: ecFieldID{
+			FieldType: oidPrimeField,
+			Prime:     p.P,
+		},
+		Curve: ecCurveCoefficients{
+			A: a.FillBytes(make([]byte, byteLen)),
+			B: p.B.FillBytes(make([]byte, byteLen)),
+		},
+		Base:     elliptic.Marshal(curve, p.Gx, p.Gy),
+		Order:    p.N,
+		Cofactor: 1,
+	}
+}
+
+// splitTBSFields breaks the fields of a tbs certificate sequence into
+// their raw encodings, so one of them can be replaced without
+// re-encoding the others
+func splitTBSFields(tbs asn1.RawValue) (fields []asn1.RawValue, err error) {
+	rest := tbs.Bytes
+	for len(rest) > 0 {
+		var field asn1.RawValue
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse tbs certificate field")
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// tbsSPKIIndex returns the position of the subject public key info in
+// the tbs certificate fields, which moves by one when the optional
+// version field is present
+func tbsSPKIIndex(fields []asn1.RawValue) (int, error) {
+	idx := 5
+	if len(fields) > 0 && fields[0].Class == asn1.ClassContextSpecific && fields[0].Tag == 0 {
+		idx = 6
+	}
+	if len(fields) <= idx {
+		return 0, errors.New("tbs certificate has too few fields")
+	}
+	return idx, nil
+}
+
+// explicitCurveEncode converts a certificate using a named curve OID
+// into one carrying explicit ec domain parameters, re-signing the
+// modified tbs certificate with the issuer private key. The returned
+// der is a valid certificate for external verifiers, but the stdlib
+// x509 parser rejects it, see parseExplicitCurveCert
+func explicitCurveEncode(certDER []byte, issuerPriv crypto.PrivateKey, rng io.Reader) ([]byte, error) {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate for explicit curve encoding")
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("explicit curve encoding requires an ecdsa public key")
+	}
+	var outer certificateASN
+	_, err = asn1.Unmarshal(certDER, &outer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate structure")
+	}
+	fields, err := splitTBSFields(outer.TBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	spkiIdx, err := tbsSPKIIndex(fields)
+	if err != nil {
+		return nil, err
+	}
+	var spki publicKeyInfoASN
+	_, err = asn1.Unmarshal(fields[spkiIdx].FullBytes, &spki)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse subject public key info")
+	}
+	paramsDER, err := asn1.Marshal(makeExplicitParams(pub.Curve))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal explicit curve parameters")
+	}
+	spki.Algorithm.Parameters = asn1.RawValue{FullBytes: paramsDER}
+	newSPKI, err := asn1.Marshal(spki)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal subject public key info")
+	}
+	fields[spkiIdx] = asn1.RawValue{FullBytes: newSPKI}
+
+	// reassemble the tbs certificate with the new spki
+	var tbsBytes []byte
+	for _, field := range fields {
+		tbsBytes = append(tbsBytes, field.FullBytes...)
+	}
+	newTBS, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSequence,
+		IsCompound: true,
+		Bytes:      tbsBytes,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal tbs certificate")
+	}
+
+	// re-sign the modified tbs with the issuer key
+	var digest []byte
+	switch cert.SignatureAlgorithm {
+	case x509.ECDSAWithSHA256:
+		sum := sha256.Sum256(newTBS)
+		digest = sum[:]
+	case x509.ECDSAWithSHA384:
+		sum := sha512.Sum384(newTBS)
+		digest = sum[:]
+	default:
+		return nil, errors.Errorf("unsupported signature algorithm %q for explicit curve encoding", cert.SignatureAlgorithm)
+	}
+	issuerSigner, ok := issuerPriv.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("issuer private key does not implement crypto.Signer")
+	}
+	issuerPub, ok := issuerSigner.Public().(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("explicit curve encoding requires an ecdsa issuer key")
+	}
+	sigBytes, err := issuerSigner.Sign(rng, digest, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to re-sign certificate")
+	}
+	// hsm signers may return raw r||s instead of der, normalize
+	sigLen := 2 * ((issuerPub.Params().BitSize + 7) / 8)
+	r, s, err := parseSignatureOutput(sigBytes, sigLen)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate signature")
+	}
+	sigDER, err := asn1.Marshal(ecdsaAsn1Signature{R: r, S: s})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal certificate signature")
+	}
+	return asn1.Marshal(certificateASN{
+		TBSCertificate:     asn1.RawValue{FullBytes: newTBS},
+		SignatureAlgorithm: outer.SignatureAlgorithm,
+		SignatureValue:     asn1.BitString{Bytes: sigDER, BitLength: len(sigDER) * 8},
+	})
+}
+
+// explicitCurveCert is the parsed form of a certificate carrying
+// explicit ec domain parameters, which the stdlib x509 parser rejects
+type explicitCurveCert struct {
+	raw       []byte
+	rawTBS    []byte
+	pub       *ecdsa.PublicKey
+	notBefore time.Time
+	notAfter  time.Time
+	hashAlg   crypto.Hash
+	signature []byte
+}
+
+// parseExplicitCurveCert parses a certificate whose public key encodes
+// the curve as explicit domain parameters, extracting the fields needed
+// to verify it manually
+func parseExplicitCurveCert(der []byte) (*explicitCurveCert, error) {
+	var outer certificateASN
+	rest, err := asn1.Unmarshal(der, &outer)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate structure")
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after certificate")
+	}
+	fields, err := splitTBSFields(outer.TBSCertificate)
+	if err != nil {
+		return nil, err
+	}
+	spkiIdx, err := tbsSPKIIndex(fields)
+	if err != nil {
+		return nil, err
+	}
+	// the validity sequence sits two fields before the spki
+	var validity struct {
+		NotBefore, NotAfter asn1.RawValue
+	}
+	_, err = asn1.Unmarshal(fields[spkiIdx-2].FullBytes, &validity)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate validity")
+	}
+	notBefore, err := parseASN1Time(validity.NotBefore)
+	if err != nil {
+		return nil, err
+	}
+	notAfter, err := parseASN1Time(validity.NotAfter)
+	if err != nil {
+		return nil, err
+	}
+	var spki publicKeyInfoASN
+	_, err = asn1.Unmarshal(fields[spkiIdx].FullBytes, &spki)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse subject public key info")
+	}
+	if !spki.Algorithm.Algorithm.Equal(oidPublicKeyECDSA) {
+		return nil, errors.New("public key algorithm is not ecdsa")
+	}
+	var params ecExplicitParams
+	_, err = asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse explicit curve parameters")
+	}
+	var curve elliptic.Curve
+	switch {
+	case params.FieldID.Prime.Cmp(elliptic.P256().Params().P) == 0:
+		curve = elliptic.P256()
+	case params.FieldID.Prime.Cmp(elliptic.P384().Params().P) == 0:
+		curve = elliptic.P384()
+	default:
+		return nil, errors.New("explicit curve parameters do not match a supported curve")
+	}
+	x, y := elliptic.Unmarshal(curve, spki.PublicKey.RightAlign())
+	if x == nil {
+		return nil, errors.New("failed to parse ec public key point")
+	}
+	var sigAlg algorithmIdentifierASN
+	_, err = asn1.Unmarshal(outer.SignatureAlgorithm.FullBytes, &sigAlg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signature algorithm")
+	}
+	var hashAlg crypto.Hash
+	switch {
+	case sigAlg.Algorithm.Equal(oidSignatureECDSAWithSHA256):
+		hashAlg = crypto.SHA256
+	case sigAlg.Algorithm.Equal(oidSignatureECDSAWithSHA384):
+		hashAlg = crypto.SHA384
+	default:
+		return nil, errors.Errorf("unsupported signature algorithm %v", sigAlg.Algorithm)
+	}
+	return &explicitCurveCert{
+		raw:       der,
+		rawTBS:    outer.TBSCertificate.FullBytes,
+		pub:       &ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		notBefore: notBefore,
+		notAfter:  notAfter,
+		hashAlg:   hashAlg,
+		signature: outer.SignatureValue.RightAlign(),
+	}, nil
+}
+
+// parseASN1Time converts a raw utc or generalized time into a time.Time
+func parseASN1Time(raw asn1.RawValue) (t time.Time, err error) {
+	switch raw.Tag {
+	case asn1.TagUTCTime:
+		_, err = asn1.Unmarshal(raw.FullBytes, &t)
+	case asn1.TagGeneralizedTime:
+		_, err = asn1.UnmarshalWithParams(raw.FullBytes, &t, "generalized")
+	default:
+		err = errors.Errorf("unsupported time tag %d in certificate validity", raw.Tag)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "failed to parse certificate validity time")
+	}
+	return
+}
+
+// verify checks the validity window of the certificate as of a given
+// time, zero meaning now, and its signature against the issuer public
+// key. Unlike the stdlib chain verification used for named curve
+// certificates, extensions are not interpreted.
+func (c *explicitCurveCert) verify(issuerPub *ecdsa.PublicKey, at time.Time) error {
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if at.Before(c.notBefore) || at.After(c.notAfter) {
+		return errors.New("certificate has expired or is not yet valid")
+	}
+	h := c.hashAlg.New()
+	h.Write(c.rawTBS)
+	if !ecdsa.VerifyASN1(issuerPub, h.Sum(nil), c.signature) {
+		return errors.New("invalid signature on explicit curve certificate")
+	}
+	return nil
+}
+
+// certificate returns a minimal stdlib certificate carrying the fields
+// the verification paths consume, for use after a successful manual
+// verification
+func (c *explicitCurveCert) certificate() *x509.Certificate {
+	return &x509.Certificate{
+		Raw:       c.raw,
+		PublicKey: c.pub,
+		NotBefore: c.notBefore,
+		NotAfter:  c.notAfter,
+	}
+}
@@ -0,0 +1,183 @@
+package contentsignaturepki // import "go.mozilla.org/autograph/signer/contentsignaturepki"
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"go.mozilla.org/autograph/signer"
+
+	"github.com/pkg/errors"
+)
+
+// domain separation prefixes of the merkle tree, following rfc 6962, so
+// a leaf hash can never be confused with an interior node hash
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleTree is a merkle tree computed over a set of files, whose root
+// can be signed with a single content signature. Individual files are
+// then verified against that signature with an inclusion proof, without
+// retrieving or hashing the rest of the set.
+type MerkleTree struct {
+	mode string
+	// levels[0] holds the leaf hashes, each following level holds the
+	// parents of the previous one, up to the root. An odd node at the
+	// end of a level is promoted to the next level unchanged.
+	levels [][][]byte
+}
+
+// newMerkleHash returns the hash function of the tree for a given
+// signing mode, matching the hash the mode signs with
+func newMerkleHash(mode string) hash.Hash {
+	switch mode {
+	case P384ECDSA:
+		return sha512.New384()
+	case P521ECDSA:
+		return sha512.New()
+	default:
+		return sha256.New()
+	}
+}
+
+// merkleLeafHash returns the hash of a leaf
+func merkleLeafHash(mode string, data []byte) []byte {
+	md := newMerkleHash(mode)
+	md.Write([]byte{merkleLeafPrefix})
+	md.Write(data)
+	return md.Sum(nil)
+}
+
+// merkleNodeHash returns the hash of an interior node from its children
+func merkleNodeHash(mode string, left, right []byte) []byte {
+	md := newMerkleHash(mode)
+	md.Write([]byte{merkleNodePrefix})
+	md.Write(left)
+	md.Write(right)
+	return md.Sum(nil)
+}
+
+// NewMerkleTree computes a merkle tree over a set of files using the
+// hash function of the given signing mode. The order of the files is
+// significant: inclusion proofs are issued and verified by index.
+func NewMerkleTree(mode string, files [][]byte) (*MerkleTree, error) {
+	if len(files) == 0 {
+		return nil, errors.New("contentsignaturepki: cannot build a merkle tree without files")
+	}
+	t := &MerkleTree{mode: mode}
+	level := make([][]byte, len(files))
+	for i, file := range files {
+		level[i] = merkleLeafHash(mode, file)
+	}
+	t.levels = append(t.levels, level)
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				// odd node at the end of the level, promote it
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNodeHash(mode, level[i], level[i+1]))
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t, nil
+}
+
+// Root returns the root hash of the tree
+func (t *MerkleTree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Len returns the number of files the tree was computed over, which
+// verifiers need alongside a file index to replay an inclusion proof
+func (t *MerkleTree) Len() int {
+	return len(t.levels[0])
+}
+
+// InclusionProof returns the sibling hashes proving that the file at the
+// given index is part of the tree, ordered from the leaf level up. A
+// level where the node is promoted contributes no sibling.
+func (t *MerkleTree) InclusionProof(index int) (proof [][]byte, err error) {
+	if index < 0 || index >= t.Len() {
+		return nil, errors.Errorf("contentsignaturepki: index %d is out of range of a tree of %d files", index, t.Len())
+	}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if index%2 == 0 && index+1 == len(level) {
+			// promoted node, no sibling at this level
+			index /= 2
+			continue
+		}
+		sibling := index + 1
+		if index%2 == 1 {
+			sibling = index - 1
+		}
+		proof = append(proof, level[sibling])
+		index /= 2
+	}
+	return proof, nil
+}
+
+// SignMerkleRoot signs the root of a merkle tree the same way SignData
+// signs regular input, templating included, and returns the signature.
+// Files of the tree are verified against it with VerifyMerkleInclusion
+// and the regular signature verification over the root.
+func (s *ContentSigner) SignMerkleRoot(t *MerkleTree, options interface{}) (signer.Signature, error) {
+	return s.SignData(t.Root(), options)
+}
+
+// VerifyMerkleInclusion replays an inclusion proof for a file at a given
+// index in a tree of total files, and returns an error unless the proof
+// reaches the given root
+func VerifyMerkleInclusion(mode string, file []byte, index, total int, proof [][]byte, root []byte) error {
+	if index < 0 || index >= total {
+		return fmt.Errorf("index %d is out of range of a tree of %d files", index, total)
+	}
+	node := merkleLeafHash(mode, file)
+	width := total
+	pos := 0
+	for width > 1 {
+		if index%2 == 0 && index+1 == width {
+			// promoted node, no sibling at this level
+			index /= 2
+			width = (width + 1) / 2
+			continue
+		}
+		if pos >= len(proof) {
+			return fmt.Errorf("inclusion proof is too short for a tree of %d files", total)
+		}
+		if index%2 == 0 {
+			node = merkleNodeHash(mode, node, proof[pos])
+		} else {
+			node = merkleNodeHash(mode, proof[pos], node)
+		}
+		pos++
+		index /= 2
+		width = (width + 1) / 2
+	}
+	if pos != len(proof) {
+		return fmt.Errorf("inclusion proof has %d unused elements", len(proof)-pos)
+	}
+	if !bytes.Equal(node, root) {
+		return fmt.Errorf("inclusion proof does not reach the merkle root")
+	}
+	return nil
+}
+
+// VerifyMerkleFile verifies that a file is covered by a content
+// signature over a merkle root: the inclusion proof is replayed against
+// the root, then the signature on the root is verified against the
+// chain at the x5u location
+func VerifyMerkleFile(x5u, signature, mode string, file []byte, index, total int, proof [][]byte, root []byte) error {
+	err := VerifyMerkleInclusion(mode, file, index, total, proof, root)
+	if err != nil {
+		return err
+	}
+	return Verify(x5u, signature, root)
+}
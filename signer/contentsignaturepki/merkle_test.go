@@ -0,0 +1,120 @@
+package contentsignaturepki
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func makeMerkleFiles(n int) (files [][]byte) {
+	for i := 0; i < n; i++ {
+		files = append(files, []byte(fmt.Sprintf("content of file number %d", i)))
+	}
+	return
+}
+
+func TestMerkleInclusionProofs(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	// odd and even file counts exercise the node promotion path
+	for _, total := range []int{1, 2, 3, 5, 8, 13} {
+		files := makeMerkleFiles(total)
+		tree, err := NewMerkleTree(s.Mode, files)
+		if err != nil {
+			t.Fatalf("failed to build merkle tree of %d files: %v", total, err)
+		}
+		sig, err := s.SignMerkleRoot(tree, nil)
+		if err != nil {
+			t.Fatalf("failed to sign merkle root of %d files: %v", total, err)
+		}
+		sigstr, err := sig.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal signature: %v", err)
+		}
+		// every file of the tree verifies with its own proof
+		for i, file := range files {
+			proof, err := tree.InclusionProof(i)
+			if err != nil {
+				t.Fatalf("failed to make inclusion proof for file %d of %d: %v", i, total, err)
+			}
+			err = VerifyMerkleFile(s.X5U, sigstr, s.Mode, file, i, tree.Len(), proof, tree.Root())
+			if err != nil {
+				t.Fatalf("failed to verify file %d of %d against the signed root: %v", i, total, err)
+			}
+		}
+	}
+}
+
+func TestMerkleTamperDetection(t *testing.T) {
+	s, err := New(PASSINGTESTCASES[0].cfg)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	files := makeMerkleFiles(5)
+	tree, err := NewMerkleTree(s.Mode, files)
+	if err != nil {
+		t.Fatalf("failed to build merkle tree: %v", err)
+	}
+	proof, err := tree.InclusionProof(2)
+	if err != nil {
+		t.Fatalf("failed to make inclusion proof: %v", err)
+	}
+
+	// a tampered file does not reach the root
+	err = VerifyMerkleInclusion(s.Mode, []byte("tampered content"), 2, tree.Len(), proof, tree.Root())
+	if err == nil || !strings.Contains(err.Error(), "does not reach the merkle root") {
+		t.Fatalf("expected a tampered file to fail verification but got: %v", err)
+	}
+
+	// a file presented at the wrong index does not reach the root
+	err = VerifyMerkleInclusion(s.Mode, files[3], 2, tree.Len(), proof, tree.Root())
+	if err == nil {
+		t.Fatal("expected a file at the wrong index to fail verification")
+	}
+
+	// a tampered proof element does not reach the root
+	badProof := make([][]byte, len(proof))
+	copy(badProof, proof)
+	badProof[0] = append([]byte{}, proof[0]...)
+	badProof[0][0] ^= 0xff
+	err = VerifyMerkleInclusion(s.Mode, files[2], 2, tree.Len(), badProof, tree.Root())
+	if err == nil || !strings.Contains(err.Error(), "does not reach the merkle root") {
+		t.Fatalf("expected a tampered proof to fail verification but got: %v", err)
+	}
+
+	// a truncated proof is rejected before reaching the root
+	err = VerifyMerkleInclusion(s.Mode, files[2], 2, tree.Len(), proof[:1], tree.Root())
+	if err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Fatalf("expected a truncated proof to fail verification but got: %v", err)
+	}
+
+	// a signed root does not vouch for a file of another tree
+	sig, err := s.SignMerkleRoot(tree, nil)
+	if err != nil {
+		t.Fatalf("failed to sign merkle root: %v", err)
+	}
+	sigstr, err := sig.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	otherTree, err := NewMerkleTree(s.Mode, makeMerkleFiles(4))
+	if err != nil {
+		t.Fatalf("failed to build second merkle tree: %v", err)
+	}
+	otherProof, err := otherTree.InclusionProof(0)
+	if err != nil {
+		t.Fatalf("failed to make inclusion proof on second tree: %v", err)
+	}
+	err = VerifyMerkleFile(s.X5U, sigstr, s.Mode, makeMerkleFiles(4)[0], 0, otherTree.Len(), otherProof, otherTree.Root())
+	if err == nil {
+		t.Fatal("expected the signature over another root to fail verification")
+	}
+
+	// an empty file set is refused
+	_, err = NewMerkleTree(s.Mode, nil)
+	if err == nil {
+		t.Fatal("expected an empty merkle tree to be refused")
+	}
+}
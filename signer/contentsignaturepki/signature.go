@@ -4,6 +4,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math/big"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -17,6 +19,32 @@ type ContentSignature struct {
 	ID       string
 	Len      int
 	Finished bool
+
+	// CMS holds a detached PKCS#7/CMS SignedData structure over the
+	// templated input, only populated when requested via the
+	// DetachedCMS signing option. It is not part of the compact
+	// marshalled signature.
+	CMS []byte
+
+	// EELabel is the label of the end-entity key that issued the
+	// signature, only populated when requested via the IncludeEELabel
+	// signing option. It is not part of the compact marshalled
+	// signature.
+	EELabel string
+
+	// RootHash is the hex encoded sha256 of the root certificate of
+	// the signer pki, only populated when requested via the
+	// IncludeRootHash signing option. It is not part of the compact
+	// marshalled signature.
+	RootHash string
+
+	// ExpiresAt is the application-level freshness deadline of the
+	// signature, independent of the validity of the certificate chain,
+	// only populated when requested via the SignatureValidity signing
+	// option. It is not part of the compact marshalled signature and
+	// must be conveyed to verifiers alongside it, see the ExpiresAt
+	// verify option.
+	ExpiresAt time.Time
 }
 
 // a private struct to unmarshal asn1 signatures produced by crypto.Signer
@@ -34,18 +62,46 @@ func (sig *ContentSignature) VerifyData(input []byte, pubKey *ecdsa.PublicKey) b
 	return sig.VerifyHash(hash, pubKey)
 }
 
+// VerifyDataWithPrefix behaves like VerifyData with a custom signature
+// prefix instead of the standard one, for verifiers migrating between
+// prefixes
+func (sig *ContentSignature) VerifyDataWithPrefix(input []byte, pubKey *ecdsa.PublicKey, prefix string) bool {
+	_, hash := MakeTemplatedHashWithPrefix(input, prefix, sig.Mode)
+	return sig.VerifyHash(hash, pubKey)
+}
+
 // VerifyHash verifies a signature on its templated hash using a public key
 func (sig *ContentSignature) VerifyHash(hash []byte, pubKey *ecdsa.PublicKey) bool {
+	if sig.CheckScalarRange(pubKey) != nil {
+		return false
+	}
 	return ecdsa.Verify(pubKey, hash, sig.R, sig.S)
 }
 
+// CheckScalarRange verifies the R and S values of a signature are within
+// [1, n-1] where n is the order of the curve of the public key. Some
+// verifiers incorrectly accept out of range values, so malformed
+// signatures are rejected explicitly before any verification happens.
+func (sig *ContentSignature) CheckScalarRange(pubKey *ecdsa.PublicKey) error {
+	n := pubKey.Curve.Params().N
+	switch {
+	case sig.R == nil || sig.S == nil:
+		return errors.New("contentsignature: signature is missing its R or S value")
+	case sig.R.Sign() <= 0 || sig.S.Sign() <= 0:
+		return errors.New("contentsignature: signature R and S values must be greater than zero")
+	case sig.R.Cmp(n) >= 0 || sig.S.Cmp(n) >= 0:
+		return errors.New("contentsignature: signature R and S values must be smaller than the curve order")
+	}
+	return nil
+}
+
 // Marshal returns the R||S signature is encoded in base64 URL safe,
 // following DL/ECSSA format spec from IEEE Std 1363-2000.
 func (sig *ContentSignature) Marshal() (str string, err error) {
 	if !sig.Finished {
 		return "", fmt.Errorf("contentsignature.Marshal: unfinished cannot be encoded")
 	}
-	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE {
+	if sig.Len != P256ECDSABYTESIZE && sig.Len != P384ECDSABYTESIZE && sig.Len != P521ECDSABYTESIZE {
 		return "", fmt.Errorf("contentsignature.Marshal: invalid signature length %d", sig.Len)
 	}
 	// write R and S into a slice of len
@@ -67,11 +123,20 @@ func (sig *ContentSignature) Marshal() (str string, err error) {
 //
 // Note this function does not set the X5U value of a signature.
 func Unmarshal(signature string) (sig *ContentSignature, err error) {
+	return UnmarshalWithCompat(signature, false)
+}
+
+// UnmarshalWithCompat behaves like Unmarshal but optionally relaxes
+// decoding for signatures produced by older versions of this package,
+// which used the standard base64 alphabet and sometimes carried
+// padding. When legacyCompat is false, only the strict unpadded
+// url-safe encoding is accepted.
+func UnmarshalWithCompat(signature string, legacyCompat bool) (sig *ContentSignature, err error) {
 	if len(signature) < 30 {
 		return nil, errors.Errorf("contentsignature: signature cannot be shorter than 30 characters, got %d", len(signature))
 	}
 	// decode the actual signature into its R and S values
-	data, err := base64.RawURLEncoding.DecodeString(signature)
+	data, err := decodeSignature(signature, legacyCompat)
 	if err != nil {
 		return nil, errors.Wrap(err, "contentsignature")
 	}
@@ -83,6 +148,8 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 		sig.Mode = P256ECDSA
 	case P384ECDSABYTESIZE:
 		sig.Mode = P384ECDSA
+	case P521ECDSABYTESIZE:
+		sig.Mode = P521ECDSA
 	default:
 		return nil, errors.Errorf("contentsignature: unknown signature length %d", len(data))
 	}
@@ -95,6 +162,24 @@ func Unmarshal(signature string) (sig *ContentSignature, err error) {
 	return sig, nil
 }
 
+// decodeSignature decodes the base64 representation of a signature. In
+// legacy compatibility mode, the padded and standard alphabet variants
+// used by older versions of this package are accepted as well
+func decodeSignature(signature string, legacyCompat bool) (data []byte, err error) {
+	data, err = base64.RawURLEncoding.DecodeString(signature)
+	if err == nil || !legacyCompat {
+		return
+	}
+	trimmed := strings.TrimRight(signature, "=")
+	for _, enc := range []*base64.Encoding{base64.RawURLEncoding, base64.RawStdEncoding} {
+		data, err = enc.DecodeString(trimmed)
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
 func (sig *ContentSignature) String() string {
 	return fmt.Sprintf("ID=%s Mode=%s Len=%d HashName=%s X5U=%s Finished=%t R=%s S=%s",
 		sig.ID, sig.Mode, sig.Len, sig.HashName, sig.X5U, sig.Finished, sig.R.String(), sig.S.String())
@@ -1,14 +1,20 @@
 package contentsignaturepki
 
 import (
+	"bytes"
+	"crypto/ecdsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -16,32 +22,60 @@ import (
 	"github.com/pkg/errors"
 )
 
+// chainUploadHeaders contains the http metadata set on uploaded chains
+// so downstream cdns and browsers cache them correctly
+type chainUploadHeaders struct {
+	contentType  string
+	cacheControl string
+}
+
+// makeChainUploadHeaders returns the headers to set on an uploaded
+// chain: a pem content-type, and a cache-control ttl derived from the
+// remaining validity of the end-entity so caches never serve a chain
+// past its expiration
+func makeChainUploadHeaders(notAfter time.Time) chainUploadHeaders {
+	ttl := time.Until(notAfter)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return chainUploadHeaders{
+		contentType:  "application/x-pem-file",
+		cacheControl: fmt.Sprintf("public, max-age=%d", int64(ttl.Seconds())),
+	}
+}
+
 // upload takes a string and a filename and puts it at the upload location
 // defined in the signer, then returns its URL
-func (s *ContentSigner) upload(data, name string) error {
+func (s *ContentSigner) upload(data, name string, headers chainUploadHeaders) error {
 	parsedURL, err := url.Parse(s.chainUploadLocation)
 	if err != nil {
 		return errors.Wrap(err, "failed to parse chain upload location")
 	}
 	switch parsedURL.Scheme {
 	case "s3":
-		return uploadToS3(data, name, parsedURL)
+		return uploadToS3(data, name, headers, parsedURL, s.httpClient)
 	case "file":
+		// the local filesystem carries no http metadata
 		return writeLocalFile(data, name, parsedURL)
 	default:
 		return errors.New("unsupported upload scheme " + parsedURL.Scheme)
 	}
 }
 
-func uploadToS3(data, name string, target *url.URL) error {
-	sess := session.Must(session.NewSession())
+func uploadToS3(data, name string, headers chainUploadHeaders, target *url.URL, client *http.Client) error {
+	cfg := aws.NewConfig()
+	if client != nil {
+		cfg = cfg.WithHTTPClient(client)
+	}
+	sess := session.Must(session.NewSession(cfg))
 	uploader := s3manager.NewUploader(sess)
 	_, err := uploader.Upload(&s3manager.UploadInput{
 		Bucket:             aws.String(target.Host),
 		Key:                aws.String(target.Path + name),
 		ACL:                aws.String("public-read"),
 		Body:               strings.NewReader(data),
-		ContentType:        aws.String("binary/octet-stream"),
+		ContentType:        aws.String(headers.contentType),
+		CacheControl:       aws.String(headers.cacheControl),
 		ContentDisposition: aws.String("attachment"),
 	})
 	return err
@@ -68,16 +102,111 @@ func writeLocalFile(data, name string, target *url.URL) error {
 // GetX5U retrieves a chain of certs from upload location, parses and verifies it,
 // then returns the slice of parsed certificates.
 func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
+	body, err := fetchX5U(x5u)
+	if err != nil {
+		return
+	}
+	return ParseChain(body)
+}
+
+// getX5U behaves like GetX5U using the http client configured on the
+// signer, when one was provided
+func (s *ContentSigner) getX5U(x5u string) (certs []*x509.Certificate, err error) {
+	body, _, _, err := fetchX5UCacheable(x5u, s.httpClient)
+	if err != nil {
+		return nil, err
+	}
+	return ParseChain(body)
+}
+
+// verifyX5U retrieves a chain of certs from an upload location with
+// the http client configured on the signer and verifies it as of a
+// given time, or now when at is zero
+func (s *ContentSigner) verifyX5U(x5u string, at time.Time) error {
+	body, _, _, err := fetchX5UCacheable(x5u, s.httpClient)
+	if err != nil {
+		return err
+	}
+	_, err = parseChainAsOf(body, DefaultMaxChainLen, at)
+	return err
+}
+
+// DefaultMaxX5USize is the number of bytes fetchX5U reads from an x5u
+// location by default, plenty for a chain of three certificates
+const DefaultMaxX5USize = 512 * 1024
+
+// MaxX5USize caps the size of x5u responses, so a malicious or broken
+// chain host cannot exhaust memory with a multi-gigabyte body
+var MaxX5USize int64 = DefaultMaxX5USize
+
+// maxX5URedirects is the maximum number of redirects followed when
+// fetching an x5u, beyond which the fetch is aborted
+const maxX5URedirects = 3
+
+// X5URedirectSameHost restricts x5u redirects to the host of the
+// original x5u location when enabled, so an open redirect on the chain
+// hosting cannot point verifiers at an attacker controlled chain.
+// Protocol downgrades and chains of more than maxX5URedirects are
+// always refused.
+var X5URedirectSameHost bool
+
+// checkX5URedirect is the redirect policy of x5u fetches, see
+// X5URedirectSameHost
+func checkX5URedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxX5URedirects {
+		return fmt.Errorf("stopped after %d redirects", maxX5URedirects)
+	}
+	origin := via[0].URL
+	if origin.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing to follow protocol downgrade redirect from %q to %q", origin, req.URL)
+	}
+	if X5URedirectSameHost && req.URL.Host != origin.Host {
+		return fmt.Errorf("refusing to follow redirect from %q to different host %q", origin, req.URL)
+	}
+	return nil
+}
+
+// X5UClient, when set, replaces the default http client used to fetch
+// x5u locations, so tests and embedders can control the transport
+var X5UClient *http.Client
+
+// defaultX5UClientTimeout bounds x5u fetches performed with the
+// default client, so a hung chain host cannot block a signing or
+// verification path indefinitely
+const defaultX5UClientTimeout = 30 * time.Second
+
+// fetchX5U retrieves the raw body of a chain of certs from an upload
+// location, without parsing or verifying it
+func fetchX5U(x5u string) (body []byte, err error) {
+	body, _, _, err = fetchX5UCacheable(x5u, nil)
+	return
+}
+
+// fetchX5UCacheable behaves like fetchX5U and additionally returns the
+// caching lifetime advertised by the cache-control header of the
+// response, when one was present. The given client, when not nil,
+// takes precedence over the package X5UClient and the default client
+func fetchX5UCacheable(x5u string, client *http.Client) (body []byte, maxAge time.Duration, hasMaxAge bool, err error) {
 	parsedURL, err := url.Parse(x5u)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse chain upload location")
 		return
 	}
-	c := &http.Client{}
+	c := client
+	if c == nil {
+		c = X5UClient
+	}
 	if parsedURL.Scheme == "file" {
+		// the local filesystem is not reachable through an http
+		// transport, injected clients don't apply
 		t := &http.Transport{}
 		t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
-		c.Transport = t
+		c = &http.Client{CheckRedirect: checkX5URedirect, Transport: t}
+	} else if c == nil {
+		c = &http.Client{
+			CheckRedirect: checkX5URedirect,
+			Timeout:       defaultX5UClientTimeout,
+		}
 	}
 	resp, err := c.Get(x5u)
 	if err != nil {
@@ -89,23 +218,158 @@ func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
 		err = errors.Errorf("failed to retrieve x5u from %s: %s", x5u, resp.Status)
 		return
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	maxAge, hasMaxAge = parseCacheControlMaxAge(resp.Header.Get("Cache-Control"))
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, MaxX5USize+1))
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse x5u body")
 		return
 	}
+	if int64(len(body)) > MaxX5USize {
+		body = nil
+		err = errors.Errorf("x5u response from %s exceeds the maximum size of %d bytes", x5u, MaxX5USize)
+		return
+	}
+	return
+}
+
+// parseCacheControlMaxAge returns the caching lifetime advertised by a
+// cache-control header and whether the header carried a caching
+// directive at all. The no-store and no-cache directives are reported
+// as a zero lifetime
+func parseCacheControlMaxAge(cc string) (time.Duration, bool) {
+	for _, directive := range strings.Split(cc, ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			return 0, true
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err != nil || seconds < 0 {
+				continue
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// X5UCacheTTL, when positive, enables in-memory caching of the chains
+// the verify path retrieves, so services verifying many signatures
+// from the same signer don't fetch the same x5u for every signature.
+// A cache-control header on the x5u response can shorten the lifetime
+// of an entry below the TTL, but never extend it. The default is no
+// caching
+var X5UCacheTTL time.Duration
+
+// x5uCacheEntry holds one parsed and validated chain
+type x5uCacheEntry struct {
+	certs     []*x509.Certificate
+	expiresAt time.Time
+}
+
+// x5uCache holds the chains cached by the verify path, keyed by x5u
+// location, see X5UCacheTTL
+var x5uCache = struct {
+	sync.Mutex
+	entries map[string]*x5uCacheEntry
+}{entries: make(map[string]*x5uCacheEntry)}
+
+// getX5UForVerify returns the parsed and validated chain at an x5u
+// location, served from the in-package cache when X5UCacheTTL enables
+// it. Failures are returned as the *VerificationError of the step that
+// failed and are never cached
+func getX5UForVerify(x5u string) ([]*x509.Certificate, error) {
+	if X5UCacheTTL > 0 {
+		x5uCache.Lock()
+		entry, ok := x5uCache.entries[x5u]
+		if ok && timeNow().Before(entry.expiresAt) {
+			certs := entry.certs
+			x5uCache.Unlock()
+			return certs, nil
+		}
+		x5uCache.Unlock()
+	}
+	body, maxAge, hasMaxAge, err := fetchX5UCacheable(x5u, nil)
+	if err != nil {
+		return nil, &VerificationError{Step: ErrX5URetrieval, Err: err}
+	}
+	certs, err := ParseChain(body)
+	if err != nil {
+		return nil, &VerificationError{Step: ErrChainValidation, Err: err}
+	}
+	ttl := X5UCacheTTL
+	if hasMaxAge && maxAge < ttl {
+		ttl = maxAge
+	}
+	if ttl > 0 {
+		x5uCache.Lock()
+		x5uCache.entries[x5u] = &x5uCacheEntry{
+			certs:     certs,
+			expiresAt: timeNow().Add(ttl),
+		}
+		x5uCache.Unlock()
+	}
+	return certs, nil
+}
+
+// DefaultMaxChainLen is the maximum number of certificates the verify
+// path accepts in a chain. Valid chains carry an end-entity, an
+// intermediate and a root, anything longer is rejected before any
+// parsing happens to limit the attack surface.
+const DefaultMaxChainLen = 3
+
+// ParseChain parses a PEM encoded certificate chain of an end-entity,
+// an intermediate and a root, verifies it and returns the slice of
+// parsed certificates. Chains longer than DefaultMaxChainLen are
+// rejected.
+func ParseChain(body []byte) (certs []*x509.Certificate, err error) {
+	return ParseChainWithMaxLen(body, DefaultMaxChainLen)
+}
+
+// ParseChainWithMaxLen behaves like ParseChain but rejects chains with
+// more than maxChainLen certificates, for callers that want a different
+// cap than the default
+func ParseChainWithMaxLen(body []byte, maxChainLen int) (certs []*x509.Certificate, err error) {
+	return parseChainAsOf(body, maxChainLen, time.Time{})
+}
+
+// parseChainAsOf behaves like ParseChainWithMaxLen but verifies the
+// validity of the chain as of a given time instead of now. A zero time
+// means now.
+func parseChainAsOf(body []byte, maxChainLen int, at time.Time) (certs []*x509.Certificate, err error) {
+	// count the certificates before doing any expensive parsing and
+	// reject pathological chains
+	if count := bytes.Count(body, []byte("-----BEGIN CERTIFICATE-----")); count > maxChainLen {
+		err = errors.Errorf("chain contains %d certificates, exceeding the maximum of %d", count, maxChainLen)
+		return
+	}
 	// verify the chain
 	// the first cert is the end entity, then the intermediate and the root
 	block, rest := pem.Decode(body)
-	ee, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		err = errors.Wrap(err, "failed to parse ee certificate from chain")
+	if block == nil {
+		err = fmt.Errorf("failed to decode ee certificate from chain")
 		return
 	}
+	ee, eeErr := x509.ParseCertificate(block.Bytes)
+	var explicitEE *explicitCurveCert
+	if eeErr != nil {
+		// the stdlib parser rejects end-entities that encode their
+		// curve as explicit parameters, fall back to the manual parser
+		explicitEE, err = parseExplicitCurveCert(block.Bytes)
+		if err != nil {
+			err = errors.Wrap(eeErr, "failed to parse ee certificate from chain")
+			return
+		}
+		ee = explicitEE.certificate()
+	}
 	certs = append(certs, ee)
 
 	// the second cert is the intermediate
 	block, rest = pem.Decode(rest)
+	if block == nil {
+		err = fmt.Errorf("failed to decode intermediate issuer certificate from chain")
+		return
+	}
 	inter, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse intermediate issuer certificate from chain")
@@ -117,6 +381,10 @@ func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
 
 	// the third and last cert is the root
 	block, rest = pem.Decode(rest)
+	if block == nil {
+		err = fmt.Errorf("failed to decode root certificate from chain")
+		return
+	}
 	root, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse root certificate from chain")
@@ -130,10 +398,36 @@ func GetX5U(x5u string) (certs []*x509.Certificate, err error) {
 	roots.AddCert(root)
 	certs = append(certs, root)
 
+	if explicitEE != nil {
+		// the stdlib cannot chain through an explicit curve
+		// end-entity, so verify the issuers with the stdlib and the
+		// end-entity manually
+		_, err = inter.Verify(x509.VerifyOptions{
+			Roots:       roots,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			CurrentTime: at,
+		})
+		if err != nil {
+			err = errors.Wrap(err, "failed to verify certificate chain")
+			return
+		}
+		interPub, ok := inter.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			err = errors.New("intermediate issuer key is not ecdsa")
+			return
+		}
+		err = explicitEE.verify(interPub, at)
+		if err != nil {
+			err = errors.Wrap(err, "failed to verify certificate chain")
+			return
+		}
+		return
+	}
 	opts := x509.VerifyOptions{
 		Roots:         roots,
 		Intermediates: inters,
 		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		CurrentTime:   at,
 	}
 	_, err = ee.Verify(opts)
 	if err != nil {
@@ -3,11 +3,16 @@ package contentsignaturepki
 import (
 	"bytes"
 	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -18,18 +23,24 @@ import (
 // findAndSetEE searches the database for an end-entity key that is currently
 // valid for this signer and is not older than cfg.Validity days
 func (s *ContentSigner) findAndSetEE(conf signer.Configuration, tx *database.Transaction) (err error) {
-	var tmpX5U string
 	if s.db == nil {
 		// no database, no chance to find an existing key
 		return database.ErrNoSuitableEEFound
 	}
-	// search the database for the label of an end-entity private key that is still valid.
-	s.eeLabel, tmpX5U, err = tx.GetLabelOfLatestEE(s.ID, s.validity)
+	// search the database for the record of an end-entity private key that is still valid.
+	ee, err := tx.GetLabelOfLatestEE(s.ID, s.validity)
 	if err != nil {
 		return
 	}
-	if tmpX5U != "" {
-		s.X5U = tmpX5U
+	if s.rotationThreshold > 0 && ee.X5U != "" && s.eeNeedsRotation(ee.X5U) {
+		// the end-entity found in database expires within the rotation
+		// threshold, treat it as unsuitable so the caller mints a
+		// fresh one instead of signing with a cert about to go stale
+		return database.ErrNoSuitableEEFound
+	}
+	s.eeLabel = ee.Label
+	if ee.X5U != "" {
+		s.X5U = ee.X5U
 	}
 	conf.PrivateKey = s.eeLabel
 	s.eePriv, err = conf.GetPrivateKey()
@@ -41,20 +52,227 @@ func (s *ContentSigner) findAndSetEE(conf signer.Configuration, tx *database.Tra
 	return
 }
 
+// eeNeedsRotation returns true when the end-entity certificate at the
+// given x5u expires within the rotation threshold of the signer. A
+// chain that cannot be fetched is reported as needing rotation, since
+// it cannot be reused either way.
+func (s *ContentSigner) eeNeedsRotation(x5u string) bool {
+	certs, err := s.getX5U(x5u)
+	if err != nil {
+		return true
+	}
+	return timeNow().Add(s.rotationThreshold).After(certs[0].NotAfter)
+}
+
+// RotateIssuer replaces the issuer private key of the signer with a new one
+// and issues a fresh end-entity under it, rebuilding and uploading the
+// chain. newKeyRef follows the same convention as the privatekey field of
+// the signer configuration: either a PEM encoded key, or the label of a
+// key stored in the HSM. The issuer certificate in the signer
+// configuration must already match the new key, so operators are expected
+// to install the re-issued intermediate certificate before rotating.
+func (s *ContentSigner) RotateIssuer(newKeyRef string) error {
+	conf := s.conf
+	conf.PrivateKey = newKeyRef
+	newPriv, err := conf.GetPrivateKey()
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to load new issuer key")
+	}
+	newPub := newPriv.(crypto.Signer).Public()
+
+	// refuse to rotate to a key that doesn't match the issuer
+	// certificate, the chain would never verify
+	block, _ := pem.Decode([]byte(s.PublicKey))
+	if block == nil {
+		return errors.New("contentsignaturepki: no pem block found in signer public key configuration")
+	}
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to parse issuer certificate")
+	}
+	issuerPubBytes, err := x509.MarshalPKIXPublicKey(issuer.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to marshal issuer certificate public key")
+	}
+	newPubBytes, err := x509.MarshalPKIXPublicKey(newPub)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to marshal new issuer public key")
+	}
+	if !bytes.Equal(issuerPubBytes, newPubBytes) {
+		return errors.New("contentsignaturepki: new issuer key does not match the issuer certificate, install the re-issued intermediate first")
+	}
+
+	// hold the in-process end-entity lock for writing for the duration
+	// of the re-issuance, so the signing paths never observe a
+	// half-swapped issuer/end-entity pair, and the end-entities db lock
+	// of this signer like New does when generating an end-entity
+	s.eeMu.Lock()
+	defer s.eeMu.Unlock()
+	var tx *database.Transaction
+	if s.db != nil {
+		tx, err = s.db.BeginSignerEndEntityOperations(s.ID)
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to begin end-entity db operations")
+		}
+	}
+	s.issuerPriv = newPriv
+	s.issuerPub = newPub
+	s.PrivateKey = newKeyRef
+	s.conf.PrivateKey = newKeyRef
+
+	// issue a fresh end-entity under the new issuer
+	s.eeLabel = makeEELabel(s.ID, time.Now())
+	s.eePriv, s.eePub, err = conf.MakeKey(s.issuerPub, s.eeLabel)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to generate key for end entity")
+	}
+	// reset the X5U to the configured base location before the new chain
+	// name is appended to it
+	s.X5U = s.conf.X5U
+	err = s.makeAndUploadChain(eeValidity{})
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to make chain and x5u for end-entity")
+	}
+	if tx != nil {
+		hsmHandle := signer.GetPrivKeyHandle(s.eePriv)
+		err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, s.Mode, hsmHandle)
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to insert new EE into database")
+		}
+		err = tx.SetEEIssuer(s.eeLabel, issuerKeyID(newKeyRef, newPubBytes))
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to record issuer key id on EE")
+		}
+		err = tx.End()
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to commit end-entity operations in database")
+		}
+	}
+	return nil
+}
+
+// RotateEEOptions sets explicit validity bounds on the end-entity
+// issued by RotateEE. When both are zero, the bounds derive from the
+// signer validity like they do at startup. A notBefore in the future
+// pre-stages a rotation, a notBefore in the past accommodates verifiers
+// with skewed clocks.
+type RotateEEOptions struct {
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// RotateEE issues a fresh end-entity under the current issuer,
+// rebuilding and uploading the chain. The options give precise control
+// over the validity window of the new end-entity.
+func (s *ContentSigner) RotateEE(opts RotateEEOptions) error {
+	switch {
+	case opts.NotBefore.IsZero() != opts.NotAfter.IsZero():
+		return errors.New("contentsignaturepki: notBefore and notAfter must be provided together")
+	case !opts.NotAfter.IsZero() && !opts.NotAfter.After(opts.NotBefore):
+		return errors.New("contentsignaturepki: notAfter must be after notBefore")
+	case !opts.NotAfter.IsZero() && opts.NotAfter.Before(time.Now()):
+		return errors.New("contentsignaturepki: notAfter is already in the past")
+	}
+
+	// hold the in-process end-entity lock for writing for the duration
+	// of the rotation, so the signing paths never observe a half-swapped
+	// key/chain pair, and the end-entities db lock of this signer like
+	// New does when generating an end-entity
+	s.eeMu.Lock()
+	defer s.eeMu.Unlock()
+	var (
+		tx  *database.Transaction
+		err error
+	)
+	if s.db != nil {
+		tx, err = s.db.BeginSignerEndEntityOperations(s.ID)
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to begin end-entity db operations")
+		}
+	}
+	s.eeLabel = makeEELabel(s.ID, time.Now())
+	s.eePriv, s.eePub, err = s.conf.MakeKey(s.issuerPub, s.eeLabel)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to generate key for end entity")
+	}
+	// reset the X5U to the configured base location before the new chain
+	// name is appended to it
+	s.X5U = s.conf.X5U
+	err = s.makeAndUploadChain(eeValidity{notBefore: opts.NotBefore, notAfter: opts.NotAfter})
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to make chain and x5u for end-entity")
+	}
+	if tx != nil {
+		hsmHandle := signer.GetPrivKeyHandle(s.eePriv)
+		err = tx.InsertEE(s.X5U, s.eeLabel, s.ID, s.Mode, hsmHandle)
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to insert new EE into database")
+		}
+		err = tx.End()
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to commit end-entity operations in database")
+		}
+	}
+	return nil
+}
+
+// issuerKeyID returns an identifier for an issuer key: hsm key labels are
+// used as-is, pem encoded keys are identified by the sha256 fingerprint of
+// their public key
+func issuerKeyID(keyRef string, pubBytes []byte) string {
+	if strings.HasPrefix(keyRef, "-----BEGIN") {
+		return fmt.Sprintf("%x", sha256.Sum256(pubBytes))
+	}
+	return keyRef
+}
+
+// eeValidity carries explicit validity bounds for a generated
+// end-entity. Zero values derive the bounds from the signer
+// configuration.
+type eeValidity struct {
+	notBefore, notAfter time.Time
+}
+
 // makeAndUploadChain makes a certificate using the end-entity public key,
 // uploads the chain to its destination and creates an X5U download URL
-func (s *ContentSigner) makeAndUploadChain() (err error) {
-	var fullChain, chainName string
-	fullChain, chainName, err = s.makeChain()
+func (s *ContentSigner) makeAndUploadChain(validity eeValidity) (err error) {
+	fullChain, chainName, ee, err := s.makeChain(validity)
 	if err != nil {
 		return errors.Wrap(err, "failed to make chain")
 	}
-	err = s.upload(fullChain, chainName)
+	s.chain = fullChain
+	s.eeExpiry = ee.NotAfter
+	// a pre-staged chain isn't valid yet, verify it as of its activation
+	var verifyAt time.Time
+	if ee.NotBefore.After(time.Now()) {
+		verifyAt = ee.NotBefore
+	}
+	if s.chainCacheFile != "" {
+		// the local bundle file is the source of truth: write the
+		// chain to it and verify from it, without touching the
+		// network at all
+		err = os.MkdirAll(filepath.Dir(s.chainCacheFile), 0755)
+		if err != nil {
+			return errors.Wrap(err, "failed to make directory for chain cache file")
+		}
+		err = ioutil.WriteFile(s.chainCacheFile, []byte(fullChain), 0755)
+		if err != nil {
+			return errors.Wrap(err, "failed to write chain cache file")
+		}
+		newX5U := "file://" + s.chainCacheFile
+		err = s.verifyX5U(newX5U, verifyAt)
+		if err != nil {
+			return errors.Wrap(err, "failed to verify chain cache file")
+		}
+		s.X5U = newX5U
+		return
+	}
+	err = s.upload(fullChain, chainName, makeChainUploadHeaders(ee.NotAfter))
 	if err != nil {
 		return errors.Wrap(err, "failed to upload chain")
 	}
 	newX5U := s.X5U + chainName
-	_, err = GetX5U(newX5U)
+	err = s.verifyX5U(newX5U, verifyAt)
 	if err != nil {
 		return errors.Wrap(err, "failed to download new chain")
 	}
@@ -65,9 +283,9 @@ func (s *ContentSigner) makeAndUploadChain() (err error) {
 // makeChain issues an end-entity certificate using the ca private key and the first
 // cert of the chain (which is supposed to match the ca private key).  it
 // returns the entire chain of certificate, its name (based on the ee cn &
-// expiration) and an error.
-func (s *ContentSigner) makeChain() (chain string, name string, err error) {
-	cn := s.ID + CSNameSpace
+// expiration), the parsed end-entity certificate and an error.
+func (s *ContentSigner) makeChain(validity eeValidity) (chain string, name string, ee *x509.Certificate, err error) {
+	cn := s.ID + s.eeNamespace
 
 	// cert is backdated to allow for clock skew tolerance
 	notBefore := time.Now().UTC().Add(-s.clockSkewTolerance)
@@ -75,6 +293,16 @@ func (s *ContentSigner) makeChain() (chain string, name string, err error) {
 	// cert will be in used for `validity` number of days, but will remain
 	// valid for longer than that to account for clock skew
 	notAfter := time.Now().UTC().Add(s.validity + s.clockSkewTolerance)
+	if s.validity < 0 {
+		// expiry is disabled, use the RFC 5280 no well-defined
+		// expiration date instead
+		notAfter = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+	}
+	if !validity.notBefore.IsZero() {
+		// explicit bounds take precedence over the derived window
+		notBefore = validity.notBefore.UTC()
+		notAfter = validity.notAfter.UTC()
+	}
 
 	block, _ := pem.Decode([]byte(s.PublicKey))
 	if block == nil {
@@ -133,6 +361,10 @@ func (s *ContentSigner) makeChain() (chain string, name string, err error) {
 		Intermediates: inter,
 		KeyUsages:     crtTpl.ExtKeyUsage,
 	}
+	if notBefore.After(time.Now()) {
+		// the ee isn't valid yet, verify the chain as of its activation
+		opts.CurrentTime = notBefore
+	}
 	cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
 		err = errors.Wrap(err, "failed to parse end-entity certificate")
@@ -144,8 +376,88 @@ func (s *ContentSigner) makeChain() (chain string, name string, err error) {
 		return
 	}
 
+	if s.eeCurveEncoding == CurveEncodingExplicit {
+		// re-encode the verified cert with explicit curve parameters
+		// and re-sign it with the issuer key, for verifiers that do
+		// not accept named curves
+		certBytes, err = explicitCurveEncode(certBytes, s.issuerPriv, s.rand)
+		if err != nil {
+			err = errors.Wrap(err, "failed to re-encode end-entity cert with explicit curve parameters")
+			return
+		}
+		certPem.Reset()
+		err = pem.Encode(&certPem, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+		if err != nil {
+			err = errors.Wrap(err, "failed to PEM encode end-entity cert")
+			return
+		}
+	}
+
 	// return a chain with the EE cert first then the issuers
 	chain = certPem.String() + s.PublicKey + s.caCert
-	name = fmt.Sprintf("%s-%s.chain", cert.Subject.CommonName, cert.NotAfter.Format("2006-01-02-15-04-05"))
+	name = chainName(cert)
+	ee = cert
 	return
 }
+
+// chainName derives the upload name of a chain from the common name and
+// expiration of its end-entity certificate
+func chainName(ee *x509.Certificate) string {
+	return fmt.Sprintf("%s-%s.chain", ee.Subject.CommonName, ee.NotAfter.Format("2006-01-02-15-04-05"))
+}
+
+// MigrateX5U re-uploads the current chain of the signer to a new storage
+// location and points its X5U at it, for migrations of chain hosting to
+// a new bucket or domain. The end-entity is not regenerated: the chain
+// currently served from the old X5U is fetched, validated and uploaded
+// as-is under the new location, which then replaces the upload location
+// and X5U base of the signer and the location recorded on its
+// end-entity in database. newLocation follows the convention of the
+// chainuploadlocation configuration field.
+func (s *ContentSigner) MigrateX5U(newLocation string) error {
+	// hold the in-process end-entity lock for writing so the signing
+	// paths never observe the X5U mid-migration
+	s.eeMu.Lock()
+	defer s.eeMu.Unlock()
+	// fetch and validate the chain currently served before moving it
+	body, err := fetchX5U(s.X5U)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to fetch current chain")
+	}
+	certs, err := ParseChain(body)
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to parse current chain")
+	}
+	ee := certs[0]
+
+	s.chainUploadLocation = newLocation
+	s.conf.ChainUploadLocation = newLocation
+	err = s.upload(string(body), chainName(ee), makeChainUploadHeaders(ee.NotAfter))
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to upload chain to new location")
+	}
+	newX5U := newLocation + chainName(ee)
+	err = s.verifyX5U(newX5U, time.Time{})
+	if err != nil {
+		return errors.Wrap(err, "contentsignaturepki: failed to verify chain at new location")
+	}
+	s.X5U = newX5U
+	s.conf.X5U = newLocation
+
+	// update the end-entity record so restarts pick up the new location
+	if s.db != nil {
+		tx, err := s.db.BeginSignerEndEntityOperations(s.ID)
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to begin end-entity db operations")
+		}
+		err = tx.UpdateX5U(s.X5U, s.eeLabel, s.ID)
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to update x5u of end-entity in database")
+		}
+		err = tx.End()
+		if err != nil {
+			return errors.Wrap(err, "contentsignaturepki: failed to commit end-entity operations in database")
+		}
+	}
+	return nil
+}
@@ -81,6 +81,7 @@ func New(conf signer.Configuration) (s *GPG2Signer, err error) {
 	s.KeyID = conf.KeyID
 
 	s.passphrase = conf.Passphrase
+	s.AuditHook = conf.AuditHook
 
 	s.tmpDir, err = createKeyRing(s)
 	if err != nil {
@@ -181,7 +182,8 @@ func (s *GPG2Signer) Config() signer.Configuration {
 }
 
 // SignData takes data and returns an armored signature with pgp header and footer
-func (s *GPG2Signer) SignData(data []byte, options interface{}) (signer.Signature, error) {
+func (s *GPG2Signer) SignData(data []byte, options interface{}) (retsig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, data, err) }()
 	keyRingPath := filepath.Join(s.tmpDir, keyRingFilename)
 	secRingPath := filepath.Join(s.tmpDir, secRingFilename)
 
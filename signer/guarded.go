@@ -0,0 +1,120 @@
+package signer
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// An InputValidator checks the input of a signing request before it
+// reaches a signer, and returns an error describing why the input is
+// rejected, or nil when it is acceptable
+type InputValidator func(input []byte) error
+
+// A GuardedSigner wraps a signer with a list of input validators that
+// must all pass before a request is delegated to the wrapped signer.
+// It is a general safety layer that prevents a signer from processing
+// unexpected content, like a json signer receiving a binary blob.
+type GuardedSigner struct {
+	wrapped    Signer
+	validators []InputValidator
+}
+
+// NewGuardedSigner wraps a signer with input validators
+func NewGuardedSigner(wrapped Signer, validators ...InputValidator) *GuardedSigner {
+	return &GuardedSigner{wrapped: wrapped, validators: validators}
+}
+
+// Config returns the configuration of the wrapped signer
+func (gs *GuardedSigner) Config() Configuration {
+	return gs.wrapped.Config()
+}
+
+// validate runs the input through every validator and rejects it on the
+// first failure
+func (gs *GuardedSigner) validate(input []byte) error {
+	for i, validator := range gs.validators {
+		err := validator(input)
+		if err != nil {
+			return errors.Wrapf(err, "input to signer %q rejected by validator %d",
+				gs.wrapped.Config().ID, i)
+		}
+	}
+	return nil
+}
+
+// SignData validates the input, then delegates it to the wrapped
+// signer, which must be able to sign data
+func (gs *GuardedSigner) SignData(input []byte, options interface{}) (Signature, error) {
+	ds, ok := gs.wrapped.(DataSigner)
+	if !ok {
+		return nil, errors.Errorf("wrapped signer %q cannot sign data", gs.wrapped.Config().ID)
+	}
+	err := gs.validate(input)
+	if err != nil {
+		return nil, err
+	}
+	return ds.SignData(input, options)
+}
+
+// SignFile validates the input, then delegates it to the wrapped
+// signer, which must be able to sign files
+func (gs *GuardedSigner) SignFile(input []byte, options interface{}) (SignedFile, error) {
+	fs, ok := gs.wrapped.(FileSigner)
+	if !ok {
+		return nil, errors.Errorf("wrapped signer %q cannot sign files", gs.wrapped.Config().ID)
+	}
+	err := gs.validate(input)
+	if err != nil {
+		return nil, err
+	}
+	return fs.SignFile(input, options)
+}
+
+// SignHash validates the input, then delegates it to the wrapped
+// signer, which must be able to sign hashes
+func (gs *GuardedSigner) SignHash(input []byte, options interface{}) (Signature, error) {
+	hs, ok := gs.wrapped.(HashSigner)
+	if !ok {
+		return nil, errors.Errorf("wrapped signer %q cannot sign hashes", gs.wrapped.Config().ID)
+	}
+	err := gs.validate(input)
+	if err != nil {
+		return nil, err
+	}
+	return hs.SignHash(input, options)
+}
+
+// GetDefaultOptions returns the default options of the wrapped signer
+func (gs *GuardedSigner) GetDefaultOptions() interface{} {
+	type defaultOptionsGetter interface {
+		GetDefaultOptions() interface{}
+	}
+	if g, ok := gs.wrapped.(defaultOptionsGetter); ok {
+		return g.GetDefaultOptions()
+	}
+	return nil
+}
+
+// ValidJSONInput is a validator that rejects input that is not well
+// formed json
+func ValidJSONInput() InputValidator {
+	return func(input []byte) error {
+		if !json.Valid(input) {
+			return errors.New("input is not valid json")
+		}
+		return nil
+	}
+}
+
+// MagicBytesInput is a validator that rejects input that does not start
+// with the given magic bytes
+func MagicBytesInput(magic []byte) InputValidator {
+	return func(input []byte) error {
+		if !bytes.HasPrefix(input, magic) {
+			return errors.Errorf("input does not start with magic bytes %x", magic)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+package signer
+
+import (
+	"strings"
+	"testing"
+)
+
+// a guardedStubSigner records the inputs it was asked to sign
+type guardedStubSigner struct {
+	signed [][]byte
+}
+
+func (s *guardedStubSigner) Config() Configuration {
+	return Configuration{ID: "teststub", Type: "testtype"}
+}
+
+func (s *guardedStubSigner) SignData(data []byte, options interface{}) (Signature, error) {
+	s.signed = append(s.signed, data)
+	return &guardedStubSignature{}, nil
+}
+
+func (s *guardedStubSigner) GetDefaultOptions() interface{} {
+	return "stuboptions"
+}
+
+type guardedStubSignature struct{}
+
+func (sig *guardedStubSignature) Marshal() (string, error) {
+	return "stubsignature", nil
+}
+
+// a configOnlyStubSigner implements the base signer interface and
+// nothing else
+type configOnlyStubSigner struct{}
+
+func (s *configOnlyStubSigner) Config() Configuration {
+	return Configuration{ID: "configonly", Type: "testtype"}
+}
+
+func TestGuardedSignerPassesValidInput(t *testing.T) {
+	t.Parallel()
+	stub := &guardedStubSigner{}
+	gs := NewGuardedSigner(stub, ValidJSONInput())
+	sig, err := gs.SignData([]byte(`{"some": "json"}`), nil)
+	if err != nil {
+		t.Fatalf("expected valid input to be signed but got: %v", err)
+	}
+	if sig == nil {
+		t.Fatal("expected a signature but got nil")
+	}
+	if len(stub.signed) != 1 || string(stub.signed[0]) != `{"some": "json"}` {
+		t.Fatalf("expected the input to reach the wrapped signer unchanged, got %q", stub.signed)
+	}
+	if gs.Config().ID != "teststub" {
+		t.Fatalf("expected the configuration of the wrapped signer but got %q", gs.Config().ID)
+	}
+	if gs.GetDefaultOptions() != "stuboptions" {
+		t.Fatalf("expected the default options of the wrapped signer but got %v", gs.GetDefaultOptions())
+	}
+}
+
+func TestGuardedSignerRejectsInvalidInput(t *testing.T) {
+	t.Parallel()
+	TESTCASES := []struct {
+		name       string
+		validators []InputValidator
+		input      string
+		err        string
+	}{
+		{"not json", []InputValidator{ValidJSONInput()}, "definitely not json", "input is not valid json"},
+		{"wrong magic", []InputValidator{MagicBytesInput([]byte("MAR1"))}, "PK\x03\x04...", "does not start with magic bytes 4d415231"},
+		{"second validator fails", []InputValidator{ValidJSONInput(), MagicBytesInput([]byte("{"))}, `["not an object"]`, "rejected by validator 1"},
+	}
+	for _, testcase := range TESTCASES {
+		stub := &guardedStubSigner{}
+		gs := NewGuardedSigner(stub, testcase.validators...)
+		_, err := gs.SignData([]byte(testcase.input), nil)
+		if err == nil {
+			t.Fatalf("testcase %q expected input to be rejected but it was signed", testcase.name)
+		}
+		if !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("testcase %q expected to fail with %q but failed with: %v", testcase.name, testcase.err, err)
+		}
+		if !strings.Contains(err.Error(), `input to signer "teststub" rejected`) {
+			t.Fatalf("testcase %q expected the rejection to name the signer but got: %v", testcase.name, err)
+		}
+		if len(stub.signed) != 0 {
+			t.Fatalf("testcase %q expected rejected input to never reach the wrapped signer", testcase.name)
+		}
+	}
+}
+
+func TestGuardedSignerUnsupportedInterfaces(t *testing.T) {
+	t.Parallel()
+	gs := NewGuardedSigner(&configOnlyStubSigner{}, ValidJSONInput())
+	_, err := gs.SignData([]byte(`{}`), nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot sign data") {
+		t.Fatalf("expected to fail signing data with a config-only signer but got: %v", err)
+	}
+	_, err = gs.SignFile([]byte(`{}`), nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot sign files") {
+		t.Fatalf("expected to fail signing files with a config-only signer but got: %v", err)
+	}
+	_, err = gs.SignHash([]byte(`{}`), nil)
+	if err == nil || !strings.Contains(err.Error(), "cannot sign hashes") {
+		t.Fatalf("expected to fail signing hashes with a config-only signer but got: %v", err)
+	}
+}
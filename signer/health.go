@@ -0,0 +1,66 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer // import "go.mozilla.org/autograph/signer"
+
+import (
+	"fmt"
+	"time"
+)
+
+// healthProbeTimeout caps how long the probe of a single signer can
+// take before it is reported as unhealthy
+const healthProbeTimeout = 10 * time.Second
+
+// SignerHealth describes the state of a single signer as returned by
+// HealthCheck
+type SignerHealth struct {
+	SignerID string `json:"signer_id"`
+	Type     string `json:"type"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HealthChecker is implemented by signers that can probe their own
+// state, eg. verify their key is usable or their x5u is retrievable
+type HealthChecker interface {
+	CheckHealth() error
+}
+
+// HealthCheck probes every signer and returns structured results, one
+// per signer. It is a cheap liveness view intended for a readiness
+// endpoint, distinct from the full monitor which produces and verifies
+// signatures. Signers that do not implement HealthChecker are reported
+// healthy, since they successfully initialized at startup. Each probe
+// runs with a timeout so a stuck backend cannot hang the whole check.
+func HealthCheck(signers []Signer) []SignerHealth {
+	results := make([]SignerHealth, len(signers))
+	for i, s := range signers {
+		conf := s.Config()
+		results[i] = SignerHealth{
+			SignerID: conf.ID,
+			Type:     conf.Type,
+			Healthy:  true,
+		}
+		checker, ok := s.(HealthChecker)
+		if !ok {
+			continue
+		}
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- checker.CheckHealth()
+		}()
+		select {
+		case err := <-errChan:
+			if err != nil {
+				results[i].Healthy = false
+				results[i].Error = err.Error()
+			}
+		case <-time.After(healthProbeTimeout):
+			results[i].Healthy = false
+			results[i].Error = fmt.Sprintf("health probe timed out after %s", healthProbeTimeout)
+		}
+	}
+	return results
+}
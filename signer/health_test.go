@@ -0,0 +1,53 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeSigner implements the Signer interface without a health probe
+type fakeSigner struct {
+	id string
+}
+
+func (f *fakeSigner) Config() Configuration {
+	return Configuration{ID: f.id, Type: "fake"}
+}
+
+// fakeCheckedSigner implements the Signer and HealthChecker interfaces
+type fakeCheckedSigner struct {
+	fakeSigner
+	err error
+}
+
+func (f *fakeCheckedSigner) CheckHealth() error {
+	return f.err
+}
+
+func TestHealthCheck(t *testing.T) {
+	signers := []Signer{
+		&fakeSigner{id: "noprobe"},
+		&fakeCheckedSigner{fakeSigner: fakeSigner{id: "healthy"}},
+		&fakeCheckedSigner{fakeSigner: fakeSigner{id: "broken"}, err: errors.New("key unusable")},
+	}
+	results := HealthCheck(signers)
+	if len(results) != len(signers) {
+		t.Fatalf("expected %d results but got %d", len(signers), len(results))
+	}
+	if !results[0].Healthy || results[0].Error != "" {
+		t.Fatalf("expected signer without probe to be healthy but got %+v", results[0])
+	}
+	if !results[1].Healthy || results[1].Error != "" {
+		t.Fatalf("expected healthy signer to pass but got %+v", results[1])
+	}
+	if results[2].Healthy || results[2].Error != "key unusable" {
+		t.Fatalf("expected broken signer to fail with its error but got %+v", results[2])
+	}
+	if results[2].SignerID != "broken" || results[2].Type != "fake" {
+		t.Fatalf("expected result to carry signer id and type but got %+v", results[2])
+	}
+}
@@ -5,21 +5,36 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"go.mozilla.org/autograph/signer"
 	margo "go.mozilla.org/mar"
 
 	"github.com/ThalesIgnite/crypto11"
 )
 
+// timeNow is the clock of the package, in a variable so tests can
+// simulate skew
+var timeNow = time.Now
+
 const (
 	// Type of this signer is "mar"
 	Type = "mar"
+
+	// SigAlgRsaPssSha384 is the ID of a signature of type RSA-PSS-SHA384.
+	// The margo package does not define it, so hashing and signing for
+	// this algorithm are handled by the signer itself. The ID follows
+	// the numbering of the margo SigAlg constants.
+	SigAlgRsaPssSha384 = 5
 )
 
 // MARSigner holds the configuration of the signer
@@ -29,6 +44,17 @@ type MARSigner struct {
 	publicKey     crypto.PublicKey
 	rand          io.Reader
 	defaultSigAlg uint32
+	trustedKeys   []crypto.PublicKey
+	trustedCerts  []*x509.Certificate
+
+	// extraKeys each contribute an additional signature to signed
+	// files, with the algorithm derived from their key type
+	extraKeys []marKeyPair
+
+	// clockSkewTolerance extends the validity period of trusted
+	// certificates on both ends, the way contentsignaturepki extends the
+	// lifetime of its end-entities around rotation boundaries
+	clockSkewTolerance time.Duration
 }
 
 // New initializes a mar signer using a configuration
@@ -49,6 +75,57 @@ func New(conf signer.Configuration) (s *MARSigner, err error) {
 		return nil, errors.New("mar: missing private key in signer configuration")
 	}
 	s.PrivateKey = conf.PrivateKey
+	s.AllowedSigAlgs = conf.AllowedSigAlgs
+	s.AuditHook = conf.AuditHook
+
+	// when configured, input files are authenticated against a set of
+	// trusted keys before being re-signed, so parse them upfront
+	s.VerifyInputSignatures = conf.VerifyInputSignatures
+	s.TrustedKeys = conf.TrustedKeys
+	s.clockSkewTolerance = conf.ClockSkewTolerance
+	if conf.VerifyInputSignatures {
+		if len(conf.TrustedKeys) == 0 {
+			return nil, errors.Errorf("mar: signer %q verifies input signatures but has no trusted keys", conf.ID)
+		}
+		for _, trustedKey := range conf.TrustedKeys {
+			// trusted keys are either PEM encoded, or base64 encoded
+			// DER like the public keys published by the service
+			keyBytes := []byte(trustedKey)
+			if strings.HasPrefix(trustedKey, "-----BEGIN") {
+				block, _ := pem.Decode(keyBytes)
+				if block == nil {
+					return nil, errors.Errorf("mar: no pem block found in trusted key of signer %q", conf.ID)
+				}
+				if block.Type == "CERTIFICATE" {
+					// trusted keys can also be certificates, in which
+					// case their validity period is checked with some
+					// tolerance for clock skew
+					cert, err := x509.ParseCertificate(block.Bytes)
+					if err != nil {
+						return nil, errors.Wrapf(err, "mar: failed to parse trusted certificate of signer %q", conf.ID)
+					}
+					err = s.checkCertValidity(cert)
+					if err != nil {
+						return nil, err
+					}
+					s.trustedKeys = append(s.trustedKeys, cert.PublicKey)
+					s.trustedCerts = append(s.trustedCerts, cert)
+					continue
+				}
+				keyBytes = block.Bytes
+			} else {
+				keyBytes, err = base64.StdEncoding.DecodeString(trustedKey)
+				if err != nil {
+					return nil, errors.Wrapf(err, "mar: failed to decode trusted key of signer %q", conf.ID)
+				}
+			}
+			pub, err := x509.ParsePKIXPublicKey(keyBytes)
+			if err != nil {
+				return nil, errors.Wrapf(err, "mar: failed to parse trusted key of signer %q", conf.ID)
+			}
+			s.trustedKeys = append(s.trustedKeys, pub)
+		}
+	}
 	s.signingKey, s.publicKey, s.rand, s.PublicKey, err = conf.GetKeysAndRand()
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to get keys and random io reader")
@@ -81,27 +158,102 @@ func New(conf signer.Configuration) (s *MARSigner, err error) {
 	default:
 		return nil, errors.Errorf("mar: unsupported public key type %T", s.signingKey)
 	}
+	// expose the selected algorithm for introspection, the way pki
+	// signers expose their curve via Mode
+	s.Mode = sigAlgName(s.defaultSigAlg)
+
+	// extra keys each add a signature to signed files, so one signer
+	// can emit several algorithms in a single pass
+	s.ExtraPrivateKeys = conf.ExtraPrivateKeys
+	for _, extraKey := range conf.ExtraPrivateKeys {
+		extraConf := conf
+		extraConf.PrivateKey = extraKey
+		priv, pub, _, _, err := extraConf.GetKeysAndRand()
+		if err != nil {
+			return nil, errors.Wrapf(err, "mar: failed to get extra signing key of signer %q", conf.ID)
+		}
+		switch priv.(type) {
+		case *rsa.PrivateKey, *crypto11.PKCS11PrivateKeyRSA, *ecdsa.PrivateKey, *crypto11.PKCS11PrivateKeyECDSA:
+		default:
+			return nil, errors.Errorf("mar: unsupported extra key type %T", priv)
+		}
+		s.extraKeys = append(s.extraKeys, marKeyPair{signingKey: priv, publicKey: pub})
+	}
 	return
 }
 
+// marKeyPair holds an extra signing key of a mar signer alongside its
+// public half, as needed to prepare a signature entry
+type marKeyPair struct {
+	signingKey crypto.PrivateKey
+	publicKey  crypto.PublicKey
+}
+
+// checkCertValidity verifies the current time falls within the validity
+// period of a trusted certificate, extended on both ends by the clock
+// skew tolerance of the signer
+func (s *MARSigner) checkCertValidity(cert *x509.Certificate) error {
+	now := timeNow().UTC()
+	if now.Add(s.clockSkewTolerance).Before(cert.NotBefore) {
+		return errors.Errorf("mar: trusted certificate of signer %q is not valid until %s", s.ID, cert.NotBefore)
+	}
+	if now.Add(-s.clockSkewTolerance).After(cert.NotAfter) {
+		return errors.Errorf("mar: trusted certificate of signer %q expired on %s", s.ID, cert.NotAfter)
+	}
+	return nil
+}
+
 // Config returns the configuration of the current signer
 func (s *MARSigner) Config() signer.Configuration {
 	return signer.Configuration{
-		ID:         s.ID,
-		Type:       s.Type,
-		PrivateKey: s.PrivateKey,
-		PublicKey:  s.PublicKey,
+		ID:                 s.ID,
+		Type:               s.Type,
+		Mode:               s.Mode,
+		PrivateKey:         s.PrivateKey,
+		PublicKey:          s.PublicKey,
+		DefaultSigAlg:      s.defaultSigAlg,
+		ClockSkewTolerance: s.clockSkewTolerance,
+		ExtraPrivateKeys:   s.ExtraPrivateKeys,
+	}
+}
+
+// CheckHealth verifies the signing key of the signer is loaded and
+// still usable by signing a small test hash, which exercises the hsm
+// when the key lives there
+func (s *MARSigner) CheckHealth() error {
+	if s.signingKey == nil {
+		return errors.New("mar: signing key is not loaded")
+	}
+	hashed, _, err := margo.Hash([]byte("AUTOGRAPH HEALTH CHECK"), s.defaultSigAlg)
+	if err != nil {
+		return errors.Wrap(err, "mar: failed to hash health check input")
+	}
+	_, err = margo.Sign(s.signingKey, s.rand, hashed, s.defaultSigAlg)
+	if err != nil {
+		return errors.Wrap(err, "mar: health check signature failed")
 	}
+	return nil
 }
 
 // SignFile takes a MAR file and returns a signed MAR file
-func (s *MARSigner) SignFile(input []byte, options interface{}) (signer.SignedFile, error) {
+func (s *MARSigner) SignFile(input []byte, options interface{}) (sf signer.SignedFile, err error) {
+	defer func() { s.Audit(signer.AuditOpSignFile, input, err) }()
 	var marFile margo.File
-	err := margo.Unmarshal(input, &marFile)
+	err = margo.Unmarshal(input, &marFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to unmarshal input file")
 	}
 
+	// when configured, refuse to re-sign an input file whose existing
+	// signatures cannot be authenticated, so the service cannot be used
+	// to launder arbitrary files into signed ones
+	if s.VerifyInputSignatures {
+		err = s.verifyInputSignatures(&marFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// flush the signatures if any is present, we'll make new ones
 	marFile.SignaturesHeader.NumSignatures = uint32(0)
 	marFile.Signatures = nil
@@ -109,6 +261,14 @@ func (s *MARSigner) SignFile(input []byte, options interface{}) (signer.SignedFi
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to prepare signature")
 	}
+	// each extra key adds its own signature entry, finalized together
+	// with the primary one over the same signature block
+	for _, extra := range s.extraKeys {
+		err = marFile.PrepareSignature(extra.signingKey, extra.publicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "mar: failed to prepare extra signature")
+		}
+	}
 	err = marFile.FinalizeSignatures()
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to finalize signature")
@@ -122,26 +282,214 @@ func (s *MARSigner) SignFile(input []byte, options interface{}) (signer.SignedFi
 	return output, nil
 }
 
+// VerifyFile checks that a signed MAR file carries a valid signature
+// from this signer, so operators can validate an artifact before
+// publishing instead of reimplementing the margo verification
+func (s *MARSigner) VerifyFile(input []byte) error {
+	var marFile margo.File
+	err := margo.Unmarshal(input, &marFile)
+	if err != nil {
+		return errors.Wrap(err, "mar: failed to unmarshal input file")
+	}
+	if len(marFile.Signatures) == 0 {
+		return errors.New("mar: input file carries no signature to verify")
+	}
+	// trusted certificates are re-validated at verification time with
+	// the clock skew tolerance of the signer, so a builder with a
+	// slightly skewed clock is not spuriously rejected. The tolerance
+	// defaults to zero, where only the exact validity period passes.
+	for _, cert := range s.trustedCerts {
+		err = s.checkCertValidity(cert)
+		if err != nil {
+			return err
+		}
+	}
+	err = marFile.VerifySignature(s.publicKey)
+	if err != nil {
+		return errors.Wrap(err, "mar: signature verification failed")
+	}
+	// files signed with extra keys carry one signature per key, each
+	// of which must verify against its own public half
+	for _, extra := range s.extraKeys {
+		err = marFile.VerifySignature(extra.publicKey)
+		if err != nil {
+			return errors.Wrap(err, "mar: extra signature verification failed")
+		}
+	}
+	return nil
+}
+
+// verifyInputSignatures checks the existing signatures of an input file
+// against the trusted keys of the signer, and returns an error if none
+// of them authenticates the file
+func (s *MARSigner) verifyInputSignatures(marFile *margo.File) error {
+	if len(marFile.Signatures) == 0 {
+		return errors.New("mar: input file carries no signature to verify")
+	}
+	for _, key := range s.trustedKeys {
+		if marFile.VerifySignature(key) == nil {
+			return nil
+		}
+	}
+	return errors.New("mar: input file signature does not verify against any trusted key")
+}
+
+// AppendSignatureToFile takes a MAR file that may already carry signatures
+// and adds a signature from this signer while preserving the existing ones,
+// for multi-party signing workflows. Note that MAR signatures cover the
+// signature headers of the whole file, so pre-existing signatures must have
+// been computed with this extra signature entry accounted for to remain
+// cryptographically valid.
+func (s *MARSigner) AppendSignatureToFile(input []byte, options interface{}) (signer.SignedFile, error) {
+	var marFile margo.File
+	err := margo.Unmarshal(input, &marFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to unmarshal input file")
+	}
+
+	// add a signature entry for this signer without touching the
+	// existing ones, then sign the block covering all entries
+	err = marFile.PrepareSignature(s.signingKey, s.publicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to prepare signature")
+	}
+	signableBlock, err := marFile.MarshalForSignature()
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to marshal file for signature")
+	}
+	newSig := &marFile.Signatures[len(marFile.Signatures)-1]
+	hashed, _, err := margo.Hash(signableBlock, newSig.AlgorithmID)
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to hash signable block")
+	}
+	// finalize the new signature ourselves, as FinalizeSignatures would
+	// attempt to re-sign the pre-existing entries we don't have keys for
+	newSig.Data, err = margo.Sign(s.signingKey, s.rand, hashed, newSig.AlgorithmID)
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to sign")
+	}
+
+	output, err := marFile.Marshal()
+	if err != nil {
+		return nil, errors.Wrap(err, "mar: failed to marshal signed file")
+	}
+	return output, nil
+}
+
+// SignFileWithSignature takes a MAR file and returns both the signed MAR
+// file and the detached signature embedded in it, so callers that store
+// the detached signature separately don't need to re-parse the output
+func (s *MARSigner) SignFileWithSignature(input []byte, options interface{}) (signer.SignedFile, signer.Signature, error) {
+	signedFile, err := s.SignFile(input, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	var marFile margo.File
+	err = margo.Unmarshal(signedFile, &marFile)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "mar: failed to unmarshal signed file")
+	}
+	if len(marFile.Signatures) < 1 {
+		return nil, nil, errors.New("mar: signed file carries no signature")
+	}
+	sig := new(Signature)
+	sig.Data = marFile.Signatures[0].Data
+	return signedFile, sig, nil
+}
+
 // SignData takes a MAR file already marshalled for signature and returns a base64 encoded signature.
 //
 // This function expects the caller to handle parsing of the MAR file, which can be really tricky
 // because the signature headers need to be placed in the file prior to marshalling it for
 // signature. You should consider calling the SignFile interface instead, which will handle
 // all that magic for you.
-func (s *MARSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+func (s *MARSigner) SignData(data []byte, options interface{}) (sig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, data, err) }()
 	opt, err := GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to get options")
 	}
+	err = opt.resolveSigAlg()
+	if err != nil {
+		return nil, err
+	}
 	// if no options were defined, use the default value from the signer
 	if opt.SigAlg == 0 {
 		opt.SigAlg = s.defaultSigAlg
 	}
-	hashed, _, err := margo.Hash(data, opt.SigAlg)
+	if opt.CorrelationID == "" {
+		opt.CorrelationID = signer.MakeCorrelationID()
+	}
+	if !s.IsAllowedSigAlg(sigAlgName(opt.SigAlg)) {
+		return nil, errors.Errorf("mar: signature algorithm %q is not allowed by signer %q", sigAlgName(opt.SigAlg), s.ID)
+	}
+	log.Infof("mar: signing data with signer %q and algorithm %d (correlation id %s)",
+		s.ID, opt.SigAlg, opt.CorrelationID)
+	hashed, h, err := margo.Hash(data, hashSigAlg(opt.SigAlg))
 	if err != nil {
+		signer.Metrics().IncSignError(Type, sigAlgName(opt.SigAlg), "hash")
 		return nil, errors.Wrap(err, "mar: failed to hash input")
 	}
-	return s.SignHash(hashed, options)
+	sig, err = s.SignHash(hashed, opt)
+	if err != nil {
+		return nil, err
+	}
+	if opt.FallbackSigAlg == 0 {
+		return sig, nil
+	}
+	// guarded algorithm fallback: a freshly issued signature that fails
+	// verification against our own key points at a library or hsm bug
+	// in the requested algorithm, so re-sign with the previous
+	// algorithm rather than returning a broken signature. This changes
+	// the algorithm the caller asked for, hence the loud logging.
+	verr := s.verifyOwnSignature(sig.(*Signature).Data, hashed, h, opt.SigAlg)
+	if verr == nil {
+		return sig, nil
+	}
+	signer.Metrics().IncSignError(Type, sigAlgName(opt.SigAlg), "self_verify")
+	log.Errorf("mar: signature from signer %q under algorithm %q failed self-verification, falling back to %q (correlation id %s): %v",
+		s.ID, sigAlgName(opt.SigAlg), sigAlgName(opt.FallbackSigAlg), opt.CorrelationID, verr)
+	fallbackOpt := opt
+	fallbackOpt.SigAlg = opt.FallbackSigAlg
+	fallbackOpt.SigAlgName = ""
+	fallbackOpt.FallbackSigAlg = 0
+	hashed, h, err = margo.Hash(data, hashSigAlg(fallbackOpt.SigAlg))
+	if err != nil {
+		signer.Metrics().IncSignError(Type, sigAlgName(fallbackOpt.SigAlg), "hash")
+		return nil, errors.Wrap(err, "mar: failed to hash input for fallback algorithm")
+	}
+	sig, err = s.SignHash(hashed, fallbackOpt)
+	if err != nil {
+		return nil, err
+	}
+	verr = s.verifyOwnSignature(sig.(*Signature).Data, hashed, h, fallbackOpt.SigAlg)
+	if verr != nil {
+		signer.Metrics().IncSignError(Type, sigAlgName(fallbackOpt.SigAlg), "self_verify")
+		return nil, errors.Errorf("mar: signature from signer %q still fails self-verification after falling back to %q (correlation id %s): %v",
+			s.ID, sigAlgName(fallbackOpt.SigAlg), opt.CorrelationID, verr)
+	}
+	return sig, nil
+}
+
+// marVerifyHashSignature checks a signature over a digest, in a
+// variable so tests can simulate verification failures
+var marVerifyHashSignature = margo.VerifyHashSignature
+
+// verifyOwnSignature checks a freshly issued signature against the
+// public key of the signer, see the FallbackSigAlg signing option
+func (s *MARSigner) verifyOwnSignature(sigData, digest []byte, h crypto.Hash, sigalg uint32) error {
+	if sigalg == SigAlgRsaPssSha384 {
+		pub, ok := s.publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("mar: signature algorithm %q requires an rsa key but signer %q holds a %T",
+				sigAlgName(sigalg), s.ID, s.publicKey)
+		}
+		return rsa.VerifyPSS(pub, crypto.SHA384, digest, sigData, &rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       crypto.SHA384,
+		})
+	}
+	return marVerifyHashSignature(sigData, digest, h, s.publicKey)
 }
 
 // SignHash takes the hash of the signable data of a MAR file, signs it and returns a base64 encoded signature
@@ -150,18 +498,61 @@ func (s *MARSigner) SignHash(hashed []byte, options interface{}) (signer.Signatu
 	if err != nil {
 		return nil, errors.Wrap(err, "mar: failed to get options")
 	}
+	err = opt.resolveSigAlg()
+	if err != nil {
+		return nil, err
+	}
 	// if no options were defined, use the default value from the signer
 	if opt.SigAlg == 0 {
 		opt.SigAlg = s.defaultSigAlg
 	}
+	if opt.CorrelationID == "" {
+		opt.CorrelationID = signer.MakeCorrelationID()
+	}
+	if !s.IsAllowedSigAlg(sigAlgName(opt.SigAlg)) {
+		signer.Metrics().IncSignError(Type, sigAlgName(opt.SigAlg), "disallowed_sigalg")
+		return nil, errors.Errorf("mar: signature algorithm %q is not allowed by signer %q", sigAlgName(opt.SigAlg), s.ID)
+	}
+	start := time.Now()
 	sig := new(Signature)
-	sig.Data, err = margo.Sign(s.signingKey, s.rand, hashed, opt.SigAlg)
+	if opt.SigAlg == SigAlgRsaPssSha384 {
+		sig.Data, err = s.signPss(hashed)
+	} else {
+		sig.Data, err = margo.Sign(s.signingKey, s.rand, hashed, opt.SigAlg)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "mar: failed to sign")
+		signer.Metrics().IncSignError(Type, sigAlgName(opt.SigAlg), "sign")
+		return nil, errors.Wrapf(err, "mar: failed to sign (correlation id %s)", opt.CorrelationID)
 	}
+	signer.Metrics().IncSignSuccess(Type, sigAlgName(opt.SigAlg))
+	signer.Metrics().ObserveSignDuration(Type, sigAlgName(opt.SigAlg), time.Since(start))
 	return sig, nil
 }
 
+// hashSigAlg returns the algorithm margo hashes with for a given
+// signature algorithm: rsa-pss-sha384 hashes like rsa-pkcs1-sha384,
+// everything else hashes as itself
+func hashSigAlg(sigalg uint32) uint32 {
+	if sigalg == SigAlgRsaPssSha384 {
+		return margo.SigAlgRsaPkcs1Sha384
+	}
+	return sigalg
+}
+
+// signPss signs a sha384 digest with rsa-pss, which the margo package
+// does not implement itself. The salt length equals the hash length,
+// matching the verification settings of pss consumers.
+func (s *MARSigner) signPss(digest []byte) ([]byte, error) {
+	if _, ok := s.publicKey.(*rsa.PublicKey); !ok {
+		return nil, errors.Errorf("mar: signature algorithm %q requires an rsa key but signer %q holds a %T",
+			sigAlgName(SigAlgRsaPssSha384), s.ID, s.publicKey)
+	}
+	return s.signingKey.(crypto.Signer).Sign(s.rand, digest, &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+		Hash:       crypto.SHA384,
+	})
+}
+
 // Signature is a MAR signature
 type Signature struct {
 	Data []byte
@@ -178,6 +569,78 @@ type Options struct {
 	// SigAlg is an integer that represents the type of signature requested.
 	// It must map the SigAlg constants from the MAR package
 	SigAlg uint32 `json:"sigalg"`
+
+	// SigAlgName is the name of the signature algorithm requested,
+	// e.g. "rsa-pss-sha384", as an ergonomic alternative to the
+	// numeric SigAlg. When both are set they must designate the same
+	// algorithm.
+	SigAlgName string `json:"sigalg_name,omitempty"`
+
+	// FallbackSigAlg, when set, makes SignData verify the freshly
+	// issued signature against the public key of the signer and
+	// re-sign with the given algorithm if that verification fails,
+	// loudly logging the incident. This is an opt-in guard for
+	// algorithm migrations, where a bug in the new algorithm should
+	// degrade to the previous one instead of shipping a broken
+	// signature.
+	FallbackSigAlg uint32 `json:"fallback_sigalg,omitempty"`
+
+	// CorrelationID is an identifier included in log lines and error
+	// messages to correlate a signing request across systems. If empty,
+	// the signer generates one.
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// resolveSigAlg folds the SigAlgName of the options into the numeric
+// SigAlg, refusing contradictory requests
+func (opt *Options) resolveSigAlg() error {
+	if opt.SigAlgName == "" {
+		return nil
+	}
+	id, err := sigAlgID(opt.SigAlgName)
+	if err != nil {
+		return err
+	}
+	if opt.SigAlg != 0 && opt.SigAlg != id {
+		return errors.Errorf("mar: signature algorithm name %q contradicts numeric algorithm %d", opt.SigAlgName, opt.SigAlg)
+	}
+	opt.SigAlg = id
+	return nil
+}
+
+// sigAlgName maps the numeric margo signature algorithm IDs to the names
+// used in the AllowedSigAlgs configuration of a signer
+func sigAlgName(id uint32) string {
+	switch id {
+	case margo.SigAlgRsaPkcs1Sha1:
+		return "rsa-pkcs1-sha1"
+	case margo.SigAlgRsaPkcs1Sha384:
+		return "rsa-pkcs1-sha384"
+	case margo.SigAlgEcdsaP256Sha256:
+		return "ecdsa-p256-sha256"
+	case margo.SigAlgEcdsaP384Sha384:
+		return "ecdsa-p384-sha384"
+	case SigAlgRsaPssSha384:
+		return "rsa-pss-sha384"
+	}
+	return "unknown"
+}
+
+// sigAlgID maps a signature algorithm name back to its numeric ID, for
+// options that request the algorithm by name
+func sigAlgID(name string) (uint32, error) {
+	for _, id := range []uint32{
+		margo.SigAlgRsaPkcs1Sha1,
+		margo.SigAlgRsaPkcs1Sha384,
+		margo.SigAlgEcdsaP256Sha256,
+		margo.SigAlgEcdsaP384Sha384,
+		SigAlgRsaPssSha384,
+	} {
+		if sigAlgName(id) == name {
+			return id, nil
+		}
+	}
+	return 0, errors.Errorf("mar: unknown signature algorithm name %q", name)
 }
 
 // GetDefaultOptions returns default options of the signer
@@ -1,12 +1,24 @@
 package mar
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	"go.mozilla.org/autograph/signer"
 	margo "go.mozilla.org/mar"
@@ -46,6 +58,88 @@ func TestSignFile(t *testing.T) {
 	}
 }
 
+func TestCheckHealth(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		err = s.CheckHealth()
+		if err != nil {
+			t.Fatalf("expected health check of signer %d to pass but got: %v", i, err)
+		}
+	}
+}
+
+func TestSignFileWithSignature(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		t.Logf("testing signer %d %q", i, s.ID)
+		signedMAR, sig, err := s.SignFileWithSignature(miniMarB, Options{SigAlg: s.defaultSigAlg})
+		if err != nil {
+			t.Fatalf("failed to sign file: %v", err)
+		}
+		var parsedMar margo.File
+		err = margo.Unmarshal(signedMAR, &parsedMar)
+		if err != nil {
+			t.Fatalf("failed to parse file: %v", err)
+		}
+		err = parsedMar.VerifySignature(s.publicKey)
+		if err != nil {
+			t.Fatalf("failed to verify signature: %v", err)
+		}
+		if !bytes.Equal(sig.(*Signature).Data, parsedMar.Signatures[0].Data) {
+			t.Fatalf("detached signature does not match the one embedded in the signed file")
+		}
+	}
+}
+
+func TestAppendSignatureToFile(t *testing.T) {
+	// sign the input with a first signer, then append a signature from a
+	// second signer and check the first signature is preserved
+	s1, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("failed to initialize first signer: %v", err)
+	}
+	signedMAR, err := s1.SignFile(miniMarB, Options{SigAlg: s1.defaultSigAlg})
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+	var firstPass margo.File
+	err = margo.Unmarshal(signedMAR, &firstPass)
+	if err != nil {
+		t.Fatalf("failed to parse file: %v", err)
+	}
+
+	s2, err := New(marsignerconfs[1])
+	if err != nil {
+		t.Fatalf("failed to initialize second signer: %v", err)
+	}
+	resignedMAR, err := s2.AppendSignatureToFile(signedMAR, nil)
+	if err != nil {
+		t.Fatalf("failed to append signature: %v", err)
+	}
+	var parsedMar margo.File
+	err = margo.Unmarshal(resignedMAR, &parsedMar)
+	if err != nil {
+		t.Fatalf("failed to parse re-signed file: %v", err)
+	}
+	if parsedMar.SignaturesHeader.NumSignatures != 2 {
+		t.Fatalf("expected 2 signatures in re-signed file, got %d", parsedMar.SignaturesHeader.NumSignatures)
+	}
+	if !bytes.Equal(parsedMar.Signatures[0].Data, firstPass.Signatures[0].Data) {
+		t.Fatal("pre-existing signature was not preserved by append")
+	}
+	// the appended signature must verify against the re-signed block
+	err = parsedMar.VerifySignature(s2.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify appended signature: %v", err)
+	}
+}
+
 func TestSignData(t *testing.T) {
 	for i, marsignerconf := range marsignerconfs {
 		s, err := New(marsignerconf)
@@ -117,6 +211,43 @@ func TestSignDataWithBadSigAlg(t *testing.T) {
 	}
 }
 
+func TestSignDataWithCorrelationID(t *testing.T) {
+	s, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	sig, err := s.SignData([]byte("foo"), Options{SigAlg: s.defaultSigAlg, CorrelationID: "unittestcorrid"})
+	if err != nil {
+		t.Fatalf("failed to sign data with correlation id: %v", err)
+	}
+	err = margo.VerifySignature([]byte("foo"), sig.(*Signature).Data, s.defaultSigAlg, s.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+}
+
+func TestAllowedSigAlgs(t *testing.T) {
+	conf := marsignerconfs[0]
+	conf.AllowedSigAlgs = []string{"rsa-pkcs1-sha384"}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	// the default algorithm of this rsa signer is in the allowlist
+	_, err = s.SignData([]byte("foo"), nil)
+	if err != nil {
+		t.Fatalf("failed to sign data with allowed algorithm: %v", err)
+	}
+	// sha1 is not in the allowlist and must be rejected
+	_, err = s.SignData([]byte("foo"), Options{SigAlg: margo.SigAlgRsaPkcs1Sha1})
+	if err == nil {
+		t.Fatal("expected to fail signing with disallowed algorithm but succeeded")
+	}
+	if err.Error() != `mar: signature algorithm "rsa-pkcs1-sha1" is not allowed by signer "unittestmar"` {
+		t.Fatalf("expected to fail with disallowed algorithm but failed with: %v", err)
+	}
+}
+
 func TestUnsupportedP521Curve(t *testing.T) {
 	_, err := New(signer.Configuration{
 		ID:   "p521marsigner",
@@ -281,3 +412,418 @@ var miniMarB = []byte("\x4D\x41\x52\x31\x00\x00\x01\x7D\x00\x00\x00\x00\x00\x00\
 	"\x61\x61\x61\x61\x61\x61\x61\x61\x61\x61\x61\x61\x61\x00\x00\x00" +
 	"\x15\x00\x00\x01\x68\x00\x00\x00\x15\x00\x00\x02\x58\x2F\x66\x6F" +
 	"\x6F\x2F\x62\x61\x72\x00")
+
+func TestConfigReflectsSigAlg(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		cfg := s.Config()
+		if cfg.DefaultSigAlg != s.defaultSigAlg {
+			t.Fatalf("signer %d config sig alg %d does not match key-derived algorithm %d",
+				i, cfg.DefaultSigAlg, s.defaultSigAlg)
+		}
+		if cfg.Mode != sigAlgName(s.defaultSigAlg) {
+			t.Fatalf("signer %d config mode %q does not match algorithm name %q",
+				i, cfg.Mode, sigAlgName(s.defaultSigAlg))
+		}
+		if cfg.Mode == "unknown" {
+			t.Fatalf("signer %d selected an unknown default signature algorithm", i)
+		}
+	}
+}
+
+func TestVerifyInputSignatures(t *testing.T) {
+	// sign the test file once to obtain an input carrying a signature
+	s1, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	signedMAR, err := s1.SignFile(miniMarB, Options{SigAlg: s1.defaultSigAlg})
+	if err != nil {
+		t.Fatalf("failed to sign MAR file: %v", err)
+	}
+
+	// a signer trusting the key of the first signer re-signs the file
+	conf := marsignerconfs[1]
+	conf.VerifyInputSignatures = true
+	conf.TrustedKeys = []string{s1.PublicKey}
+	s2, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	resignedMAR, err := s2.SignFile(signedMAR, Options{SigAlg: s2.defaultSigAlg})
+	if err != nil {
+		t.Fatalf("failed to re-sign authenticated MAR file: %v", err)
+	}
+	var reparsed margo.File
+	err = margo.Unmarshal(resignedMAR, &reparsed)
+	if err != nil {
+		t.Fatalf("failed to unmarshal re-signed file: %v", err)
+	}
+	err = reparsed.VerifySignature(s2.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify re-signed file: %v", err)
+	}
+
+	// the test file carries a signature from a key the signer doesn't
+	// trust, so it is refused
+	_, err = s2.SignFile(miniMarB, Options{SigAlg: s2.defaultSigAlg})
+	if err == nil {
+		t.Fatal("expected to refuse a file signed by an unknown key but it was signed")
+	}
+	if !strings.Contains(err.Error(), "does not verify against any trusted key") {
+		t.Fatalf("expected to fail with untrusted signature but failed with: %v", err)
+	}
+
+	// a signer trusting a different key refuses the file even though it
+	// carries a valid signature
+	conf = marsignerconfs[1]
+	conf.VerifyInputSignatures = true
+	conf.TrustedKeys = []string{s2.PublicKey}
+	s3, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	_, err = s3.SignFile(signedMAR, Options{SigAlg: s3.defaultSigAlg})
+	if err == nil {
+		t.Fatal("expected to refuse a file signed by an untrusted key but it was signed")
+	}
+	if !strings.Contains(err.Error(), "does not verify against any trusted key") {
+		t.Fatalf("expected to fail with untrusted signature but failed with: %v", err)
+	}
+
+	// verification without trusted keys is rejected at initialization
+	conf = marsignerconfs[1]
+	conf.VerifyInputSignatures = true
+	conf.TrustedKeys = nil
+	_, err = New(conf)
+	if err == nil || !strings.Contains(err.Error(), "has no trusted keys") {
+		t.Fatalf("expected to fail without trusted keys but got: %v", err)
+	}
+}
+
+func TestTrustedCertClockSkewTolerance(t *testing.T) {
+	// issue a self signed certificate that expired half an hour ago
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mar trusted key test"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-30 * time.Minute),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	// within the skew tolerance the expired certificate is accepted
+	conf := marsignerconfs[0]
+	conf.VerifyInputSignatures = true
+	conf.TrustedKeys = []string{string(certPem)}
+	conf.ClockSkewTolerance = time.Hour
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	if len(s.trustedKeys) != 1 {
+		t.Fatalf("expected 1 trusted key, got %d", len(s.trustedKeys))
+	}
+	if s.Config().ClockSkewTolerance != time.Hour {
+		t.Fatal("expected the signer configuration to record the clock skew tolerance")
+	}
+
+	// without tolerance the expired certificate is refused
+	conf.ClockSkewTolerance = 0
+	_, err = New(conf)
+	if err == nil || !strings.Contains(err.Error(), "expired on") {
+		t.Fatalf("expected to fail with expired certificate but got: %v", err)
+	}
+
+	// a certificate that only becomes valid in half an hour behaves the
+	// same way on the other end of the validity period
+	tmpl.NotBefore = time.Now().Add(30 * time.Minute)
+	tmpl.NotAfter = time.Now().Add(2 * time.Hour)
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	conf.TrustedKeys = []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+	_, err = New(conf)
+	if err == nil || !strings.Contains(err.Error(), "is not valid until") {
+		t.Fatalf("expected to fail with not yet valid certificate but got: %v", err)
+	}
+	conf.ClockSkewTolerance = time.Hour
+	_, err = New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+}
+
+func TestSignFileWithExtraKeys(t *testing.T) {
+	// an rsa signer carrying an extra p256 key emits both signatures
+	// in a single pass
+	conf := marsignerconfs[0]
+	conf.ExtraPrivateKeys = []string{marsignerconfs[2].PrivateKey}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	// a second signer on the extra key provides its public half for
+	// independent verification
+	extraSigner, err := New(marsignerconfs[2])
+	if err != nil {
+		t.Fatalf("failed to initialize extra signer: %v", err)
+	}
+	signedMAR, err := s.SignFile(miniMarB, Options{SigAlg: s.defaultSigAlg})
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+	var parsedMar margo.File
+	err = margo.Unmarshal(signedMAR, &parsedMar)
+	if err != nil {
+		t.Fatalf("failed to parse file: %v", err)
+	}
+	if parsedMar.SignaturesHeader.NumSignatures != 2 || len(parsedMar.Signatures) != 2 {
+		t.Fatalf("expected 2 signatures but header declares %d and file carries %d",
+			parsedMar.SignaturesHeader.NumSignatures, len(parsedMar.Signatures))
+	}
+	if parsedMar.Signatures[0].AlgorithmID != margo.SigAlgRsaPkcs1Sha384 {
+		t.Fatalf("expected primary signature algorithm %d but got %d",
+			margo.SigAlgRsaPkcs1Sha384, parsedMar.Signatures[0].AlgorithmID)
+	}
+	if parsedMar.Signatures[1].AlgorithmID != margo.SigAlgEcdsaP256Sha256 {
+		t.Fatalf("expected extra signature algorithm %d but got %d",
+			margo.SigAlgEcdsaP256Sha256, parsedMar.Signatures[1].AlgorithmID)
+	}
+	// each signature is independently valid against its own key
+	err = parsedMar.VerifySignature(s.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify primary signature: %v", err)
+	}
+	err = parsedMar.VerifySignature(extraSigner.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify extra signature: %v", err)
+	}
+	// the extra keys round-trip through the signer configuration
+	if len(s.Config().ExtraPrivateKeys) != 1 {
+		t.Fatalf("expected 1 extra private key in configuration but got %d", len(s.Config().ExtraPrivateKeys))
+	}
+	// a broken extra key fails initialization
+	conf.ExtraPrivateKeys = []string{"not a private key"}
+	_, err = New(conf)
+	if err == nil {
+		t.Fatal("expected initialization with a broken extra key to fail but it passed")
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	for i, marsignerconf := range marsignerconfs {
+		s, err := New(marsignerconf)
+		if err != nil {
+			t.Fatalf("failed to initialize signer %d: %v", i, err)
+		}
+		signedMAR, err := s.SignFile(miniMarB, Options{SigAlg: s.defaultSigAlg})
+		if err != nil {
+			t.Fatalf("failed to sign file with signer %d: %v", i, err)
+		}
+		// a signed file round-trips through verification
+		err = s.VerifyFile(signedMAR)
+		if err != nil {
+			t.Fatalf("failed to verify file signed by signer %d: %v", i, err)
+		}
+		// an unsigned file is refused
+		err = s.VerifyFile(miniMarB)
+		if err == nil {
+			t.Fatalf("expected verification of unsigned file to fail with signer %d but it passed", i)
+		}
+		// tampering with the content is detected
+		tampered := make([]byte, len(signedMAR))
+		copy(tampered, signedMAR)
+		tampered[len(tampered)-1] ^= 0xff
+		err = s.VerifyFile(tampered)
+		if err == nil {
+			t.Fatalf("expected verification of tampered file to fail with signer %d but it passed", i)
+		}
+	}
+	// a signer with an extra key requires its signature to be present
+	// too, so a file signed without it is refused
+	primary, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	signedMAR, err := primary.SignFile(miniMarB, Options{SigAlg: primary.defaultSigAlg})
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+	conf := marsignerconfs[0]
+	conf.ExtraPrivateKeys = []string{marsignerconfs[2].PrivateKey}
+	multi, err := New(conf)
+	if err != nil {
+		t.Fatalf("failed to initialize multi-key signer: %v", err)
+	}
+	err = multi.VerifyFile(signedMAR)
+	if err == nil || !strings.Contains(err.Error(), "extra signature verification failed") {
+		t.Fatalf("expected an extra signature verification error but got: %v", err)
+	}
+	multiSigned, err := multi.SignFile(miniMarB, Options{SigAlg: multi.defaultSigAlg})
+	if err != nil {
+		t.Fatalf("failed to sign file with multi-key signer: %v", err)
+	}
+	err = multi.VerifyFile(multiSigned)
+	if err != nil {
+		t.Fatalf("failed to verify file signed by multi-key signer: %v", err)
+	}
+}
+
+func TestSignDataRsaPss(t *testing.T) {
+	s, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	input := []byte("foo")
+	hashed, _, err := margo.Hash(input, margo.SigAlgRsaPkcs1Sha384)
+	if err != nil {
+		t.Fatalf("failed to hash input: %v", err)
+	}
+	// the algorithm can be requested by name or by numeric id
+	for _, opts := range []Options{
+		{SigAlgName: "rsa-pss-sha384"},
+		{SigAlg: SigAlgRsaPssSha384},
+	} {
+		sig, err := s.SignData(input, opts)
+		if err != nil {
+			t.Fatalf("failed to sign data with options %+v: %v", opts, err)
+		}
+		err = rsa.VerifyPSS(s.publicKey.(*rsa.PublicKey), crypto.SHA384, hashed, sig.(*Signature).Data,
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA384})
+		if err != nil {
+			t.Fatalf("failed to verify pss signature made with options %+v: %v", opts, err)
+		}
+	}
+	// a name contradicting the numeric id is refused
+	_, err = s.SignData(input, Options{SigAlg: margo.SigAlgRsaPkcs1Sha384, SigAlgName: "rsa-pss-sha384"})
+	if err == nil || !strings.Contains(err.Error(), "contradicts") {
+		t.Fatalf("expected a contradictory options error but got: %v", err)
+	}
+	// an unknown name is refused
+	_, err = s.SignData(input, Options{SigAlgName: "rsa-pss-sha512"})
+	if err == nil || !strings.Contains(err.Error(), "unknown signature algorithm name") {
+		t.Fatalf("expected an unknown algorithm error but got: %v", err)
+	}
+	// pss requires an rsa key
+	ecdsaSigner, err := New(marsignerconfs[2])
+	if err != nil {
+		t.Fatalf("failed to initialize ecdsa signer: %v", err)
+	}
+	_, err = ecdsaSigner.SignData(input, Options{SigAlgName: "rsa-pss-sha384"})
+	if err == nil || !strings.Contains(err.Error(), "requires an rsa key") {
+		t.Fatalf("expected an rsa key requirement error but got: %v", err)
+	}
+}
+
+func TestVerifyFileClockSkewTolerance(t *testing.T) {
+	defer func(orig func() time.Time) { timeNow = orig }(timeNow)
+
+	// issue a self signed trusted certificate valid for another hour
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mar verify skew test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to issue certificate: %v", err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	conf := marsignerconfs[0]
+	conf.VerifyInputSignatures = true
+	conf.TrustedKeys = []string{string(certPem)}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatalf("signer initialization failed with: %v", err)
+	}
+	signedMAR, err := s.AppendSignatureToFile(miniMarB, nil)
+	if err != nil {
+		t.Fatalf("failed to sign file: %v", err)
+	}
+	err = s.VerifyFile(signedMAR)
+	if err != nil {
+		t.Fatalf("failed to verify file: %v", err)
+	}
+
+	// move the clock half an hour past expiry of the trusted
+	// certificate: without tolerance verification is refused
+	timeNow = func() time.Time {
+		return tmpl.NotAfter.Add(30 * time.Minute)
+	}
+	err = s.VerifyFile(signedMAR)
+	if err == nil || !strings.Contains(err.Error(), "expired on") {
+		t.Fatalf("expected an expired certificate error but got: %v", err)
+	}
+
+	// with an hour of tolerance the skew is covered
+	s.clockSkewTolerance = time.Hour
+	err = s.VerifyFile(signedMAR)
+	if err != nil {
+		t.Fatalf("failed to verify file within clock skew tolerance: %v", err)
+	}
+}
+
+func TestSignDataFallbackSigAlg(t *testing.T) {
+	defer func(orig func([]byte, []byte, crypto.Hash, crypto.PublicKey) error) { marVerifyHashSignature = orig }(marVerifyHashSignature)
+
+	s, err := New(marsignerconfs[0])
+	if err != nil {
+		t.Fatalf("failed to initialize signer: %v", err)
+	}
+	input := []byte("foo")
+
+	// simulate a broken sha384 implementation: self-verification of
+	// the requested algorithm fails and the signer falls back
+	marVerifyHashSignature = func(sigData, digest []byte, h crypto.Hash, pub crypto.PublicKey) error {
+		if h == crypto.SHA384 {
+			return fmt.Errorf("simulated verification failure")
+		}
+		return margo.VerifyHashSignature(sigData, digest, h, pub)
+	}
+	sig, err := s.SignData(input, Options{SigAlg: margo.SigAlgRsaPkcs1Sha384, FallbackSigAlg: margo.SigAlgRsaPkcs1Sha1})
+	if err != nil {
+		t.Fatalf("failed to sign data with fallback: %v", err)
+	}
+	// the returned signature is under the fallback algorithm
+	err = margo.VerifySignature(input, sig.(*Signature).Data, margo.SigAlgRsaPkcs1Sha1, s.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify fallback signature: %v", err)
+	}
+
+	// without the opt-in, the broken algorithm is not second-guessed
+	sig, err = s.SignData(input, Options{SigAlg: margo.SigAlgRsaPkcs1Sha384})
+	if err != nil {
+		t.Fatalf("failed to sign data without fallback: %v", err)
+	}
+	err = margo.VerifySignature(input, sig.(*Signature).Data, margo.SigAlgRsaPkcs1Sha384, s.publicKey)
+	if err != nil {
+		t.Fatalf("failed to verify signature made without fallback: %v", err)
+	}
+
+	// a fallback that fails self-verification too is a hard error
+	marVerifyHashSignature = func(sigData, digest []byte, h crypto.Hash, pub crypto.PublicKey) error {
+		return fmt.Errorf("simulated verification failure")
+	}
+	_, err = s.SignData(input, Options{SigAlg: margo.SigAlgRsaPkcs1Sha384, FallbackSigAlg: margo.SigAlgRsaPkcs1Sha1})
+	if err == nil || !strings.Contains(err.Error(), "still fails self-verification") {
+		t.Fatalf("expected a persistent self-verification error but got: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package signer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	log "github.com/sirupsen/logrus"
+)
+
+// SignerMetrics receives counts of successful and failed signatures and
+// signing latency, broken down by signer type and mode. The service
+// registers a backend at startup, tests can register a fake, and a no-op
+// default discards measurements otherwise.
+type SignerMetrics interface {
+	// IncSignSuccess increments the count of successful signatures
+	IncSignSuccess(signerType, mode string)
+
+	// IncSignError increments the count of failed signatures, with a
+	// short reason describing the step that failed
+	IncSignError(signerType, mode, reason string)
+
+	// ObserveSignDuration records how long a signing operation took
+	ObserveSignDuration(signerType, mode string, value time.Duration)
+
+	// ObserveBatchDedup records the outcome of deduplicating one batch
+	// of signing requests: how many items named the signer, how many
+	// unique inputs were actually signed, and how many were served
+	// from a duplicate
+	ObserveBatchDedup(signerType, mode string, total, unique, hits int)
+}
+
+// nopMetrics discards all measurements
+type nopMetrics struct{}
+
+func (nopMetrics) IncSignSuccess(signerType, mode string)                           {}
+func (nopMetrics) IncSignError(signerType, mode, reason string)                     {}
+func (nopMetrics) ObserveSignDuration(signerType, mode string, value time.Duration) {}
+func (nopMetrics) ObserveBatchDedup(signerType, mode string, total, unique, hits int) {
+}
+
+var registeredMetrics SignerMetrics = nopMetrics{}
+
+// RegisterMetrics sets the backend signers emit measurements to
+func RegisterMetrics(m SignerMetrics) {
+	registeredMetrics = m
+}
+
+// Metrics returns the backend signers emit measurements to
+func Metrics() SignerMetrics {
+	return registeredMetrics
+}
+
+// StatsdSignerMetrics implements SignerMetrics on top of a statsd client
+type StatsdSignerMetrics struct {
+	stats *statsd.Client
+}
+
+// NewStatsdSignerMetrics makes a SignerMetrics backend from a statsd client
+func NewStatsdSignerMetrics(stats *statsd.Client) *StatsdSignerMetrics {
+	return &StatsdSignerMetrics{stats: stats}
+}
+
+func metricsTags(signerType, mode string) []string {
+	return []string{
+		fmt.Sprintf("autograph-signer-type:%s", signerType),
+		fmt.Sprintf("autograph-signer-mode:%s", mode),
+	}
+}
+
+// IncSignSuccess increments the signer.sign_success counter
+func (m *StatsdSignerMetrics) IncSignSuccess(signerType, mode string) {
+	err := m.stats.Count("signer.sign_success", 1, metricsTags(signerType, mode), 1)
+	if err != nil {
+		log.Warnf("Error sending counter signer.sign_success: %s", err)
+	}
+}
+
+// IncSignError increments the signer.sign_error counter with a reason tag
+func (m *StatsdSignerMetrics) IncSignError(signerType, mode, reason string) {
+	tags := append(metricsTags(signerType, mode), fmt.Sprintf("autograph-sign-error-reason:%s", reason))
+	err := m.stats.Count("signer.sign_error", 1, tags, 1)
+	if err != nil {
+		log.Warnf("Error sending counter signer.sign_error: %s", err)
+	}
+}
+
+// ObserveSignDuration sends the signer.sign_duration histogram in ms
+func (m *StatsdSignerMetrics) ObserveSignDuration(signerType, mode string, value time.Duration) {
+	err := m.stats.Histogram("signer.sign_duration", float64(value/time.Millisecond), metricsTags(signerType, mode), 1)
+	if err != nil {
+		log.Warnf("Error sending histogram signer.sign_duration: %s", err)
+	}
+}
+
+// ObserveBatchDedup sends the signer.batch_items, signer.batch_unique_items
+// and signer.batch_dedup_hits counters
+func (m *StatsdSignerMetrics) ObserveBatchDedup(signerType, mode string, total, unique, hits int) {
+	tags := metricsTags(signerType, mode)
+	for _, counter := range []struct {
+		name  string
+		value int64
+	}{
+		{"signer.batch_items", int64(total)},
+		{"signer.batch_unique_items", int64(unique)},
+		{"signer.batch_dedup_hits", int64(hits)},
+	} {
+		err := m.stats.Count(counter.name, counter.value, tags, 1)
+		if err != nil {
+			log.Warnf("Error sending counter %s: %s", counter.name, err)
+		}
+	}
+}
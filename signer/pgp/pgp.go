@@ -66,6 +66,7 @@ func New(conf signer.Configuration) (s *PGPSigner, err error) {
 	}
 	ewrbuf.Close()
 	s.PublicKey = armoredbuf.String()
+	s.AuditHook = conf.AuditHook
 
 	return
 }
@@ -81,10 +82,11 @@ func (s *PGPSigner) Config() signer.Configuration {
 }
 
 // SignData takes data and returns an armored signature with pgp header and footer
-func (s *PGPSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+func (s *PGPSigner) SignData(data []byte, options interface{}) (retsig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, data, err) }()
 	out := bytes.NewBuffer(nil)
 	message := bytes.NewBuffer(data)
-	err := openpgp.ArmoredDetachSign(out, s.entity, message, nil)
+	err = openpgp.ArmoredDetachSign(out, s.entity, message, nil)
 	if err != nil {
 		return nil, errors.Wrap(err, "pgp: failed to sign")
 	}
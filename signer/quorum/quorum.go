@@ -0,0 +1,205 @@
+package quorum // import "go.mozilla.org/autograph/signer/quorum"
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"go.mozilla.org/autograph/signer"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Type of this signer is 'quorum'
+	Type = "quorum"
+)
+
+// A QuorumSigner coordinates several backend signers to implement an
+// M-of-N signing policy: signing requests are forwarded to every
+// member, and the combined signature carries all member signatures
+// alongside the threshold of valid ones required for verification
+type QuorumSigner struct {
+	signer.Configuration
+	members   []member
+	threshold int
+}
+
+// a member pairs a backend signer with its configuration, so combined
+// signatures can identify which signer issued each member signature
+type member struct {
+	conf   signer.Configuration
+	signer signer.DataSigner
+}
+
+// New initializes a quorum signer from a configuration and the list of
+// candidate signers its members are resolved from. Every id listed in
+// QuorumMembers must match a constructed signer able to sign data, and
+// the threshold must be between one and the number of members.
+func New(conf signer.Configuration, candidates []signer.Signer) (s *QuorumSigner, err error) {
+	s = new(QuorumSigner)
+	if conf.Type != Type {
+		return nil, errors.Errorf("quorum: invalid type %q, must be %q", conf.Type, Type)
+	}
+	if conf.ID == "" {
+		return nil, errors.New("quorum: missing signer ID in signer configuration")
+	}
+	if len(conf.QuorumMembers) < 2 {
+		return nil, errors.Errorf("quorum: signer %q needs at least two members", conf.ID)
+	}
+	if conf.QuorumThreshold < 1 || conf.QuorumThreshold > len(conf.QuorumMembers) {
+		return nil, errors.Errorf("quorum: signer %q has an invalid threshold %d for %d members",
+			conf.ID, conf.QuorumThreshold, len(conf.QuorumMembers))
+	}
+	s.ID = conf.ID
+	s.Type = conf.Type
+	s.QuorumMembers = conf.QuorumMembers
+	s.QuorumThreshold = conf.QuorumThreshold
+	s.AuditHook = conf.AuditHook
+	s.threshold = conf.QuorumThreshold
+	for _, id := range conf.QuorumMembers {
+		var found signer.Signer
+		for _, candidate := range candidates {
+			if candidate.Config().ID == id {
+				found = candidate
+				break
+			}
+		}
+		if found == nil {
+			return nil, errors.Errorf("quorum: member %q of signer %q does not exist", id, conf.ID)
+		}
+		ds, ok := found.(signer.DataSigner)
+		if !ok {
+			return nil, errors.Errorf("quorum: member %q of signer %q cannot sign data", id, conf.ID)
+		}
+		s.members = append(s.members, member{conf: found.Config(), signer: ds})
+	}
+	return s, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *QuorumSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:              s.ID,
+		Type:            s.Type,
+		QuorumMembers:   s.QuorumMembers,
+		QuorumThreshold: s.QuorumThreshold,
+	}
+}
+
+// SignData forwards the input data to every member and returns the
+// combined signature. Members sign with their own default options.
+// Signing succeeds as long as at least the threshold of members
+// produced a signature, so a single faulty member doesn't block the
+// whole quorum
+func (s *QuorumSigner) SignData(data []byte, options interface{}) (combined signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, data, err) }()
+	sig := &Signature{Threshold: s.threshold}
+	var lastErr error
+	for _, m := range s.members {
+		msig, serr := m.signer.SignData(data, m.signer.GetDefaultOptions())
+		if serr != nil {
+			lastErr = errors.Wrapf(serr, "quorum: member %q failed to sign", m.conf.ID)
+			continue
+		}
+		marshalled, serr := msig.Marshal()
+		if serr != nil {
+			lastErr = errors.Wrapf(serr, "quorum: failed to marshal signature of member %q", m.conf.ID)
+			continue
+		}
+		sig.Signatures = append(sig.Signatures, MemberSignature{
+			SignerID:  m.conf.ID,
+			Type:      m.conf.Type,
+			Mode:      m.conf.Mode,
+			Signature: marshalled,
+		})
+	}
+	if len(sig.Signatures) < s.threshold {
+		if lastErr != nil {
+			return nil, errors.Wrapf(lastErr, "quorum: only %d of %d members signed, %d required",
+				len(sig.Signatures), len(s.members), s.threshold)
+		}
+		return nil, errors.Errorf("quorum: only %d of %d members signed, %d required",
+			len(sig.Signatures), len(s.members), s.threshold)
+	}
+	return sig, nil
+}
+
+// GetDefaultOptions returns nil because members sign with their own
+// default options
+func (s *QuorumSigner) GetDefaultOptions() interface{} {
+	return nil
+}
+
+// Signature is the combined signature of a quorum of signers
+type Signature struct {
+	Threshold  int               `json:"threshold"`
+	Signatures []MemberSignature `json:"signatures"`
+}
+
+// MemberSignature carries the marshalled signature of a single quorum
+// member alongside the identity of the signer that issued it
+type MemberSignature struct {
+	SignerID  string `json:"signer_id"`
+	Type      string `json:"type"`
+	Mode      string `json:"mode,omitempty"`
+	Signature string `json:"signature"`
+}
+
+// Marshal returns the base64 url safe encoding of the json
+// representation of the combined signature
+func (sig *Signature) Marshal() (string, error) {
+	if len(sig.Signatures) < sig.Threshold {
+		return "", errors.Errorf("quorum: refusing to marshal a signature carrying %d members, below the threshold of %d",
+			len(sig.Signatures), sig.Threshold)
+	}
+	buf, err := json.Marshal(sig)
+	if err != nil {
+		return "", errors.Wrap(err, "quorum: failed to marshal signature")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Unmarshal parses a base64 url encoded quorum signature
+func Unmarshal(signature string) (*Signature, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errors.Wrap(err, "quorum: failed to decode signature")
+	}
+	var sig Signature
+	err = json.Unmarshal(buf, &sig)
+	if err != nil {
+		return nil, errors.Wrap(err, "quorum: failed to parse signature")
+	}
+	if sig.Threshold < 1 {
+		return nil, errors.New("quorum: signature carries an invalid threshold")
+	}
+	return &sig, nil
+}
+
+// Verify checks that at least the threshold of member signatures are
+// valid. Verification of each member signature is delegated to the
+// callback, as every member type has its own verification procedure
+func (sig *Signature) Verify(verifyMember func(MemberSignature) error) error {
+	if sig.Threshold < 1 {
+		return errors.New("quorum: signature carries an invalid threshold")
+	}
+	valid := 0
+	var lastErr error
+	for _, m := range sig.Signatures {
+		err := verifyMember(m)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		valid++
+	}
+	if valid < sig.Threshold {
+		if lastErr != nil {
+			return errors.Wrapf(lastErr, "quorum: only %d of %d member signatures are valid, %d required",
+				valid, len(sig.Signatures), sig.Threshold)
+		}
+		return errors.Errorf("quorum: only %d of %d member signatures are valid, %d required",
+			valid, len(sig.Signatures), sig.Threshold)
+	}
+	return nil
+}
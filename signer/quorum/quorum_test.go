@@ -0,0 +1,229 @@
+package quorum
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/contentsignature"
+
+	"github.com/pkg/errors"
+)
+
+// makeMember generates an ecdsa key and returns a content signature
+// signer for it alongside its public key, for verifying its signatures
+func makeMember(t *testing.T, id string) (signer.Signer, *ecdsa.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate member key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal member key: %v", err)
+	}
+	s, err := contentsignature.New(signer.Configuration{
+		ID:         id,
+		Type:       contentsignature.Type,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize member signer: %v", err)
+	}
+	return s, &key.PublicKey
+}
+
+// a failingSigner always fails to sign, to exercise quorum tolerance
+// of faulty members
+type failingSigner struct {
+	signer.Configuration
+}
+
+func (s *failingSigner) Config() signer.Configuration {
+	return signer.Configuration{ID: s.ID, Type: s.Type}
+}
+
+func (s *failingSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+	return nil, errors.New("member is on fire")
+}
+
+func (s *failingSigner) GetDefaultOptions() interface{} {
+	return nil
+}
+
+// a configOnlySigner implements the base signer interface but cannot
+// sign data
+type configOnlySigner struct {
+	signer.Configuration
+}
+
+func (s *configOnlySigner) Config() signer.Configuration {
+	return signer.Configuration{ID: s.ID, Type: s.Type}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	candidates := make([]signer.Signer, 0, 3)
+	pubKeys := make(map[string]*ecdsa.PublicKey)
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("member%d", i)
+		member, pubKey := makeMember(t, id)
+		candidates = append(candidates, member)
+		pubKeys[id] = pubKey
+	}
+	s, err := New(signer.Configuration{
+		ID:              "quorumsigner",
+		Type:            Type,
+		QuorumMembers:   []string{"member0", "member1", "member2"},
+		QuorumThreshold: 2,
+	}, candidates)
+	if err != nil {
+		t.Fatalf("failed to initialize quorum signer: %v", err)
+	}
+	combined, err := s.SignData(input, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	marshalled, err := combined.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal signature: %v", err)
+	}
+	sig, err := Unmarshal(marshalled)
+	if err != nil {
+		t.Fatalf("failed to unmarshal signature: %v", err)
+	}
+	if sig.Threshold != 2 {
+		t.Fatalf("expected a threshold of 2 but got %d", sig.Threshold)
+	}
+	if len(sig.Signatures) != 3 {
+		t.Fatalf("expected 3 member signatures but got %d", len(sig.Signatures))
+	}
+	err = sig.Verify(func(m MemberSignature) error {
+		pubKey, ok := pubKeys[m.SignerID]
+		if !ok {
+			return errors.Errorf("unknown member %q", m.SignerID)
+		}
+		csig, err := contentsignature.Unmarshal(m.Signature)
+		if err != nil {
+			return err
+		}
+		if !csig.VerifyData(input, pubKey) {
+			return errors.Errorf("signature of member %q does not verify", m.SignerID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to verify combined signature: %v", err)
+	}
+}
+
+func TestVerifyThresholdNotMet(t *testing.T) {
+	sig := &Signature{
+		Threshold: 2,
+		Signatures: []MemberSignature{
+			{SignerID: "member0", Type: contentsignature.Type, Signature: "sig0"},
+			{SignerID: "member1", Type: contentsignature.Type, Signature: "sig1"},
+			{SignerID: "member2", Type: contentsignature.Type, Signature: "sig2"},
+		},
+	}
+	// a verifier that only accepts a single member cannot reach the
+	// threshold of two
+	err := sig.Verify(func(m MemberSignature) error {
+		if m.SignerID != "member1" {
+			return errors.Errorf("signature of member %q does not verify", m.SignerID)
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected verification below the threshold to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), "only 1 of 3 member signatures are valid, 2 required") {
+		t.Fatalf("verification failed with an unexpected error: %v", err)
+	}
+}
+
+func TestSignToleratesFailingMember(t *testing.T) {
+	input := []byte("foobarbaz1234abcd")
+	member0, _ := makeMember(t, "member0")
+	member1, _ := makeMember(t, "member1")
+	candidates := []signer.Signer{
+		member0,
+		member1,
+		&failingSigner{signer.Configuration{ID: "member2", Type: contentsignature.Type}},
+	}
+	s, err := New(signer.Configuration{
+		ID:              "quorumsigner",
+		Type:            Type,
+		QuorumMembers:   []string{"member0", "member1", "member2"},
+		QuorumThreshold: 2,
+	}, candidates)
+	if err != nil {
+		t.Fatalf("failed to initialize quorum signer: %v", err)
+	}
+	combined, err := s.SignData(input, s.GetDefaultOptions())
+	if err != nil {
+		t.Fatalf("expected signing to tolerate a failing member but got: %v", err)
+	}
+	if len(combined.(*Signature).Signatures) != 2 {
+		t.Fatalf("expected 2 member signatures but got %d", len(combined.(*Signature).Signatures))
+	}
+
+	// with a threshold of three, the failing member blocks the quorum
+	s, err = New(signer.Configuration{
+		ID:              "quorumsigner",
+		Type:            Type,
+		QuorumMembers:   []string{"member0", "member1", "member2"},
+		QuorumThreshold: 3,
+	}, candidates)
+	if err != nil {
+		t.Fatalf("failed to initialize quorum signer: %v", err)
+	}
+	_, err = s.SignData(input, s.GetDefaultOptions())
+	if err == nil {
+		t.Fatal("expected signing below the threshold to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), "only 2 of 3 members signed, 3 required") {
+		t.Fatalf("signing failed with an unexpected error: %v", err)
+	}
+}
+
+func TestNewFailures(t *testing.T) {
+	member0, _ := makeMember(t, "member0")
+	member1, _ := makeMember(t, "member1")
+	candidates := []signer.Signer{
+		member0,
+		member1,
+		&configOnlySigner{signer.Configuration{ID: "member2", Type: "teststub"}},
+	}
+	TESTCASES := []struct {
+		err string
+		cfg signer.Configuration
+	}{
+		{err: `invalid type "abcd"`, cfg: signer.Configuration{Type: "abcd"}},
+		{err: "missing signer ID", cfg: signer.Configuration{Type: Type}},
+		{err: "needs at least two members", cfg: signer.Configuration{
+			ID: "bad", Type: Type, QuorumMembers: []string{"member0"}, QuorumThreshold: 1}},
+		{err: "invalid threshold 0", cfg: signer.Configuration{
+			ID: "bad", Type: Type, QuorumMembers: []string{"member0", "member1"}}},
+		{err: "invalid threshold 3", cfg: signer.Configuration{
+			ID: "bad", Type: Type, QuorumMembers: []string{"member0", "member1"}, QuorumThreshold: 3}},
+		{err: `member "nonexistent" of signer "bad" does not exist`, cfg: signer.Configuration{
+			ID: "bad", Type: Type, QuorumMembers: []string{"member0", "nonexistent"}, QuorumThreshold: 1}},
+		{err: `member "member2" of signer "bad" cannot sign data`, cfg: signer.Configuration{
+			ID: "bad", Type: Type, QuorumMembers: []string{"member0", "member2"}, QuorumThreshold: 1}},
+	}
+	for i, testcase := range TESTCASES {
+		_, err := New(testcase.cfg, candidates)
+		if err == nil {
+			t.Fatalf("testcase %d expected to fail with %q but passed", i, testcase.err)
+		}
+		if !strings.Contains(err.Error(), testcase.err) {
+			t.Fatalf("testcase %d expected to fail with %q but failed with: %v", i, testcase.err, err)
+		}
+	}
+}
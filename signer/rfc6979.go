@@ -0,0 +1,136 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer // import "go.mozilla.org/autograph/signer"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"hash"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// RFC6979Signer signs ECDSA digests with deterministic nonces generated
+// per RFC 6979. It is used as a software fallback when an HSM is
+// unavailable, because in that situation no hardware RNG can be trusted
+// to provide the per-signature nonce, and a bad nonce leaks the private
+// key. Signatures it produces verify like any other ECDSA signature.
+type RFC6979Signer struct {
+	key *ecdsa.PrivateKey
+}
+
+// NewRFC6979Signer wraps an ECDSA private key into a deterministic signer
+func NewRFC6979Signer(key *ecdsa.PrivateKey) *RFC6979Signer {
+	return &RFC6979Signer{key: key}
+}
+
+// Public returns the public key of the wrapped ECDSA key
+func (s *RFC6979Signer) Public() crypto.PublicKey {
+	return s.key.Public()
+}
+
+// Sign signs a digest and returns an ASN.1 encoded ECDSA signature. The
+// random reader and signer options are ignored, the nonce is derived
+// deterministically from the private key and the digest.
+func (s *RFC6979Signer) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	r, sv, err := signRFC6979(s.key, digest)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{R: r, S: sv})
+}
+
+// signRFC6979 computes an ECDSA signature of a digest using the
+// deterministic nonce generation procedure of RFC 6979 section 3.2. The
+// hash function used for the HMAC is matched to the curve size, like the
+// content signature protocol does.
+func signRFC6979(priv *ecdsa.PrivateKey, digest []byte) (r, s *big.Int, err error) {
+	c := priv.Curve
+	q := c.Params().N
+	qlen := q.BitLen()
+	rlen := (qlen + 7) / 8
+
+	var newHash func() hash.Hash
+	switch c.Params().BitSize {
+	case 256:
+		newHash = sha256.New
+	case 384:
+		newHash = sha512.New384
+	default:
+		return nil, nil, errors.Errorf("rfc6979: unsupported curve %q", c.Params().Name)
+	}
+	holen := newHash().Size()
+
+	// bits2int takes the leftmost qlen bits of the input
+	bits2int := func(in []byte) *big.Int {
+		out := new(big.Int).SetBytes(in)
+		if excess := len(in)*8 - qlen; excess > 0 {
+			out.Rsh(out, uint(excess))
+		}
+		return out
+	}
+	// int2octets left pads a value to the octet length of the curve order
+	int2octets := func(v *big.Int) []byte {
+		out := v.Bytes()
+		if len(out) < rlen {
+			out = append(make([]byte, rlen-len(out)), out...)
+		}
+		return out[len(out)-rlen:]
+	}
+	bits2octets := func(in []byte) []byte {
+		z := bits2int(in)
+		z.Mod(z, q)
+		return int2octets(z)
+	}
+	hmacSum := func(key []byte, chunks ...[]byte) []byte {
+		mac := hmac.New(newHash, key)
+		for _, chunk := range chunks {
+			mac.Write(chunk)
+		}
+		return mac.Sum(nil)
+	}
+
+	V := bytes.Repeat([]byte{0x01}, holen)
+	K := make([]byte, holen)
+	K = hmacSum(K, V, []byte{0x00}, int2octets(priv.D), bits2octets(digest))
+	V = hmacSum(K, V)
+	K = hmacSum(K, V, []byte{0x01}, int2octets(priv.D), bits2octets(digest))
+	V = hmacSum(K, V)
+
+	e := bits2int(digest)
+	for {
+		var T []byte
+		for len(T)*8 < qlen {
+			V = hmacSum(K, V)
+			T = append(T, V...)
+		}
+		k := bits2int(T)
+		if k.Sign() > 0 && k.Cmp(q) < 0 {
+			x, _ := c.ScalarBaseMult(k.Bytes())
+			r = new(big.Int).Mod(x, q)
+			if r.Sign() != 0 {
+				kinv := new(big.Int).ModInverse(k, q)
+				s = new(big.Int).Mul(priv.D, r)
+				s.Add(s, e)
+				s.Mul(s, kinv)
+				s.Mod(s, q)
+				if s.Sign() != 0 {
+					return r, s, nil
+				}
+			}
+		}
+		K = hmacSum(K, V, []byte{0x00})
+		V = hmacSum(K, V)
+	}
+}
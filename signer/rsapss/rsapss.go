@@ -47,6 +47,7 @@ func New(conf signer.Configuration) (s *RSAPSSSigner, err error) {
 		return nil, errors.New("rsapss: missing private key in signer configuration")
 	}
 	s.PrivateKey = conf.PrivateKey
+	s.AuditHook = conf.AuditHook
 
 	if conf.PublicKey == "" {
 		return nil, errors.New("rsapss: missing public key in signer configuration")
@@ -75,7 +76,8 @@ func (s *RSAPSSSigner) Config() signer.Configuration {
 }
 
 // SignData takes data hashes it and returns a signed base64 encoded hash
-func (s *RSAPSSSigner) SignData(data []byte, options interface{}) (signer.Signature, error) {
+func (s *RSAPSSSigner) SignData(data []byte, options interface{}) (sig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, data, err) }()
 	h := sha1.New()
 	h.Write(data)
 	digest := h.Sum(nil)
@@ -0,0 +1,35 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package signer // import "go.mozilla.org/autograph/signer"
+
+// SecretsProvider resolves a reference found in the configuration, such
+// as vault://path/to/key, into the secret value it points to. The
+// service registers a provider at startup to source private keys from
+// an external secrets store, and the default provider treats references
+// as inline values, which covers private keys pasted directly in the
+// configuration as well as hsm key labels.
+type SecretsProvider interface {
+	Resolve(ref string) ([]byte, error)
+}
+
+// inlineSecrets is the default provider and returns references unchanged
+type inlineSecrets struct{}
+
+func (inlineSecrets) Resolve(ref string) ([]byte, error) {
+	return []byte(ref), nil
+}
+
+var registeredSecretsProvider SecretsProvider = inlineSecrets{}
+
+// RegisterSecretsProvider sets the provider used to resolve secret
+// references in signer configurations
+func RegisterSecretsProvider(p SecretsProvider) {
+	registeredSecretsProvider = p
+}
+
+// ResolveSecret resolves a secret reference using the registered provider
+func ResolveSecret(ref string) ([]byte, error) {
+	return registeredSecretsProvider.Resolve(ref)
+}
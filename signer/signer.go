@@ -10,6 +10,7 @@ import (
 	"crypto"
 	"crypto/dsa"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -21,7 +22,9 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -70,6 +73,19 @@ type Configuration struct {
 	Certificate string            `json:"certificate,omitempty"`
 	DB          *database.Handler `json:"-"`
 
+	// AuditHook, when set, receives a structured AuditEvent for every
+	// signing operation performed by the signer, which deployments can
+	// forward to an external stream for compliance. It is wired
+	// programmatically and cannot be set from the configuration file.
+	AuditHook func(AuditEvent) `json:"-"`
+
+	// HTTPClient, when set, replaces the default client used by the
+	// network operations of the signer, like fetching and uploading
+	// certificate chains, so deployments behind a proxy or with custom
+	// CA bundles can control the transport. It is wired
+	// programmatically and cannot be set from the configuration file.
+	HTTPClient *http.Client `json:"-"`
+
 	// X5U (X.509 URL) is a URL that points to an X.509 public key
 	// certificate chain to validate a content signature
 	X5U string `json:"x5u,omitempty"`
@@ -99,13 +115,114 @@ type Configuration struct {
 	// have a total validity of 10+30+10=50 days.
 	ClockSkewTolerance time.Duration `json:"clock_skew_tolerance,omitempty"`
 
+	// RotationThreshold is the amount of remaining validity under which
+	// a content signature pki signer proactively rotates its end-entity
+	// at startup instead of reusing it, so certificates never expire
+	// mid-deployment. The default is to reuse any end-entity that is
+	// still valid.
+	RotationThreshold time.Duration `json:"rotation_threshold,omitempty"`
+
 	// ChainUploadLocation is the target a certificate chain should be
 	// uploaded to in order for clients to find it at the x5u location.
 	ChainUploadLocation string `json:"chain_upload_location,omitempty"`
 
+	// ChainCacheFile is a local file the certificate chain is written
+	// to and verified from instead of the chain upload location, which
+	// allows air-gapped environments to operate without network access.
+	ChainCacheFile string `json:"chain_cache_file,omitempty"`
+
 	// CaCert is the certificate of the root of the pki, when used
 	CaCert string `json:"cacert,omitempty"`
 
+	// EENamespace is the namespace appended to the signer ID to build
+	// the common name of issued end-entity certificates. It defaults to
+	// the Mozilla content signature namespace.
+	EENamespace string `json:"ee_namespace,omitempty"`
+
+	// EECurveEncoding controls how issued end-entity certificates
+	// encode their ec curve, either as a named curve OID or as
+	// explicit domain parameters, see signer/contentsignaturepki. It
+	// defaults to named curve.
+	EECurveEncoding string `json:"ee_curve_encoding,omitempty"`
+
+	// SignatureNamespace is the namespace embedded in signatures issued
+	// by the sshsig signer type, see signer/sshsig
+	SignatureNamespace string `json:"signature_namespace,omitempty"`
+
+	// DefaultSigAlg is the numeric id of the signature algorithm a mar
+	// signer derived from its key type, see signer/mar. It is
+	// informational and only set in configurations returned by Config()
+	DefaultSigAlg uint32 `json:"default_sig_alg,omitempty"`
+
+	// ExtraPrivateKeys are additional signing keys of a mar signer.
+	// Each one contributes an extra signature to signed files, with
+	// the algorithm derived from its key type like the primary key,
+	// so a single signer can emit both rsa and ecdsa signatures
+	// during staged rollouts. See signer/mar
+	ExtraPrivateKeys []string `json:"extra_private_keys,omitempty"`
+
+	// PrefixSeparator is the separator placed between the signature
+	// prefix label and the input data by the contentsignature signer
+	// type. It defaults to a single null byte, see signer/contentsignature
+	PrefixSeparator string `json:"prefix_separator,omitempty"`
+
+	// KeyGenRand overrides the entropy source used to generate keys in
+	// memory, for tests and environments that mandate a specific
+	// hardware source. It defaults to crypto/rand, and is ignored for
+	// keys generated inside an hsm, which always use the hsm entropy.
+	// It is wired programmatically and cannot be set from the
+	// configuration file.
+	KeyGenRand io.Reader `json:"-"`
+
+	// HsmKeyAttributes selects the PKCS#11 attributes applied to
+	// private keys generated in an hsm, see MakeKey. The zero value
+	// requests the secure defaults: sensitive, non-extractable keys
+	// labeled after the key name.
+	HsmKeyAttributes HsmKeyAttributes `json:"hsm_key_attributes,omitempty"`
+
+	// LengthBoundHashing instructs the contentsignature signer type to
+	// encode the length of the input data into the hashed preimage, as
+	// a domain separation hardening. It defaults to off for
+	// compatibility with standard verifiers, see signer/contentsignature
+	LengthBoundHashing bool `json:"length_bound_hashing,omitempty"`
+
+	// HsmFallbackEnabled opts into software signing when the private key
+	// lives in an HSM that cannot be reached. It requires a backup key in
+	// HsmFallbackKey and changes the trust model of issued signatures, so
+	// it must only be enabled in non-production environments.
+	HsmFallbackEnabled bool `json:"hsm_fallback_enabled,omitempty"`
+
+	// HsmFallbackKey is a PEM encoded ECDSA private key used to sign when
+	// the HSM is unavailable and HsmFallbackEnabled is set. Signatures
+	// made with it use deterministic RFC 6979 nonces because no hardware
+	// RNG can be trusted in that situation.
+	HsmFallbackKey string `json:"hsm_fallback_key,omitempty"`
+
+	// QuorumMembers lists the IDs of the backend signers a quorum
+	// signer forwards signing requests to, see signer/quorum
+	QuorumMembers []string `json:"quorum_members,omitempty"`
+
+	// QuorumThreshold is the minimum number of valid member signatures
+	// a quorum signature must carry to verify, see signer/quorum
+	QuorumThreshold int `json:"quorum_threshold,omitempty"`
+
+	// AllowedSigAlgs restricts the signature algorithms a signer is
+	// willing to use, regardless of what clients request via options.
+	// An empty list allows all algorithms supported by the signer.
+	AllowedSigAlgs []string `json:"allowedsigalgs,omitempty"`
+
+	// VerifyInputSignatures instructs the mar signer type to verify the
+	// existing signatures of input files against TrustedKeys before
+	// re-signing, and to refuse files it cannot authenticate. It
+	// defaults to off, see signer/mar
+	VerifyInputSignatures bool `json:"verify_input_signatures,omitempty"`
+
+	// TrustedKeys is a list of PEM encoded public keys or certificates
+	// the existing signatures of input files are verified against when
+	// VerifyInputSignatures is set. Certificates are checked for
+	// validity within ClockSkewTolerance, see signer/mar
+	TrustedKeys []string `json:"trusted_keys,omitempty"`
+
 	isHsmAvailable bool
 	hsmCtx         *pkcs11.Ctx
 }
@@ -116,6 +233,49 @@ func (cfg *Configuration) HsmIsAvailable(ctx *pkcs11.Ctx) {
 	cfg.hsmCtx = ctx
 }
 
+// Validate performs static checks on a signer configuration: the ID and
+// type must be well formed, and locally defined keys and certificates
+// must parse. It does not reach out to the HSM, database or chain
+// upload location, which makes it suitable for validating configuration
+// files before deployment.
+func (cfg *Configuration) Validate() error {
+	if !regexp.MustCompile(IDFormat).MatchString(cfg.ID) {
+		return errors.Errorf("signer ID %q does not match the permitted format %q", cfg.ID, IDFormat)
+	}
+	if cfg.Type == "" {
+		return errors.Errorf("signer %q has no type", cfg.ID)
+	}
+	privateKey := strings.TrimLeft(cfg.PrivateKey, "\r\n")
+	if strings.HasPrefix(privateKey, "-----BEGIN") &&
+		!strings.HasPrefix(privateKey, "-----BEGIN PGP") {
+		_, err := ParsePrivateKey([]byte(privateKey))
+		if err != nil {
+			return errors.Wrapf(err, "signer %q has an invalid private key", cfg.ID)
+		}
+	}
+	for _, certField := range []struct {
+		name, value string
+	}{
+		{"certificate", cfg.Certificate},
+		{"publickey", cfg.PublicKey},
+		{"cacert", cfg.CaCert},
+	} {
+		value := strings.TrimLeft(certField.value, "\r\n")
+		if !strings.HasPrefix(value, "-----BEGIN CERTIFICATE") {
+			continue
+		}
+		block, _ := pem.Decode([]byte(value))
+		if block == nil {
+			return errors.Errorf("signer %q has an invalid %s: no pem block found", cfg.ID, certField.name)
+		}
+		_, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Wrapf(err, "signer %q has an invalid %s", cfg.ID, certField.name)
+		}
+	}
+	return nil
+}
+
 // Signer is an interface to a configurable issuer of digital signatures
 type Signer interface {
 	Config() Configuration
@@ -178,6 +338,16 @@ func (cfg *Configuration) GetKeysAndRand() (priv crypto.PrivateKey, pub crypto.P
 		unmarshaledPub = &privateKey.PublicKey
 		rng = rand.Reader
 
+	case ed25519.PrivateKey:
+		pub = privateKey.Public()
+		unmarshaledPub = privateKey.Public().(ed25519.PublicKey)
+		rng = rand.Reader
+
+	case *RFC6979Signer:
+		pub = privateKey.Public()
+		unmarshaledPub = privateKey.Public().(*ecdsa.PublicKey)
+		rng = rand.Reader
+
 	case *crypto11.PKCS11PrivateKeyECDSA:
 		pub = privateKey.Public()
 		unmarshaledPub = privateKey.PubKey.(*ecdsa.PublicKey)
@@ -214,22 +384,56 @@ func (cfg *Configuration) GetPrivateKey() (crypto.PrivateKey, error) {
 	// make sure heading newlines are removed
 	removeNewlines := regexp.MustCompile(`^(\r?\n)`)
 	cfg.PrivateKey = removeNewlines.ReplaceAllString(cfg.PrivateKey, "")
-	// if a private key in the config starts with a PEM header, it is
-	// defined locally and is parsed and returned
-	if strings.HasPrefix(cfg.PrivateKey, "-----BEGIN") {
-		return ParsePrivateKey([]byte(cfg.PrivateKey))
+	// resolve the private key through the registered secrets provider,
+	// the default provider returns the configured value unchanged
+	resolved, err := ResolveSecret(cfg.PrivateKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve private key of signer %q", cfg.ID)
+	}
+	privateKey := removeNewlines.ReplaceAllString(string(resolved), "")
+	// if a private key starts with a PEM header, it is defined locally
+	// and is parsed and returned
+	if strings.HasPrefix(privateKey, "-----BEGIN") {
+		return ParsePrivateKey([]byte(privateKey))
 	}
 	// otherwise, we assume the privatekey represents a label in the HSM
 	if cfg.isHsmAvailable {
-		key, err := crypto11.FindKeyPair(nil, []byte(cfg.PrivateKey))
+		key, err := crypto11.FindKeyPair(nil, []byte(privateKey))
 		if err != nil {
+			if fallback := cfg.hsmFallbackKey(); fallback != nil {
+				return fallback, nil
+			}
 			return nil, err
 		}
 		return key, nil
 	}
+	if fallback := cfg.hsmFallbackKey(); fallback != nil {
+		return fallback, nil
+	}
 	return nil, fmt.Errorf("no suitable key found")
 }
 
+// hsmFallbackKey returns a deterministic software signer when the
+// configuration explicitly opts into HSM fallback and carries a backup
+// ECDSA key, or nil when fallback is not permitted
+func (cfg *Configuration) hsmFallbackKey() crypto.PrivateKey {
+	if !cfg.HsmFallbackEnabled || cfg.HsmFallbackKey == "" {
+		return nil
+	}
+	key, err := ParsePrivateKey([]byte(cfg.HsmFallbackKey))
+	if err != nil {
+		log.Errorf("signer %q: failed to parse hsm fallback key: %v", cfg.ID, err)
+		return nil
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		log.Errorf("signer %q: hsm fallback is only supported for ECDSA keys, not %T", cfg.ID, key)
+		return nil
+	}
+	log.Warnf("signer %q: HSM UNAVAILABLE, falling back to software signing key with deterministic RFC 6979 nonces. this changes the trust model of issued signatures and must not happen in production", cfg.ID)
+	return NewRFC6979Signer(ecKey)
+}
+
 // ParsePrivateKey takes a PEM blocks are returns a crypto.PrivateKey
 // It tries to parse as many known key types as possible before failing and
 // returning all the errors it encountered.
@@ -263,7 +467,7 @@ func ParsePrivateKey(keyPEMBlock []byte) (key crypto.PrivateKey, err error) {
 	savedErr = append(savedErr, "pkcs1: "+err.Error())
 	if key, err = x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes); err == nil {
 		switch key := key.(type) {
-		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key, nil
 		}
 	}
@@ -320,13 +524,78 @@ func parseDSAPKCS8PrivateKey(der []byte) (*dsa.PrivateKey, error) {
 	}, nil
 }
 
+// HsmKeyAttributes selects the PKCS#11 attributes applied to private
+// keys generated in an hsm. The zero value requests the secure
+// defaults: sensitive, non-extractable keys labeled after the key
+// name. The crypto11 backend cannot generate keys with weaker
+// attributes, so requesting them is refused at generation time rather
+// than silently ignored.
+type HsmKeyAttributes struct {
+	// Extractable requests CKA_EXTRACTABLE=true on generated private
+	// keys, allowing their export from the hsm. Refused by policy.
+	Extractable bool `json:"extractable,omitempty"`
+
+	// NonSensitive requests CKA_SENSITIVE=false on generated private
+	// keys, exposing their values to the application. Refused by
+	// policy.
+	NonSensitive bool `json:"non_sensitive,omitempty"`
+
+	// LabelTemplate formats the CKA_LABEL of generated keys from the
+	// key name using a single %s verb, for deployments that namespace
+	// their hsm objects. It defaults to the key name itself.
+	LabelTemplate string `json:"label_template,omitempty"`
+}
+
+// check refuses attribute combinations the hsm backend cannot honor
+func (attrs HsmKeyAttributes) check() error {
+	if attrs.Extractable {
+		return errors.New("refusing to generate an extractable private key in the hsm")
+	}
+	if attrs.NonSensitive {
+		return errors.New("refusing to generate a non-sensitive private key in the hsm")
+	}
+	if attrs.LabelTemplate != "" && strings.Count(attrs.LabelTemplate, "%s") != 1 {
+		return errors.Errorf("invalid hsm key label template %q, expected a single %%s verb", attrs.LabelTemplate)
+	}
+	return nil
+}
+
+// Label returns the CKA_LABEL of a generated key of the given name
+func (attrs HsmKeyAttributes) Label(keyName string) string {
+	if attrs.LabelTemplate == "" {
+		return keyName
+	}
+	return fmt.Sprintf(attrs.LabelTemplate, keyName)
+}
+
+// hsm access points used by MakeKey, declared as variables so tests
+// can exercise key generation without a physical hsm. The crypto11
+// generation templates request CKA_SENSITIVE=true and
+// CKA_EXTRACTABLE=false, matching the only attribute values check
+// accepts.
+var (
+	hsmListSlots = func(ctx *pkcs11.Ctx) ([]uint, error) {
+		return ctx.GetSlotList(true)
+	}
+	hsmGenerateECDSAKeyPair = func(slot uint, id, label []byte, curve elliptic.Curve, attrs HsmKeyAttributes) (crypto.PrivateKey, error) {
+		return crypto11.GenerateECDSAKeyPairOnSlot(slot, id, label, curve)
+	}
+	hsmGenerateRSAKeyPair = func(slot uint, id, label []byte, bits int, attrs HsmKeyAttributes) (crypto.PrivateKey, error) {
+		return crypto11.GenerateRSAKeyPairOnSlot(slot, id, label, bits)
+	}
+)
+
 // MakeKey generates a new key of type keyTpl and returns the priv and public interfaces.
 // If an HSM is available, it is used to generate and store the key, in which case 'priv'
 // just points to the HSM handler and must be used via the crypto.Signer interface.
 func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv crypto.PrivateKey, pub crypto.PublicKey, err error) {
 	if cfg.isHsmAvailable {
+		err = cfg.HsmKeyAttributes.check()
+		if err != nil {
+			return nil, nil, err
+		}
 		var slots []uint
-		slots, err = cfg.hsmCtx.GetSlotList(true)
+		slots, err = hsmListSlots(cfg.hsmCtx)
 		if err != nil {
 			return nil, nil, errors.Wrap(err, "failed to list PKCS#11 Slots")
 		}
@@ -334,9 +603,10 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 			return nil, nil, errors.New("failed to find a usable slot in hsm context")
 		}
 		keyNameBytes := []byte(keyName)
+		keyLabel := []byte(cfg.HsmKeyAttributes.Label(keyName))
 		switch keyTplType := keyTpl.(type) {
 		case *ecdsa.PublicKey:
-			priv, err = crypto11.GenerateECDSAKeyPairOnSlot(slots[0], keyNameBytes, keyNameBytes, keyTplType)
+			priv, err = hsmGenerateECDSAKeyPair(slots[0], keyNameBytes, keyLabel, keyTplType, cfg.HsmKeyAttributes)
 			if err != nil {
 				return nil, nil, errors.Wrap(err, "failed to generate ecdsa key in hsm")
 			}
@@ -344,7 +614,7 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 			return
 		case *rsa.PublicKey:
 			keySize := keyTplType.Size()
-			priv, err = crypto11.GenerateRSAKeyPairOnSlot(slots[0], keyNameBytes, keyNameBytes, keySize)
+			priv, err = hsmGenerateRSAKeyPair(slots[0], keyNameBytes, keyLabel, keySize, cfg.HsmKeyAttributes)
 			if err != nil {
 				return nil, nil, errors.Wrap(err, "failed to generate rsa key in hsm")
 			}
@@ -355,13 +625,16 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 		}
 	}
 	// no hsm, make keys in memory
+	rng := cfg.keyGenRand()
 	switch keyTplType := keyTpl.(type) {
 	case *ecdsa.PublicKey:
 		switch keyTplType.Params().Name {
 		case "P-256":
-			priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			priv, err = ecdsa.GenerateKey(elliptic.P256(), rng)
 		case "P-384":
-			priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+			priv, err = ecdsa.GenerateKey(elliptic.P384(), rng)
+		case "P-521":
+			priv, err = ecdsa.GenerateKey(elliptic.P521(), rng)
 		default:
 			return nil, nil, fmt.Errorf("unsupported curve %q",
 				keyTpl.(*ecdsa.PublicKey).Params().Name)
@@ -373,7 +646,7 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 		return
 	case *rsa.PublicKey:
 		keySize := keyTplType.Size()
-		priv, err = rsa.GenerateKey(rand.Reader, keySize)
+		priv, err = rsa.GenerateKey(rng, keySize)
 		if err != nil {
 			return nil, nil, errors.Wrap(err, "failed to generate rsa key in memory")
 		}
@@ -384,6 +657,45 @@ func (cfg *Configuration) MakeKey(keyTpl interface{}, keyName string) (priv cryp
 	}
 }
 
+// keyGenRand returns the entropy source used to generate keys in
+// memory: the configured KeyGenRand when set, crypto/rand otherwise
+func (cfg *Configuration) keyGenRand() io.Reader {
+	if cfg.KeyGenRand != nil {
+		return cfg.KeyGenRand
+	}
+	return rand.Reader
+}
+
+// IsAllowedSigAlg returns true when the allowed signature algorithms list
+// is empty or contains the given algorithm name
+func (cfg *Configuration) IsAllowedSigAlg(alg string) bool {
+	if len(cfg.AllowedSigAlgs) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowedSigAlgs {
+		if alg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// MakeCorrelationID returns a 128bits random correlation id encoded in
+// base36. Signers include it in their log lines and error messages so a
+// single signing operation can be tied together across the service, HSM
+// and database logs.
+func MakeCorrelationID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	x, y := new(big.Int), new(big.Int)
+	x.SetBytes(b[:8])
+	y.SetBytes(b[8:])
+	return strconv.FormatUint(x.Uint64(), 36) + strconv.FormatUint(y.Uint64(), 36)
+}
+
 // GetPrivKeyHandle returns the hsm handler object id of a key stored in the hsm,
 // or 0 if the key is not stored in the hsm
 func GetPrivKeyHandle(priv crypto.PrivateKey) uint {
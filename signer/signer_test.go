@@ -7,9 +7,19 @@
 package signer
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/miekg/pkcs11"
 )
 
 func TestParseRSAPrivateKey(t *testing.T) {
@@ -205,6 +215,100 @@ func TestNoSuitableKeyFound(t *testing.T) {
 	}
 }
 
+// mockSecretsProvider resolves mock:// references from a map and fails
+// on anything else, standing in for an external secrets store
+type mockSecretsProvider map[string]string
+
+func (m mockSecretsProvider) Resolve(ref string) ([]byte, error) {
+	if !strings.HasPrefix(ref, "mock://") {
+		return []byte(ref), nil
+	}
+	secret, ok := m[ref]
+	if !ok {
+		return nil, fmt.Errorf("no secret found at %q", ref)
+	}
+	return []byte(secret), nil
+}
+
+func TestSecretsProvider(t *testing.T) {
+	RegisterSecretsProvider(mockSecretsProvider{
+		"mock://keys/unittest": rsaPrivateKey,
+	})
+	defer RegisterSecretsProvider(inlineSecrets{})
+
+	tcfg := new(Configuration)
+	tcfg.PrivateKey = "mock://keys/unittest"
+	key, err := tcfg.GetPrivateKey()
+	if err != nil {
+		t.Fatalf("failed to resolve private key reference: %v", err)
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		break
+	default:
+		t.Fatalf("expected rsa private key but got %T", key)
+	}
+
+	// a reference the provider doesn't know about must fail resolution
+	tcfg = new(Configuration)
+	tcfg.PrivateKey = "mock://keys/doesnotexist"
+	_, err = tcfg.GetPrivateKey()
+	if err == nil {
+		t.Fatal("expected to fail resolving an unknown reference but succeeded")
+	}
+}
+
+func TestHsmFallbackRFC6979(t *testing.T) {
+	// the private key is an hsm label and no hsm is available, which
+	// simulates an unreachable hsm, so the signer must fall back to the
+	// backup software key with deterministic signatures
+	tcfg := new(Configuration)
+	tcfg.ID = "testfallback"
+	tcfg.PrivateKey = "some-hsm-key-label"
+	tcfg.HsmFallbackEnabled = true
+	tcfg.HsmFallbackKey = PASSINGTESTCASES[1].cfg.PrivateKey
+	key, err := tcfg.GetPrivateKey()
+	if err != nil {
+		t.Fatalf("expected to fall back to software key but failed with: %v", err)
+	}
+	fallback, ok := key.(*RFC6979Signer)
+	if !ok {
+		t.Fatalf("expected an RFC6979Signer but got %T", key)
+	}
+	digest := sha256.Sum256([]byte("test data for hsm fallback signing"))
+	sig1, err := fallback.Sign(nil, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed to sign with fallback key: %v", err)
+	}
+	if !ecdsa.VerifyASN1(fallback.Public().(*ecdsa.PublicKey), digest[:], sig1) {
+		t.Fatal("fallback signature failed to verify")
+	}
+	// rfc6979 signatures are deterministic, signing twice must yield the
+	// same signature
+	sig2, err := fallback.Sign(nil, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("failed to sign with fallback key: %v", err)
+	}
+	if !bytes.Equal(sig1, sig2) {
+		t.Fatal("expected deterministic signatures but got different ones")
+	}
+}
+
+func TestHsmFallbackNotEnabled(t *testing.T) {
+	// without the explicit opt-in flag, a configured backup key must not
+	// be used
+	tcfg := new(Configuration)
+	tcfg.PrivateKey = "some-hsm-key-label"
+	tcfg.HsmFallbackKey = PASSINGTESTCASES[1].cfg.PrivateKey
+	_, err := tcfg.GetPrivateKey()
+	if err == nil {
+		t.Fatal("expected to fail without the fallback flag but succeeded")
+	}
+	if err.Error() != "no suitable key found" {
+		t.Fatalf("expected to fail with no suitable key found but failed with: %v", err)
+	}
+}
+
 func TestMakeKey(t *testing.T) {
 	for i, testcase := range PASSINGTESTCASES {
 		_, keyTpl, _, _, err := testcase.cfg.GetKeysAndRand()
@@ -273,3 +377,123 @@ ZkJ9hRz+l4ZVOsgNPHXPEi0AXWnDV6zrRQBpDYyiGhY=
 -----END RSA PRIVATE KEY-----`,
 	}},
 }
+
+// constByteReader returns the same byte forever, making in-memory key
+// generation deterministic even when the generator discards a byte
+type constByteReader struct {
+	b byte
+}
+
+func (r constByteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	return len(p), nil
+}
+
+func TestMakeKeyWithSeededRand(t *testing.T) {
+	// the p-256 testcase provides the key template
+	_, keyTpl, _, _, err := PASSINGTESTCASES[1].cfg.GetKeysAndRand()
+	if err != nil {
+		t.Fatalf("failed to load signer configuration: %v", err)
+	}
+	cfg := PASSINGTESTCASES[1].cfg
+	cfg.KeyGenRand = constByteReader{b: 0x42}
+	priv1, pub1, err := cfg.MakeKey(keyTpl, "test")
+	if err != nil {
+		t.Fatalf("failed to make key from seeded rand: %v", err)
+	}
+	_, pub2, err := cfg.MakeKey(keyTpl, "test")
+	if err != nil {
+		t.Fatalf("failed to make second key from seeded rand: %v", err)
+	}
+	if !pub1.(*ecdsa.PublicKey).Equal(pub2.(*ecdsa.PublicKey)) {
+		t.Fatal("expected identical keys from the same seeded rand but they differ")
+	}
+	if GetPrivKeyHandle(priv1) != 0 {
+		t.Fatalf("expected private key handle 0 but got %d", GetPrivKeyHandle(priv1))
+	}
+
+	// the default entropy source yields a different key
+	cfg.KeyGenRand = nil
+	_, pub3, err := cfg.MakeKey(keyTpl, "test")
+	if err != nil {
+		t.Fatalf("failed to make key from default rand: %v", err)
+	}
+	if pub1.(*ecdsa.PublicKey).Equal(pub3.(*ecdsa.PublicKey)) {
+		t.Fatal("expected a different key from the default rand but got the seeded one")
+	}
+}
+
+func TestMakeKeyHsmAttributes(t *testing.T) {
+	defer func(origSlots func(*pkcs11.Ctx) ([]uint, error), origEcdsa func(uint, []byte, []byte, elliptic.Curve, HsmKeyAttributes) (crypto.PrivateKey, error)) {
+		hsmListSlots = origSlots
+		hsmGenerateECDSAKeyPair = origEcdsa
+	}(hsmListSlots, hsmGenerateECDSAKeyPair)
+	hsmListSlots = func(ctx *pkcs11.Ctx) ([]uint, error) {
+		return []uint{0}, nil
+	}
+	var (
+		calls           int
+		gotID, gotLabel []byte
+		gotAttrs        HsmKeyAttributes
+		generated       *ecdsa.PrivateKey
+	)
+	hsmGenerateECDSAKeyPair = func(slot uint, id, label []byte, curve elliptic.Curve, attrs HsmKeyAttributes) (crypto.PrivateKey, error) {
+		calls++
+		gotID, gotLabel, gotAttrs = id, label, attrs
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		generated = priv
+		return &crypto11.PKCS11PrivateKeyECDSA{
+			PKCS11PrivateKey: crypto11.PKCS11PrivateKey{
+				PKCS11Object: crypto11.PKCS11Object{Handle: 1, Slot: slot},
+				PubKey:       priv.Public(),
+			},
+		}, nil
+	}
+
+	cfg := Configuration{
+		HsmKeyAttributes: HsmKeyAttributes{LabelTemplate: "autograph-%s-ee"},
+	}
+	cfg.HsmIsAvailable(nil)
+	_, pub, err := cfg.MakeKey(&ecdsa.PublicKey{Curve: elliptic.P256()}, "unittestkey")
+	if err != nil {
+		t.Fatalf("failed to make key in mocked hsm: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single key generation call but got %d", calls)
+	}
+	if string(gotID) != "unittestkey" {
+		t.Fatalf("expected key id %q but got %q", "unittestkey", gotID)
+	}
+	if string(gotLabel) != "autograph-unittestkey-ee" {
+		t.Fatalf("expected key label %q but got %q", "autograph-unittestkey-ee", gotLabel)
+	}
+	if gotAttrs.Extractable || gotAttrs.NonSensitive {
+		t.Fatalf("expected sensitive non-extractable attributes but got %+v", gotAttrs)
+	}
+	if !pub.(*ecdsa.PublicKey).Equal(generated.Public()) {
+		t.Fatal("returned public key does not match the generated key")
+	}
+
+	// attributes the hsm backend cannot honor are refused before any
+	// key is generated
+	for _, attrs := range []HsmKeyAttributes{
+		{Extractable: true},
+		{NonSensitive: true},
+		{LabelTemplate: "no verb"},
+		{LabelTemplate: "%s-%s"},
+	} {
+		cfg.HsmKeyAttributes = attrs
+		_, _, err = cfg.MakeKey(&ecdsa.PublicKey{Curve: elliptic.P256()}, "unittestkey")
+		if err == nil {
+			t.Fatalf("expected key generation with attributes %+v to be refused but it passed", attrs)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected no key generation call for refused attributes but got %d", calls-1)
+	}
+}
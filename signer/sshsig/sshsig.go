@@ -0,0 +1,413 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sshsig implements a signer that issues signatures in the
+// OpenSSH signature format (SSHSIG), consumed by tooling that verifies
+// artifacts with `ssh-keygen -Y verify`. The wire format is described
+// in the PROTOCOL.sshsig document of the OpenSSH distribution.
+package sshsig // import "go.mozilla.org/autograph/signer/sshsig"
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/autograph/signer"
+)
+
+const (
+	// Type of this signer is "sshsig"
+	Type = "sshsig"
+
+	// DefaultNamespace is the signature namespace applied when the
+	// configuration doesn't specify one. It matches the namespace
+	// ssh-keygen uses when signing files.
+	DefaultNamespace = "file"
+
+	// magicPreamble starts both the signature blob and the blob
+	// covered by the signature
+	magicPreamble = "SSHSIG"
+
+	// sigVersion is the version of the SSHSIG format this signer emits
+	sigVersion = 1
+
+	// hashAlgorithm is the hash applied to the input data before it is
+	// embedded in the signed blob
+	hashAlgorithm = "sha512"
+
+	// pem block type of armored ssh signatures
+	pemType = "SSH SIGNATURE"
+)
+
+// SSHSigner holds the configuration of the signer
+type SSHSigner struct {
+	signer.Configuration
+
+	// key is the private key to sign with, either rsa or ed25519
+	key crypto.PrivateKey
+
+	// rng is our random number generator
+	rng io.Reader
+
+	// namespace is embedded in every signature and must match the
+	// namespace the verifier expects
+	namespace string
+
+	// pubBlob is the ssh wire encoding of the public key
+	pubBlob []byte
+}
+
+// New initializes an ssh signer using a configuration
+func New(conf signer.Configuration) (s *SSHSigner, err error) {
+	s = new(SSHSigner)
+
+	if conf.Type != Type {
+		return nil, errors.Errorf("sshsig: invalid type %q, must be %q", conf.Type, Type)
+	}
+	s.Type = conf.Type
+
+	if conf.ID == "" {
+		return nil, errors.New("sshsig: missing signer ID in signer configuration")
+	}
+	s.ID = conf.ID
+
+	if conf.PrivateKey == "" {
+		return nil, errors.New("sshsig: missing private key in signer configuration")
+	}
+	s.PrivateKey = conf.PrivateKey
+
+	s.namespace = conf.SignatureNamespace
+	s.AuditHook = conf.AuditHook
+	if s.namespace == "" {
+		s.namespace = DefaultNamespace
+	}
+	s.SignatureNamespace = s.namespace
+
+	s.key, _, s.rng, _, err = conf.GetKeysAndRand()
+	if err != nil {
+		return nil, errors.Wrap(err, "sshsig: error fetching key and rand from signer configuration")
+	}
+	s.pubBlob, err = marshalPublicKey(s.key.(crypto.Signer).Public())
+	if err != nil {
+		return nil, errors.Wrap(err, "sshsig: failed to encode public key")
+	}
+	// the public key is exposed in its ssh wire form, which verifiers
+	// can feed to their allowed signers file
+	s.PublicKey = base64.StdEncoding.EncodeToString(s.pubBlob)
+
+	return s, nil
+}
+
+// Config returns the configuration of the current signer
+func (s *SSHSigner) Config() signer.Configuration {
+	return signer.Configuration{
+		ID:                 s.ID,
+		Type:               s.Type,
+		PrivateKey:         s.PrivateKey,
+		PublicKey:          s.PublicKey,
+		SignatureNamespace: s.namespace,
+	}
+}
+
+// SignData hashes the input data and returns an SSHSIG signature over it
+func (s *SSHSigner) SignData(data []byte, options interface{}) (sig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, data, err) }()
+	digest := sha512.Sum512(data)
+	return s.SignHash(digest[:], options)
+}
+
+// SignHash takes the sha512 of the input data and returns an SSHSIG
+// signature embedding it
+func (s *SSHSigner) SignHash(digest []byte, options interface{}) (signer.Signature, error) {
+	if len(digest) != sha512.Size {
+		return nil, errors.Errorf("sshsig: refusing to sign input hash. Got length %d, expected %d.", len(digest), sha512.Size)
+	}
+	signedData := makeSignedData(s.namespace, digest)
+	var (
+		sigAlg   string
+		sigBytes []byte
+		err      error
+	)
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		// SSHSIG mandates the rsa-sha2-512 algorithm for rsa keys
+		sigAlg = "rsa-sha2-512"
+		hashed := sha512.Sum512(signedData)
+		sigBytes, err = rsa.SignPKCS1v15(s.rng, key, crypto.SHA512, hashed[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "sshsig: error signing with rsa key")
+		}
+	case ed25519.PrivateKey:
+		sigAlg = "ssh-ed25519"
+		sigBytes = ed25519.Sign(key, signedData)
+	default:
+		return nil, errors.Errorf("sshsig: unsupported private key type %T, must be rsa or ed25519", s.key)
+	}
+
+	// assemble the signature blob
+	buf := new(bytes.Buffer)
+	buf.WriteString(magicPreamble)
+	writeUint32(buf, sigVersion)
+	writeString(buf, s.pubBlob)
+	writeString(buf, []byte(s.namespace))
+	writeString(buf, nil) // reserved
+	writeString(buf, []byte(hashAlgorithm))
+	sigWire := new(bytes.Buffer)
+	writeString(sigWire, []byte(sigAlg))
+	writeString(sigWire, sigBytes)
+	writeString(buf, sigWire.Bytes())
+
+	sig := new(Signature)
+	sig.Data = buf.Bytes()
+	return sig, nil
+}
+
+// makeSignedData assembles the blob covered by the signature, per the
+// PROTOCOL.sshsig document
+func makeSignedData(namespace string, digest []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(magicPreamble)
+	writeString(buf, []byte(namespace))
+	writeString(buf, nil) // reserved
+	writeString(buf, []byte(hashAlgorithm))
+	writeString(buf, digest)
+	return buf.Bytes()
+}
+
+// Signature is an SSHSIG signature blob
+type Signature struct {
+	Data []byte
+}
+
+// Marshal returns the pem armored representation of a signature
+func (sig *Signature) Marshal() (string, error) {
+	if len(sig.Data) == 0 {
+		return "", errors.New("sshsig: cannot marshal empty signature")
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: sig.Data})), nil
+}
+
+// Unmarshal decodes a pem armored signature string into a Signature
+func Unmarshal(sigstr string) (signer.Signature, error) {
+	block, _ := pem.Decode([]byte(sigstr))
+	if block == nil || block.Type != pemType {
+		return nil, errors.Errorf("sshsig: failed to find a %q pem block in signature", pemType)
+	}
+	sig := new(Signature)
+	sig.Data = block.Bytes
+	return sig, nil
+}
+
+// Options are not implemented for this signer
+type Options struct {
+}
+
+// GetDefaultOptions returns default options of the signer
+func (s *SSHSigner) GetDefaultOptions() interface{} {
+	return Options{}
+}
+
+// VerifySignature verifies an SSHSIG signature blob over the input data
+// using a public key in ssh wire form. The signature namespace must
+// match the one the blob was issued under.
+func VerifySignature(input, sigData, pubBlob []byte, namespace string) error {
+	rest := sigData
+	if !bytes.HasPrefix(rest, []byte(magicPreamble)) {
+		return errors.New("sshsig: signature is missing the SSHSIG preamble")
+	}
+	rest = rest[len(magicPreamble):]
+	version, rest, err := readUint32(rest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read signature version")
+	}
+	if version != sigVersion {
+		return errors.Errorf("sshsig: unsupported signature version %d", version)
+	}
+	sigPubBlob, rest, err := readString(rest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read public key from signature")
+	}
+	if !bytes.Equal(sigPubBlob, pubBlob) {
+		return errors.New("sshsig: public key in signature does not match the expected key")
+	}
+	sigNamespace, rest, err := readString(rest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read namespace from signature")
+	}
+	if string(sigNamespace) != namespace {
+		return errors.Errorf("sshsig: signature namespace %q does not match expected namespace %q", sigNamespace, namespace)
+	}
+	// reserved
+	_, rest, err = readString(rest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read reserved field from signature")
+	}
+	hashAlg, rest, err := readString(rest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read hash algorithm from signature")
+	}
+	if string(hashAlg) != hashAlgorithm {
+		return errors.Errorf("sshsig: unsupported hash algorithm %q", hashAlg)
+	}
+	sigWire, _, err := readString(rest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read signature field")
+	}
+	sigAlg, sigRest, err := readString(sigWire)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read signature algorithm")
+	}
+	sigBytes, _, err := readString(sigRest)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to read signature bytes")
+	}
+
+	digest := sha512.Sum512(input)
+	signedData := makeSignedData(namespace, digest[:])
+	switch string(sigAlg) {
+	case "rsa-sha2-512":
+		pubKey, err := parseRSAPublicKey(pubBlob)
+		if err != nil {
+			return err
+		}
+		hashed := sha512.Sum512(signedData)
+		err = rsa.VerifyPKCS1v15(pubKey, crypto.SHA512, hashed[:], sigBytes)
+		return errors.Wrap(err, "sshsig: failed to verify rsa signature")
+	case "ssh-ed25519":
+		pubKey, err := parseEd25519PublicKey(pubBlob)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(pubKey, signedData, sigBytes) {
+			return errors.New("sshsig: failed to verify ed25519 signature")
+		}
+		return nil
+	default:
+		return errors.Errorf("sshsig: unsupported signature algorithm %q", sigAlg)
+	}
+}
+
+// VerifySignatureFromB64 verifies a pem armored signature and a base64
+// encoded public key as autograph returns from its API, used in the
+// client and monitor
+func VerifySignatureFromB64(input []byte, armoredSig, b64PubKey, namespace string) error {
+	sig, err := Unmarshal(armoredSig)
+	if err != nil {
+		return err
+	}
+	pubBlob, err := base64.StdEncoding.DecodeString(b64PubKey)
+	if err != nil {
+		return errors.Wrap(err, "sshsig: failed to decode public key")
+	}
+	return VerifySignature(input, sig.(*Signature).Data, pubBlob, namespace)
+}
+
+// marshalPublicKey returns the ssh wire encoding of an rsa or ed25519
+// public key
+func marshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		writeString(buf, []byte("ssh-rsa"))
+		writeMpint(buf, big.NewInt(int64(key.E)))
+		writeMpint(buf, key.N)
+	case ed25519.PublicKey:
+		writeString(buf, []byte("ssh-ed25519"))
+		writeString(buf, key)
+	default:
+		return nil, errors.Errorf("sshsig: unsupported public key type %T, must be rsa or ed25519", pub)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseRSAPublicKey parses the ssh wire encoding of an rsa public key
+func parseRSAPublicKey(blob []byte) (*rsa.PublicKey, error) {
+	alg, rest, err := readString(blob)
+	if err != nil || string(alg) != "ssh-rsa" {
+		return nil, errors.New("sshsig: public key is not an ssh-rsa key")
+	}
+	eBytes, rest, err := readString(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "sshsig: failed to read rsa exponent")
+	}
+	nBytes, _, err := readString(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "sshsig: failed to read rsa modulus")
+	}
+	e := new(big.Int).SetBytes(eBytes)
+	if !e.IsInt64() || e.Int64() > 1<<31 {
+		return nil, errors.New("sshsig: rsa exponent is out of range")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(e.Int64()),
+	}, nil
+}
+
+// parseEd25519PublicKey parses the ssh wire encoding of an ed25519
+// public key
+func parseEd25519PublicKey(blob []byte) (ed25519.PublicKey, error) {
+	alg, rest, err := readString(blob)
+	if err != nil || string(alg) != "ssh-ed25519" {
+		return nil, errors.New("sshsig: public key is not an ssh-ed25519 key")
+	}
+	keyBytes, _, err := readString(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "sshsig: failed to read ed25519 key bytes")
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("sshsig: invalid ed25519 key length %d", len(keyBytes))
+	}
+	return ed25519.PublicKey(keyBytes), nil
+}
+
+// ssh wire encoding helpers, strings are length prefixed with a big
+// endian uint32 and mpints are signed big endian integers
+
+func writeUint32(buf *bytes.Buffer, v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	buf.Write(b[:])
+}
+
+func writeString(buf *bytes.Buffer, data []byte) {
+	writeUint32(buf, uint32(len(data)))
+	buf.Write(data)
+}
+
+func writeMpint(buf *bytes.Buffer, v *big.Int) {
+	b := v.Bytes()
+	// prepend a zero byte when the high bit is set, so the value is
+	// not interpreted as negative
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	writeString(buf, b)
+}
+
+func readUint32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errors.New("truncated uint32")
+	}
+	return binary.BigEndian.Uint32(data[:4]), data[4:], nil
+}
+
+func readString(data []byte) ([]byte, []byte, error) {
+	length, rest, err := readUint32(data)
+	if err != nil {
+		return nil, nil, errors.New("truncated string")
+	}
+	if uint32(len(rest)) < length {
+		return nil, nil, errors.New("truncated string")
+	}
+	return rest[:length], rest[length:], nil
+}
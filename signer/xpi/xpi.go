@@ -155,6 +155,7 @@ func New(conf signer.Configuration, stats *signer.StatsClient) (s *XPISigner, er
 		return nil, errors.Errorf("xpi: unknown signer mode %q, must be 'add-on', 'extension', 'system add-on' or 'hotfix'", conf.Mode)
 	}
 	s.Mode = conf.Mode
+	s.AuditHook = conf.AuditHook
 	s.stats = stats
 
 	// If the private key is rsa, launch go routines that
@@ -211,6 +212,7 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 		coseSigAlgs   []*cose.Algorithm
 	)
 
+	defer func() { s.Audit(signer.AuditOpSignFile, input, err) }()
 	opt, err = GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: cannot get options")
@@ -283,7 +285,8 @@ func (s *XPISigner) SignFile(input []byte, options interface{}) (signedFile sign
 }
 
 // SignData takes an input signature file and returns a PKCS7 or COSE detached signature
-func (s *XPISigner) SignData(sigfile []byte, options interface{}) (signer.Signature, error) {
+func (s *XPISigner) SignData(sigfile []byte, options interface{}) (retsig signer.Signature, err error) {
+	defer func() { s.Audit(signer.AuditOpSignData, sigfile, err) }()
 	opt, err := GetOptions(options)
 	if err != nil {
 		return nil, errors.Wrap(err, "xpi: cannot get options")
@@ -0,0 +1,67 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// signatureCountFlushInterval is how often buffered signature
+	// counts are written to the database
+	signatureCountFlushInterval = 10 * time.Second
+
+	// signatureCountBufferSize is the number of signatures that can
+	// be buffered before new ones are dropped from the stats, so the
+	// signing path never blocks on accounting
+	signatureCountBufferSize = 1000
+)
+
+// startSignatureCounter launches a goroutine that aggregates per-signer
+// signature counts and flushes them to the database at a regular
+// interval, so usage reporting doesn't add database latency to every
+// signature. It does nothing when no database is configured.
+func (a *autographer) startSignatureCounter() {
+	if a.db == nil {
+		return
+	}
+	a.sigCounts = make(chan string, signatureCountBufferSize)
+	go func() {
+		counts := make(map[string]int)
+		ticker := time.NewTicker(signatureCountFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case signerID := <-a.sigCounts:
+				counts[signerID]++
+			case <-ticker.C:
+				for signerID, n := range counts {
+					err := a.db.IncrSignatureCount(signerID, n)
+					if err != nil {
+						// keep the count around and retry at the next flush
+						log.Errorf("main: failed to record %d signatures of signer %q: %s", n, signerID, err)
+						continue
+					}
+					delete(counts, signerID)
+				}
+			}
+		}
+	}()
+}
+
+// countSignature records one issued signature in the usage statistics.
+// It never blocks: when the buffer is full or counting is disabled, the
+// signature is left out of the stats
+func (a *autographer) countSignature(signerID string) {
+	if a.sigCounts == nil {
+		return
+	}
+	select {
+	case a.sigCounts <- signerID:
+	default:
+	}
+}
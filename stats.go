@@ -4,6 +4,7 @@ import (
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"go.mozilla.org/autograph/signer"
 )
 
 func loadStatsd(conf configuration) (*statsd.Client, error) {
@@ -18,6 +19,11 @@ func loadStatsd(conf configuration) (*statsd.Client, error) {
 
 func (a *autographer) addStats(conf configuration) (err error) {
 	a.stats, err = loadStatsd(conf)
+	if err != nil {
+		return err
+	}
+	// give signers a backend to report their throughput and latency to
+	signer.RegisterMetrics(signer.NewStatsdSignerMetrics(a.stats))
 	log.Infof("Statsd enabled at %s with namespace %s", conf.Statsd.Addr, conf.Statsd.Namespace)
-	return err
+	return nil
 }
@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// autograph-configcheck validates the signers of a configuration file
+// without starting the service, so CI can catch bad configurations
+// before deploy. It runs static validation on every signer, then
+// constructs each one through its regular constructor unless the
+// dry-run flag is set, in which case signers that would reach out to an
+// hsm, database or chain upload location are only validated statically.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	sops "go.mozilla.org/sops"
+	"go.mozilla.org/sops/decrypt"
+	yaml "gopkg.in/yaml.v2"
+
+	"go.mozilla.org/autograph/signer"
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/autograph/signer/contentsignature"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+	"go.mozilla.org/autograph/signer/gpg2"
+	"go.mozilla.org/autograph/signer/mar"
+	"go.mozilla.org/autograph/signer/pgp"
+	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/sshsig"
+	"go.mozilla.org/autograph/signer/xpi"
+)
+
+type configuration struct {
+	Signers []signer.Configuration `yaml:"signers"`
+}
+
+func main() {
+	var (
+		cfgFile string
+		dryRun  bool
+	)
+	flag.StringVar(&cfgFile, "c", "autograph.yaml", "Path to configuration file")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Skip constructing signers that touch the hsm, database or chain upload location")
+	flag.Parse()
+
+	conf, err := loadConfig(cfgFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	problems := checkSigners(conf.Signers, dryRun)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "error: %v\n", problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("found %d problem(s) in %d signer configuration(s)\n",
+			len(problems), len(conf.Signers))
+		os.Exit(1)
+	}
+	fmt.Printf("%d signer configuration(s) pass validation\n", len(conf.Signers))
+}
+
+// loadConfig reads a configuration file, decrypting it with sops first
+// when it is encrypted, like the service does at startup
+func loadConfig(path string) (conf configuration, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	confData, err := decrypt.Data(data, "yaml")
+	if err != nil {
+		if err != sops.MetadataNotFound {
+			err = errors.Wrap(err, "failed to load sops encrypted configuration")
+			return
+		}
+		// not an encrypted file
+		confData = data
+	}
+	err = yaml.Unmarshal(confData, &conf)
+	return
+}
+
+// checkSigners validates every signer configuration and returns all the
+// problems found, instead of stopping at the first one
+func checkSigners(confs []signer.Configuration, dryRun bool) (problems []error) {
+	sids := make(map[string]bool)
+	for _, conf := range confs {
+		if sids[conf.ID] {
+			problems = append(problems, errors.Errorf("duplicate signer ID %q is not permitted", conf.ID))
+			continue
+		}
+		sids[conf.ID] = true
+		err := conf.Validate()
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if dryRun && hasSideEffects(conf) {
+			log.Printf("skipping construction of signer %q in dry-run mode", conf.ID)
+			continue
+		}
+		err = construct(conf)
+		if err != nil {
+			problems = append(problems, errors.Wrapf(err, "failed to construct signer %q", conf.ID))
+		}
+	}
+	return
+}
+
+// hasSideEffects returns true when constructing a signer would reach
+// out to an hsm, database or chain upload location
+func hasSideEffects(conf signer.Configuration) bool {
+	if conf.Type == contentsignaturepki.Type {
+		// the pki signer issues an end-entity and uploads a chain
+		// at construction time
+		return true
+	}
+	privateKey := strings.TrimLeft(conf.PrivateKey, "\r\n")
+	// a private key that isn't inline pem is a label in the hsm
+	return !strings.HasPrefix(privateKey, "-----BEGIN")
+}
+
+// construct initializes a signer from its configuration, like the
+// service does at startup, and discards the result
+func construct(conf signer.Configuration) (err error) {
+	switch conf.Type {
+	case contentsignature.Type:
+		_, err = contentsignature.New(conf)
+	case contentsignaturepki.Type:
+		_, err = contentsignaturepki.New(conf)
+	case xpi.Type:
+		_, err = xpi.New(conf, nil)
+	case apk.Type:
+		_, err = apk.New(conf)
+	case mar.Type:
+		_, err = mar.New(conf)
+	case pgp.Type:
+		_, err = pgp.New(conf)
+	case gpg2.Type:
+		_, err = gpg2.New(conf)
+	case rsapss.Type:
+		_, err = rsapss.New(conf)
+	case sshsig.Type:
+		_, err = sshsig.New(conf)
+	default:
+		err = errors.Errorf("unknown signer type %q", conf.Type)
+	}
+	return
+}
@@ -1,15 +1,44 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
 	"log"
+	"strings"
 
 	"go.mozilla.org/autograph/signer/apk"
 )
 
-func verifyAPKSignature(sig string) error {
+func verifyAPKSignature(sig string, signerID string) error {
 	xpiSig, err := apk.Unmarshal(sig, []byte(inputdata))
 	if err != nil {
 		log.Fatal(err)
 	}
-	return xpiSig.Verify()
+	err = xpiSig.Verify()
+	if err != nil {
+		return err
+	}
+	if pin, ok := conf.apkCertPins[signerID]; ok {
+		return verifyAPKCertPin(xpiSig, pin)
+	}
+	return nil
+}
+
+// verifyAPKCertPin asserts the certificate embedded in an apk signature
+// matches the sha256 fingerprint pinned for the signer, catching the case
+// where a valid-but-wrong key produced the signature
+func verifyAPKCertPin(sig *apk.Signature, pin string) error {
+	cert, err := sig.SignerCert()
+	if err != nil {
+		return err
+	}
+	h := sha256.Sum256(cert.Raw)
+	fingerprint := fmt.Sprintf("%X", h[:])
+	// compare in constant time so a public-facing monitor cannot leak
+	// how much of a pin matched through timing
+	if subtle.ConstantTimeCompare([]byte(strings.ToUpper(strings.Replace(pin, ":", "", -1))), []byte(fingerprint)) != 1 {
+		return fmt.Errorf("apk signing certificate fingerprint %s does not match pinned certificate %s", fingerprint, pin)
+	}
+	return nil
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mozilla.org/autograph/signer/apk"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestVerifyAPKCertPin(t *testing.T) {
+	// make a throwaway key and self-signed cert, sign the monitoring
+	// input with it, then check the pin against right and wrong
+	// fingerprints
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+	crtTpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "apk unit test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, crtTpl, crtTpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatalf("failed to parse test certificate: %v", err)
+	}
+	toBeSigned, err := pkcs7.NewSignedData([]byte(inputdata))
+	if err != nil {
+		t.Fatalf("failed to init signed data: %v", err)
+	}
+	err = toBeSigned.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		t.Fatalf("failed to add signer: %v", err)
+	}
+	p7sig, err := toBeSigned.Finish()
+	if err != nil {
+		t.Fatalf("failed to finish signature: %v", err)
+	}
+	sig, err := apk.Unmarshal(base64.StdEncoding.EncodeToString(p7sig), []byte(inputdata))
+	if err != nil {
+		t.Fatalf("failed to unmarshal signature: %v", err)
+	}
+
+	err = verifyAPKCertPin(sig, strings.Repeat("00", 32))
+	if err == nil {
+		t.Fatal("expected pin verification to fail with a mismatched cert but it passed")
+	}
+
+	h := sha256.Sum256(cert.Raw)
+	err = verifyAPKCertPin(sig, fmt.Sprintf("%X", h[:]))
+	if err != nil {
+		t.Fatalf("expected pin verification to pass with matching cert but failed with: %v", err)
+	}
+}
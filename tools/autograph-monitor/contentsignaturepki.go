@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"go.mozilla.org/autograph/signer/contentsignature"
 	"go.mozilla.org/autograph/signer/contentsignaturepki"
 )
 
@@ -55,7 +57,10 @@ func verifyContentSignature(response signatureresponse) error {
 			return err
 		}
 	}
-	if !sig.VerifyData([]byte(inputdata), key) {
+	// template the probe payload with the same prefix separator as
+	// the signer under test, so environments that configure a custom
+	// separator still pass monitoring
+	if !sig.VerifyHash(templatedProbeDigest(sig.Mode), key) {
 		return fmt.Errorf("Signature verification failed")
 	}
 	if certs != nil {
@@ -71,6 +76,28 @@ func verifyContentSignature(response signatureresponse) error {
 	return nil
 }
 
+// templatedProbeDigest returns the digest of the probe payload
+// templated with the configured prefix separator, using the hash
+// algorithm of the given signature mode
+func templatedProbeDigest(mode string) []byte {
+	sep := conf.prefixSeparator
+	if sep == "" {
+		sep = contentsignature.DefaultPrefixSeparator
+	}
+	templated := []byte(contentsignature.SignaturePrefixLabel + sep + inputdata)
+	switch mode {
+	case contentsignaturepki.P384ECDSA:
+		digest := sha512.Sum384(templated)
+		return digest[:]
+	case contentsignaturepki.P521ECDSA:
+		digest := sha512.Sum512(templated)
+		return digest[:]
+	default:
+		digest := sha256.Sum256(templated)
+		return digest[:]
+	}
+}
+
 func parsePublicKeyFromB64(b64PubKey string) (pubkey *ecdsa.PublicKey, err error) {
 	keyBytes, err := base64.StdEncoding.DecodeString(b64PubKey)
 	if err != nil {
@@ -107,6 +134,13 @@ func verifyCertChain(certs []*x509.Certificate) error {
 			// cert expires in less than 30 days, this is a soft error. send an email.
 			err := sendSoftNotification(
 				fmt.Sprintf("%x", sha256.Sum256(cert.Raw)),
+				notificationContext{
+					severity: severityWarning,
+					// the common name of the end-entity starts with
+					// the id of the signer under test
+					signerID:   strings.SplitN(certs[0].Subject.CommonName, ".", 2)[0],
+					reasonCode: reasonCertExpired,
+				},
 				"Certificate %d %q expires in less than 30 days: notAfter=%s",
 				i, cert.Subject.CommonName, cert.NotAfter)
 			if err != nil {
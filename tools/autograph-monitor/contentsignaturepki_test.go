@@ -1,7 +1,12 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"go.mozilla.org/autograph/signer/contentsignature"
 	"go.mozilla.org/autograph/signer/contentsignaturepki"
 )
 
@@ -420,3 +426,58 @@ ZARKjbu1TuYQHf0fs+GwID8zeLc2zJL7UzcHFwwQ6Nda9OJN4uPAuC/BKaIpxCLL
 26b24/tRam4SJjqpiq20lynhUrmTtt6hbG3E1Hpy3bmkt2DYnuMFwEx2gfXNcnbT
 wNuvFqc=
 -----END CERTIFICATE-----`
+
+func TestVerifyCustomPrefixSignature(t *testing.T) {
+	prevSep := conf.prefixSeparator
+	defer func() { conf.prefixSeparator = prevSep }()
+
+	// sign the probe payload templated with a custom prefix separator,
+	// the way a signer configured with prefix_separator would
+	conf.prefixSeparator = "|"
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templated := []byte(contentsignature.SignaturePrefixLabel + "|" + inputdata)
+	digest := sha512.Sum384(templated)
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	csig := &contentsignaturepki.ContentSignature{
+		R:        r,
+		S:        s,
+		Mode:     contentsignaturepki.P384ECDSA,
+		Len:      contentsignaturepki.P384ECDSABYTESIZE,
+		Finished: true,
+	}
+	sigstr, err := csig.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := signatureresponse{
+		Type:      "contentsignature",
+		Mode:      "p384ecdsa",
+		SignerID:  "customprefix",
+		PublicKey: base64.StdEncoding.EncodeToString(pubDER),
+		Signature: sigstr,
+	}
+
+	// with a matching separator configured, monitoring passes
+	err = verifyContentSignature(response)
+	if err != nil {
+		t.Fatalf("Failed to verify custom prefix content signature: %v", err)
+	}
+
+	// with the default separator, templating diverges and the same
+	// signature must fail verification
+	conf.prefixSeparator = contentsignature.DefaultPrefixSeparator
+	err = verifyContentSignature(response)
+	if err == nil {
+		t.Fatal("Expected verification to fail with a mismatched prefix separator, but it passed")
+	}
+}
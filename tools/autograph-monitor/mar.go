@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/x509"
 	"encoding/base64"
+	"fmt"
+	"sort"
 
 	margo "go.mozilla.org/mar"
 )
@@ -32,5 +35,54 @@ func verifyMARSignature(b64Sig, b64Key string) error {
 			sigalg = margo.SigAlgEcdsaP384Sha384
 		}
 	}
-	return margo.VerifySignature([]byte(inputdata), sig, uint32(sigalg), key)
+	err = margo.VerifySignature([]byte(inputdata), sig, uint32(sigalg), key)
+	if err != nil {
+		return err
+	}
+	// when the monitored input is an actual mar file, a good signature
+	// is not sufficient: its structure must be self-consistent too
+	if bytes.HasPrefix([]byte(inputdata), []byte("MAR1")) {
+		return checkMARStructure([]byte(inputdata))
+	}
+	return nil
+}
+
+// checkMARStructure parses a mar file and verifies that its structure is
+// self-consistent: every index entry must point inside the content
+// region, entries must not overlap each other, and together they must
+// cover the content region without gaps, such that no byte of content is
+// hidden from, or counted twice by, a consumer walking the index
+func checkMARStructure(marData []byte) error {
+	var file margo.File
+	err := margo.Unmarshal(marData, &file)
+	if err != nil {
+		return fmt.Errorf("failed to parse mar file: %v", err)
+	}
+	// walk a copy of the index sorted by offset so overlaps and gaps
+	// show up between adjacent entries
+	index := make([]margo.IndexEntry, len(file.Index))
+	copy(index, file.Index)
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].OffsetToContent < index[j].OffsetToContent
+	})
+	cursor := uint64(index[0].OffsetToContent)
+	for _, entry := range index {
+		if entry.OffsetToContent < margo.MarIDLen+margo.OffsetToIndexLen {
+			return fmt.Errorf("index entry %q points inside the file header", entry.FileName)
+		}
+		if uint64(entry.OffsetToContent)+uint64(entry.Size) > uint64(file.OffsetToIndex) {
+			return fmt.Errorf("index entry %q overruns into the index", entry.FileName)
+		}
+		switch {
+		case uint64(entry.OffsetToContent) < cursor:
+			return fmt.Errorf("index entry %q overlaps the previous entry", entry.FileName)
+		case uint64(entry.OffsetToContent) > cursor:
+			return fmt.Errorf("index entry %q leaves a gap in the content region", entry.FileName)
+		}
+		cursor += uint64(entry.Size)
+	}
+	if cursor != uint64(file.OffsetToIndex) {
+		return fmt.Errorf("content region ends at %d but the index starts at %d", cursor, file.OffsetToIndex)
+	}
+	return nil
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	margo "go.mozilla.org/mar"
+)
+
+// makeTestMAR builds a small signed MAR with two content entries and
+// returns its marshalled bytes
+func makeTestMAR(t *testing.T) []byte {
+	m := margo.New()
+	err := m.AddContent([]byte("firefox update payload"), "/foo/bar", 0600)
+	if err != nil {
+		t.Fatalf("failed to add content to test mar: %v", err)
+	}
+	err = m.AddContent([]byte("another payload"), "/foo/baz", 0600)
+	if err != nil {
+		t.Fatalf("failed to add content to test mar: %v", err)
+	}
+	m.AddProductInfo("caribou maurice v1.2")
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate signing key: %v", err)
+	}
+	err = m.PrepareSignature(key, key.Public())
+	if err != nil {
+		t.Fatalf("failed to prepare mar signature: %v", err)
+	}
+	err = m.FinalizeSignatures()
+	if err != nil {
+		t.Fatalf("failed to finalize mar signatures: %v", err)
+	}
+	marData, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal test mar: %v", err)
+	}
+	return marData
+}
+
+func TestCheckMARStructure(t *testing.T) {
+	marData := makeTestMAR(t)
+	err := checkMARStructure(marData)
+	if err != nil {
+		t.Fatalf("structure check failed on a well-formed mar: %v", err)
+	}
+}
+
+func TestCheckMARStructureBroken(t *testing.T) {
+	var testcases = []struct {
+		name    string
+		corrupt func(marData []byte)
+	}{
+		{"shrunken index entry size hides a byte of content", func(marData []byte) {
+			// the size field sits 4 bytes into the first index entry
+			// header, which starts right after the index header
+			offsetToIndex := binary.BigEndian.Uint32(marData[4:8])
+			sizePos := offsetToIndex + margo.IndexHeaderLen + 4
+			size := binary.BigEndian.Uint32(marData[sizePos : sizePos+4])
+			binary.BigEndian.PutUint32(marData[sizePos:sizePos+4], size-1)
+		}},
+		{"index entry pointing inside the file header", func(marData []byte) {
+			offsetToIndex := binary.BigEndian.Uint32(marData[4:8])
+			offsetPos := offsetToIndex + margo.IndexHeaderLen
+			binary.BigEndian.PutUint32(marData[offsetPos:offsetPos+4], 4)
+		}},
+		{"index entry overlapping the previous one", func(marData []byte) {
+			// point the first index entry at the offset of the second
+			// one, so both cover the same content region
+			offsetToIndex := binary.BigEndian.Uint32(marData[4:8])
+			firstEntry := offsetToIndex + margo.IndexHeaderLen
+			nameLen := uint32(bytes.IndexByte(marData[firstEntry+12:], 0)) + 1
+			secondEntry := firstEntry + 12 + nameLen
+			secondOffset := binary.BigEndian.Uint32(marData[secondEntry : secondEntry+4])
+			secondSize := binary.BigEndian.Uint32(marData[secondEntry+4 : secondEntry+8])
+			binary.BigEndian.PutUint32(marData[firstEntry:firstEntry+4], secondOffset)
+			binary.BigEndian.PutUint32(marData[firstEntry+4:firstEntry+8], secondSize)
+		}},
+		{"truncated file", func(marData []byte) {
+			// handled below, truncation changes the slice length
+		}},
+	}
+	for _, testcase := range testcases {
+		t.Run(testcase.name, func(t *testing.T) {
+			marData := makeTestMAR(t)
+			if testcase.name == "truncated file" {
+				marData = marData[:len(marData)-8]
+			} else {
+				testcase.corrupt(marData)
+			}
+			err := checkMARStructure(marData)
+			if err == nil {
+				t.Fatal("structure check passed on a corrupted mar")
+			}
+			t.Logf("structure check correctly failed: %v", err)
+		})
+	}
+}
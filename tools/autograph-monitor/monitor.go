@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
@@ -9,6 +10,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
@@ -22,6 +25,7 @@ import (
 	"go.mozilla.org/autograph/signer/mar"
 	"go.mozilla.org/autograph/signer/pgp"
 	"go.mozilla.org/autograph/signer/rsapss"
+	"go.mozilla.org/autograph/signer/sshsig"
 	"go.mozilla.org/autograph/signer/xpi"
 	"go.mozilla.org/hawk"
 )
@@ -45,11 +49,98 @@ type configuration struct {
 	env           string
 	rootHash      string
 	truststore    *x509.CertPool
+
+	// apkCertPins maps an apk signer id to the sha256 fingerprint of
+	// the certificate expected to sign its responses
+	apkCertPins map[string]string
+
+	// expectedModes maps a signer id to the list of modes its
+	// responses are allowed to use
+	expectedModes map[string][]string
+
+	// rsapssKeys maps an rsapss signer id to the base64 public key its
+	// responses must verify against. Without it the monitor would
+	// trust the key embedded in the response, which an attacker who
+	// controls the response could swap for their own
+	rsapssKeys map[string]string
+
+	// prefixSeparator is the separator the signers under test place
+	// between the signature prefix label and the input data when
+	// templating content signatures
+	prefixSeparator string
 }
 
 var conf configuration
 
-const inputdata string = "AUTOGRAPH MONITORING"
+// defaultInputData is the historical fixed probe string signed by the
+// monitoring endpoint
+const defaultInputData = "AUTOGRAPH MONITORING"
+
+// inputdata is the probe payload signatures are verified against. It
+// defaults to the fixed probe string unless overridden via environment,
+// see buildProbePayload
+var inputdata = defaultInputData
+
+// buildProbePayload assembles the monitoring probe payload from the
+// AUTOGRAPH_MONITORING_PAYLOAD and AUTOGRAPH_MONITORING_PAYLOAD_SIZE
+// environment variables: the content string is repeated until it
+// reaches the requested size, so bugs that only appear with large
+// multi-chunk inputs get monitoring coverage. The autograph service
+// must be configured with the same values, as the signatures it
+// returns cover this exact payload.
+func buildProbePayload() ([]byte, error) {
+	content := os.Getenv("AUTOGRAPH_MONITORING_PAYLOAD")
+	if content == "" {
+		content = defaultInputData
+	}
+	sizeStr := os.Getenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+	if sizeStr == "" {
+		return []byte(content), nil
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("invalid AUTOGRAPH_MONITORING_PAYLOAD_SIZE %q, expected a positive integer", sizeStr)
+	}
+	payload := bytes.Repeat([]byte(content), (size+len(content)-1)/len(content))
+	return payload[:size], nil
+}
+
+// reason codes attached to monitoring failures so alerting can route
+// by cause without parsing error messages
+const (
+	reasonSignatureInvalid = "SIGNATURE_INVALID"
+	reasonX5UFetchFailed   = "X5U_FETCH_FAILED"
+	reasonCertExpired      = "CERT_EXPIRED"
+	reasonUnknownType      = "UNKNOWN_TYPE"
+	reasonModeDisallowed   = "MODE_DISALLOWED"
+)
+
+// a monitorFailure describes a failed verification with a machine
+// readable reason code alongside the human readable message
+type monitorFailure struct {
+	SignerID string `json:"signer_id"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// failureCode maps an error returned by a verification to a reason code
+func failureCode(err error) string {
+	if verr, ok := err.(*contentsignaturepki.VerificationError); ok && verr.Step == contentsignaturepki.ErrX5URetrieval {
+		return reasonX5UFetchFailed
+	}
+	switch {
+	case strings.Contains(err.Error(), "unknown signature type"):
+		return reasonUnknownType
+	case strings.Contains(err.Error(), "certificate has expired"),
+		strings.Contains(err.Error(), "expires in less than"):
+		return reasonCertExpired
+	case strings.Contains(err.Error(), "failed to retrieve x5u"):
+		return reasonX5UFetchFailed
+	case strings.Contains(err.Error(), "is not in the mode allowlist"):
+		return reasonModeDisallowed
+	}
+	return reasonSignatureInvalid
+}
 
 var softNotifCache map[string]time.Time
 
@@ -59,6 +150,11 @@ func init() {
 }
 
 func main() {
+	payload, err := buildProbePayload()
+	if err != nil {
+		log.Fatal(err)
+	}
+	inputdata = string(payload)
 	conf.url = os.Getenv("AUTOGRAPH_URL")
 	if conf.url == "" {
 		log.Fatal("AUTOGRAPH_URL must be set to the base url of the autograph service")
@@ -81,6 +177,53 @@ func main() {
 		conf.rootHash = "5E36F214DE823F8B299689235F0341ACAFA075AF82CB4CD4307C3DB343392AFE"
 		conf.truststore = nil
 	}
+	// apk cert pins are passed as a comma separated list of
+	// <signer id>=<sha256 fingerprint> pairs
+	conf.apkCertPins = make(map[string]string)
+	for _, pin := range strings.Split(os.Getenv("AUTOGRAPH_APK_CERT_PINS"), ",") {
+		if pin == "" {
+			continue
+		}
+		parts := strings.SplitN(pin, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid apk cert pin %q, expected <signer id>=<sha256 fingerprint>", pin)
+		}
+		conf.apkCertPins[parts[0]] = parts[1]
+	}
+	// environments whose content signers template with a custom
+	// prefix separator must set the same value here, or signature
+	// verification will fail, see the prefix_separator signer setting
+	conf.prefixSeparator = os.Getenv("AUTOGRAPH_PREFIX_SEPARATOR")
+	if conf.prefixSeparator == "" {
+		conf.prefixSeparator = contentsignature.DefaultPrefixSeparator
+	}
+	// expected modes are passed as a comma separated list of
+	// <signer id>=<mode> pairs, with multiple acceptable modes
+	// separated by pipes, e.g. normandy=p384ecdsa|p256ecdsa
+	conf.expectedModes = make(map[string][]string)
+	for _, em := range strings.Split(os.Getenv("AUTOGRAPH_EXPECTED_MODES"), ",") {
+		if em == "" {
+			continue
+		}
+		parts := strings.SplitN(em, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			log.Fatalf("invalid expected mode %q, expected <signer id>=<mode>[|<mode>...]", em)
+		}
+		conf.expectedModes[parts[0]] = strings.Split(parts[1], "|")
+	}
+	// expected rsapss public keys are passed as a comma separated list
+	// of <signer id>=<base64 public key> pairs
+	conf.rsapssKeys = make(map[string]string)
+	for _, pin := range strings.Split(os.Getenv("AUTOGRAPH_RSAPSS_KEYS"), ",") {
+		if pin == "" {
+			continue
+		}
+		parts := strings.SplitN(pin, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			log.Fatalf("invalid rsapss key pin %q, expected <signer id>=<base64 public key>", pin)
+		}
+		conf.rsapssKeys[parts[0]] = parts[1]
+	}
 	if os.Getenv("LAMBDA_TASK_ROOT") != "" {
 		// we are inside a lambda environment so run as lambda
 		lambda.Start(Handler)
@@ -121,6 +264,11 @@ func Handler() (err error) {
 		return
 	}
 
+	// an auth rejection means the monitoring key is wrong, which no
+	// amount of retrying will fix, so report it distinctly
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("monitoring auth rejected with %s, check the AUTOGRAPH_KEY configuration: %s", resp.Status, body)
+	}
 	if resp.StatusCode != http.StatusCreated {
 		return fmt.Errorf("Request failed with %s: %s", resp.Status, body)
 	}
@@ -132,55 +280,144 @@ func Handler() (err error) {
 		return
 	}
 	failed := false
-	var failures []error
+	var (
+		failures []monitorFailure
+		results  []monitorResult
+	)
 	for i, response := range responses {
-		switch response.Type {
-		case contentsignature.Type:
-			log.Printf("Verifying content signature from signer %q", response.SignerID)
-			err = verifyContentSignature(response)
-		case contentsignaturepki.Type:
-			log.Printf("Verifying content signature pki from signer %q", response.SignerID)
-			err = contentsignaturepki.Verify(response.X5U, response.Signature, []byte(inputdata))
-		case xpi.Type:
-			log.Printf("Verifying XPI signature from signer %q", response.SignerID)
-			err = verifyXPISignature(response.Signature)
-		case apk.Type:
-			log.Printf("Verifying APK signature from signer %q", response.SignerID)
-			err = verifyAPKSignature(response.Signature)
-		case mar.Type:
-			log.Printf("Verifying MAR signature from signer %q", response.SignerID)
-			err = verifyMARSignature(response.Signature, response.PublicKey)
-		case rsapss.Type:
-			log.Printf("Verifying RSA-PSS signature from signer %q", response.SignerID)
-			err = verifyRsapssSignature(response.Signature, response.PublicKey)
-		case pgp.Type, gpg2.Type:
-			// we don't verify pgp signatures because that requires building a keyring
-			// using the public key which is hard to do using the current openpgp package
-			log.Printf("Skipping verification of PGP signature from signer %q", response.SignerID)
-			continue
-		default:
-			err = fmt.Errorf("unknown signature type %q", response.Type)
+		// enforce the mode allowlist before verifying anything: during
+		// a migration, a signer that rolls back to a retired mode must
+		// fail monitoring even though its signatures still verify
+		err = checkExpectedMode(response)
+		if err == nil {
+			err = verifyResponse(response)
+			if err == errSkipVerification {
+				err = nil
+				continue
+			}
+		}
+		result := monitorResult{
+			SignerID: response.SignerID,
+			Type:     response.Type,
+			Pass:     true,
 		}
 		if err != nil {
 			failed = true
 			log.Printf("Response %d from signer %q does not pass: %v", i, response.SignerID, err)
 			log.Printf("Response was: %+v", response)
-			failures = append(failures, err)
+			failures = append(failures, monitorFailure{
+				SignerID: response.SignerID,
+				Code:     failureCode(err),
+				Message:  err.Error(),
+			})
+			result.Pass = false
+			result.Code = failureCode(err)
+			result.Error = err.Error()
 		} else {
 			log.Printf("Response %d from signer %q passes verification", i, response.SignerID)
 		}
+		results = append(results, result)
+	}
+	// post the results of the run, pass or fail, to the dashboard
+	// webhook when one is configured
+	summary := monitorSummary{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Status:    "pass",
+		Results:   results,
 	}
 	if failed {
-		failure := "Errors found during monitoring:"
-		for i, fail := range failures {
-			failure += fmt.Sprintf("\n%d. %s", i+1, fail.Error())
+		summary.Status = "fail"
+	}
+	werr := postResultsToWebhook(summary)
+	if werr != nil {
+		log.Printf("%v", werr)
+	}
+	if failed {
+		failureJSON, marshalErr := json.Marshal(failures)
+		if marshalErr != nil {
+			return fmt.Errorf("Errors found during monitoring, and failed to marshal them to json: %v", marshalErr)
 		}
-		return fmt.Errorf(failure)
+		return fmt.Errorf("Errors found during monitoring: %s", failureJSON)
 	}
 	log.Println("All signature responses passed, monitoring OK")
 	return
 }
 
+// errSkipVerification is returned by verifyResponse for signature types
+// the monitor cannot verify, which are skipped rather than failed
+var errSkipVerification = fmt.Errorf("signature type is not verified by the monitor")
+
+// verifyResponse dispatches the verification of a signature response to
+// the verifier of its type
+func verifyResponse(response signatureresponse) (err error) {
+	switch response.Type {
+	case contentsignature.Type:
+		log.Printf("Verifying content signature from signer %q", response.SignerID)
+		err = verifyContentSignature(response)
+	case contentsignaturepki.Type:
+		log.Printf("Verifying content signature pki from signer %q", response.SignerID)
+		err = contentsignaturepki.Verify(response.X5U, response.Signature, []byte(inputdata))
+		if verr, ok := err.(*contentsignaturepki.VerificationError); ok && verr.Step == contentsignaturepki.ErrX5URetrieval {
+			// a failed chain fetch is usually a transient network or
+			// hosting problem rather than a bad signature: send a soft
+			// notification and let the next run retry instead of paging
+			nerr := sendSoftNotification(
+				fmt.Sprintf("x5u-fetch-%s", response.SignerID),
+				notificationContext{
+					severity:   severityWarning,
+					signerID:   response.SignerID,
+					reasonCode: reasonX5UFetchFailed,
+				},
+				"Failed to retrieve x5u of signer %q: %v", response.SignerID, verr.Err)
+			if nerr != nil {
+				log.Printf("failed to send soft notification: %v", nerr)
+			}
+			err = nil
+		}
+	case xpi.Type:
+		log.Printf("Verifying XPI signature from signer %q", response.SignerID)
+		err = verifyXPISignature(response.Signature)
+	case apk.Type:
+		log.Printf("Verifying APK signature from signer %q", response.SignerID)
+		err = verifyAPKSignature(response.Signature, response.SignerID)
+	case mar.Type:
+		log.Printf("Verifying MAR signature from signer %q", response.SignerID)
+		err = verifyMARSignature(response.Signature, response.PublicKey)
+	case rsapss.Type:
+		log.Printf("Verifying RSA-PSS signature from signer %q", response.SignerID)
+		err = verifyRsapssSignature(response.Signature, response.PublicKey, response.SignerID)
+	case sshsig.Type:
+		log.Printf("Verifying SSH signature from signer %q", response.SignerID)
+		err = verifySSHSigSignature(response.Signature, response.PublicKey)
+	case pgp.Type, gpg2.Type:
+		// we don't verify pgp signatures because that requires building a keyring
+		// using the public key which is hard to do using the current openpgp package
+		log.Printf("Skipping verification of PGP signature from signer %q", response.SignerID)
+		err = errSkipVerification
+	default:
+		err = fmt.Errorf("unknown signature type %q", response.Type)
+	}
+	return
+}
+
+// checkExpectedMode asserts the mode of a response is in the allowlist
+// configured for its signer, if any. During a curve migration this lets
+// the monitor enforce progress: a signer using a mode outside its
+// allowlist fails monitoring even when its signatures are valid
+func checkExpectedMode(response signatureresponse) error {
+	allowed, ok := conf.expectedModes[response.SignerID]
+	if !ok {
+		return nil
+	}
+	for _, mode := range allowed {
+		if response.Mode == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("mode %q of signer %q is not in the mode allowlist %q",
+		response.Mode, response.SignerID, strings.Join(allowed, "|"))
+}
+
 func makeAuthHeader(req *http.Request, user, token string) string {
 	auth := hawk.NewRequestAuth(req,
 		&hawk.Credentials{
@@ -195,8 +432,64 @@ func makeAuthHeader(req *http.Request, user, token string) string {
 	return auth.RequestHeader()
 }
 
+const (
+	// softNotifAttempts is the default number of times an sns publish
+	// is tried before giving up, overridable with
+	// AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS
+	softNotifAttempts = 3
+
+	// softNotifRetryDelay is how long to wait between publish attempts
+	softNotifRetryDelay = 1 * time.Second
+)
+
+// snsPublish sends a publish input to sns, and is swapped out in tests
+// to avoid hitting aws
+var snsPublish = func(params *sns.PublishInput) error {
+	svc := sns.New(session.New())
+	_, err := svc.Publish(params)
+	return err
+}
+
+// severities attached to soft notifications
+const (
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// notificationContext carries the metadata attached to a soft
+// notification as sns message attributes, so subscribers can filter and
+// route on severity, signer or environment without parsing the body
+type notificationContext struct {
+	severity   string
+	signerID   string
+	reasonCode string
+}
+
+// makeMessageAttributes converts a notification context into sns
+// message attributes, leaving out empty values which sns refuses
+func makeMessageAttributes(ctx notificationContext) map[string]*sns.MessageAttributeValue {
+	attrs := make(map[string]*sns.MessageAttributeValue)
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		attrs[name] = &sns.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(value),
+		}
+	}
+	if ctx.severity == "" {
+		ctx.severity = severityWarning
+	}
+	set("severity", ctx.severity)
+	set("signer_id", ctx.signerID)
+	set("env", conf.env)
+	set("reason_code", ctx.reasonCode)
+	return attrs
+}
+
 // send a message to a predefined sns topic
-func sendSoftNotification(id string, format string, a ...interface{}) error {
+func sendSoftNotification(id string, ctx notificationContext, format string, a ...interface{}) error {
 	if ts, ok := softNotifCache[id]; ok {
 		// don't send dup notifications for 24 hours
 		if ts.Add(24 * time.Hour).After(time.Now()) {
@@ -207,20 +500,41 @@ func sendSoftNotification(id string, format string, a ...interface{}) error {
 	if os.Getenv("LAMBDA_TASK_ROOT") == "" || os.Getenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS") == "" {
 		// We're not running in lambda or the conf isnt ready so don't try to publish to SQS
 		log.Printf("soft notification ID %s: %s", id, fmt.Sprintf(format, a...))
+		// the log line is the delivery in this environment, cache it
+		// so long-running local use dedups the same way lambda does
+		softNotifCache[id] = time.Now()
 		return nil
 	}
 
-	svc := sns.New(session.New())
+	attempts := softNotifAttempts
+	if env := os.Getenv("AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS"); env != "" {
+		parsed, err := strconv.Atoi(env)
+		if err != nil || parsed < 1 {
+			return fmt.Errorf("invalid AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS %q, expected a positive integer", env)
+		}
+		attempts = parsed
+	}
 	params := &sns.PublishInput{
-		Message:  aws.String(fmt.Sprintf(format, a...)),
-		TopicArn: aws.String(os.Getenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")),
+		Message:           aws.String(fmt.Sprintf(format, a...)),
+		TopicArn:          aws.String(os.Getenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")),
+		MessageAttributes: makeMessageAttributes(ctx),
 	}
-	_, err := svc.Publish(params)
-	if err != nil {
-		return err
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(softNotifRetryDelay)
+		}
+		err = snsPublish(params)
+		if err != nil {
+			log.Printf("soft notification attempt %d of %d failed: %v", attempt, attempts, err)
+			continue
+		}
+		log.Printf("Soft notification send to %q with body: %s", os.Getenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS"), *params.Message)
+		// only add the notification to the cache after a confirmed
+		// publish, so a failed publish is retried on the next run
+		// instead of being silently deduped
+		softNotifCache[id] = time.Now()
+		return nil
 	}
-	log.Printf("Soft notification send to %q with body: %s", os.Getenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS"), *params.Message)
-	// add the notification to the cache
-	softNotifCache[id] = time.Now()
-	return nil
+	return fmt.Errorf("failed to publish soft notification after %d attempts: %v", attempts, err)
 }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sns"
+	"go.mozilla.org/autograph/signer/contentsignaturepki"
+	margo "go.mozilla.org/mar"
+)
+
+func TestFailureCode(t *testing.T) {
+	var testcases = []struct {
+		err  error
+		code string
+	}{
+		{fmt.Errorf("unknown signature type %q", "foo"), reasonUnknownType},
+		{fmt.Errorf("failed to verify certificate chain: x509: certificate has expired or is not yet valid"), reasonCertExpired},
+		{fmt.Errorf("Certificate 0 \"example.net\" expires in less than 15 days: notAfter=2017-11-07"), reasonCertExpired},
+		{fmt.Errorf("failed to retrieve x5u: Get https://example.net/chain.pem: connection refused"), reasonX5UFetchFailed},
+		{&contentsignaturepki.VerificationError{Step: contentsignaturepki.ErrX5URetrieval, Err: fmt.Errorf("connection refused")}, reasonX5UFetchFailed},
+		{fmt.Errorf("ecdsa signature verification failed"), reasonSignatureInvalid},
+	}
+	for i, testcase := range testcases {
+		code := failureCode(testcase.err)
+		if code != testcase.code {
+			t.Fatalf("testcase %d expected code %q but got %q for error: %v",
+				i, testcase.code, code, testcase.err)
+		}
+	}
+}
+
+func TestSendSoftNotificationRetries(t *testing.T) {
+	// pretend we run in lambda with a topic configured so the publish
+	// path is exercised
+	os.Setenv("LAMBDA_TASK_ROOT", "/tmp")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS", "arn:aws:sns:us-east-1:000000000000:test")
+	defer os.Unsetenv("LAMBDA_TASK_ROOT")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")
+	defer func(orig func(*sns.PublishInput) error) { snsPublish = orig }(snsPublish)
+	softNotifCache = make(map[string]time.Time)
+
+	// the first two attempts fail, the third succeeds
+	calls := 0
+	snsPublish = func(params *sns.PublishInput) error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("transient sns error")
+		}
+		return nil
+	}
+	err := sendSoftNotification("test-retry", notificationContext{}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("expected the retries to recover but got: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 publish attempts but got %d", calls)
+	}
+	if _, ok := softNotifCache["test-retry"]; !ok {
+		t.Fatal("expected a successful publish to be added to the cache")
+	}
+}
+
+func TestSendSoftNotificationCachesOnlyOnSuccess(t *testing.T) {
+	os.Setenv("LAMBDA_TASK_ROOT", "/tmp")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS", "arn:aws:sns:us-east-1:000000000000:test")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS", "2")
+	defer os.Unsetenv("LAMBDA_TASK_ROOT")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS")
+	defer func(orig func(*sns.PublishInput) error) { snsPublish = orig }(snsPublish)
+	softNotifCache = make(map[string]time.Time)
+
+	// a publish that fails all attempts must not be cached, so the
+	// next run can retry it
+	calls := 0
+	snsPublish = func(params *sns.PublishInput) error {
+		calls++
+		return fmt.Errorf("permanent sns error")
+	}
+	err := sendSoftNotification("test-cache", notificationContext{}, "monitoring issue: %s", "foo")
+	if err == nil {
+		t.Fatal("expected an error when all publish attempts fail")
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 publish attempts but got %d", calls)
+	}
+	if _, ok := softNotifCache["test-cache"]; ok {
+		t.Fatal("a failed publish must not be added to the cache")
+	}
+
+	// once the publish succeeds, the notification is cached and
+	// subsequent sends are silenced without calling sns
+	calls = 0
+	snsPublish = func(params *sns.PublishInput) error {
+		calls++
+		return nil
+	}
+	err = sendSoftNotification("test-cache", notificationContext{}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("failed to send soft notification: %v", err)
+	}
+	err = sendSoftNotification("test-cache", notificationContext{}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("failed to send silenced soft notification: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single publish call but got %d", calls)
+	}
+}
+
+func TestSendSoftNotificationInvalidAttempts(t *testing.T) {
+	os.Setenv("LAMBDA_TASK_ROOT", "/tmp")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS", "arn:aws:sns:us-east-1:000000000000:test")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS", "zero")
+	defer os.Unsetenv("LAMBDA_TASK_ROOT")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_ATTEMPTS")
+	softNotifCache = make(map[string]time.Time)
+
+	err := sendSoftNotification("test-attempts", notificationContext{}, "monitoring issue: %s", "foo")
+	if err == nil {
+		t.Fatal("expected an error with an invalid attempts configuration")
+	}
+}
+
+func TestSendSoftNotificationCachesLogPath(t *testing.T) {
+	// outside lambda the notification is only logged, but that log
+	// line is the delivery and must dedup like a publish
+	os.Unsetenv("LAMBDA_TASK_ROOT")
+	os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")
+	defer func(orig func(*sns.PublishInput) error) { snsPublish = orig }(snsPublish)
+	softNotifCache = make(map[string]time.Time)
+
+	calls := 0
+	snsPublish = func(params *sns.PublishInput) error {
+		calls++
+		return nil
+	}
+	err := sendSoftNotification("test-log-path", notificationContext{}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("failed to send soft notification: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected no publish call outside lambda but got %d", calls)
+	}
+	if _, ok := softNotifCache["test-log-path"]; !ok {
+		t.Fatal("expected a logged notification to be added to the cache")
+	}
+
+	// a second send within the dedup window is silenced even if the
+	// environment switches to lambda in the meantime
+	os.Setenv("LAMBDA_TASK_ROOT", "/tmp")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS", "arn:aws:sns:us-east-1:000000000000:test")
+	defer os.Unsetenv("LAMBDA_TASK_ROOT")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")
+	err = sendSoftNotification("test-log-path", notificationContext{}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("failed to send silenced soft notification: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("expected the cached notification to be silenced but sns was called %d times", calls)
+	}
+}
+
+func TestBuildProbePayload(t *testing.T) {
+	defer os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD")
+	defer os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+
+	// without configuration, the historical fixed probe string is used
+	os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD")
+	os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+	payload, err := buildProbePayload()
+	if err != nil {
+		t.Fatalf("failed to build probe payload: %v", err)
+	}
+	if string(payload) != defaultInputData {
+		t.Fatalf("expected the default probe string but got %q", payload)
+	}
+
+	// a configured size repeats the content until it is reached
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD", "chunked probe ")
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE", "1048576")
+	payload, err = buildProbePayload()
+	if err != nil {
+		t.Fatalf("failed to build probe payload: %v", err)
+	}
+	if len(payload) != 1048576 {
+		t.Fatalf("expected a payload of 1048576 bytes but got %d", len(payload))
+	}
+	if !bytes.HasPrefix(payload, []byte("chunked probe chunked probe ")) {
+		t.Fatalf("expected the payload to repeat the configured content, got %q...", payload[:32])
+	}
+
+	// invalid sizes are rejected
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE", "many")
+	_, err = buildProbePayload()
+	if err == nil {
+		t.Fatal("expected an error with an invalid payload size")
+	}
+}
+
+func TestVerifyLargeProbePayload(t *testing.T) {
+	// configure a multi-megabyte probe and check that verification
+	// covers that exact payload rather than the fixed string
+	os.Setenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE", "1048576")
+	defer os.Unsetenv("AUTOGRAPH_MONITORING_PAYLOAD_SIZE")
+	payload, err := buildProbePayload()
+	if err != nil {
+		t.Fatalf("failed to build probe payload: %v", err)
+	}
+	defer func(orig string) { inputdata = orig }(inputdata)
+	inputdata = string(payload)
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate signing key: %v", err)
+	}
+	rawKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	b64Key := base64.StdEncoding.EncodeToString(rawKey)
+
+	// a signature over the configured payload verifies
+	digest, _, err := margo.Hash([]byte(inputdata), uint32(margo.SigAlgEcdsaP384Sha384))
+	if err != nil {
+		t.Fatalf("failed to hash payload: %v", err)
+	}
+	sig, err := margo.Sign(key, rand.Reader, digest, uint32(margo.SigAlgEcdsaP384Sha384))
+	if err != nil {
+		t.Fatalf("failed to sign payload: %v", err)
+	}
+	err = verifyMARSignature(base64.StdEncoding.EncodeToString(sig), b64Key)
+	if err != nil {
+		t.Fatalf("failed to verify signature over configured payload: %v", err)
+	}
+
+	// a signature over the fixed default string must not verify
+	// against the larger payload
+	digest, _, err = margo.Hash([]byte(defaultInputData), uint32(margo.SigAlgEcdsaP384Sha384))
+	if err != nil {
+		t.Fatalf("failed to hash default payload: %v", err)
+	}
+	sig, err = margo.Sign(key, rand.Reader, digest, uint32(margo.SigAlgEcdsaP384Sha384))
+	if err != nil {
+		t.Fatalf("failed to sign default payload: %v", err)
+	}
+	err = verifyMARSignature(base64.StdEncoding.EncodeToString(sig), b64Key)
+	if err == nil {
+		t.Fatal("a signature over the default string verified against the configured payload")
+	}
+}
+
+func TestCheckExpectedMode(t *testing.T) {
+	prevModes := conf.expectedModes
+	defer func() { conf.expectedModes = prevModes }()
+	conf.expectedModes = map[string][]string{
+		"normandy": {"p384ecdsa"},
+		"appkey1":  {"p384ecdsa", "p256ecdsa"},
+	}
+
+	// a signer without an allowlist is not constrained
+	err := checkExpectedMode(signatureresponse{SignerID: "webextensions", Mode: "p256ecdsa"})
+	if err != nil {
+		t.Fatalf("expected a signer without an allowlist to pass but got: %v", err)
+	}
+	// an allowed mode passes
+	err = checkExpectedMode(signatureresponse{SignerID: "appkey1", Mode: "p256ecdsa"})
+	if err != nil {
+		t.Fatalf("expected an allowed mode to pass but got: %v", err)
+	}
+	// a response with a mode outside the allowlist fails, even though
+	// the mode check runs before verification and would therefore fail
+	// a perfectly valid signature
+	err = checkExpectedMode(signatureresponse{SignerID: "normandy", Mode: "p256ecdsa"})
+	if err == nil {
+		t.Fatal("expected a disallowed mode to fail but it passed")
+	}
+	if !strings.Contains(err.Error(), "is not in the mode allowlist") {
+		t.Fatalf("expected a mode allowlist error but got: %v", err)
+	}
+	if failureCode(err) != reasonModeDisallowed {
+		t.Fatalf("expected failure code %q but got %q", reasonModeDisallowed, failureCode(err))
+	}
+}
+
+func TestSendSoftNotificationMessageAttributes(t *testing.T) {
+	os.Setenv("LAMBDA_TASK_ROOT", "/tmp")
+	os.Setenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS", "arn:aws:sns:us-east-1:000000000000:test")
+	defer os.Unsetenv("LAMBDA_TASK_ROOT")
+	defer os.Unsetenv("AUTOGRAPH_SOFT_NOTIFICATION_SNS")
+	defer func(orig func(*sns.PublishInput) error) { snsPublish = orig }(snsPublish)
+	defer func(orig string) { conf.env = orig }(conf.env)
+	softNotifCache = make(map[string]time.Time)
+	conf.env = "stage"
+
+	var published *sns.PublishInput
+	snsPublish = func(params *sns.PublishInput) error {
+		published = params
+		return nil
+	}
+	err := sendSoftNotification("test-attributes", notificationContext{
+		severity:   severityCritical,
+		signerID:   "testsigner1",
+		reasonCode: reasonCertExpired,
+	}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("failed to send soft notification: %v", err)
+	}
+	if published == nil {
+		t.Fatal("expected a publish call but got none")
+	}
+	expected := map[string]string{
+		"severity":    severityCritical,
+		"signer_id":   "testsigner1",
+		"env":         "stage",
+		"reason_code": reasonCertExpired,
+	}
+	for name, value := range expected {
+		attr, ok := published.MessageAttributes[name]
+		if !ok {
+			t.Fatalf("expected message attribute %q but it is missing", name)
+		}
+		if *attr.StringValue != value {
+			t.Fatalf("expected message attribute %q to be %q but got %q", name, value, *attr.StringValue)
+		}
+	}
+
+	// the severity defaults to warning and empty attributes are left out
+	softNotifCache = make(map[string]time.Time)
+	conf.env = ""
+	err = sendSoftNotification("test-attributes", notificationContext{}, "monitoring issue: %s", "foo")
+	if err != nil {
+		t.Fatalf("failed to send soft notification: %v", err)
+	}
+	if *published.MessageAttributes["severity"].StringValue != severityWarning {
+		t.Fatal("expected the severity to default to warning")
+	}
+	for _, name := range []string{"signer_id", "env", "reason_code"} {
+		if _, ok := published.MessageAttributes[name]; ok {
+			t.Fatalf("expected empty message attribute %q to be left out", name)
+		}
+	}
+}
+
+func TestHandlerReportsAuthRejection(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("authorization verification failed"))
+	}))
+	defer srv.Close()
+	defer func(origURL, origKey string) {
+		conf.url = origURL
+		conf.monitoringKey = origKey
+	}(conf.url, conf.monitoringKey)
+	conf.url = srv.URL + "/"
+	conf.monitoringKey = "wrongkey"
+
+	err := Handler()
+	if err == nil {
+		t.Fatal("expected the handler to fail on an auth rejection but it passed")
+	}
+	if !strings.Contains(err.Error(), "monitoring auth rejected") {
+		t.Fatalf("expected a distinct auth rejection error but got: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected a single request without retries but got %d", requests)
+	}
+}
+
+func TestVerifyResponseSoftensX5UFetchFailure(t *testing.T) {
+	softNotifCache = make(map[string]time.Time)
+
+	// a failure to fetch the chain is reported softly instead of
+	// failing the monitoring run
+	err := verifyResponse(signatureresponse{
+		Type:     contentsignaturepki.Type,
+		SignerID: "testpkisigner",
+		X5U:      "file:///nonexistent/autograph_monitor_tests/chain.pem",
+	})
+	if err != nil {
+		t.Fatalf("expected an x5u fetch failure to be softened but got: %v", err)
+	}
+	if _, ok := softNotifCache["x5u-fetch-testpkisigner"]; !ok {
+		t.Fatal("expected a soft notification for the fetch failure")
+	}
+
+	// a chain that fetches but fails validation is still a hard failure
+	garbageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "this is not a certificate chain")
+	}))
+	defer garbageServer.Close()
+	err = verifyResponse(signatureresponse{
+		Type:     contentsignaturepki.Type,
+		SignerID: "testpkisigner",
+		X5U:      garbageServer.URL + "/chain.pem",
+	})
+	if err == nil {
+		t.Fatal("expected an invalid chain to fail verification but it passed")
+	}
+	verr, ok := err.(*contentsignaturepki.VerificationError)
+	if !ok {
+		t.Fatalf("expected a *contentsignaturepki.VerificationError but got %T: %v", err, err)
+	}
+	if verr.Step != contentsignaturepki.ErrChainValidation {
+		t.Fatalf("expected step %v but got %v", contentsignaturepki.ErrChainValidation, verr.Step)
+	}
+}
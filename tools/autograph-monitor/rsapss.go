@@ -3,11 +3,22 @@ package main
 import (
 	"crypto/sha1"
 	"encoding/base64"
+	"fmt"
 
 	"go.mozilla.org/autograph/signer/rsapss"
 )
 
-func verifyRsapssSignature(b64Sig, b64Key string) error {
+func verifyRsapssSignature(b64Sig, b64Key, signerID string) error {
+	// when an expected public key is configured for the signer, the
+	// response key must match it and verification uses the configured
+	// key, so a response carrying an attacker supplied key never
+	// verifies against itself
+	if expected, ok := conf.rsapssKeys[signerID]; ok {
+		if b64Key != expected {
+			return fmt.Errorf("rsapss public key of signer %q does not match the configured key", signerID)
+		}
+		b64Key = expected
+	}
 	shasum := sha1.Sum([]byte(inputdata))
 	digest := base64.StdEncoding.EncodeToString(shasum[:])
 	return rsapss.VerifySignatureFromB64(digest, b64Sig, b64Key)
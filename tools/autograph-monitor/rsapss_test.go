@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// makeRsapssResponse signs the monitoring input data with a fresh rsa
+// key and returns the base64 signature and public key, as autograph
+// returns them in a signature response
+func makeRsapssResponse(t *testing.T) (b64Sig, b64Key string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	digest := sha1.Sum([]byte(inputdata))
+	sig, err := rsa.SignPSS(rand.Reader, key, crypto.SHA1, digest[:], &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+		Hash:       crypto.SHA1,
+	})
+	if err != nil {
+		t.Fatalf("failed to sign input data: %v", err)
+	}
+	pubKey, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig), base64.StdEncoding.EncodeToString(pubKey)
+}
+
+func TestVerifyRsapssSignatureExpectedKey(t *testing.T) {
+	b64Sig, b64Key := makeRsapssResponse(t)
+
+	// without a configured key, the response key is trusted
+	err := verifyRsapssSignature(b64Sig, b64Key, "rsapsstest")
+	if err != nil {
+		t.Fatalf("failed to verify rsapss signature: %v", err)
+	}
+
+	// with the matching key configured, verification still passes
+	conf.rsapssKeys = map[string]string{"rsapsstest": b64Key}
+	defer func() { conf.rsapssKeys = nil }()
+	err = verifyRsapssSignature(b64Sig, b64Key, "rsapsstest")
+	if err != nil {
+		t.Fatalf("failed to verify rsapss signature against the configured key: %v", err)
+	}
+
+	// a response self-signed with a swapped key is rejected even
+	// though the signature verifies against the key it carries
+	swappedSig, swappedKey := makeRsapssResponse(t)
+	err = verifyRsapssSignature(swappedSig, swappedKey, "rsapsstest")
+	if err == nil {
+		t.Fatal("expected a swapped public key to be rejected but it verified")
+	}
+	if !strings.Contains(err.Error(), "does not match the configured key") {
+		t.Fatalf("expected a key mismatch error but got: %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"go.mozilla.org/autograph/signer/sshsig"
+)
+
+func verifySSHSigSignature(armoredSig, b64Key string) error {
+	// the monitor doesn't know the namespace each signer is configured
+	// with, so it verifies against the default file signing namespace
+	return sshsig.VerifySignatureFromB64([]byte(inputdata), armoredSig, b64Key, sshsig.DefaultNamespace)
+}
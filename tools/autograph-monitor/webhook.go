@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// webhookTimeout caps how long a single POST to the result webhook
+	// can take, so a slow dashboard doesn't hang the monitor
+	webhookTimeout = 10 * time.Second
+
+	// webhookAttempts is the number of times a POST is tried before
+	// giving up
+	webhookAttempts = 3
+
+	// webhookRetryDelay is how long to wait between attempts
+	webhookRetryDelay = 1 * time.Second
+)
+
+// a monitorResult summarizes the verification of a single signature
+// response
+type monitorResult struct {
+	SignerID string `json:"signer_id"`
+	Type     string `json:"type"`
+	Pass     bool   `json:"pass"`
+	Code     string `json:"code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// a monitorSummary describes a full monitoring run, pass or fail, and
+// is posted to the result webhook for dashboards to consume
+type monitorSummary struct {
+	Timestamp string          `json:"timestamp"`
+	Status    string          `json:"status"`
+	Results   []monitorResult `json:"results"`
+}
+
+// postResultsToWebhook sends a monitoring summary to the webhook
+// configured in AUTOGRAPH_RESULT_WEBHOOK, retrying a few times on
+// failure. It does nothing when no webhook is configured.
+func postResultsToWebhook(summary monitorSummary) error {
+	webhookURL := os.Getenv("AUTOGRAPH_RESULT_WEBHOOK")
+	if webhookURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal monitoring summary: %v", err)
+	}
+	cli := &http.Client{Timeout: webhookTimeout}
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(webhookRetryDelay)
+		}
+		var resp *http.Response
+		resp, err = cli.Post(webhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("webhook attempt %d of %d failed: %v", attempt, webhookAttempts, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+			log.Printf("webhook attempt %d of %d failed: %v", attempt, webhookAttempts, err)
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to post results to webhook after %d attempts: %v", webhookAttempts, err)
+}
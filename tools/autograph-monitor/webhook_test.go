@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPostResultsToWebhook(t *testing.T) {
+	summary := monitorSummary{
+		Timestamp: "2019-01-01T00:00:00Z",
+		Status:    "fail",
+		Results: []monitorResult{
+			{SignerID: "testsigner", Type: "mar", Pass: false, Code: reasonSignatureInvalid, Error: "bad signature"},
+		},
+	}
+
+	// without a webhook configured, posting is a no-op
+	os.Unsetenv("AUTOGRAPH_RESULT_WEBHOOK")
+	err := postResultsToWebhook(summary)
+	if err != nil {
+		t.Fatalf("expected no-op without a webhook but got: %v", err)
+	}
+
+	// the webhook receives the summary as json
+	var received monitorSummary
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.Unmarshal(body, &received)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("AUTOGRAPH_RESULT_WEBHOOK", srv.URL)
+	defer os.Unsetenv("AUTOGRAPH_RESULT_WEBHOOK")
+	err = postResultsToWebhook(summary)
+	if err != nil {
+		t.Fatalf("failed to post results to webhook: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call to the webhook but got %d", calls)
+	}
+	if received.Status != "fail" || len(received.Results) != 1 ||
+		received.Results[0].Code != reasonSignatureInvalid {
+		t.Fatalf("webhook received an unexpected summary: %+v", received)
+	}
+}
+
+func TestPostResultsToWebhookRetries(t *testing.T) {
+	// the first two attempts fail, the third succeeds
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	os.Setenv("AUTOGRAPH_RESULT_WEBHOOK", srv.URL)
+	defer os.Unsetenv("AUTOGRAPH_RESULT_WEBHOOK")
+	err := postResultsToWebhook(monitorSummary{Status: "pass"})
+	if err != nil {
+		t.Fatalf("expected the retries to recover but got: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 calls to the webhook but got %d", calls)
+	}
+}